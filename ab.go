@@ -11,37 +11,51 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/rich1111/plcconnector/cip"
 )
 
 // PLC .
 type PLC struct {
-	callback  func(service int, statut int, tag *Tag)
-	closeI    bool
-	closeMut  sync.RWMutex
-	closeWMut sync.Mutex
-	closeWait *sync.Cond
-	eds       map[string]map[string]string
-	favicon   []byte
-	port      uint16
-	symbols   *Class
-	template  *Class
-	tids      map[string]structData
-	tidLast   int
-	tMut      sync.RWMutex
-	tags      map[string]*Tag
-	timOff    time.Duration
-
-	Class       map[int]*Class
-	DumpNetwork bool // enables dumping network packets
-	Name        string
-	Verbose     bool // enables debugging output
-	Timeout     time.Duration
+	met      metrics // first for alignment of atomic counters
+	alarms   alarming
+	aud      auditLog
+	callback func(service int, statut int, tag *Tag)
+	ctrl     controller
+	eds      map[string]map[string]string
+	favicon  []byte
+	hist     historian
+	httpServ *http.Server // see ServeHTTP
+	serv     *Server      // see Serve
+	servMut  sync.Mutex
+	servStop bool // Close called without serv, Serve returns at once
+	sim      simulation
+	symbols  *Class
+	template *Class
+	tids     map[string]structData
+	tidLast  int
+	tMut     sync.RWMutex
+	tags     map[string]*Tag
+	tagIdx   sync.Map // lower case name to *Tag, lookups without tMut
+	timOff   time.Duration
+	writing  int32 // tMut locked for writing, see lockTags
+
+	AtomicMultiServ bool    // MultipleServicePacket with writes is executed atomically
+	Capture         Capture // receives sent and received frames, see PcapWriter and TraceWriter
+	Class           map[int]*Class
+	DumpNetwork     bool   // enables dumping network packets
+	Logger          Logger // receives diagnostics, NopLogger by default
+	Name            string
+	Verbose         bool // enables debugging output
+	Timeout         time.Duration
 }
 
 // Init initialize library. Must be called first.
@@ -52,82 +66,51 @@ func Init(eds string) (*PLC, error) {
 	p.tids = make(map[string]structData)
 	p.tidLast = 1
 	p.Timeout = 60 * time.Second
+	p.Logger = NopLogger{}
 
 	err := p.loadEDS(eds)
 	if err != nil {
 		return nil, err
 	}
+	p.initController()
 
 	return &p, nil
 }
 
-func (p *PLC) debug(args ...interface{}) {
-	if p.Verbose {
-		fmt.Println(args...)
-	}
-}
-
 // Callback registers function called at receiving communication with PLC.
 // tag may be nil in event of error or reset.
 func (p *PLC) Callback(function func(service int, status int, tag *Tag)) {
 	p.callback = function
 }
 
-// Serve listens on the TCP network address host.
+// Serve listens on the TCP and UDP network address host until Close is called.
 func (p *PLC) Serve(host string) error {
-	rand.Seed(time.Now().UnixNano())
-
-	p.closeMut.Lock()
-	p.closeI = false
-	p.closeMut.Unlock()
-
-	p.closeWait = sync.NewCond(&p.closeWMut)
-
-	sock := net.ListenConfig{}
-	sock.Control = sockControl
-	serv2, err := sock.Listen(context.Background(), "tcp", host)
+	s, err := p.ServeContext(context.Background(), Options{Addr: host})
 	if err != nil {
 		return err
 	}
-	p.port = getPort(host)
-	serv := serv2.(*net.TCPListener)
-	go p.serveUDP(host)
-	for {
-		err = serv.SetDeadline(time.Now().Add(time.Second))
-		if err != nil {
-			return err
-		}
-		conn, err := serv.AcceptTCP()
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			p.closeMut.RLock()
-			endP := p.closeI
-			p.closeMut.RUnlock()
-			if endP {
-				break
-			}
-		} else if err != nil {
-			return err
-		} else {
-			go p.handleRequest(conn)
-		}
+	p.servMut.Lock()
+	if p.servStop { // closed while binding
+		p.servStop = false
+		p.servMut.Unlock()
+		s.Close()
+		return s.Wait()
 	}
-	err = serv.Close()
-	if err != nil {
-		return err
-	}
-	p.debug("Serve shutdown")
-	p.closeWait.Signal()
-	return nil
+	p.serv = s
+	p.servMut.Unlock()
+	return s.Wait()
 }
 
-// Close shutdowns server
+// Close shutdowns server started by Serve, also one still binding.
 func (p *PLC) Close() {
-	p.closeMut.Lock()
-	p.closeI = true
-	p.closeMut.Unlock()
-	p.closeWait.L.Lock()
-	p.closeWait.Wait()
-	p.closeWait.L.Unlock()
+	p.servMut.Lock()
+	s := p.serv
+	p.serv = nil
+	p.servStop = s == nil
+	p.servMut.Unlock()
+	if s != nil {
+		s.Close()
+	}
 }
 
 type req struct {
@@ -137,37 +120,60 @@ type req struct {
 	member   int
 	path     []pathEl
 
+	addr     net.Addr // remote address
 	c        net.Conn
+	cpf      []uint8 // CPF items of the reply
 	connID   uint32
+	locked   bool // tMut held for the whole MultipleServicePacket
 	dataLen  int
 	lenRem   int
-	uDataLen int
-	encHead  encapsulationHeader
+	encHead  cip.EncapsulationHeader
+	ext      [1]uint16 // additional status of resp
 	file     map[int]*[3]uint8
+	in       []uint8 // see next
 	maxData  int
 	maxFO    int
+	names    map[string]string // interned symbolic segments
+	out      []uint8
 	p        *PLC
+	port     uint16 // TCP port reported by ListIdentity
 	protd    protocolData
 	readBuf  *bufio.Reader
-	resp     response
-	rrdata   sendData
-	wrCIPBuf *bytes.Buffer
+	resp     cip.Response
+	rrdata   cip.SendData
 	writeBuf *bytes.Buffer
 }
 
+const maxPooledBuf = 64 << 10
+
+var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getBuf returns empty response buffer from the pool.
+func getBuf() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+func putBuf(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuf {
+		return
+	}
+	b.Reset()
+	bufPool.Put(b)
+}
+
 func (r *req) read(data interface{}) (bool, error) {
 	toRead := binary.Size(data)
 	if r.lenRem != -1 && r.lenRem < toRead {
 		r.err(NotEnoughData)
-		return true, errors.New("not enough data")
+		return true, errNotEnoughData
 	}
 	err := binary.Read(r.readBuf, binary.LittleEndian, data)
 	if err != nil {
-		fmt.Println(err)
+		r.readErr(err)
 	}
 	r.lenRem -= toRead
 	if r.p.DumpNetwork {
-		fmt.Printf("%#v\n", data)
+		r.log(LevelDebug, "read", "data", fmt.Sprintf("%#v", data))
 	}
 	return false, err
 }
@@ -175,356 +181,423 @@ func (r *req) read(data interface{}) (bool, error) {
 func (r *req) write(data interface{}) {
 	err := binary.Write(r.writeBuf, binary.LittleEndian, data)
 	if err != nil {
-		fmt.Println(err)
+		r.log(LevelError, "write", "err", err)
+	}
+}
+
+func (r *req) reset() {
+	r.protd = protocolData{}
+	r.lenRem = -1
+	r.writeBuf.Reset()
+	r.cpf = r.cpf[:0]
+}
+
+// tagLock locks tMut for writing unless it is already held for the whole MultipleServicePacket.
+func (r *req) tagLock() {
+	if !r.locked {
+		r.p.lockTags()
+	}
+}
+
+func (r *req) tagUnlock() {
+	if !r.locked {
+		r.p.unlockTags()
+	}
+}
+
+// readLock read locks tMut only if a writer holds it, single tag reads need just the tag lock otherwise.
+func (r *req) readLock() bool {
+	if r.locked || atomic.LoadInt32(&r.p.writing) == 0 {
+		return false
+	}
+	r.p.tMut.RLock()
+	return true
+}
+
+func (r *req) readUnlock(locked bool) {
+	if locked {
+		r.p.tMut.RUnlock()
 	}
 }
 
-func (r *req) writeCIP(data interface{}) {
-	err := binary.Write(r.wrCIPBuf, binary.LittleEndian, data)
+// writeView writes ReadTag response with data of the view from offset, trimmed to maxData.
+func (r *req) writeView(v *tagView, offset int) {
+	n := v.n - offset
+	if n > r.maxData {
+		r.resp.Status = PartialTransfer
+		if v.elLen > r.maxData {
+			n = r.maxData
+		} else {
+			n = (r.maxData / v.elLen) * v.elLen
+		}
+	}
+	r.writeResp()
+	if v.typ >= TypeStructHead {
+		r.writeUINT(uint16(v.typ >> 16))
+	}
+	r.writeUINT(uint16(v.typ))
+	r.p.readView(r.writeBuf, v, offset, n)
+}
+
+// multiServWrites reports whether services of the MultipleServicePacket write tags. ok is false if packet can't be inspected.
+func (r *req) multiServWrites(svs []uint16, offset int) (bool, bool) {
+	if r.dataLen-offset > r.lenRem {
+		return false, false
+	}
+	body, err := r.readBuf.Peek(r.dataLen - offset)
 	if err != nil {
-		fmt.Println(err)
+		return false, false
+	}
+	for _, s := range svs {
+		if int(s) < offset || int(s)-offset >= len(body) {
+			return false, false
+		}
+		switch body[int(s)-offset] {
+		case WriteTag, WriteTagFrag, ReadModifyWrite:
+			return true, true
+		case MultiServ: // nested packet may write, served exclusively
+			return false, false
+		}
 	}
+	return false, true
 }
 
-func (r *req) reset() {
-	r.lenRem = -1
-	r.writeBuf.Reset()
-	r.wrCIPBuf.Reset()
+// programSymbols reports whether the path is Symbol class instance in the program scope.
+func (r *req) programSymbols() bool {
+	return len(r.path) == 3 && r.path[0].typ == ansiExtended && strings.HasPrefix(r.path[0].txt, "Program:") &&
+		r.path[1].typ == pathClass && r.path[1].val == SymbolClass && r.path[2].typ == pathInstance
 }
 
 func (r *req) err(status int) bool {
 	r.resp.Status = uint8(status)
-	r.write(r.resp)
+	r.writeResp()
 	return true
 }
 
-func (p *PLC) handleRequest(conn net.Conn) {
+// handleRequest serves session on conn, s is nil outside of ServeContext.
+func (p *PLC) handleRequest(conn net.Conn, s *Server) {
+	if p.Capture != nil {
+		conn = newCaptureConn(conn, p.Capture)
+	}
 	r := req{}
 	r.connID = uint32(0)
+	r.addr = conn.RemoteAddr()
 	r.c = conn
 	r.file = make(map[int]*[3]uint8)
 	r.p = p
 	r.readBuf = bufio.NewReader(conn)
-	r.writeBuf = new(bytes.Buffer)
-	r.wrCIPBuf = new(bytes.Buffer)
+	r.writeBuf = getBuf()
 	r.maxFO = 472
+	if s != nil {
+		r.port = s.port
+	}
+	session := false
+	atomic.AddUint64(&p.met.connsOpened, 1)
+	atomic.AddInt64(&p.met.connsActive, 1)
+	defer func() {
+		putBuf(r.writeBuf)
+		atomic.AddInt64(&p.met.connsActive, -1)
+		if session {
+			atomic.AddInt64(&p.met.sessionsActive, -1)
+		}
+	}()
 
 loop:
 	for {
 		r.reset()
 
-		p.closeMut.RLock()
-		endP := p.closeI
-		p.closeMut.RUnlock()
-		if endP {
-			break loop
-		}
-
 		timeout := time.Now().Add(p.Timeout)
-		err := conn.SetReadDeadline(timeout)
+		err := s.deadline(conn, timeout)
 		if err != nil {
-			fmt.Println(err)
+			if err != errServerClosed {
+				r.log(LevelWarn, "set deadline", "err", err)
+			}
 			break loop
 		}
-
-		p.debug()
-		_, err = r.read(&r.encHead)
+		err = r.readEncHead()
 		if err != nil {
 			break loop
 		}
+		start := time.Now()
 		r.lenRem = int(r.encHead.Length)
+		p.met.request(r.encHead.Command, cip.EncapsulationHeaderLen+r.lenRem)
 
 		switch r.encHead.Command {
-		case ecNOP:
+		case cip.CommandNOP:
 			if r.eipNOP() != nil {
 				break loop
 			}
 			continue loop
 
-		case ecRegisterSession:
+		case cip.CommandRegisterSession:
 			if r.eipRegisterSession() != nil {
 				break loop
 			}
+			if !session && r.encHead.Status == 0 {
+				session = true
+				atomic.AddUint64(&p.met.sessionsOpened, 1)
+				atomic.AddInt64(&p.met.sessionsActive, 1)
+			}
 
-		case ecUnRegisterSession:
-			p.debug("UnregisterSession")
+		case cip.CommandUnRegisterSession:
+			r.debug("UnregisterSession")
 			break loop
 
-		case ecListIdentity:
+		case cip.CommandListIdentity:
 			if r.eipListIdentity() != nil {
 				break loop
 			}
 
-		case ecListServices:
+		case cip.CommandListServices:
 			if r.eipListServices() != nil {
 				break loop
 			}
 
-		case ecListInterfaces:
-			p.debug("ListInterfaces")
-			r.write(uint16(0)) // ItemCount
+		case cip.CommandListInterfaces:
+			r.debug("ListInterfaces")
+			r.writeUINT(0) // ItemCount
 
-		case ecSendRRData, ecSendUnitData:
-			p.debug("SendRRData/SendUnitData")
+		case cip.CommandSendRRData, cip.CommandSendUnitData:
+			r.debug("SendRRData/SendUnitData")
 
 			var (
-				item         itemType
+				addr         cip.ItemHeader
+				item         cip.ItemHeader
 				protSeqCount uint16
 			)
-			_, err = r.read(&r.rrdata)
+			status, err := r.readCPF(&addr, &item)
 			if err != nil {
 				break loop
 			}
-
-			if r.rrdata.Timeout != 0 && r.encHead.Command == ecSendRRData {
-				timeout = time.Now().Add(time.Duration(r.rrdata.Timeout) * time.Second)
-				err = conn.SetReadDeadline(timeout)
-				if err != nil {
-					fmt.Println(err)
-					break loop
-				}
-			}
-
-			r.rrdata.Timeout = 0
-			cidok := false
-			itemserror := false
-
-			if r.rrdata.ItemCount != 2 {
-				p.debug("itemCount != 2")
-				r.encHead.Status = eipIncorrectData
+			if status != cip.EncapSuccess {
+				r.encHead.Status = status
 				break
 			}
 
-			// address item
-			_, err = r.read(&item)
-			if err != nil {
-				break loop
-			}
-			if item.Type == itConnAddress { // TODO itemdata to connID
-				itemdata := make([]uint8, item.Length)
-				_, err = r.read(&itemdata)
-				if err != nil {
-					break loop
-				}
-				cidok = true
-			} else if item.Type != itNullAddress {
-				p.debug("unkown address item:", item.Type)
-				itemserror = true
-				itemdata := make([]uint8, item.Length)
-				_, err = r.read(&itemdata)
+			if r.rrdata.Timeout != 0 && r.encHead.Command == cip.CommandSendRRData {
+				timeout = time.Now().Add(time.Duration(r.rrdata.Timeout) * time.Second)
+				err = s.deadline(conn, timeout)
 				if err != nil {
+					if err != errServerClosed {
+						r.log(LevelWarn, "set deadline", "err", err)
+					}
 					break loop
 				}
 			}
+			r.rrdata.Timeout = 0
 
-			// data item
-			_, err = r.read(&item)
-			if err != nil {
-				break loop
-			}
 			r.dataLen = int(item.Length)
 			r.maxData = 472
-			if item.Type == itConnData {
-				_, err = r.read(&protSeqCount)
+			if item.Type == cip.ItemConnData {
+				_, err = r.readUINT(&protSeqCount)
 				if err != nil {
 					break loop
 				}
 				r.maxData = r.maxFO
 				r.dataLen -= 2
-				cidok = true
-			} else if item.Type != itUnconnData {
-				p.debug("unkown data item:", item.Type)
-				itemserror = true
-				itemdata := make([]uint8, item.Length)
-				_, err = r.read(&itemdata)
-				if err != nil {
-					break loop
-				}
 			}
 
-			if itemserror {
-				r.encHead.Status = eipIncorrectData
-				break
-			}
-
-			// CIP
-			_, err = r.read(&r.protd)
-			if err != nil {
+			if !r.message() {
 				break loop
 			}
 
-			r.resp.Service = r.protd.Service + 128
-			r.resp.Status = Success
-			r.resp.AddStatusSize = 0
-
-			ePath := make([]uint8, r.protd.PathSize*2)
-			_, err = r.read(&ePath)
-			if err != nil {
-				break loop
+			r.cpf = r.rrdata.AppendTo(r.cpf)
+			cidok := addr.Type == cip.ItemConnAddress || item.Type == cip.ItemConnData // TODO address item data to connID
+			if cidok && r.connID != 0 {
+				r.cpf = (&cip.ItemHeader{Type: cip.ItemConnAddress, Length: 4}).AppendTo(r.cpf)
+				r.cpf = appendUDINT(r.cpf, r.connID)
+				r.cpf = (&cip.ItemHeader{Type: cip.ItemConnData, Length: uint16(2 + r.writeBuf.Len())}).AppendTo(r.cpf)
+				r.cpf = appendUINT(r.cpf, protSeqCount)
+			} else {
+				r.cpf = (&cip.ItemHeader{Type: cip.ItemNullAddress, Length: 0}).AppendTo(r.cpf)
+				r.cpf = (&cip.ItemHeader{Type: cip.ItemUnconnData, Length: uint16(r.writeBuf.Len())}).AppendTo(r.cpf)
 			}
-			r.dataLen -= 2 + len(ePath)
-			r.uDataLen = r.dataLen
 
-			unc := false
+		default:
+			r.log(LevelWarn, "unknown command", "command", r.encHead.Command)
 
-			r.class, r.instance, r.attr, r.member, r.path, err = r.parsePath(ePath)
+			data, _, err := r.next(int(r.encHead.Length))
 			if err != nil {
-				r.resp.Status = PathSegmentError
-				r.resp.AddStatusSize = 1
-				r.write(r.resp)
-				r.write(uint16(0))
-				r.readBuf.Reset(r.c)
-				goto errl
-			}
-			if p.Verbose {
-				fmt.Printf("Class %X Instance %X Attr %X %v\n", r.class, r.instance, r.attr, r.path)
-			}
-
-			if r.class == ConnManager && r.instance == 1 && r.protd.Service == UnconnectedSend {
-				unc = true
-				var usdata itemType
-				rb, err := r.read(&usdata)
-				if err != nil {
-					if rb {
-						goto errl
-					}
-					break loop
-				}
-				rb, err = r.read(&r.protd)
-				if err != nil {
-					if rb {
-						goto errl
-					}
-					break loop
-				}
-
-				r.resp.Service = r.protd.Service + 128
-
-				ePath = make([]uint8, r.protd.PathSize*2)
-				rb, err = r.read(&ePath)
-				if err != nil {
-					if rb {
-						goto errl
-					}
-					break loop
-				}
-				r.uDataLen -= binary.Size(usdata) + int(usdata.Length)
-				r.dataLen -= 6 + len(ePath) + r.uDataLen
-
-				r.class, r.instance, r.attr, r.member, r.path, err = r.parsePath(ePath)
-				if err != nil {
-					r.resp.Status = PathSegmentError
-					r.resp.AddStatusSize = 1
-					r.write(r.resp)
-					r.write(uint16(0))
-					r.readBuf.Reset(r.c)
-					goto errl
-				}
-				if p.Verbose {
-					fmt.Printf("UNC SEND: Class %X Instance %X Attr %X %v\n", r.class, r.instance, r.attr, r.path)
-				}
-			}
-
-			if !r.serviceHandle() {
-				r.readBuf.Reset(r.c)
 				break loop
 			}
+			r.encHead.Status = cip.EncapInvalidCommand
 
-			if unc { // path
-				// fmt.Println(">>>", r.uDataLen)
-				data := make([]uint8, r.uDataLen)
-				rb, err := r.read(&data)
-				if err != nil && !rb {
-					break loop
-				}
-			}
-
-		errl:
-			r.writeCIP(r.rrdata)
-			if cidok && r.connID != 0 {
-				r.writeCIP(itemType{Type: itConnAddress, Length: uint16(binary.Size(r.connID))})
-				r.writeCIP(r.connID)
-				r.writeCIP(itemType{Type: itConnData, Length: uint16(binary.Size(protSeqCount) + r.writeBuf.Len())})
-				r.writeCIP(protSeqCount)
-			} else {
-				r.writeCIP(itemType{Type: itNullAddress, Length: 0})
-				r.writeCIP(itemType{Type: itUnconnData, Length: uint16(r.writeBuf.Len())})
-			}
-
-		default:
-			fmt.Println("unknown command:", r.encHead.Command)
+			r.writeBuf.Write(data)
+		}
 
-			data := make([]uint8, r.encHead.Length)
-			_, err = r.read(&data)
+		// data of malformed requests, which isn't read by the command
+		if r.lenRem > 0 {
+			_, err = r.skip(r.lenRem)
 			if err != nil {
 				break loop
 			}
-			r.encHead.Status = eipInvalid
-
-			r.write(data)
 		}
 
 		err = conn.SetWriteDeadline(timeout)
 		if err != nil {
-			fmt.Println(err)
+			r.log(LevelWarn, "set deadline", "err", err)
 			break loop
 		}
 
-		r.encHead.Length = uint16(r.wrCIPBuf.Len() + r.writeBuf.Len())
-		var buf bytes.Buffer
-
-		err = binary.Write(&buf, binary.LittleEndian, r.encHead)
-		if err != nil {
-			fmt.Println(err)
-			break loop
-		}
-		buf.Write(r.wrCIPBuf.Bytes())
-		buf.Write(r.writeBuf.Bytes())
+		r.encHead.Length = uint16(len(r.cpf) + r.writeBuf.Len())
+		r.out = r.encHead.AppendTo(r.out[:0])
+		r.out = append(r.out, r.cpf...)
+		r.out = append(r.out, r.writeBuf.Bytes()...)
 
-		_, err = conn.Write(buf.Bytes())
+		_, err = conn.Write(r.out)
 		if err != nil {
-			fmt.Println(err)
+			r.log(LevelWarn, "write", "err", err)
 			break loop
 		}
+		p.met.reply(r.encHead.Command, len(r.out), start)
 	}
 	err := conn.Close()
 	if err != nil {
-		fmt.Println(err)
+		r.log(LevelWarn, "close", "err", err)
 	}
 }
 
-func (r *req) serviceHandle() bool {
-	switch {
-	case r.class == MessageRouter && r.instance == 1 && r.protd.Service == MultiServ: // TODO errors, status 6
-		r.p.debug("MultipleServicePacket")
+// message serves CIP request of the data item, false is returned on read error.
+func (r *req) message() bool {
+	r.resp = cip.Response{Service: cip.ServiceReply}
 
-		var (
-			count  uint16
-			offset uint16
-		)
+	rb, err := r.readProtd()
+	if err != nil {
+		return rb
+	}
+	r.resp.Service = r.protd.Service + 128
 
-		rb, err := r.read(&count)
+	ePath, rb, err := r.next(int(r.protd.PathSize) * 2)
+	if err != nil {
+		return rb
+	}
+	r.dataLen -= 2 + len(ePath)
+	if r.dataLen < 0 {
+		return r.err(NotEnoughData)
+	}
+
+	r.class, r.instance, r.attr, r.member, r.path, err = r.parsePath(ePath)
+	if err != nil {
+		r.errExt(PathSegmentError, 0)
+		return true
+	}
+	if r.p.Verbose {
+		r.debug("request", "path", r.path)
+	}
+
+	if r.class == ConnManager && r.instance == 1 && r.protd.Service == UnconnectedSend {
+		b, rb, err := r.next(4) // priority, timeout ticks, message size
 		if err != nil {
 			return rb
 		}
-		offset = 2 + 2*count
+		msgLen := int(binary.LittleEndian.Uint16(b[2:]))
+		if msgLen > r.dataLen-4 {
+			return r.err(NotEnoughData)
+		}
+		rb, err = r.readProtd()
+		if err != nil {
+			return rb
+		}
+		r.resp.Service = r.protd.Service + 128
 
-		svs := make([]uint16, count)
-		rb, err = r.read(&svs)
+		ePath, rb, err = r.next(int(r.protd.PathSize) * 2)
 		if err != nil {
 			return rb
 		}
+		r.dataLen = msgLen - 2 - len(ePath) // route path is discarded with the rest of the request
+		if r.dataLen < 0 {
+			return r.err(NotEnoughData)
+		}
 
-		r.write(r.resp)
-		r.write(count)
+		r.class, r.instance, r.attr, r.member, r.path, err = r.parsePath(ePath)
+		if err != nil {
+			r.errExt(PathSegmentError, 0)
+			return true
+		}
+		if r.p.Verbose {
+			r.debug("UnconnectedSend", "path", r.path)
+		}
+	}
+
+	service := r.protd.Service // of the message, protd is overwritten by MultipleServicePacket
+	ok := r.service()
+	if r.writeBuf.Len() > maxReply {
+		r.writeBuf.Reset()
+		r.resp.Service = service + 128
+		r.resp.AddStatus = nil
+		r.err(ReplyTooLarge)
+	}
+	return ok
+}
+
+func (r *req) serviceHandle() bool {
+	switch {
+	case r.class == MessageRouter && r.instance == 1 && r.protd.Service == MultiServ: // TODO status 6
+		r.debug("MultipleServicePacket")
+
+		var svsArr [maxStackList]uint16
+
+		svs, rb, err := r.readUINTList(svsArr[:])
+		if err != nil {
+			return rb
+		}
+		offset := 2 + 2*len(svs)
+		base := r.lenRem + offset // lenRem at the start of the packet
+
+		start := r.writeBuf.Len()
+		r.writeResp()
+		r.writeUINT(uint16(len(svs)))
+
+		if !r.locked {
+			writes, ok := r.multiServWrites(svs, offset)
+			switch {
+			case ok && !writes: // consistent snapshot
+				r.p.tMut.RLock()
+				r.locked = true
+				defer func() {
+					r.locked = false
+					r.p.tMut.RUnlock()
+				}()
+			case !ok || r.p.AtomicMultiServ:
+				r.p.lockTags()
+				r.locked = true
+				defer func() {
+					r.locked = false
+					r.p.unlockTags()
+				}()
+			}
+		}
 
 		oldBuf := r.writeBuf
-		newBuf := new(bytes.Buffer)
+		newBuf := getBuf()
 		r.writeBuf = newBuf
+		defer func() {
+			if r.writeBuf == newBuf { // error in the middle of the packet
+				r.writeBuf = oldBuf
+				oldBuf.Truncate(start)
+				r.resp.Service = MultiServ + 128
+				r.err(int(r.resp.Status))
+			}
+			putBuf(newBuf)
+		}()
 
 		olddl := r.dataLen
 		for i := range svs {
-			rb, err = r.read(&r.protd)
+			end := olddl
+			if i+1 < len(svs) {
+				end = int(svs[i+1])
+			}
+			pos := base - r.lenRem
+			if int(svs[i]) < pos || end > olddl {
+				r.debug("service offset error", "offset", svs[i])
+				return r.err(InvalidPar)
+			}
+			rb, err = r.skip(int(svs[i]) - pos)
+			if err != nil {
+				return rb
+			}
+
+			rb, err = r.readProtd()
 			if err != nil {
 				return rb
 			}
@@ -532,101 +605,98 @@ func (r *req) serviceHandle() bool {
 			r.resp.Service = r.protd.Service + 128
 			r.resp.Status = Success
 
-			ePath := make([]uint8, r.protd.PathSize*2)
-			rb, err = r.read(&ePath)
+			ePath, rb, err := r.next(int(r.protd.PathSize) * 2)
 			if err != nil {
 				return rb
 			}
-			if i+1 < len(svs) {
-				r.dataLen = int(svs[i+1] - svs[i])
-			} else {
-				r.dataLen = olddl - int(svs[i])
+			r.dataLen = end - int(svs[i]) - 2 - len(ePath)
+			svs[i] = uint16(offset + r.writeBuf.Len())
+			if r.dataLen < 0 {
+				r.err(NotEnoughData)
+				continue
 			}
-			r.dataLen -= 2 + len(ePath)
 
 			r.class, r.instance, r.attr, r.member, r.path, err = r.parsePath(ePath)
+			if err != nil {
+				r.errExt(PathSegmentError, 0)
+				continue
+			}
 			if r.p.Verbose {
-				fmt.Printf("Class %X Instance %X Attr %X %v\n", r.class, r.instance, r.attr, r.path)
+				r.debug("request", "path", r.path)
 			}
 
-			svs[i] = offset + uint16(r.writeBuf.Len())
-			if !r.serviceHandle() {
+			if !r.service() {
 				return false
 			}
 		}
 		r.writeBuf = oldBuf
-		r.write(svs)
-		r.write(newBuf.Bytes())
+		for _, s := range svs {
+			r.writeUINT(s)
+		}
+		r.writeBuf.Write(newBuf.Bytes())
 
 	case r.protd.Service == GetAttrAll:
-		r.p.debug("GetAttributesAll")
+		r.debug("GetAttributesAll")
 
 		in := r.p.GetClassInstance(r.class, r.instance)
 		if in != nil {
-			r.write(r.resp)
-			r.write(in.getAttrAll())
+			r.writeResp()
+			r.writeBuf.Write(in.getAttrAll())
 		} else {
-			r.p.debug("path unknown", r.path)
+			r.debug("path unknown", "path", r.path)
 			if r.class == FileClass {
 				r.resp.Status = ObjectNotExist
 			} else {
 				r.resp.Status = PathUnknown
 			}
-			r.write(r.resp)
+			r.writeResp()
 		}
 
 	case r.protd.Service == GetAttrList:
-		r.p.debug("GetAttributeList")
-		var (
-			count uint16
-			buf   bytes.Buffer
-			st    uint16
-		)
+		r.debug("GetAttributeList")
+		var attrArr [maxStackList]uint16
 
-		rb, err := r.read(&count)
-		if err != nil {
-			return rb
-		}
-		attr := make([]uint16, count)
-		rb, err = r.read(&attr)
+		attr, rb, err := r.readUINTList(attrArr[:])
 		if err != nil {
 			return rb
 		}
 
 		in := r.p.GetClassInstance(r.class, r.instance)
 		if in != nil {
+			start := r.writeBuf.Len()
+			r.writeResp()
+			r.writeUINT(uint16(len(attr)))
 			in.m.RLock()
 			ln := len(in.attr)
 			for _, i := range attr {
-				bwrite(&buf, i)
+				r.writeUINT(i)
 				if int(i) < ln && in.attr[i] != nil {
-					r.p.debug(in.attr[i].Name)
-					st = Success
-					bwrite(&buf, st)
-					bwrite(&buf, in.attr[i].DataBytes())
+					if r.p.Verbose {
+						if r.p.Verbose {
+							r.debug("attribute", "name", in.attr[i].Name)
+						}
+					}
+					r.writeUINT(Success)
+					r.writeBuf.Write(in.attr[i].DataBytes())
 				} else {
 					r.resp.Status = AttrListError
-					st = AttrNotSup
-					bwrite(&buf, st)
+					r.writeUINT(AttrNotSup)
 				}
 			}
 			in.m.RUnlock()
-
-			r.write(r.resp)
-			r.write(count)
-			r.write(buf.Bytes())
+			r.writeBuf.Bytes()[start+2] = r.resp.Status
 		} else {
-			r.p.debug("path unknown", r.path)
+			r.debug("path unknown", "path", r.path)
 			if r.class == FileClass {
 				r.resp.Status = ObjectNotExist
 			} else {
 				r.resp.Status = PathUnknown
 			}
-			r.write(r.resp)
+			r.writeResp()
 		}
 
 	case r.protd.Service == SetAttrList:
-		r.p.debug("SetAttributeList")
+		r.debug("SetAttributeList")
 		var (
 			attr  uint16
 			count uint16
@@ -641,7 +711,8 @@ func (r *req) serviceHandle() bool {
 
 		in := r.p.GetClassInstance(r.class, r.instance)
 		if in != nil {
-			in.m.RLock()
+			in.m.Lock()
+			defer in.m.Unlock()
 			ln := len(in.attr)
 			for i := uint16(0); i < count; i++ {
 				rb, err := r.read(&attr)
@@ -650,14 +721,18 @@ func (r *req) serviceHandle() bool {
 				}
 				bwrite(&buf, attr)
 				if int(attr) < ln && in.attr[attr] != nil {
-					r.p.debug(in.attr[attr].Name)
+					if r.p.Verbose {
+						r.debug("attribute", "name", in.attr[attr].Name)
+					}
 					wrData := make([]uint8, len(in.attr[attr].data))
 					rb, err := r.read(wrData)
 					if err != nil {
 						return rb
 					}
 					st = Success
+					old := append([]uint8(nil), in.attr[attr].DataBytes()...)
 					sdb := in.attr[attr].SetDataBytes(wrData)
+					r.p.audit(r.auditCtx("SetAttrList"), attrPathString(r.class, r.instance, int(attr)), old, wrData, int(sdb))
 					if sdb != Success {
 						r.resp.Status = AttrListError
 						st = uint16(sdb)
@@ -668,78 +743,87 @@ func (r *req) serviceHandle() bool {
 				}
 				bwrite(&buf, st)
 			}
-			in.m.RUnlock()
 
-			r.write(r.resp)
-			r.write(count)
-			r.write(buf.Bytes())
+			r.writeResp()
+			r.writeUINT(count)
+			r.writeBuf.Write(buf.Bytes())
 		} else {
-			r.p.debug("path unknown", r.path)
+			r.debug("path unknown", "path", r.path)
 			if r.class == FileClass {
 				r.resp.Status = ObjectNotExist
 			} else {
 				r.resp.Status = PathUnknown
 			}
-			r.write(r.resp)
+			r.writeResp()
 		}
 
-	case r.class == SymbolClass && r.protd.Service == GetInstAttrList:
-		r.p.debug("GetInstanceAttributesList")
-		var (
-			count uint16
-			buf   bytes.Buffer
-		)
+	case (r.class == SymbolClass || r.programSymbols()) && r.protd.Service == GetInstAttrList:
+		r.debug("GetInstanceAttributesList")
+		var attrArr [maxStackList]uint16
 
-		rb, err := r.read(&count)
-		if err != nil {
-			return rb
-		}
-		attr := make([]uint16, count)
-		rb, err = r.read(&attr)
+		attr, rb, err := r.readUINTList(attrArr[:])
 		if err != nil {
 			return rb
 		}
 
-		li, ins := r.p.GetClassInstancesList(r.class, r.instance, 0)
+		instance, prefix := r.instance, ""
+		if r.class != SymbolClass { // Program:name, Symbol class, instance
+			instance, prefix = r.path[2].val, r.path[0].txt+"."
+		}
+		li, ins := r.p.classInstances(SymbolClass, instance)
 		if li != nil {
+			start := r.writeBuf.Len()
+			r.writeResp()
 			for a, x := range li {
-				if buf.Len() >= r.maxData-20 {
+				in := ins[a]
+				in.m.RLock()
+				var name string
+				if prefix != "" {
+					name = in.attr[1].DataString()
+					if len(name) <= len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+						in.m.RUnlock()
+						continue
+					}
+				}
+				if r.writeBuf.Len()-start-4 >= r.maxData-20 {
+					in.m.RUnlock()
 					r.resp.Status = PartialTransfer
 					break
 				}
-				bwrite(&buf, uint32(x))
-				in := ins[a]
-				in.m.RLock()
+				r.writeUDINT(uint32(x))
 				ln := len(in.attr)
 				for _, i := range attr {
-					if int(i) < ln && in.attr[i] != nil {
-						bwrite(&buf, in.attr[i].DataBytes())
+					if i == 1 && prefix != "" { // name in the program scope
+						r.writeUINT(uint16(len(name) - len(prefix)))
+						r.writeBuf.WriteString(name[len(prefix):])
+					} else if int(i) < ln && in.attr[i] != nil {
+						r.writeBuf.Write(in.attr[i].DataBytes())
 					} else { // FIXME break
 						r.resp.Status = AttrListError
 					}
 				}
 				in.m.RUnlock()
 			}
-
-			r.write(r.resp)
-			r.write(buf.Bytes())
+			r.writeBuf.Bytes()[start+2] = r.resp.Status
 		} else {
 			r.err(PathUnknown)
 		}
 
 	case r.protd.Service == GetAttr:
-		r.p.debug("GetAttributeSingle")
+		r.debug("GetAttributeSingle")
 
 		at, aok, in := r.p.GetClassInstanceAttr(r.class, r.instance, r.attr)
 
 		r.resp.Service = r.protd.Service + 128
 
 		if in && aok {
-			r.p.debug(at.Name)
-			r.write(r.resp)
-			r.write(at.DataBytes())
+			if r.p.Verbose {
+				r.debug("attribute", "name", at.Name)
+			}
+			r.writeResp()
+			r.writeBuf.Write(at.DataBytes())
 		} else {
-			r.p.debug("path unknown", r.path)
+			r.debug("path unknown", "path", r.path)
 			if in {
 				r.resp.Status = AttrNotSup
 			} else if r.class == FileClass {
@@ -747,11 +831,11 @@ func (r *req) serviceHandle() bool {
 			} else {
 				r.resp.Status = PathUnknown
 			}
-			r.write(r.resp)
+			r.writeResp()
 		}
 
 	case r.protd.Service == SetAttr:
-		r.p.debug("SetAttributeSingle")
+		r.debug("SetAttributeSingle")
 
 		var (
 			aok bool
@@ -769,14 +853,21 @@ func (r *req) serviceHandle() bool {
 		r.resp.Service = r.protd.Service + 128
 
 		if in && aok {
-			r.p.debug(at.Name)
+			if r.p.Verbose {
+				r.debug("attribute", "name", at.Name)
+			}
 			if r.instance == 0 {
 				r.resp.Status = ServNotSup
 			} else {
+				inst := r.p.GetClassInstance(r.class, r.instance)
+				inst.m.Lock()
+				old := append([]uint8(nil), at.DataBytes()...)
 				r.resp.Status = at.SetDataBytes(wrData)
+				inst.m.Unlock()
+				r.p.audit(r.auditCtx("SetAttr"), attrPathString(r.class, r.instance, r.attr), old, wrData, int(r.resp.Status))
 			}
 		} else {
-			r.p.debug("path unknown", r.path)
+			r.debug("path unknown", "path", r.path)
 			if in {
 				if r.instance == 0 {
 					r.resp.Status = ServNotSup
@@ -789,10 +880,10 @@ func (r *req) serviceHandle() bool {
 				r.resp.Status = PathUnknown
 			}
 		}
-		r.write(r.resp)
+		r.writeResp()
 
 	case r.class == FileClass && r.instance != 0 && r.protd.Service == InititateUpload:
-		r.p.debug("InititateUpload")
+		r.debug("InititateUpload")
 		var maxSize uint8
 
 		rb, err := r.read(&maxSize)
@@ -806,14 +897,14 @@ func (r *req) serviceHandle() bool {
 			sr.FileSize = uint32(len(in.data))
 			sr.TransferSize = maxSize
 			r.file[r.instance] = &[3]uint8{maxSize, 0, 0} // TransferSize, TransferNumber, TransferNumber rollover
-			r.write(r.resp)
+			r.writeResp()
 			r.write(sr)
 		} else {
 			r.err(PathUnknown)
 		}
 
 	case r.class == FileClass && r.instance != 0 && r.protd.Service == UploadTransfer:
-		r.p.debug("UploadTransfer")
+		r.debug("UploadTransfer")
 		var transferNo uint8
 
 		rb, err := r.read(&transferNo)
@@ -826,7 +917,7 @@ func (r *req) serviceHandle() bool {
 		if in != nil && fok {
 			if transferNo == f[1] || transferNo == f[1]+1 || (transferNo == 0 && f[1] == 255) {
 				if transferNo == 0 && f[1] == 255 { // rollover
-					r.p.debug("rollover")
+					r.debug("rollover")
 					f[2]++ // FIXME retry!
 				}
 
@@ -834,6 +925,11 @@ func (r *req) serviceHandle() bool {
 				addcksum := false
 				dtlen := len(in.data)
 				pos := (int(f[2]) + 1) * int(transferNo) * int(f[0])
+				if pos > dtlen {
+					r.debug("transfer beyond file", "transfer", transferNo)
+					r.errExt(InvalidPar, 0)
+					return true
+				}
 				posto := pos + int(f[0])
 				if posto > dtlen {
 					posto = dtlen
@@ -853,123 +949,93 @@ func (r *req) serviceHandle() bool {
 				}
 				f[1] = transferNo
 
-				r.p.debug(pos, ":", posto)
+				r.debug("upload", "from", pos, "to", posto)
 
-				r.write(r.resp)
+				r.writeResp()
 				r.write(sr)
 				r.write(dt)
 				if addcksum {
 					r.write(in.getAttrData(7))
 				}
 			} else {
-				r.p.debug("transfer number error", transferNo)
-
-				r.resp.Status = InvalidPar
-				r.resp.AddStatusSize = 1
+				r.debug("transfer number error", "transfer", transferNo)
 
-				r.write(r.resp)
-				r.write(uint16(0))
+				r.errExt(InvalidPar, 0)
 			}
 		} else {
 			r.err(PathUnknown)
 		}
 
-	case r.class == ConnManager && r.instance == 1 && r.protd.Service == ForwardOpen:
-		r.p.debug("ForwardOpen")
-
-		var (
-			fodata forwardOpenData
-			sr     forwardOpenResponse
-		)
+	case r.class == ConnManager && r.instance == 1 && (r.protd.Service == ForwardOpen || r.protd.Service == LargeForwOpen):
+		fo := cip.ForwardOpen{Large: r.protd.Service == LargeForwOpen}
+		n := cip.ForwardOpenLen
+		if fo.Large {
+			r.debug("LargeForwardOpen")
+			n = cip.LargeForwardOpenLen
+		} else {
+			r.debug("ForwardOpen")
+		}
 
-		rb, err := r.read(&fodata)
+		b, rb, err := r.nextSized(n, n-1)
 		if err != nil {
 			return rb
 		}
-		connPath := make([]uint8, fodata.ConnPathSize*2)
-		rb, err = r.read(&connPath)
-		if err != nil {
-			return rb
+		if fo.Unmarshal(b) != nil {
+			return r.err(NotEnoughData)
 		}
 
-		sr.OTConnectionID = rand.Uint32()
-		sr.TOConnectionID = fodata.TOConnectionID
-		sr.ConnSerialNumber = fodata.ConnSerialNumber
-		sr.VendorID = fodata.VendorID
-		sr.OriginatorSerialNumber = fodata.OriginatorSerialNumber
-		sr.OTAPI = fodata.OTRPI
-		sr.TOAPI = fodata.TORPI
-		sr.AppReplySize = 0
-
-		r.connID = fodata.TOConnectionID
-		r.maxFO = int(fodata.TOConnPar&0x1FF) - 32
-
-		r.write(r.resp)
-		r.write(sr)
-
-	case r.class == ConnManager && r.instance == 1 && r.protd.Service == LargeForwOpen:
-		r.p.debug("LargeForwardOpen")
-
-		var (
-			fodata largeForwardOpenData
-			sr     forwardOpenResponse
-		)
+		sr := cip.ForwardOpenResponse{
+			OTConnectionID:         rand.Uint32(),
+			TOConnectionID:         fo.TOConnectionID,
+			ConnSerialNumber:       fo.ConnSerialNumber,
+			VendorID:               fo.VendorID,
+			OriginatorSerialNumber: fo.OriginatorSerialNumber,
+			OTAPI:                  fo.OTRPI,
+			TOAPI:                  fo.TORPI,
+		}
 
-		rb, err := r.read(&fodata)
-		if err != nil {
-			return rb
+		size := int(fo.TOConnParams & 0x1FF)
+		if fo.Large {
+			size = int(fo.TOConnParams & 0xFFFF)
 		}
-		connPath := make([]uint8, fodata.ConnPathSize*2)
-		rb, err = r.read(&connPath)
-		if err != nil {
-			return rb
+		if size <= 32 {
+			r.debug("invalid connection size", "size", size)
+			r.errExt(ConnFailure, 0x0109)
+			return true
 		}
+		r.connID = fo.TOConnectionID
+		r.maxFO = size - 32
 
-		sr.OTConnectionID = rand.Uint32()
-		sr.TOConnectionID = fodata.TOConnectionID
-		sr.ConnSerialNumber = fodata.ConnSerialNumber
-		sr.VendorID = fodata.VendorID
-		sr.OriginatorSerialNumber = fodata.OriginatorSerialNumber
-		sr.OTAPI = fodata.OTRPI
-		sr.TOAPI = fodata.TORPI
-		sr.AppReplySize = 0
-
-		r.connID = fodata.TOConnectionID
-		r.maxFO = int(fodata.TOConnPar&0xFFFF) - 32
-
-		r.write(r.resp)
-		r.write(sr)
+		r.writeResp()
+		b, _ = sr.AppendTo(b[:0])
+		r.writeBuf.Write(b)
 
 	case r.class == ConnManager && r.instance == 1 && r.protd.Service == ForwardClose:
-		r.p.debug("ForwardClose")
+		r.debug("ForwardClose")
 
-		var (
-			fcdata forwardCloseData
-			sr     forwardCloseResponse
-		)
-
-		rb, err := r.read(&fcdata)
+		var fc cip.ForwardClose
+		b, rb, err := r.nextSized(cip.ForwardCloseLen, cip.ForwardCloseLen-2)
 		if err != nil {
 			return rb
 		}
-		connPath := make([]uint8, fcdata.ConnPathSize*2)
-		rb, err = r.read(&connPath)
-		if err != nil {
-			return rb
+		if fc.Unmarshal(b) != nil {
+			return r.err(NotEnoughData)
 		}
 
-		sr.ConnSerialNumber = fcdata.ConnSerialNumber
-		sr.VendorID = fcdata.VendorID
-		sr.OriginatorSerialNumber = fcdata.OriginatorSerialNumber
-		sr.AppReplySize = 0
+		sr := cip.ForwardCloseResponse{
+			ConnSerialNumber:       fc.ConnSerialNumber,
+			VendorID:               fc.VendorID,
+			OriginatorSerialNumber: fc.OriginatorSerialNumber,
+		}
 
 		r.connID = 0
 
-		r.write(r.resp)
-		r.write(sr)
+		r.writeResp()
+		b, _ = sr.AppendTo(b[:0])
+		r.writeBuf.Write(b)
 
 	case r.class == TemplateClass && r.protd.Service == ReadTemplate:
-		r.p.debug("ReadTemplate")
+		r.debug("ReadTemplate")
 
 		var rd readTemplateResponse
 
@@ -977,7 +1043,7 @@ func (r *req) serviceHandle() bool {
 		if err != nil {
 			return rb
 		}
-		r.p.debug(rd.Offset, rd.Number)
+		r.debug("template", "offset", rd.Offset, "number", rd.Number)
 
 		if in := r.p.GetClassInstance(r.class, r.instance); in != nil && rd.Offset < uint32(len(in.data)) {
 			data := in.data[rd.Offset:]
@@ -985,17 +1051,16 @@ func (r *req) serviceHandle() bool {
 				r.resp.Status = PartialTransfer
 				data = data[:r.maxData]
 			}
-			r.write(r.resp)
+			r.writeResp()
 			r.write(data)
 		} else {
 			r.err(PathUnknown)
 		}
 
 	case r.class == 0xAC && r.protd.Service == ReadTag:
-		fmt.Println("unknown service:", r.protd.Service)
+		r.log(LevelWarn, "unknown service")
 
-		data := make([]uint8, r.dataLen)
-		rb, err := r.read(&data)
+		rb, err := r.skip(r.dataLen)
 		if err != nil {
 			return rb
 		}
@@ -1003,150 +1068,124 @@ func (r *req) serviceHandle() bool {
 		r.err(ServNotSup)
 
 	case (r.class == -1 || r.class == SymbolClass) && r.protd.Service == ReadTag:
-		r.p.debug("ReadTag")
+		r.debug("ReadTag")
 
 		var tagCount uint16
 
-		rb, err := r.read(&tagCount)
+		rb, err := r.readUINT(&tagCount)
 		if err != nil {
 			return rb
 		}
 
-		if rtData, tagType, elLen, ok := r.p.readTag(r.path, tagCount); ok {
-			if len(rtData) > r.maxData {
-				r.resp.Status = PartialTransfer
-				if elLen > r.maxData {
-					rtData = rtData[:r.maxData]
-				} else {
-					rtData = rtData[:(r.maxData/elLen)*elLen]
-				}
-			}
-			r.write(r.resp)
-			if tagType >= TypeStructHead {
-				r.write(uint16(tagType >> 16))
-			}
-			r.write(uint16(tagType))
-			r.write(rtData)
-		} else {
-			r.resp.Status = PathSegmentError
-			r.resp.AddStatusSize = 1
-
-			r.write(r.resp)
-			r.write(uint16(0))
+		locked := r.readLock()
+		v, ok := r.p.viewTag(r.path, tagCount)
+		if ok {
+			r.writeView(&v, 0)
+		}
+		r.readUnlock(locked)
+		if !ok {
+			r.errExt(PathSegmentError, 0)
 		}
 
 	case (r.class == -1 || r.class == SymbolClass) && r.protd.Service == ReadTagFrag:
-		r.p.debug("ReadTagFragmented")
+		r.debug("ReadTagFragmented")
 
 		var (
 			tagCount  uint16
 			tagOffset uint32
 		)
 
-		rb, err := r.read(&tagCount)
+		rb, err := r.readUINT(&tagCount)
 		if err != nil {
 			return rb
 		}
-		rb, err = r.read(&tagOffset)
+		rb, err = r.readUDINT(&tagOffset)
 		if err != nil {
 			return rb
 		}
 
-		if rtData, tagType, elLen, ok := r.p.readTag(r.path, tagCount); ok && tagOffset < uint32(len(rtData)) {
-			rtData = rtData[tagOffset:]
-			if len(rtData) > r.maxData {
-				r.resp.Status = PartialTransfer
-				if elLen > r.maxData {
-					rtData = rtData[:r.maxData]
-				} else {
-					rtData = rtData[:(r.maxData/elLen)*elLen]
-				}
-			}
-			r.write(r.resp)
-			if tagType >= TypeStructHead {
-				r.write(uint16(tagType >> 16))
-			}
-			r.write(uint16(tagType))
-			r.write(rtData)
-		} else {
-			r.resp.Status = PathSegmentError
-			r.resp.AddStatusSize = 1
-
-			r.write(r.resp)
-			r.write(uint16(0))
+		locked := r.readLock()
+		v, ok := r.p.viewTag(r.path, tagCount)
+		ok = ok && tagOffset < uint32(v.n)
+		if ok {
+			r.writeView(&v, int(tagOffset))
+		}
+		r.readUnlock(locked)
+		if !ok {
+			r.errExt(PathSegmentError, 0)
 		}
 
 	case (r.class == -1 || r.class == SymbolClass) && r.protd.Service == ReadModifyWrite:
-		r.p.debug("ReadModifyWrite")
+		r.debug("ReadModifyWrite")
 
 		var maskSize uint16
 
-		rb, err := r.read(&maskSize)
+		rb, err := r.readUINT(&maskSize)
 		if err != nil {
 			return rb
 		}
-		orMask := make([]uint8, maskSize)
-		rb, err = r.read(&orMask)
+		masks, rb, err := r.next(2 * int(maskSize))
 		if err != nil {
 			return rb
 		}
-		andMask := make([]uint8, maskSize)
-		rb, err = r.read(&andMask)
-		if err != nil {
-			return rb
-		}
-		if r.p.readModWriteTag(r.path, orMask, andMask) {
-			r.write(r.resp)
+		orMask, andMask := masks[:maskSize], masks[maskSize:]
+		allowed := r.p.writeAllowed()
+		r.tagLock()
+		ok := allowed && r.p.readModWriteTag(r.path, orMask, andMask, r.auditCtx("ReadModifyWrite"))
+		r.tagUnlock()
+		if !allowed {
+			r.resp.Status = DeviceStateConflict
+			r.writeResp()
+		} else if ok {
+			r.writeResp()
 		} else {
-			r.resp.Status = PathSegmentError
-			r.resp.AddStatusSize = 1
-
-			r.write(r.resp)
-			r.write(uint16(0))
+			r.errExt(PathSegmentError, 0)
 		}
 
 	case (r.class == -1 || r.class == SymbolClass) && r.protd.Service == WriteTag:
-		r.p.debug("WriteTag")
+		r.debug("WriteTag")
 
 		var (
 			tagType  uint16
 			tagCount uint16
 		)
 
-		rb, err := r.read(&tagType)
+		rb, err := r.readUINT(&tagType)
 		if err != nil {
 			return rb
 		}
 		if tagType == 0x02A0 {
-			rb, err = r.read(&tagType)
+			rb, err = r.readUINT(&tagType)
 			if err != nil {
 				return rb
 			}
 			r.dataLen -= 2
 		}
-		rb, err = r.read(&tagCount)
+		rb, err = r.readUINT(&tagCount)
 		if err != nil {
 			return rb
 		}
 
-		wrData := make([]uint8, r.dataLen-4)
-		rb, err = r.read(wrData)
+		wrData, rb, err := r.next(r.dataLen - 4)
 		if err != nil {
 			return rb
 		}
 
-		if r.p.saveTag(r.path, tagType, int(tagCount), wrData, 0) {
-			r.write(r.resp)
+		allowed := r.p.writeAllowed()
+		r.tagLock()
+		ok := allowed && r.p.saveTag(r.path, tagType, int(tagCount), wrData, 0, r.auditCtx("WriteTag"))
+		r.tagUnlock()
+		if !allowed {
+			r.resp.Status = DeviceStateConflict
+			r.writeResp()
+		} else if ok {
+			r.writeResp()
 		} else {
-			r.resp.Status = PathSegmentError
-			r.resp.AddStatusSize = 1
-
-			r.write(r.resp)
-			r.write(uint16(0))
+			r.errExt(PathSegmentError, 0)
 		}
 
 	case (r.class == -1 || r.class == SymbolClass) && r.protd.Service == WriteTagFrag:
-		r.p.debug("WriteTagFragmented")
+		r.debug("WriteTagFragmented")
 
 		var (
 			tagType   uint16
@@ -1154,44 +1193,50 @@ func (r *req) serviceHandle() bool {
 			tagOffset uint32
 		)
 
-		rb, err := r.read(&tagType)
+		rb, err := r.readUINT(&tagType)
 		if err != nil {
 			return rb
 		}
 		if tagType == 0x02A0 {
-			rb, err = r.read(&tagType)
+			rb, err = r.readUINT(&tagType)
 			if err != nil {
 				return rb
 			}
 			r.dataLen -= 2
 		}
-		rb, err = r.read(&tagCount)
+		rb, err = r.readUINT(&tagCount)
 		if err != nil {
 			return rb
 		}
-		rb, err = r.read(&tagOffset)
+		rb, err = r.readUDINT(&tagOffset)
 		if err != nil {
 			return rb
 		}
 
-		wrData := make([]uint8, r.dataLen-8)
-		rb, err = r.read(wrData)
+		wrData, rb, err := r.next(r.dataLen - 8)
 		if err != nil {
 			return rb
 		}
+		count := 0
+		if tl := int(typeLen(tagType)); tl > 0 {
+			count = len(wrData) / tl
+		}
 
-		if r.p.saveTag(r.path, tagType, (r.dataLen-8)/int(typeLen(tagType)), wrData, int(tagOffset)) {
-			r.write(r.resp)
+		allowed := r.p.writeAllowed()
+		r.tagLock()
+		ok := allowed && r.p.saveTag(r.path, tagType, count, wrData, int(tagOffset), r.auditCtx("WriteTagFrag"))
+		r.tagUnlock()
+		if !allowed {
+			r.resp.Status = DeviceStateConflict
+			r.writeResp()
+		} else if ok {
+			r.writeResp()
 		} else {
-			r.resp.Status = PathSegmentError
-			r.resp.AddStatusSize = 1
-
-			r.write(r.resp)
-			r.write(uint16(0))
+			r.errExt(PathSegmentError, 0)
 		}
 
 	case r.protd.Service == Reset:
-		r.p.debug("Reset")
+		r.debug("Reset")
 
 		data := make([]uint8, r.dataLen)
 		rb, err := r.read(&data)
@@ -1201,16 +1246,23 @@ func (r *req) serviceHandle() bool {
 
 		if r.dataLen >= 1 && data[0] > 1 {
 			r.resp.Status = InvalidPar
+		} else if r.class == IdentityClass {
+			var typ uint8
+			if r.dataLen >= 1 {
+				typ = data[0]
+			}
+			r.p.identityReset(typ)
 		}
 
+		r.p.audit(r.auditCtx("Reset"), attrPathString(r.class, r.instance, -1), nil, data, int(r.resp.Status))
 		if r.p.callback != nil {
 			go r.p.callback(Reset, int(r.resp.Status), nil)
 		}
 
-		r.write(r.resp)
+		r.writeResp()
 
 	case r.protd.Service == NextInst:
-		r.p.debug("FindNextObjectInstance")
+		r.debug("FindNextObjectInstance")
 		var (
 			count uint8
 			buf   bytes.Buffer
@@ -1228,38 +1280,37 @@ func (r *req) serviceHandle() bool {
 				bwrite(&buf, uint16(x))
 			}
 
-			r.write(r.resp)
+			r.writeResp()
 			r.write(buf.Bytes())
 		} else {
 			r.err(PathUnknown)
 		}
 
 	case r.protd.Service == GetMember:
-		r.p.debug("GetMember")
-
-		fmt.Println(r.class, r.instance, r.attr, r.member)
+		r.debug("GetMember", "member", r.member)
 
 		at, aok, in := r.p.GetClassInstanceAttr(r.class, r.instance, r.attr)
 		r.resp.Service = r.protd.Service + 128
 
 		if in && aok && at.st != nil && at.st.l > 0 {
-			r.p.debug(at.Name)
-			from := r.member * at.st.l
-			to := from + at.st.l
-			if to > len(at.data) {
+			if r.p.Verbose {
+				r.debug("attribute", "name", at.Name)
+			}
+			if r.member < 0 || r.member >= len(at.data)/at.st.l {
 				return r.err(InvalidPar)
 			}
-			r.write(r.resp)
+			from := r.member * at.st.l
+			to := from + at.st.l
+			r.writeResp()
 			r.write(at.data[from:to])
 		} else {
 			r.err(ServNotSup)
 		}
 
 	default:
-		fmt.Println("unknown service:", r.protd.Service)
+		r.log(LevelWarn, "unknown service")
 
-		data := make([]uint8, r.dataLen)
-		rb, err := r.read(&data)
+		rb, err := r.skip(r.dataLen)
 		if err != nil {
 			return rb
 		}
@@ -0,0 +1,231 @@
+package plcconnector
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// testConn replays request n times and collects replies.
+type testConn struct {
+	req   []uint8
+	n     int
+	pos   int
+	out   bytes.Buffer
+	keep  bool // collect replies
+	wrote int
+}
+
+func (c *testConn) Read(b []uint8) (int, error) {
+	if c.n == 0 {
+		return 0, io.EOF
+	}
+	x := 0
+	for x < len(b) && c.n > 0 {
+		m := copy(b[x:], c.req[c.pos:])
+		x += m
+		c.pos += m
+		if c.pos == len(c.req) {
+			c.pos = 0
+			c.n--
+		}
+	}
+	return x, nil
+}
+
+func (c *testConn) Write(b []uint8) (int, error) {
+	if c.keep {
+		c.out.Write(b)
+	}
+	c.wrote += len(b)
+	return len(b), nil
+}
+
+func (c *testConn) Close() error                       { return nil }
+func (c *testConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *testConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234} }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// testRRData wraps CIP request in SendRRData encapsulation.
+func testRRData(msg []uint8) []uint8 {
+	h := cip.EncapsulationHeader{Command: cip.CommandSendRRData, Length: uint16(cip.SendDataLen + 2*cip.ItemHeaderLen + len(msg)), SessionHandle: 1}
+	b := h.AppendTo(nil)
+	b = (&cip.SendData{ItemCount: 2}).AppendTo(b)
+	b = (&cip.ItemHeader{Type: cip.ItemNullAddress}).AppendTo(b)
+	b = (&cip.ItemHeader{Type: cip.ItemUnconnData, Length: uint16(len(msg))}).AppendTo(b)
+	return append(b, msg...)
+}
+
+func testSymbolPath(name string) []uint8 {
+	b := []uint8{ansiExtended, uint8(len(name))}
+	b = append(b, name...)
+	if len(name)&1 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func testReadTagReq(name string, count uint16) []uint8 {
+	path := testSymbolPath(name)
+	b := []uint8{ReadTag, uint8(len(path) / 2)}
+	b = append(b, path...)
+	return appendUINT(b, count)
+}
+
+func testMultiServReq(svs ...[]uint8) []uint8 {
+	b := []uint8{MultiServ, 2, 0x20, MessageRouter, 0x24, 1}
+	b = appendUINT(b, uint16(len(svs)))
+	offset := 2 + 2*len(svs)
+	for _, s := range svs {
+		b = appendUINT(b, uint16(offset))
+		offset += len(s)
+	}
+	for _, s := range svs {
+		b = append(b, s...)
+	}
+	return b
+}
+
+func testWriteDINTReq(name string, v int32) []uint8 {
+	path := testSymbolPath(name)
+	b := []uint8{WriteTag, uint8(len(path) / 2)}
+	b = append(b, path...)
+	b = appendUINT(b, TypeDINT)
+	b = appendUINT(b, 1)
+	return appendUDINT(b, uint32(v))
+}
+
+func testInstAttrListReq() []uint8 {
+	b := []uint8{GetInstAttrList, 2, 0x20, SymbolClass, 0x24, 0}
+	b = appendUINT(b, 2)
+	b = appendUINT(b, 1)    // name
+	return appendUINT(b, 2) // type
+}
+
+func TestHandleRequest(t *testing.T) {
+	p := testSTPLC(t)
+	p.UpdateTag("arr", 0, []uint8{1, 0, 2, 0, 3, 0, 4, 0, 5, 0})
+
+	tests := []struct {
+		name string
+		msg  []uint8
+		want []uint8
+	}{
+		{"ReadTag", testReadTagReq("arr", 2), []uint8{ReadTag + 128, 0, Success, 0, TypeINT, 0, 1, 0, 2, 0}},
+		{"no tag", testReadTagReq("none", 1), []uint8{ReadTag + 128, 0, PathSegmentError, 1, 0, 0}},
+		{"MultiServ", testMultiServReq(testReadTagReq("a", 1), testReadTagReq("arr", 1)), []uint8{
+			MultiServ + 128, 0, Success, 0, 2, 0, 6, 0, 16, 0,
+			ReadTag + 128, 0, Success, 0, TypeDINT, 0, 0, 0, 0, 0,
+			ReadTag + 128, 0, Success, 0, TypeINT, 0, 1, 0}},
+		{"unknown service", []uint8{0x77, 2, 0x20, 1, 0x24, 1, 9, 9}, []uint8{0x77 + 128, 0, ServNotSup, 0}},
+		{"MultiServ offset", []uint8{MultiServ, 2, 0x20, MessageRouter, 0x24, 1, 1, 0, 0, 0, ReadTag, 0}, []uint8{MultiServ + 128, 0, InvalidPar, 0}},
+		{"UnconnectedSend length", []uint8{UnconnectedSend, 2, 0x20, ConnManager, 0x24, 1, 5, 0x99, 0xFF, 0, ReadTag, 0}, []uint8{UnconnectedSend + 128, 0, NotEnoughData, 0}},
+		{"ForwardOpen size", append([]uint8{ForwardOpen, 2, 0x20, ConnManager, 0x24, 1}, make([]uint8, cip.ForwardOpenLen)...), []uint8{ForwardOpen + 128, 0, ConnFailure, 1, 0x09, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &testConn{req: testRRData(tt.msg), n: 2, keep: true}
+			p.handleRequest(c, nil)
+			out := c.out.Bytes()
+			if len(out)%2 != 0 || !bytes.Equal(out[:len(out)/2], out[len(out)/2:]) {
+				t.Fatal("replies differ")
+			}
+			out = out[:len(out)/2]
+			var h cip.EncapsulationHeader
+			h.Unmarshal(out)
+			if h.Command != cip.CommandSendRRData || h.SessionHandle != 1 || int(h.Length) != len(out)-cip.EncapsulationHeaderLen {
+				t.Fatalf("header %+v", h)
+			}
+			var it cip.ItemHeader
+			it.Unmarshal(out[cip.EncapsulationHeaderLen+cip.SendDataLen+cip.ItemHeaderLen:])
+			msg := out[cip.EncapsulationHeaderLen+cip.SendDataLen+2*cip.ItemHeaderLen:]
+			if it.Type != cip.ItemUnconnData || int(it.Length) != len(msg) || !bytes.Equal(msg, tt.want) {
+				t.Errorf("reply % X, want % X", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestNestedMultiServWrite(t *testing.T) {
+	p := testSTPLC(t)
+	req := testRRData(testMultiServReq(testReadTagReq("b", 1), testMultiServReq(testWriteDINTReq("a", 7))))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.handleRequest(&testConn{req: req, n: 1}, nil)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if v, _ := p.ReadNum("a"); v != 7 {
+				t.Errorf("a = %v, want 7", v)
+			}
+			return
+		default:
+			p.ReadNum("a")
+		}
+	}
+}
+
+func TestMalformedFrame(t *testing.T) {
+	p := testSTPLC(t)
+	good := testRRData(testReadTagReq("a", 1))
+	tests := []struct {
+		name   string
+		req    []uint8
+		status uint32
+	}{
+		{"data item length", func() []uint8 { b := testRRData(testReadTagReq("a", 1)); b[38]++; return b }(), cip.EncapInvalidLength},
+		{"item count", func() []uint8 { b := testRRData(testReadTagReq("a", 1)); b[30] = 3; return b }(), cip.EncapIncorrectData},
+		{"address item", func() []uint8 { b := testRRData(testReadTagReq("a", 1)); b[32] = 0x99; return b }(), cip.EncapIncorrectData},
+		{"short", append((&cip.EncapsulationHeader{Command: cip.CommandSendRRData, Length: 4}).AppendTo(nil), 0, 0, 0, 0), cip.EncapInvalidLength},
+		{"register session", append((&cip.EncapsulationHeader{Command: cip.CommandRegisterSession, Length: 2}).AppendTo(nil), 1, 0), cip.EncapInvalidLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &testConn{req: append(tt.req, good...), n: 1, keep: true}
+			p.handleRequest(c, nil)
+			var e cip.Encapsulation
+			if err := e.Unmarshal(c.out.Bytes()); err != nil || e.Status != tt.status {
+				t.Fatalf("reply %+v, %v, want status 0x%X", e.EncapsulationHeader, err, tt.status)
+			}
+			if err := e.Unmarshal(c.out.Bytes()[cip.EncapsulationHeaderLen+len(e.Data):]); err != nil || e.Status != cip.EncapSuccess {
+				t.Errorf("next reply %+v, %v", e.EncapsulationHeader, err)
+			}
+		})
+	}
+}
+
+func benchRequest(b *testing.B, p *PLC, msg []uint8) {
+	req := testRRData(msg)
+	c := &testConn{req: req, n: b.N}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req)))
+	b.ResetTimer()
+	p.handleRequest(c, nil)
+}
+
+func BenchmarkRequestReadTag(b *testing.B) {
+	benchRequest(b, benchPLC(b), testReadTagReq("a", 100))
+}
+
+func BenchmarkRequestMultiServ(b *testing.B) {
+	var svs [][]uint8
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		svs = append(svs, testReadTagReq(n, 10))
+	}
+	benchRequest(b, benchPLC(b), testMultiServReq(svs...))
+}
+
+func BenchmarkRequestGetInstAttrList(b *testing.B) {
+	benchRequest(b, benchPLC(b), testInstAttrListReq())
+}
@@ -0,0 +1,425 @@
+package plcconnector
+
+import (
+	"errors"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alarm types
+const (
+	AlarmHi        = "hi"        // value >= Limit
+	AlarmHiHi      = "hihi"      // value >= Limit
+	AlarmLo        = "lo"        // value <= Limit
+	AlarmLoLo      = "lolo"      // value <= Limit
+	AlarmDeviation = "deviation" // |value - Setpoint| >= Limit
+	AlarmDigital   = "digital"   // value == Limit
+	AlarmROC       = "roc"       // |rate of change| >= Limit per second
+)
+
+// Alarm events
+const (
+	AlarmActive = iota + 1
+	AlarmCleared
+	AlarmAcked
+)
+
+const alarmEventsLen = 100
+
+// Alarm describes condition on numeric tag or member path.
+type Alarm struct {
+	Name     string // name of the AlarmState tag created for the alarm
+	Path     string
+	Type     string
+	Limit    float64
+	Setpoint float64 // deviation alarm
+	Deadband float64 // hysteresis on return to normal
+	Delay    time.Duration
+	Severity int // 1..1000, default 500
+	Message  string
+}
+
+// AlarmState is layout of the alarm tag. Writing Acked from the client acknowledges alarm.
+type AlarmState struct {
+	InAlarm  bool
+	Acked    bool
+	Severity int32
+	Value    float32
+	Limit    float32
+	Count    int32
+}
+
+// AlarmInfo .
+type AlarmInfo struct {
+	Alarm
+	InAlarm bool
+	Acked   bool
+	Value   float64
+	Count   int
+	Since   time.Time
+	AckTime time.Time
+}
+
+// AlarmEvent .
+type AlarmEvent struct {
+	Name     string
+	Event    int
+	Time     time.Time
+	Value    float64
+	Severity int
+	Message  string
+}
+
+type alarm struct {
+	Alarm
+	path    []pathEl
+	acked   []pathEl
+	src     string
+	tag     *Tag
+	inAlarm bool
+	ack     bool
+	value   float64
+	prev    float64
+	prevT   time.Time
+	rate    float64
+	count   int
+	since   time.Time
+	ackTime time.Time
+	pending time.Time
+	timer   *time.Timer
+}
+
+type alarming struct {
+	alarms map[string]*alarm
+	byTag  map[string][]*alarm
+	events chan AlarmEvent
+	m      sync.Mutex
+}
+
+func (a *alarm) cond() bool {
+	db := 0.0
+	if a.inAlarm {
+		db = a.Deadband
+	}
+	switch a.Type {
+	case AlarmHi, AlarmHiHi:
+		return a.value >= a.Limit-db
+	case AlarmLo, AlarmLoLo:
+		return a.value <= a.Limit+db
+	case AlarmDeviation:
+		return math.Abs(a.value-a.Setpoint) >= a.Limit-db
+	case AlarmDigital:
+		return a.value == a.Limit
+	case AlarmROC:
+		return math.Abs(a.rate) >= a.Limit-db
+	}
+	return false
+}
+
+func (a *alarm) state() AlarmState {
+	return AlarmState{
+		InAlarm:  a.inAlarm,
+		Acked:    a.ack,
+		Severity: int32(a.Severity),
+		Value:    float32(a.value),
+		Limit:    float32(a.Limit),
+		Count:    int32(a.count),
+	}
+}
+
+func (a *alarm) info() AlarmInfo {
+	return AlarmInfo{Alarm: a.Alarm, InAlarm: a.inAlarm, Acked: a.ack, Value: a.value, Count: a.count, Since: a.since, AckTime: a.ackTime}
+}
+
+// AddAlarm adds alarm and creates its AlarmState tag. Alarm with the same name is replaced.
+func (p *PLC) AddAlarm(a Alarm) error {
+	switch a.Type {
+	case AlarmHi, AlarmHiHi, AlarmLo, AlarmLoLo, AlarmDeviation, AlarmDigital, AlarmROC:
+	default:
+		return errors.New("alarm " + a.Name + ": unknown type " + a.Type)
+	}
+	if a.Name == "" {
+		return errors.New("alarm name required")
+	}
+	if a.Severity == 0 {
+		a.Severity = 500
+	}
+	al := &alarm{Alarm: a, ack: true}
+	al.path = parsePath(a.Path)
+	al.acked = parsePath(a.Name + ".Acked")
+	if al.path == nil || al.acked == nil {
+		return errors.New("alarm " + a.Name + ": " + errPath.Error())
+	}
+	name := strings.ToLower(a.Name)
+
+	p.tMut.RLock()
+	_, _, err := p.readNum(al.path)
+	if err == nil {
+		pth, _ := splitBit(al.path)
+		tg, _, _, _, _, _ := p.parsePathEl(pth)
+		al.src = strings.ToLower(tg.Name)
+	}
+	tg, tagExists := p.tags[name]
+	p.tMut.RUnlock()
+	if err != nil {
+		return errors.New("alarm " + a.Name + ": " + err.Error())
+	}
+
+	p.alarms.m.Lock()
+	old, ok := p.alarms.alarms[name]
+	p.alarms.m.Unlock()
+	if tagExists && (!ok || old.tag != tg) {
+		return errors.New("alarm " + a.Name + ": tag already exists")
+	}
+	if !tagExists {
+		p.NewTag(AlarmState{}, a.Name)
+	}
+
+	p.lockTags()
+	defer p.unlockTags()
+	p.alarms.m.Lock()
+	defer p.alarms.m.Unlock()
+	al.tag = p.tags[name]
+	if old, ok := p.alarms.alarms[name]; ok {
+		p.removeAlarm(old)
+	}
+	if p.alarms.alarms == nil {
+		p.alarms.alarms = make(map[string]*alarm)
+		p.alarms.byTag = make(map[string][]*alarm)
+	}
+	p.alarms.alarms[name] = al
+	p.alarms.byTag[al.src] = append(p.alarms.byTag[al.src], al)
+	p.alarmEval(al, time.Now(), true)
+	return nil
+}
+
+// removeAlarm must be called with alarms.m locked.
+func (p *PLC) removeAlarm(al *alarm) {
+	if al.timer != nil {
+		al.timer.Stop()
+	}
+	delete(p.alarms.alarms, strings.ToLower(al.Name))
+	list := p.alarms.byTag[al.src]
+	for i, x := range list {
+		if x == al {
+			p.alarms.byTag[al.src] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+}
+
+// alarmCheck must be called with tMut locked.
+func (p *PLC) alarmCheck(t *Tag) {
+	p.alarms.m.Lock()
+	defer p.alarms.m.Unlock()
+	if len(p.alarms.alarms) == 0 {
+		return
+	}
+	name := strings.ToLower(t.Name)
+	now := time.Now()
+	if al, ok := p.alarms.alarms[name]; ok && al.tag == t {
+		if v, _, err := p.readNum(al.acked); err == nil && v != 0 && !al.ack {
+			p.alarmAck(al, now)
+		}
+		p.alarmSync(al)
+	}
+	for _, al := range p.alarms.byTag[name] {
+		p.alarmEval(al, now, true)
+	}
+}
+
+func (p *PLC) alarmTimer(al *alarm) {
+	p.lockTags()
+	defer p.unlockTags()
+	p.alarms.m.Lock()
+	defer p.alarms.m.Unlock()
+	if p.alarms.alarms[strings.ToLower(al.Name)] == al {
+		p.alarmEval(al, time.Now(), false)
+	}
+}
+
+// alarmEval must be called with tMut and alarms.m locked. Rate of change is updated from the previous sample unless only the delay expired.
+func (p *PLC) alarmEval(al *alarm, now time.Time, sample bool) {
+	v, _, err := p.readNum(al.path)
+	if err != nil {
+		return
+	}
+	if sample || al.prevT.IsZero() {
+		if dt := now.Sub(al.prevT).Seconds(); !al.prevT.IsZero() && dt > 0 {
+			al.rate = (v - al.prev) / dt
+		}
+		al.prev = v
+		al.prevT = now
+	}
+	al.value = v
+
+	if al.cond() {
+		if !al.inAlarm && al.Delay > 0 && al.pending.IsZero() {
+			al.pending = now
+			al.timer = time.AfterFunc(al.Delay, func() { p.alarmTimer(al) })
+		}
+		if !al.inAlarm && (al.Delay <= 0 || now.Sub(al.pending) >= al.Delay) {
+			al.inAlarm = true
+			al.ack = false
+			al.count++
+			al.since = now
+			al.pending = time.Time{}
+			p.alarmEmit(al, AlarmActive, now)
+		}
+	} else {
+		if !al.pending.IsZero() {
+			al.pending = time.Time{}
+			al.timer.Stop()
+		}
+		if al.inAlarm {
+			al.inAlarm = false
+			p.alarmEmit(al, AlarmCleared, now)
+		}
+	}
+	p.alarmSync(al)
+}
+
+func (p *PLC) alarmAck(al *alarm, now time.Time) {
+	al.ack = true
+	al.ackTime = now
+	p.alarmEmit(al, AlarmAcked, now)
+}
+
+// alarmSync writes alarm state to its tag without notification.
+func (p *PLC) alarmSync(al *alarm) {
+	v := reflect.ValueOf(al.state())
+	data := make([]uint8, 0, len(al.tag.data))
+	for i := 0; i < v.NumField(); i++ {
+		data = append(data, valueToByte(v.Field(i))...)
+	}
+	al.tag.lock()
+	copy(al.tag.data, data)
+	al.tag.unlock()
+}
+
+func (p *PLC) alarmEmit(al *alarm, event int, now time.Time) {
+	p.debug("alarm", "name", al.Name, "event", event, "value", al.value)
+	if p.alarms.events == nil {
+		return
+	}
+	select {
+	case p.alarms.events <- AlarmEvent{Name: al.Name, Event: event, Time: now, Value: al.value, Severity: al.Severity, Message: al.Message}:
+	default:
+		p.debug("alarm event dropped", "name", al.Name)
+	}
+}
+
+// AlarmEvents returns channel of alarm events. Events are dropped when channel is full.
+func (p *PLC) AlarmEvents() <-chan AlarmEvent {
+	p.alarms.m.Lock()
+	defer p.alarms.m.Unlock()
+	if p.alarms.events == nil {
+		p.alarms.events = make(chan AlarmEvent, alarmEventsLen)
+	}
+	return p.alarms.events
+}
+
+// AckAlarm acknowledges alarm.
+func (p *PLC) AckAlarm(name string) error {
+	p.lockTags()
+	defer p.unlockTags()
+	p.alarms.m.Lock()
+	defer p.alarms.m.Unlock()
+	al, ok := p.alarms.alarms[strings.ToLower(name)]
+	if !ok {
+		return errors.New("no alarm named " + name)
+	}
+	if !al.ack {
+		p.alarmAck(al, time.Now())
+		p.alarmSync(al)
+	}
+	return nil
+}
+
+// Alarms returns alarms with their state, sorted by name.
+func (p *PLC) Alarms() []AlarmInfo {
+	p.alarms.m.Lock()
+	defer p.alarms.m.Unlock()
+	r := make([]AlarmInfo, 0, len(p.alarms.alarms))
+	for _, al := range p.alarms.alarms {
+		r = append(r, al.info())
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+type jsAlarm struct {
+	Name     string  `json:"name"`
+	Path     string  `json:"path"`
+	Type     string  `json:"type"`
+	Limit    float64 `json:"limit,omitempty"`
+	Setpoint float64 `json:"setpoint,omitempty"`
+	Deadband float64 `json:"deadband,omitempty"`
+	Delay    string  `json:"delay,omitempty"`
+	Severity int     `json:"severity,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
+func (p *PLC) importAlarms(js []jsAlarm) error {
+	for _, j := range js {
+		a := Alarm{Name: j.Name, Path: j.Path, Type: j.Type, Limit: j.Limit, Setpoint: j.Setpoint, Deadband: j.Deadband, Severity: j.Severity, Message: j.Message}
+		if j.Delay != "" {
+			var err error
+			if a.Delay, err = time.ParseDuration(j.Delay); err != nil {
+				return errors.New("alarm " + j.Name + ": " + err.Error())
+			}
+		}
+		if err := p.AddAlarm(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PLC) alarmsHTML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var toSend strings.Builder
+
+	toSend.WriteString("<!DOCTYPE html>\n<html><style>" + mainCSS + "</style><meta http-equiv=refresh content=5><title>" + p.Name + " - alarmy</title><a href=\"/\">powrót</a> <a href=\"\">odśwież</a><h3>Alarmy</h3>\n<table><tr><th>Nazwa</th><th>Zmienna</th><th>Typ</th><th>Wartość</th><th>Limit</th><th>Priorytet</th><th>Stan</th><th>Od</th><th>Potwierdzenie</th><th>Komunikat</th></tr>\n")
+	for _, a := range p.Alarms() {
+		toSend.WriteString("<tr><td><a href=\"/" + html.EscapeString(url.PathEscape(a.Name)) + "\">" + html.EscapeString(a.Name) + "</a></td><td>" + html.EscapeString(a.Path) + "</td><td>" + html.EscapeString(a.Type) + "</td><td>" + strconv.FormatFloat(a.Value, 'g', -1, 64) + "</td><td>" + strconv.FormatFloat(a.Limit, 'g', -1, 64) + "</td><td>" + strconv.Itoa(a.Severity) + "</td><td>" + iif(a.InAlarm, "<b>ALARM</b>", "norma") + "</td><td>")
+		if !a.Since.IsZero() {
+			toSend.WriteString(a.Since.Format("2006-01-02 15:04:05"))
+		}
+		toSend.WriteString("</td><td>")
+		if a.Acked {
+			toSend.WriteString("☑")
+		} else {
+			toSend.WriteString("<form method=post action=\"/.alarmAck\"><input type=hidden name=name value=\"" + html.EscapeString(a.Name) + "\"><input type=submit value=\"Potwierdź\"></form>")
+		}
+		toSend.WriteString("</td><td>" + html.EscapeString(a.Message) + "</td></tr>\n")
+	}
+	toSend.WriteString("</table></html>")
+
+	io.WriteString(w, toSend.String())
+}
+
+func (p *PLC) alarmAckHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.AckAlarm(r.FormValue("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/.alarms", http.StatusSeeOther)
+}
@@ -0,0 +1,181 @@
+package plcconnector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlarm(t *testing.T) {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(float32(0), "level")
+	p.NewTag(int32(0), "pump")
+
+	if p.AddAlarm(Alarm{Name: "bad", Path: "nosuchtag", Type: AlarmHi}) == nil {
+		t.Error("unknown tag accepted")
+	}
+	if p.AddAlarm(Alarm{Name: "level", Path: "pump", Type: AlarmDigital}) == nil {
+		t.Error("existing tag accepted as alarm name")
+	}
+	ev := p.AlarmEvents()
+	if err = p.AddAlarm(Alarm{Name: "LevelHi", Path: "level", Type: AlarmHi, Limit: 80, Deadband: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.AddAlarm(Alarm{Name: "PumpFault", Path: "pump.1", Type: AlarmDigital, Limit: 1, Delay: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	inAlarm := func(name string) bool {
+		v, err := p.ReadNum(name + ".InAlarm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v != 0
+	}
+
+	tests := []struct {
+		level float64
+		want  bool
+	}{
+		{50, false},
+		{80, true},
+		{77, true},
+		{74, false},
+		{79, false},
+	}
+	for _, tt := range tests {
+		p.WriteNum("level", tt.level)
+		if got := inAlarm("LevelHi"); got != tt.want {
+			t.Errorf("level %v: InAlarm = %v, want %v", tt.level, got, tt.want)
+		}
+	}
+	if e := <-ev; e.Name != "LevelHi" || e.Event != AlarmActive || e.Value != 80 {
+		t.Errorf("event = %+v", e)
+	}
+	if e := <-ev; e.Event != AlarmCleared {
+		t.Errorf("event = %+v", e)
+	}
+
+	if a, _ := p.ReadNum("LevelHi.Acked"); a != 0 {
+		t.Error("alarm acknowledged")
+	}
+	p.lockTags()
+	ok := p.saveTag(parsePath("LevelHi.Acked"), TypeBOOL, 1, []uint8{1}, 0, auditCtx{})
+	p.unlockTags()
+	if !ok {
+		t.Fatal("ack write failed")
+	}
+	if a, _ := p.ReadNum("LevelHi.Acked"); a != 1 || (<-ev).Event != AlarmAcked {
+		t.Error("alarm not acknowledged by tag write")
+	}
+	p.lockTags()
+	p.saveTag(parsePath("LevelHi.InAlarm"), TypeBOOL, 1, []uint8{1}, 0, auditCtx{})
+	p.unlockTags()
+	if inAlarm("LevelHi") {
+		t.Error("alarm state overwritten by client")
+	}
+
+	p.WriteNum("pump", 2)
+	if inAlarm("PumpFault") {
+		t.Error("delayed alarm active too early")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !inAlarm("PumpFault") {
+		t.Error("delayed alarm not active")
+	}
+	if err = p.AckAlarm("pumpfault"); err != nil {
+		t.Error(err)
+	}
+	if p.AckAlarm("nosuchalarm") == nil {
+		t.Error("unknown alarm acknowledged")
+	}
+	if al := p.Alarms(); len(al) != 2 || al[1].Name != "PumpFault" || !al[1].Acked || al[1].Count != 1 {
+		t.Errorf("Alarms() = %+v", al)
+	}
+}
+
+func TestAlarmROC(t *testing.T) {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(float32(0), "flow")
+	if err = p.AddAlarm(Alarm{Name: "FlowROC", Path: "flow", Type: AlarmROC, Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	inAlarm := func() bool {
+		v, _ := p.ReadNum("FlowROC.InAlarm")
+		return v != 0
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	p.WriteNum("flow", 100) // step
+	if !inAlarm() {
+		t.Error("alarm not active after step")
+	}
+	time.Sleep(10 * time.Millisecond)
+	p.WriteNum("flow", 100) // held
+	if inAlarm() {
+		t.Error("alarm not cleared while value held")
+	}
+}
+
+func TestAlarmHTTP(t *testing.T) {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(float32(90), "level")
+	if err = p.AddAlarm(Alarm{Name: "Hi", Path: "level", Type: AlarmHi, Limit: 80}); err != nil {
+		t.Fatal(err)
+	}
+	p.alarms.m.Lock()
+	p.alarms.alarms["hi"].Path = "<b>level" // not a valid path, shown as is
+	p.alarms.m.Unlock()
+
+	w := httptest.NewRecorder()
+	p.handler(w, httptest.NewRequest(http.MethodGet, "/.alarms", nil))
+	if body := w.Body.String(); strings.Contains(body, "<b>level") || !strings.Contains(body, "&lt;b&gt;level") {
+		t.Errorf("alarm path not escaped:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	p.handler(w, httptest.NewRequest(http.MethodGet, "/.alarmAck?name=Hi", nil))
+	if w.Code != http.StatusMethodNotAllowed || p.Alarms()[0].Acked {
+		t.Errorf("GET ack: %d, acked %v", w.Code, p.Alarms()[0].Acked)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/.alarmAck", strings.NewReader("name=Hi"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	p.handler(w, req)
+	if w.Code != http.StatusSeeOther || !p.Alarms()[0].Acked {
+		t.Errorf("POST ack: %d, acked %v", w.Code, p.Alarms()[0].Acked)
+	}
+}
+
+func Test_alarmCond(t *testing.T) {
+	tests := []struct {
+		name string
+		a    alarm
+		want bool
+	}{
+		{"lo", alarm{Alarm: Alarm{Type: AlarmLo, Limit: 10}, value: 10}, true},
+		{"lo deadband", alarm{Alarm: Alarm{Type: AlarmLo, Limit: 10, Deadband: 2}, value: 11, inAlarm: true}, true},
+		{"deviation", alarm{Alarm: Alarm{Type: AlarmDeviation, Limit: 5, Setpoint: 50}, value: 44}, true},
+		{"deviation ok", alarm{Alarm: Alarm{Type: AlarmDeviation, Limit: 5, Setpoint: 50}, value: 53}, false},
+		{"roc", alarm{Alarm: Alarm{Type: AlarmROC, Limit: 2}, rate: -3}, true},
+		{"digital", alarm{Alarm: Alarm{Type: AlarmDigital}, value: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.cond(); got != tt.want {
+				t.Errorf("cond() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package plcconnector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditMaxSize = 10 << 20
+	auditKeep    = 5
+)
+
+// AuditEntry is single mutating operation.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Source  string    `json:"source"` // IP:port of the client, "api" for Go calls
+	Session uint32    `json:"session,omitempty"`
+	ConnID  uint32    `json:"connId,omitempty"`
+	Path    string    `json:"path"`
+	Old     string    `json:"old,omitempty"` // hex
+	New     string    `json:"new,omitempty"` // hex
+	Status  int       `json:"status,omitempty"`
+}
+
+// AuditFilter selects entries returned by AuditLog. Zero fields match everything.
+type AuditFilter struct {
+	From    time.Time
+	To      time.Time
+	Service string
+	Source  string // prefix
+	Path    string // case insensitive prefix
+	Limit   int    // newest entries only
+}
+
+type auditCtx struct {
+	service string
+	source  string
+	addr    net.Addr // source if set
+	session uint32
+	conn    uint32
+}
+
+type auditLog struct {
+	file    string
+	f       *os.File
+	size    int64
+	maxSize int64
+	keep    int
+	m       sync.Mutex
+}
+
+func (r *req) auditCtx(service string) auditCtx {
+	a := auditCtx{service: service, session: r.encHead.SessionHandle, conn: r.connID}
+	if r.c != nil {
+		a.addr = r.c.RemoteAddr()
+	}
+	return a
+}
+
+// attrPathString formats class/instance/attribute, attribute -1 is omitted.
+func attrPathString(class, instance, attr int) string {
+	s := fmt.Sprintf("@%02X/%d", class, instance)
+	if attr >= 0 {
+		s += "/" + strconv.Itoa(attr)
+	}
+	return s
+}
+
+func (f *AuditFilter) match(e *AuditEntry) bool {
+	return (f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || !e.Time.After(f.To)) &&
+		(f.Service == "" || strings.EqualFold(f.Service, e.Service)) &&
+		strings.HasPrefix(e.Source, f.Source) &&
+		strings.HasPrefix(strings.ToLower(e.Path), strings.ToLower(f.Path))
+}
+
+// StartAudit starts logging of mutating operations into JSON lines file.
+// File is rotated to file.1 .. file.keep after reaching maxSize bytes, zero values mean 10 MiB and 5 files.
+func (p *PLC) StartAudit(file string, maxSize int64, keep int) error {
+	a := &p.aud
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.f != nil {
+		return errors.New("audit already started")
+	}
+	if maxSize <= 0 {
+		maxSize = auditMaxSize
+	}
+	if keep <= 0 {
+		keep = auditKeep
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = file
+	a.f = f
+	a.size = st.Size()
+	a.maxSize = maxSize
+	a.keep = keep
+	return nil
+}
+
+// StopAudit stops logging.
+func (p *PLC) StopAudit() error {
+	a := &p.aud
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func (p *PLC) auditEnabled() bool {
+	p.aud.m.Lock()
+	defer p.aud.m.Unlock()
+	return p.aud.f != nil
+}
+
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	a.f = nil
+	os.Remove(a.file + "." + strconv.Itoa(a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(a.file+"."+strconv.Itoa(i), a.file+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(a.file, a.file+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	a.f = f
+	a.size = 0
+	return nil
+}
+
+func (p *PLC) audit(ctx auditCtx, path string, oldData, newData []uint8, status int) {
+	a := &p.aud
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.f == nil {
+		return
+	}
+	if ctx.addr != nil {
+		ctx.source = ctx.addr.String()
+	}
+	e := AuditEntry{
+		Time:    time.Now(),
+		Service: ctx.service,
+		Source:  ctx.source,
+		Session: ctx.session,
+		ConnID:  ctx.conn,
+		Path:    path,
+		Old:     hex.EncodeToString(oldData),
+		New:     hex.EncodeToString(newData),
+		Status:  status,
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		p.log(LevelError, "audit", "err", err)
+		return
+	}
+	n, err := a.f.Write(append(b, '\n'))
+	a.size += int64(n)
+	if err != nil {
+		p.log(LevelError, "audit", "err", err)
+		return
+	}
+	if a.size >= a.maxSize {
+		if err = a.rotate(); err != nil {
+			p.log(LevelError, "audit", "err", err)
+		}
+	}
+}
+
+func readAuditFile(file string, f *AuditFilter, r []AuditEntry) ([]AuditEntry, error) {
+	fl, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return r, err
+	}
+	defer fl.Close()
+	sc := bufio.NewScanner(fl)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if f.match(&e) {
+			r = append(r, e)
+		}
+	}
+	return r, sc.Err()
+}
+
+// AuditLog returns logged entries matching filter, oldest first.
+func (p *PLC) AuditLog(f AuditFilter) ([]AuditEntry, error) {
+	a := &p.aud
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.f == nil {
+		return nil, errors.New("audit not started")
+	}
+	var (
+		r   []AuditEntry
+		err error
+	)
+	for i := a.keep; i >= 0; i-- {
+		file := a.file
+		if i > 0 {
+			file += "." + strconv.Itoa(i)
+		}
+		if r, err = readAuditFile(file, &f, r); err != nil {
+			return nil, err
+		}
+	}
+	if f.Limit > 0 && len(r) > f.Limit {
+		r = r[len(r)-f.Limit:]
+	}
+	return r, nil
+}
+
+type jsAudit struct {
+	File    string `json:"file"`
+	MaxSize int64  `json:"maxSize,omitempty"`
+	Keep    int    `json:"keep,omitempty"`
+}
+
+// auditHTTP serves /.audit?path=&source=&service=&limit=, newest entries first.
+func (p *PLC) auditHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := AuditFilter{Path: q.Get("path"), Source: q.Get("source"), Service: q.Get("service"), Limit: 200}
+	if s := q.Get("limit"); s != "" {
+		f.Limit, _ = strconv.Atoi(s)
+	}
+	log, err := p.AuditLog(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var toSend strings.Builder
+
+	toSend.WriteString("<!DOCTYPE html>\n<html><style>" + mainCSS + "</style><title>" + p.Name + " - dziennik zapisów</title><a href=\"/\">powrót</a> <a href=\"\">odśwież</a><h3>Dziennik zapisów</h3>\n")
+	toSend.WriteString("<form>Ścieżka <input name=path value=\"" + html.EscapeString(f.Path) + "\"> Źródło <input name=source value=\"" + html.EscapeString(f.Source) + "\"> Limit <input name=limit size=5 value=\"" + strconv.Itoa(f.Limit) + "\"> <input type=submit value=\"Szukaj\"></form>\n")
+	toSend.WriteString("<table><tr><th>Czas</th><th>Usługa</th><th>Źródło</th><th>Sesja</th><th>Połączenie</th><th>Ścieżka</th><th>Stara wartość</th><th>Nowa wartość</th><th>Status</th></tr>\n")
+	for i := len(log) - 1; i >= 0; i-- {
+		e := log[i]
+		fmt.Fprintf(&toSend, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%X</td><td>%X</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td></tr>\n",
+			e.Time.Format("2006-01-02 15:04:05.000"), html.EscapeString(e.Service), html.EscapeString(e.Source), e.Session, e.ConnID, html.EscapeString(e.Path), e.Old, e.New, e.Status)
+	}
+	toSend.WriteString("</table></html>")
+
+	io.WriteString(w, toSend.String())
+}
@@ -0,0 +1,75 @@
+package plcconnector
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(int16(0x1234), "cnt")
+	p.NewTag(stTestPos{}, "pos")
+
+	if _, err = p.AuditLog(AuditFilter{}); err == nil {
+		t.Error("audit log without start")
+	}
+	if err = p.StartAudit(file, 400, 2); err != nil {
+		t.Fatal(err)
+	}
+	src := auditCtx{service: "WriteTag", source: "10.0.0.1:5000", session: 7, conn: 9}
+	p.lockTags()
+	p.saveTag(parsePath("cnt"), TypeINT, 1, []uint8{0x78, 0x56}, 0, src)
+	p.readModWriteTag(parsePath("pos.X"), []uint8{1, 0, 0, 0}, []uint8{0xFF, 0xFF, 0xFF, 0xFF}, auditCtx{service: "ReadModifyWrite", source: "10.0.0.2:5000"})
+	p.unlockTags()
+	p.UpdateTag("cnt", 0, []uint8{1, 0})
+
+	log, err := p.AuditLog(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 3 {
+		t.Fatalf("len = %d, want 3", len(log))
+	}
+	if e := log[0]; e.Service != "WriteTag" || e.Source != "10.0.0.1:5000" || e.Session != 7 || e.ConnID != 9 || e.Path != "cnt" || e.Old != "3412" || e.New != "7856" {
+		t.Errorf("entry = %+v", e)
+	}
+	if e := log[1]; e.Path != "pos.X" || e.Old != "00000000" || e.New != "01000000" {
+		t.Errorf("entry = %+v", e)
+	}
+	if e := log[2]; e.Service != "UpdateTag" || e.Source != "api" || e.Old != "7856" {
+		t.Errorf("entry = %+v", e)
+	}
+
+	tests := []struct {
+		name string
+		f    AuditFilter
+		want int
+	}{
+		{"path", AuditFilter{Path: "POS"}, 1},
+		{"source", AuditFilter{Source: "10.0.0."}, 2},
+		{"service", AuditFilter{Service: "updatetag"}, 1},
+		{"limit", AuditFilter{Limit: 2}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if log, _ := p.AuditLog(tt.f); len(log) != tt.want {
+				t.Errorf("len = %d, want %d", len(log), tt.want)
+			}
+		})
+	}
+
+	for i := 0; i < 20; i++ {
+		p.UpdateTag("cnt", 0, []uint8{uint8(i), 0})
+	}
+	if matches, _ := filepath.Glob(file + "*"); len(matches) != 3 {
+		t.Errorf("files = %v", matches)
+	}
+	if log, _ = p.AuditLog(AuditFilter{Limit: 1}); len(log) != 1 || log[0].New != "1300" {
+		t.Errorf("after rotation = %+v", log)
+	}
+	p.StopAudit()
+}
@@ -4,7 +4,9 @@ package main
 import "C"
 
 import (
+	"log"
 	"net"
+	"os"
 	"strconv"
 	"unsafe"
 
@@ -45,6 +47,7 @@ func call(service int, status int, tag *plc.Tag) {
 //export plcconnector_init
 func plcconnector_init() {
 	p, _ = plc.Init("")
+	p.Logger = plc.NewStdLogger(log.New(os.Stdout, "", 0), plc.LevelDebug)
 }
 
 //export plcconnector_set_verbose
@@ -0,0 +1,297 @@
+package plcconnector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// Frame is an encapsulation message sent or received by PLC or Client.
+type Frame struct {
+	Time time.Time
+	Src  net.Addr // *net.TCPAddr or *net.UDPAddr
+	Dst  net.Addr
+	Data []uint8 // encapsulation header and data, valid only during Capture call
+}
+
+// Capture receives every encapsulation frame, see PcapWriter and TraceWriter.
+// Capture must be safe for concurrent use.
+type Capture interface {
+	Capture(f Frame)
+}
+
+// framer splits TCP stream into encapsulation frames.
+type framer struct {
+	c        Capture
+	src, dst net.Addr
+	buf      []uint8
+}
+
+func (f *framer) write(b []uint8) {
+	f.buf = append(f.buf, b...)
+	for len(f.buf) >= cip.EncapsulationHeaderLen {
+		n := cip.EncapsulationHeaderLen + int(binary.LittleEndian.Uint16(f.buf[2:]))
+		if len(f.buf) < n {
+			break
+		}
+		f.c.Capture(Frame{Time: time.Now(), Src: f.src, Dst: f.dst, Data: f.buf[:n]})
+		f.buf = f.buf[n:]
+	}
+	if len(f.buf) == 0 {
+		f.buf = f.buf[:0:0]
+	}
+}
+
+// captureConn passes data read and written on the connection to Capture.
+type captureConn struct {
+	net.Conn
+	in  framer
+	out framer
+}
+
+func newCaptureConn(conn net.Conn, c Capture) *captureConn {
+	return &captureConn{
+		Conn: conn,
+		in:   framer{c: c, src: conn.RemoteAddr(), dst: conn.LocalAddr()},
+		out:  framer{c: c, src: conn.LocalAddr(), dst: conn.RemoteAddr()},
+	}
+}
+
+func (c *captureConn) Read(b []uint8) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.in.write(b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []uint8) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.out.write(b[:n])
+	}
+	return n, err
+}
+
+// SetCapture passes frames of the client connection to cp, nil disables capture.
+func (c *Client) SetCapture(cp Capture) {
+	c.mu.Lock()
+	c.capture = cp
+	c.mu.Unlock()
+}
+
+// captureFrame passes the frame sent or received in the session to the capture of the client.
+func (s *session) captureFrame(b []uint8, sent bool) {
+	s.cl.mu.Lock()
+	cp := s.cl.capture
+	s.cl.mu.Unlock()
+	if cp == nil {
+		return
+	}
+	src, dst := s.c.RemoteAddr(), s.c.LocalAddr()
+	if sent {
+		src, dst = dst, src
+	}
+	cp.Capture(Frame{Time: time.Now(), Src: src, Dst: dst, Data: b})
+}
+
+const (
+	pcapMaxSegment = 65000
+	pcapSnapLen    = 262144
+	linkEthernet   = 1
+)
+
+// PcapWriter writes frames to a pcap file with synthetic Ethernet, IP and TCP/UDP headers, readable by Wireshark.
+// Data is flushed after every frame.
+type PcapWriter struct {
+	m   sync.Mutex
+	w   *bufio.Writer
+	c   io.Closer
+	seq map[string]uint32 // next TCP sequence number of the flow
+	id  uint16
+	buf []uint8
+	err error
+}
+
+// NewPcapWriter writes pcap header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	p := &PcapWriter{w: bufio.NewWriter(w), seq: make(map[string]uint32)}
+	var h [24]uint8
+	binary.LittleEndian.PutUint32(h[0:], 0xA1B2C3D4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkEthernet)
+	p.w.Write(h[:])
+	return p, p.w.Flush()
+}
+
+// CreatePcap creates pcap file.
+func CreatePcap(file string) (*PcapWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPcapWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.c = f
+	return p, nil
+}
+
+// Err returns first write error.
+func (p *PcapWriter) Err() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.err
+}
+
+// Close flushes data and closes file created by CreatePcap.
+func (p *PcapWriter) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	err := p.w.Flush()
+	if p.c != nil {
+		if e := p.c.Close(); err == nil {
+			err = e
+		}
+		p.c = nil
+	}
+	return err
+}
+
+func addrIPPort(a net.Addr) (net.IP, int, bool) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+// Capture writes the frame as one or more packets.
+func (p *PcapWriter) Capture(f Frame) {
+	sip, sport, udp := addrIPPort(f.Src)
+	dip, dport, _ := addrIPPort(f.Dst)
+	v4 := (sip == nil || sip.To4() != nil) && (dip == nil || dip.To4() != nil)
+	if v4 {
+		sip, dip = ip4(sip), ip4(dip)
+	} else {
+		sip, dip = ip6(sip), ip6(dip)
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.err != nil {
+		return
+	}
+	flow, back := f.Src.String()+">"+f.Dst.String(), f.Dst.String()+">"+f.Src.String()
+	data := f.Data
+	for len(data) > 0 {
+		seg := data
+		if !udp && len(seg) > pcapMaxSegment {
+			seg = seg[:pcapMaxSegment]
+		}
+		data = data[len(seg):]
+
+		b := p.buf[:0]
+		b = append(b, 2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1) // dst, src MAC
+		l4 := 20
+		proto := uint8(6)
+		if udp {
+			l4, proto = 8, 17
+		}
+		if v4 {
+			b = append(b, 0x08, 0x00)
+			ip := len(b)
+			p.id++
+			b = append(b, 0x45, 0)
+			b = appendBE16(b, uint16(20+l4+len(seg)))
+			b = appendBE16(b, p.id)
+			b = append(b, 0x40, 0, 64, proto, 0, 0)
+			b = append(b, sip...)
+			b = append(b, dip...)
+			binary.BigEndian.PutUint16(b[ip+10:], ipChecksum(b[ip:]))
+		} else {
+			b = append(b, 0x86, 0xDD, 0x60, 0, 0, 0)
+			b = appendBE16(b, uint16(l4+len(seg)))
+			b = append(b, proto, 64)
+			b = append(b, sip...)
+			b = append(b, dip...)
+		}
+		b = appendBE16(b, uint16(sport))
+		b = appendBE16(b, uint16(dport))
+		if udp {
+			b = appendBE16(b, uint16(8+len(seg)))
+			b = append(b, 0, 0)
+		} else {
+			seq, ok := p.seq[flow]
+			if !ok {
+				seq = 1
+			}
+			ack, ok := p.seq[back]
+			if !ok {
+				ack = 1
+			}
+			p.seq[flow] = seq + uint32(len(seg))
+			b = appendBE32(b, seq)
+			b = appendBE32(b, ack)
+			b = append(b, 5<<4, 0x18, 0xFF, 0xFF, 0, 0, 0, 0) // PSH, ACK
+		}
+		b = append(b, seg...)
+
+		var h [16]uint8
+		binary.LittleEndian.PutUint32(h[0:], uint32(f.Time.Unix()))
+		binary.LittleEndian.PutUint32(h[4:], uint32(f.Time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(h[8:], uint32(len(b)))
+		binary.LittleEndian.PutUint32(h[12:], uint32(len(b)))
+		p.w.Write(h[:])
+		_, p.err = p.w.Write(b)
+		p.buf = b
+	}
+	if p.err == nil {
+		p.err = p.w.Flush()
+	}
+}
+
+func ip4(ip net.IP) net.IP {
+	if ip == nil || ip.IsUnspecified() {
+		return net.IPv4(127, 0, 0, 1).To4()
+	}
+	return ip.To4()
+}
+
+func ip6(ip net.IP) net.IP {
+	if ip == nil || ip.IsUnspecified() {
+		return net.IPv6loopback
+	}
+	return ip.To16()
+}
+
+func appendBE16(b []uint8, v uint16) []uint8 {
+	return append(b, uint8(v>>8), uint8(v))
+}
+
+func appendBE32(b []uint8, v uint32) []uint8 {
+	return append(b, uint8(v>>24), uint8(v>>16), uint8(v>>8), uint8(v))
+}
+
+func ipChecksum(h []uint8) uint16 {
+	var s uint32
+	for i := 0; i+1 < 20; i += 2 {
+		s += uint32(h[i])<<8 | uint32(h[i+1])
+	}
+	for s > 0xFFFF {
+		s = s&0xFFFF + s>>16
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,156 @@
+package plcconnector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+type testCapture struct {
+	frames [][]uint8
+	m      sync.Mutex
+}
+
+func (c *testCapture) Capture(f Frame) {
+	c.m.Lock()
+	c.frames = append(c.frames, append([]uint8(nil), f.Data...))
+	c.m.Unlock()
+}
+
+func TestFramer(t *testing.T) {
+	a := testRRData(testReadTagReq("a", 1))
+	b := testRRData(testReadTagReq("arr", 2))
+	stream := append(append([]uint8(nil), a...), b...)
+	for _, chunk := range []int{1, 5, 24, 100, len(stream)} {
+		c := &testCapture{}
+		f := framer{c: c}
+		for i := 0; i < len(stream); i += chunk {
+			end := i + chunk
+			if end > len(stream) {
+				end = len(stream)
+			}
+			f.write(stream[i:end])
+		}
+		if len(c.frames) != 2 || !bytes.Equal(c.frames[0], a) || !bytes.Equal(c.frames[1], b) || len(f.buf) != 0 {
+			t.Errorf("chunk %d: frames % X", chunk, c.frames)
+		}
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+	p := testSTPLC(t)
+	var out bytes.Buffer
+	p.Capture = NewTraceWriter(&out)
+	p.handleRequest(&testConn{req: testRRData(testReadTagReq("arr", 2)), n: 1}, nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"127.0.0.1:1234 > :0 SendRRData session=0x1 status=0x0 items=[Null UnconnData(10)] ReadTag path=arr data=2",
+		":0 > 127.0.0.1:1234 SendRRData session=0x1 status=0x0 items=[Null UnconnData(10)] ReadTag reply status=0x0 data=6",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("trace %q", lines)
+	}
+	for i, l := range lines {
+		if !strings.HasSuffix(l, want[i]) {
+			t.Errorf("trace %q, want suffix %q", l, want[i])
+		}
+	}
+}
+
+func Test_epathString(t *testing.T) {
+	tests := []struct {
+		path []uint8
+		want string
+	}{
+		{[]uint8{0x20, 0x6B, 0x24, 0x01}, "@6B/1"},
+		{[]uint8{0x20, 0x02, 0x25, 0x00, 0x34, 0x12, 0x30, 0x03}, "@2/4660/3"},
+		{append(testSymbolPath("tag"), 0x28, 2, 0x91, 1, 'b', 0), "tag[2].b"},
+		{[]uint8{0x91, 9, 'a'}, "?91 09 61"},
+		{[]uint8{0x01, 0x00, 0x12, 0x08, '1', '0', '.', '0', '.', '0', '.', '1'}, "port1:0 port2:10.0.0.1"},
+		{[]uint8{0x20}, "?20"},
+	}
+	for _, tt := range tests {
+		if got := epathString(tt.path); got != tt.want {
+			t.Errorf("epathString(% X) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPcapWriter(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewPcapWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 50000}
+	srv := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 44818}
+	req := testRRData(testReadTagReq("arr", 2))
+	big := make([]uint8, cip.EncapsulationHeaderLen+0xFFFF)
+	binary.LittleEndian.PutUint16(big[2:], 0xFFFF)
+	now := time.Unix(1700000000, 123456000)
+	w.Capture(Frame{Time: now, Src: cl, Dst: srv, Data: req})
+	w.Capture(Frame{Time: now, Src: srv, Dst: cl, Data: big})
+	w.Capture(Frame{Time: now, Src: cl, Dst: srv, Data: req})
+	w.Capture(Frame{Time: now, Src: &net.UDPAddr{IP: cl.IP, Port: 2222}, Dst: &net.UDPAddr{IP: srv.IP, Port: 44818}, Data: req[:cip.EncapsulationHeaderLen]})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := out.Bytes()
+	if binary.LittleEndian.Uint32(b) != 0xA1B2C3D4 || binary.LittleEndian.Uint32(b[20:]) != linkEthernet {
+		t.Fatalf("header % X", b[:24])
+	}
+	b = b[24:]
+	type pkt struct {
+		proto    uint8
+		sport    int
+		seq, ack uint32
+		payload  int
+	}
+	want := []pkt{
+		{6, 50000, 1, 1, len(req)},
+		{6, 44818, 1, 1 + uint32(len(req)), pcapMaxSegment},
+		{6, 44818, 1 + pcapMaxSegment, 1 + uint32(len(req)), len(big) - pcapMaxSegment},
+		{6, 50000, 1 + uint32(len(req)), 1 + uint32(len(big)), len(req)},
+		{17, 2222, 0, 0, cip.EncapsulationHeaderLen},
+	}
+	for i, wp := range want {
+		if len(b) < 16 {
+			t.Fatalf("packet %d missing", i)
+		}
+		if sec, usec := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:]); sec != 1700000000 || usec != 123456 {
+			t.Errorf("packet %d time %d.%d", i, sec, usec)
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		p := b[16 : 16+n]
+		b = b[16+n:]
+		ip := p[14:]
+		if binary.BigEndian.Uint16(p[12:]) != 0x0800 || ipChecksum(ip) != 0 || int(binary.BigEndian.Uint16(ip[2:])) != len(ip) || ip[9] != wp.proto {
+			t.Errorf("packet %d IP header % X", i, ip[:20])
+		}
+		l4 := ip[20:]
+		if int(binary.BigEndian.Uint16(l4)) != wp.sport {
+			t.Errorf("packet %d source port %d", i, binary.BigEndian.Uint16(l4))
+		}
+		hl := 8
+		if wp.proto == 6 {
+			hl = 20
+			if seq, ack := binary.BigEndian.Uint32(l4[4:]), binary.BigEndian.Uint32(l4[8:]); seq != wp.seq || ack != wp.ack {
+				t.Errorf("packet %d seq %d ack %d, want %d %d", i, seq, ack, wp.seq, wp.ack)
+			}
+		}
+		if len(l4)-hl != wp.payload {
+			t.Errorf("packet %d payload %d, want %d", i, len(l4)-hl, wp.payload)
+		}
+	}
+	if len(b) != 0 {
+		t.Errorf("%d bytes left", len(b))
+	}
+}
@@ -0,0 +1,125 @@
+// Package cip encodes and decodes EtherNet/IP encapsulation and CIP messages.
+//
+// Fixed size types have AppendTo, Marshal and Unmarshal methods. AppendTo doesn't allocate if b has enough capacity.
+// Unmarshal of variable size types doesn't copy, slices of the result reference the input.
+package cip
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Errors returned by Unmarshal and AppendTo.
+var (
+	ErrShort   = errors.New("cip: not enough data")
+	ErrSegment = errors.New("cip: unsupported segment")
+	ErrTooLong = errors.New("cip: value too long")
+)
+
+// Encapsulation commands
+const (
+	CommandNOP               = 0x00
+	CommandListServices      = 0x04
+	CommandListIdentity      = 0x63
+	CommandListInterfaces    = 0x64
+	CommandRegisterSession   = 0x65
+	CommandUnRegisterSession = 0x66
+	CommandSendRRData        = 0x6F
+	CommandSendUnitData      = 0x70
+	CommandIndicateStatus    = 0x72
+	CommandCancel            = 0x73
+)
+
+// Encapsulation status
+const (
+	EncapSuccess             = 0x00
+	EncapInvalidCommand      = 0x01
+	EncapNoMemory            = 0x02
+	EncapIncorrectData       = 0x03
+	EncapInvalidSession      = 0x64
+	EncapInvalidLength       = 0x65
+	EncapUnsupportedProtocol = 0x69
+)
+
+// Common Packet Format item types
+const (
+	ItemNullAddress  = 0x0000
+	ItemListIdentity = 0x000C
+	ItemConnAddress  = 0x00A1
+	ItemConnData     = 0x00B1
+	ItemUnconnData   = 0x00B2
+	ItemListServices = 0x0100
+	ItemSockAddrOT   = 0x8000
+	ItemSockAddrTO   = 0x8001
+	ItemSeqAddress   = 0x8002
+)
+
+// ListServices capability flags
+const (
+	CapabilityTCP = 0x20
+	CapabilityUDP = 0x100
+)
+
+// Services
+const (
+	ServiceGetAttributesAll       = 0x01
+	ServiceSetAttributesAll       = 0x02
+	ServiceGetAttributeList       = 0x03
+	ServiceSetAttributeList       = 0x04
+	ServiceReset                  = 0x05
+	ServiceMultipleService        = 0x0A
+	ServiceGetAttributeSingle     = 0x0E
+	ServiceSetAttributeSingle     = 0x10
+	ServiceFindNextObjectInstance = 0x11
+	ServiceGetMember              = 0x18
+
+	// Connection Manager
+	ServiceForwardClose     = 0x4E
+	ServiceUnconnectedSend  = 0x52
+	ServiceForwardOpen      = 0x54
+	ServiceLargeForwardOpen = 0x5B
+
+	ServiceReply = 0x80 // set in the service of the response
+)
+
+// General status codes
+const (
+	StatusSuccess             = 0x00
+	StatusConnectionFailure   = 0x01
+	StatusPathSegmentError    = 0x04
+	StatusPathUnknown         = 0x05
+	StatusPartialTransfer     = 0x06
+	StatusServiceNotSupported = 0x08
+	StatusAttrListError       = 0x0A
+	StatusObjectStateConflict = 0x0C
+	StatusAttrNotSettable     = 0x0E
+	StatusPrivilegeViolation  = 0x0F
+	StatusDeviceStateConflict = 0x10
+	StatusReplyDataTooLarge   = 0x11
+	StatusNotEnoughData       = 0x13
+	StatusAttrNotSupported    = 0x14
+	StatusTooMuchData         = 0x15
+	StatusObjectNotExist      = 0x16
+	StatusEmbeddedServiceErr  = 0x1E
+	StatusInvalidParameter    = 0x20
+)
+
+func appendUINT(b []uint8, v uint16) []uint8 {
+	return append(b, uint8(v), uint8(v>>8))
+}
+
+func appendUDINT(b []uint8, v uint32) []uint8 {
+	return append(b, uint8(v), uint8(v>>8), uint8(v>>16), uint8(v>>24))
+}
+
+func appendULINT(b []uint8, v uint64) []uint8 {
+	return appendUDINT(appendUDINT(b, uint32(v)), uint32(v>>32))
+}
+
+func uint16At(b []uint8, i int) uint16 {
+	return binary.LittleEndian.Uint16(b[i:])
+}
+
+func uint32At(b []uint8, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
@@ -0,0 +1,147 @@
+package cip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type codec interface {
+	Marshal() ([]uint8, error)
+	Unmarshal([]uint8) error
+}
+
+func TestEncapsulationHeader(t *testing.T) {
+	h := EncapsulationHeader{Command: 0x6F, Length: 0x1234, SessionHandle: 0xDEADBEEF, Status: 1, SenderContext: 0x0102030405060708, Options: 2}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	b := h.Marshal()
+	if !bytes.Equal(b, buf.Bytes()) {
+		t.Errorf("Marshal() = % X, want % X", b, buf.Bytes())
+	}
+	var h2 EncapsulationHeader
+	if err := h2.Unmarshal(b); err != nil || h2 != h {
+		t.Errorf("Unmarshal() = %+v, %v, want %+v", h2, err, h)
+	}
+	if err := h2.Unmarshal(b[:23]); err != ErrShort {
+		t.Error("short header:", err)
+	}
+}
+
+var marshalTests = []struct {
+	name string
+	v    codec
+	want []uint8
+	zero codec
+	min  int // shorter input is an error
+}{
+	{"Encapsulation", &Encapsulation{EncapsulationHeader{Command: CommandRegisterSession, Length: 4, SessionHandle: 7}, []uint8{1, 0, 0, 0}},
+		[]uint8{0x65, 0, 4, 0, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}, &Encapsulation{}, 28},
+	{"CPF", &CPF{Timeout: 10, Items: []Item{{Type: ItemNullAddress, Data: []uint8{}}, {Type: ItemUnconnData, Data: []uint8{1, 2, 3}}}},
+		[]uint8{0, 0, 0, 0, 10, 0, 2, 0, 0, 0, 0, 0, 0xB2, 0, 3, 0, 1, 2, 3}, &CPF{}, 19},
+	{"Request", &Request{Service: 0x4C, Path: []uint8{0x91, 1, 'a', 0}, Data: []uint8{1, 0}},
+		[]uint8{0x4C, 2, 0x91, 1, 'a', 0, 1, 0}, &Request{}, 6},
+	{"Response", &Response{Service: 0xCC, Status: 4, AddStatus: []uint16{0x0102}, Data: []uint8{9}},
+		[]uint8{0xCC, 0, 4, 1, 2, 1, 9}, &Response{}, 6},
+	{"UnconnectedSend", &UnconnectedSend{PriorityTimeTick: 5, TimeoutTicks: 0x99, Request: []uint8{1, 0, 2}, RoutePath: []uint8{1, 0}},
+		[]uint8{5, 0x99, 3, 0, 1, 0, 2, 0, 1, 0, 1, 0}, &UnconnectedSend{}, 12},
+	{"ForwardOpen", &ForwardOpen{PriorityTimeTick: 10, TimeoutTicks: 5, OTConnectionID: 1, TOConnectionID: 2, ConnSerialNumber: 3, VendorID: 4,
+		OriginatorSerialNumber: 5, ConnTimeoutMult: 1, OTRPI: 6, OTConnParams: 0x43F4, TORPI: 7, TOConnParams: 0x43F4, TransportType: 0xA3, ConnPath: []uint8{0x20, 2, 0x24, 1}},
+		[]uint8{10, 5, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 4, 0, 5, 0, 0, 0, 1, 0, 0, 0, 6, 0, 0, 0, 0xF4, 0x43, 7, 0, 0, 0, 0xF4, 0x43, 0xA3, 2, 0x20, 2, 0x24, 1}, &ForwardOpen{}, 40},
+	{"LargeForwardOpen", &ForwardOpen{Large: true, OTConnParams: 0x42000FA2, TORPI: 7, TOConnParams: 0x42000FA2, TransportType: 0xA3, ConnPath: []uint8{}},
+		[]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xA2, 0x0F, 0, 0x42, 7, 0, 0, 0, 0xA2, 0x0F, 0, 0x42, 0xA3, 0}, &ForwardOpen{Large: true}, 40},
+	{"ForwardOpenResponse", &ForwardOpenResponse{OTConnectionID: 1, TOConnectionID: 2, ConnSerialNumber: 3, VendorID: 4, OriginatorSerialNumber: 5, OTAPI: 6, TOAPI: 7, AppReply: []uint8{}},
+		[]uint8{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 4, 0, 5, 0, 0, 0, 6, 0, 0, 0, 7, 0, 0, 0, 0, 0}, &ForwardOpenResponse{}, 26},
+	{"ForwardClose", &ForwardClose{PriorityTimeTick: 10, TimeoutTicks: 5, ConnSerialNumber: 3, VendorID: 4, OriginatorSerialNumber: 5, ConnPath: []uint8{0x20, 2, 0x24, 1}},
+		[]uint8{10, 5, 3, 0, 4, 0, 5, 0, 0, 0, 2, 0, 0x20, 2, 0x24, 1}, &ForwardClose{}, 16},
+	{"ForwardCloseResponse", &ForwardCloseResponse{ConnSerialNumber: 3, VendorID: 4, OriginatorSerialNumber: 5, AppReply: []uint8{1, 2}},
+		[]uint8{3, 0, 4, 0, 5, 0, 0, 0, 1, 0, 1, 2}, &ForwardCloseResponse{}, 12},
+	{"ListServices", &ListServices{ProtocolVersion: 1, CapabilityFlags: CapabilityTCP, Name: "Communications"},
+		[]uint8{1, 0, 0x20, 0, 'C', 'o', 'm', 'm', 'u', 'n', 'i', 'c', 'a', 't', 'i', 'o', 'n', 's', 0, 0}, &ListServices{}, 20},
+	{"ListIdentity", &ListIdentity{ProtocolVersion: 1, Socket: SocketAddr{Family: 2, Port: 44818, Addr: [4]uint8{10, 0, 0, 1}}, VendorID: 1, DeviceType: 0x0E,
+		ProductCode: 0x36, Revision: [2]uint8{20, 11}, Status: 0x60, SerialNumber: 0x12345678, ProductName: "PLC", State: 3},
+		[]uint8{1, 0, 0, 2, 0xAF, 0x12, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0x0E, 0, 0x36, 0, 20, 11, 0x60, 0, 0x78, 0x56, 0x34, 0x12, 3, 'P', 'L', 'C', 3}, &ListIdentity{}, 37},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, tt := range marshalTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.v.Marshal()
+			if err != nil || !bytes.Equal(b, tt.want) {
+				t.Fatalf("Marshal() = % X, %v, want % X", b, err, tt.want)
+			}
+			if err := tt.zero.Unmarshal(b); err != nil || !reflect.DeepEqual(tt.zero, tt.v) {
+				t.Errorf("Unmarshal() = %+v, %v, want %+v", tt.zero, err, tt.v)
+			}
+			for i := 0; i < tt.min; i++ {
+				if err := tt.zero.Unmarshal(b[:i]); err == nil {
+					t.Errorf("Unmarshal(% X) succeeded", b[:i])
+					break
+				}
+			}
+		})
+	}
+}
+
+var segmentTests = []struct {
+	name string
+	path Path
+	want []uint8
+	str  string
+}{
+	{"logical", Path{Class(0x6B), Instance(0x1234), Attribute(0x12345678)},
+		[]uint8{0x20, 0x6B, 0x25, 0, 0x34, 0x12, 0x32, 0, 0x78, 0x56, 0x34, 0x12}, "@6B/4660/305419896"},
+	{"symbols", Path{Symbol("tag"), Member(2), Symbol("ab"), Member(300)},
+		[]uint8{0x91, 3, 't', 'a', 'g', 0, 0x28, 2, 0x91, 2, 'a', 'b', 0x29, 0, 0x2C, 1}, "tag[2].ab[300]"},
+	{"symbolic", Path{Symbolic("abc"), Symbolic("de")}, []uint8{0x63, 'a', 'b', 'c', 0x62, 'd', 'e', 0}, "abc.de"},
+	{"port", Path{Port(1, []uint8{0}), Port(2, []uint8("10.0.0.1")), Port(18, []uint8{3})},
+		[]uint8{0x01, 0, 0x12, 8, '1', '0', '.', '0', '.', '0', '.', '1', 0x0F, 18, 0, 3}, "port1:0 port2:10.0.0.1 port18:3"},
+	{"key", Path{Key(ElectronicKey{VendorID: 1, DeviceType: 0x0E, ProductCode: 0x36, Compatibility: true, MajorRevision: 20, MinorRevision: 11}), Class(2), Instance(1)},
+		[]uint8{0x34, 4, 1, 0, 0x0E, 0, 0x36, 0, 0x94, 11, 0x20, 2, 0x24, 1}, "{key 1/14/54 20.11 compat}@2/1"},
+	{"connection point", Path{Class(4), Instance(100), ConnPoint(150)}, []uint8{0x20, 4, 0x24, 100, 0x2C, 150}, "@4/100#150"},
+	{"data", Path{Symbol("a"), SimpleData([]uint8{1, 2, 3, 4})}, []uint8{0x91, 1, 'a', 0, 0x80, 2, 1, 2, 3, 4}, "a{data 01 02 03 04}"},
+}
+
+func TestSegments(t *testing.T) {
+	for _, tt := range segmentTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.path.Marshal()
+			if err != nil || !bytes.Equal(b, tt.want) {
+				t.Fatalf("Marshal() = % X, %v, want % X", b, err, tt.want)
+			}
+			var p Path
+			if err := p.Unmarshal(b); err != nil || !reflect.DeepEqual(p, tt.path) {
+				t.Errorf("Unmarshal() = %v, %v, want %v", p, err, tt.path)
+			}
+			if s := p.String(); s != tt.str {
+				t.Errorf("String() = %q, want %q", s, tt.str)
+			}
+		})
+	}
+}
+
+func TestSegmentErrors(t *testing.T) {
+	tests := []struct {
+		b   []uint8
+		err error
+	}{
+		{[]uint8{0x20}, ErrShort},
+		{[]uint8{0x21, 0, 1}, ErrShort},
+		{[]uint8{0x23, 0}, ErrSegment},
+		{[]uint8{0x91, 9, 'a'}, ErrShort},
+		{[]uint8{0x91, 1, 'a'}, ErrShort},
+		{[]uint8{0x12, 8, '1'}, ErrShort},
+		{[]uint8{0x60, 0}, ErrSegment},
+		{[]uint8{0x40, 0}, ErrSegment},
+		{[]uint8{0x34, 5, 0, 0, 0, 0, 0, 0, 0, 0}, ErrSegment},
+	}
+	for _, tt := range tests {
+		if _, _, err := NextSegment(tt.b); err != tt.err {
+			t.Errorf("NextSegment(% X) = %v, want %v", tt.b, err, tt.err)
+		}
+	}
+	if _, err := (Path{Symbol(string(make([]uint8, 256)))}).Marshal(); err != ErrTooLong {
+		t.Error("long symbol:", err)
+	}
+}
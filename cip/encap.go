@@ -0,0 +1,389 @@
+package cip
+
+// Sizes of fixed size types.
+const (
+	EncapsulationHeaderLen = 24
+	RegisterSessionLen     = 4
+	SendDataLen            = 8
+	ItemHeaderLen          = 4
+	SocketAddrLen          = 16
+	ListServicesLen        = 20
+)
+
+// EncapsulationHeader precedes every encapsulation message, Length is the size of the data that follows.
+type EncapsulationHeader struct {
+	Command       uint16
+	Length        uint16
+	SessionHandle uint32
+	Status        uint32
+	SenderContext uint64
+	Options       uint32
+}
+
+// AppendTo appends encoded header to b.
+func (h *EncapsulationHeader) AppendTo(b []uint8) []uint8 {
+	b = appendUINT(b, h.Command)
+	b = appendUINT(b, h.Length)
+	b = appendUDINT(b, h.SessionHandle)
+	b = appendUDINT(b, h.Status)
+	b = appendULINT(b, h.SenderContext)
+	return appendUDINT(b, h.Options)
+}
+
+// Marshal returns encoded header.
+func (h *EncapsulationHeader) Marshal() []uint8 {
+	return h.AppendTo(make([]uint8, 0, EncapsulationHeaderLen))
+}
+
+// Unmarshal decodes header from b.
+func (h *EncapsulationHeader) Unmarshal(b []uint8) error {
+	if len(b) < EncapsulationHeaderLen {
+		return ErrShort
+	}
+	h.Command = uint16At(b, 0)
+	h.Length = uint16At(b, 2)
+	h.SessionHandle = uint32At(b, 4)
+	h.Status = uint32At(b, 8)
+	h.SenderContext = uint64(uint32At(b, 12)) | uint64(uint32At(b, 16))<<32
+	h.Options = uint32At(b, 20)
+	return nil
+}
+
+// Encapsulation is encapsulation message, Length of the header is ignored by AppendTo.
+type Encapsulation struct {
+	EncapsulationHeader
+	Data []uint8
+}
+
+// AppendTo appends encoded message to b.
+func (e *Encapsulation) AppendTo(b []uint8) ([]uint8, error) {
+	if len(e.Data) > 0xFFFF {
+		return b, ErrTooLong
+	}
+	h := e.EncapsulationHeader
+	h.Length = uint16(len(e.Data))
+	return append(h.AppendTo(b), e.Data...), nil
+}
+
+// Marshal returns encoded message.
+func (e *Encapsulation) Marshal() ([]uint8, error) {
+	return e.AppendTo(make([]uint8, 0, EncapsulationHeaderLen+len(e.Data)))
+}
+
+// Unmarshal decodes message from b, data after Length bytes is ignored.
+func (e *Encapsulation) Unmarshal(b []uint8) error {
+	err := e.EncapsulationHeader.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	n := EncapsulationHeaderLen + int(e.Length)
+	if len(b) < n {
+		return ErrShort
+	}
+	e.Data = b[EncapsulationHeaderLen:n]
+	return nil
+}
+
+// RegisterSession is data of RegisterSession request and reply.
+type RegisterSession struct {
+	ProtocolVersion uint16
+	OptionFlags     uint16
+}
+
+// AppendTo appends encoded data to b.
+func (r *RegisterSession) AppendTo(b []uint8) []uint8 {
+	return appendUINT(appendUINT(b, r.ProtocolVersion), r.OptionFlags)
+}
+
+// Marshal returns encoded data.
+func (r *RegisterSession) Marshal() []uint8 {
+	return r.AppendTo(make([]uint8, 0, RegisterSessionLen))
+}
+
+// Unmarshal decodes data from b.
+func (r *RegisterSession) Unmarshal(b []uint8) error {
+	if len(b) < RegisterSessionLen {
+		return ErrShort
+	}
+	r.ProtocolVersion = uint16At(b, 0)
+	r.OptionFlags = uint16At(b, 2)
+	return nil
+}
+
+// SendData is the fixed part of SendRRData and SendUnitData data, ItemCount items follow.
+type SendData struct {
+	InterfaceHandle uint32
+	Timeout         uint16
+	ItemCount       uint16
+}
+
+// AppendTo appends encoded data to b.
+func (s *SendData) AppendTo(b []uint8) []uint8 {
+	b = appendUDINT(b, s.InterfaceHandle)
+	b = appendUINT(b, s.Timeout)
+	return appendUINT(b, s.ItemCount)
+}
+
+// Marshal returns encoded data.
+func (s *SendData) Marshal() []uint8 {
+	return s.AppendTo(make([]uint8, 0, SendDataLen))
+}
+
+// Unmarshal decodes data from b.
+func (s *SendData) Unmarshal(b []uint8) error {
+	if len(b) < SendDataLen {
+		return ErrShort
+	}
+	s.InterfaceHandle = uint32At(b, 0)
+	s.Timeout = uint16At(b, 4)
+	s.ItemCount = uint16At(b, 6)
+	return nil
+}
+
+// ItemHeader is type and length of Common Packet Format item.
+type ItemHeader struct {
+	Type   uint16
+	Length uint16
+}
+
+// AppendTo appends encoded header to b.
+func (i *ItemHeader) AppendTo(b []uint8) []uint8 {
+	return appendUINT(appendUINT(b, i.Type), i.Length)
+}
+
+// Marshal returns encoded header.
+func (i *ItemHeader) Marshal() []uint8 {
+	return i.AppendTo(make([]uint8, 0, ItemHeaderLen))
+}
+
+// Unmarshal decodes header from b.
+func (i *ItemHeader) Unmarshal(b []uint8) error {
+	if len(b) < ItemHeaderLen {
+		return ErrShort
+	}
+	i.Type = uint16At(b, 0)
+	i.Length = uint16At(b, 2)
+	return nil
+}
+
+// Item is Common Packet Format item.
+type Item struct {
+	Type uint16
+	Data []uint8
+}
+
+// AppendTo appends encoded item to b.
+func (i *Item) AppendTo(b []uint8) ([]uint8, error) {
+	if len(i.Data) > 0xFFFF {
+		return b, ErrTooLong
+	}
+	h := ItemHeader{Type: i.Type, Length: uint16(len(i.Data))}
+	return append(h.AppendTo(b), i.Data...), nil
+}
+
+// Unmarshal decodes item from b and returns its encoded size.
+func (i *Item) Unmarshal(b []uint8) (int, error) {
+	var h ItemHeader
+	err := h.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	n := ItemHeaderLen + int(h.Length)
+	if len(b) < n {
+		return 0, ErrShort
+	}
+	i.Type = h.Type
+	i.Data = b[ItemHeaderLen:n]
+	return n, nil
+}
+
+// CPF is data of SendRRData and SendUnitData: interface handle, timeout and Common Packet Format items.
+type CPF struct {
+	InterfaceHandle uint32
+	Timeout         uint16
+	Items           []Item
+}
+
+// AppendTo appends encoded data to b.
+func (c *CPF) AppendTo(b []uint8) ([]uint8, error) {
+	if len(c.Items) > 0xFFFF {
+		return b, ErrTooLong
+	}
+	s := SendData{InterfaceHandle: c.InterfaceHandle, Timeout: c.Timeout, ItemCount: uint16(len(c.Items))}
+	b = s.AppendTo(b)
+	var err error
+	for i := range c.Items {
+		b, err = c.Items[i].AppendTo(b)
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// Marshal returns encoded data.
+func (c *CPF) Marshal() ([]uint8, error) {
+	return c.AppendTo(nil)
+}
+
+// Unmarshal decodes data from b, capacity of Items is reused.
+func (c *CPF) Unmarshal(b []uint8) error {
+	var s SendData
+	err := s.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	c.InterfaceHandle = s.InterfaceHandle
+	c.Timeout = s.Timeout
+	c.Items = c.Items[:0]
+	b = b[SendDataLen:]
+	for i := 0; i < int(s.ItemCount); i++ {
+		var it Item
+		n, err := it.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		c.Items = append(c.Items, it)
+		b = b[n:]
+	}
+	return nil
+}
+
+// Item returns data of the first item of type t.
+func (c *CPF) Item(t uint16) ([]uint8, bool) {
+	for _, it := range c.Items {
+		if it.Type == t {
+			return it.Data, true
+		}
+	}
+	return nil, false
+}
+
+// SocketAddr is IPv4 socket address of ListIdentity and SockAddr items, encoded big endian.
+type SocketAddr struct {
+	Family uint16 // 2 for AF_INET
+	Port   uint16
+	Addr   [4]uint8
+}
+
+// AppendTo appends encoded address to b.
+func (s *SocketAddr) AppendTo(b []uint8) []uint8 {
+	b = append(b, uint8(s.Family>>8), uint8(s.Family), uint8(s.Port>>8), uint8(s.Port))
+	b = append(b, s.Addr[:]...)
+	return append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// Marshal returns encoded address.
+func (s *SocketAddr) Marshal() []uint8 {
+	return s.AppendTo(make([]uint8, 0, SocketAddrLen))
+}
+
+// Unmarshal decodes address from b.
+func (s *SocketAddr) Unmarshal(b []uint8) error {
+	if len(b) < SocketAddrLen {
+		return ErrShort
+	}
+	s.Family = uint16(b[0])<<8 | uint16(b[1])
+	s.Port = uint16(b[2])<<8 | uint16(b[3])
+	copy(s.Addr[:], b[4:8])
+	return nil
+}
+
+// ListServices is data of ListServices item.
+type ListServices struct {
+	ProtocolVersion uint16
+	CapabilityFlags uint16
+	Name            string // up to 16 characters, NUL terminated if shorter
+}
+
+// AppendTo appends encoded data to b.
+func (l *ListServices) AppendTo(b []uint8) ([]uint8, error) {
+	if len(l.Name) > 16 {
+		return b, ErrTooLong
+	}
+	b = appendUINT(appendUINT(b, l.ProtocolVersion), l.CapabilityFlags)
+	var name [16]uint8
+	copy(name[:], l.Name)
+	return append(b, name[:]...), nil
+}
+
+// Marshal returns encoded data.
+func (l *ListServices) Marshal() ([]uint8, error) {
+	return l.AppendTo(make([]uint8, 0, ListServicesLen))
+}
+
+// Unmarshal decodes data from b.
+func (l *ListServices) Unmarshal(b []uint8) error {
+	if len(b) < ListServicesLen {
+		return ErrShort
+	}
+	l.ProtocolVersion = uint16At(b, 0)
+	l.CapabilityFlags = uint16At(b, 2)
+	name := b[4:ListServicesLen]
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	l.Name = string(name)
+	return nil
+}
+
+// ListIdentity is data of ListIdentity item.
+type ListIdentity struct {
+	ProtocolVersion uint16
+	Socket          SocketAddr
+	VendorID        uint16
+	DeviceType      uint16
+	ProductCode     uint16
+	Revision        [2]uint8 // major, minor
+	Status          uint16
+	SerialNumber    uint32
+	ProductName     string
+	State           uint8
+}
+
+// AppendTo appends encoded data to b.
+func (l *ListIdentity) AppendTo(b []uint8) ([]uint8, error) {
+	if len(l.ProductName) > 255 {
+		return b, ErrTooLong
+	}
+	b = appendUINT(b, l.ProtocolVersion)
+	b = l.Socket.AppendTo(b)
+	b = appendUINT(b, l.VendorID)
+	b = appendUINT(b, l.DeviceType)
+	b = appendUINT(b, l.ProductCode)
+	b = append(b, l.Revision[:]...)
+	b = appendUINT(b, l.Status)
+	b = appendUDINT(b, l.SerialNumber)
+	b = append(b, uint8(len(l.ProductName)))
+	b = append(b, l.ProductName...)
+	return append(b, l.State), nil
+}
+
+// Marshal returns encoded data.
+func (l *ListIdentity) Marshal() ([]uint8, error) {
+	return l.AppendTo(nil)
+}
+
+// Unmarshal decodes data from b.
+func (l *ListIdentity) Unmarshal(b []uint8) error {
+	const fixed = 2 + SocketAddrLen + 14
+	if len(b) < fixed+2 || len(b) < fixed+2+int(b[fixed]) {
+		return ErrShort
+	}
+	l.ProtocolVersion = uint16At(b, 0)
+	l.Socket.Unmarshal(b[2:])
+	b = b[2+SocketAddrLen:]
+	l.VendorID = uint16At(b, 0)
+	l.DeviceType = uint16At(b, 2)
+	l.ProductCode = uint16At(b, 4)
+	l.Revision = [2]uint8{b[6], b[7]}
+	l.Status = uint16At(b, 8)
+	l.SerialNumber = uint32At(b, 10)
+	n := int(b[14])
+	l.ProductName = string(b[15 : 15+n])
+	l.State = b[15+n]
+	return nil
+}
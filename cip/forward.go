@@ -0,0 +1,224 @@
+package cip
+
+// Sizes of Forward Open and Forward Close without connection path.
+const (
+	ForwardOpenLen      = 36
+	LargeForwardOpenLen = 40
+	ForwardCloseLen     = 12
+)
+
+// ForwardOpen is data of Forward Open and Large Forward Open requests.
+type ForwardOpen struct {
+	Large                  bool // Large Forward Open with 32 bit connection parameters
+	PriorityTimeTick       uint8
+	TimeoutTicks           uint8
+	OTConnectionID         uint32
+	TOConnectionID         uint32
+	ConnSerialNumber       uint16
+	VendorID               uint16
+	OriginatorSerialNumber uint32
+	ConnTimeoutMult        uint8
+	OTRPI                  uint32 // µs
+	OTConnParams           uint32
+	TORPI                  uint32 // µs
+	TOConnParams           uint32
+	TransportType          uint8
+	ConnPath               []uint8 // padded EPATH
+}
+
+func (f *ForwardOpen) len() int {
+	if f.Large {
+		return LargeForwardOpenLen
+	}
+	return ForwardOpenLen
+}
+
+// AppendTo appends encoded request data to b.
+func (f *ForwardOpen) AppendTo(b []uint8) ([]uint8, error) {
+	if len(f.ConnPath)&1 == 1 || len(f.ConnPath) > 2*255 {
+		return b, ErrTooLong
+	}
+	b = append(b, f.PriorityTimeTick, f.TimeoutTicks)
+	b = appendUDINT(b, f.OTConnectionID)
+	b = appendUDINT(b, f.TOConnectionID)
+	b = appendUINT(b, f.ConnSerialNumber)
+	b = appendUINT(b, f.VendorID)
+	b = appendUDINT(b, f.OriginatorSerialNumber)
+	b = append(b, f.ConnTimeoutMult, 0, 0, 0)
+	b = appendUDINT(b, f.OTRPI)
+	if f.Large {
+		b = appendUDINT(b, f.OTConnParams)
+	} else {
+		b = appendUINT(b, uint16(f.OTConnParams))
+	}
+	b = appendUDINT(b, f.TORPI)
+	if f.Large {
+		b = appendUDINT(b, f.TOConnParams)
+	} else {
+		b = appendUINT(b, uint16(f.TOConnParams))
+	}
+	b = append(b, f.TransportType, uint8(len(f.ConnPath)/2))
+	return append(b, f.ConnPath...), nil
+}
+
+// Marshal returns encoded request data.
+func (f *ForwardOpen) Marshal() ([]uint8, error) {
+	return f.AppendTo(make([]uint8, 0, f.len()+len(f.ConnPath)))
+}
+
+// Unmarshal decodes request data from b, Large selects the format.
+func (f *ForwardOpen) Unmarshal(b []uint8) error {
+	n := f.len()
+	if len(b) < n || len(b) < n+2*int(b[n-1]) {
+		return ErrShort
+	}
+	f.PriorityTimeTick = b[0]
+	f.TimeoutTicks = b[1]
+	f.OTConnectionID = uint32At(b, 2)
+	f.TOConnectionID = uint32At(b, 6)
+	f.ConnSerialNumber = uint16At(b, 10)
+	f.VendorID = uint16At(b, 12)
+	f.OriginatorSerialNumber = uint32At(b, 14)
+	f.ConnTimeoutMult = b[18]
+	f.OTRPI = uint32At(b, 22)
+	if f.Large {
+		f.OTConnParams = uint32At(b, 26)
+		f.TORPI = uint32At(b, 30)
+		f.TOConnParams = uint32At(b, 34)
+	} else {
+		f.OTConnParams = uint32(uint16At(b, 26))
+		f.TORPI = uint32At(b, 28)
+		f.TOConnParams = uint32(uint16At(b, 32))
+	}
+	f.TransportType = b[n-2]
+	f.ConnPath = b[n : n+2*int(b[n-1])]
+	return nil
+}
+
+// ForwardOpenResponse is data of successful Forward Open response.
+type ForwardOpenResponse struct {
+	OTConnectionID         uint32
+	TOConnectionID         uint32
+	ConnSerialNumber       uint16
+	VendorID               uint16
+	OriginatorSerialNumber uint32
+	OTAPI                  uint32 // µs
+	TOAPI                  uint32 // µs
+	AppReply               []uint8
+}
+
+// AppendTo appends encoded response data to b.
+func (f *ForwardOpenResponse) AppendTo(b []uint8) ([]uint8, error) {
+	if len(f.AppReply)&1 == 1 || len(f.AppReply) > 2*255 {
+		return b, ErrTooLong
+	}
+	b = appendUDINT(b, f.OTConnectionID)
+	b = appendUDINT(b, f.TOConnectionID)
+	b = appendUINT(b, f.ConnSerialNumber)
+	b = appendUINT(b, f.VendorID)
+	b = appendUDINT(b, f.OriginatorSerialNumber)
+	b = appendUDINT(b, f.OTAPI)
+	b = appendUDINT(b, f.TOAPI)
+	b = append(b, uint8(len(f.AppReply)/2), 0)
+	return append(b, f.AppReply...), nil
+}
+
+// Marshal returns encoded response data.
+func (f *ForwardOpenResponse) Marshal() ([]uint8, error) {
+	return f.AppendTo(make([]uint8, 0, 26+len(f.AppReply)))
+}
+
+// Unmarshal decodes response data from b.
+func (f *ForwardOpenResponse) Unmarshal(b []uint8) error {
+	if len(b) < 26 || len(b) < 26+2*int(b[24]) {
+		return ErrShort
+	}
+	f.OTConnectionID = uint32At(b, 0)
+	f.TOConnectionID = uint32At(b, 4)
+	f.ConnSerialNumber = uint16At(b, 8)
+	f.VendorID = uint16At(b, 10)
+	f.OriginatorSerialNumber = uint32At(b, 12)
+	f.OTAPI = uint32At(b, 16)
+	f.TOAPI = uint32At(b, 20)
+	f.AppReply = b[26 : 26+2*int(b[24])]
+	return nil
+}
+
+// ForwardClose is data of Forward Close request.
+type ForwardClose struct {
+	PriorityTimeTick       uint8
+	TimeoutTicks           uint8
+	ConnSerialNumber       uint16
+	VendorID               uint16
+	OriginatorSerialNumber uint32
+	ConnPath               []uint8 // padded EPATH
+}
+
+// AppendTo appends encoded request data to b.
+func (f *ForwardClose) AppendTo(b []uint8) ([]uint8, error) {
+	if len(f.ConnPath)&1 == 1 || len(f.ConnPath) > 2*255 {
+		return b, ErrTooLong
+	}
+	b = append(b, f.PriorityTimeTick, f.TimeoutTicks)
+	b = appendUINT(b, f.ConnSerialNumber)
+	b = appendUINT(b, f.VendorID)
+	b = appendUDINT(b, f.OriginatorSerialNumber)
+	b = append(b, uint8(len(f.ConnPath)/2), 0)
+	return append(b, f.ConnPath...), nil
+}
+
+// Marshal returns encoded request data.
+func (f *ForwardClose) Marshal() ([]uint8, error) {
+	return f.AppendTo(make([]uint8, 0, ForwardCloseLen+len(f.ConnPath)))
+}
+
+// Unmarshal decodes request data from b.
+func (f *ForwardClose) Unmarshal(b []uint8) error {
+	if len(b) < ForwardCloseLen || len(b) < ForwardCloseLen+2*int(b[10]) {
+		return ErrShort
+	}
+	f.PriorityTimeTick = b[0]
+	f.TimeoutTicks = b[1]
+	f.ConnSerialNumber = uint16At(b, 2)
+	f.VendorID = uint16At(b, 4)
+	f.OriginatorSerialNumber = uint32At(b, 6)
+	f.ConnPath = b[ForwardCloseLen : ForwardCloseLen+2*int(b[10])]
+	return nil
+}
+
+// ForwardCloseResponse is data of successful Forward Close response.
+type ForwardCloseResponse struct {
+	ConnSerialNumber       uint16
+	VendorID               uint16
+	OriginatorSerialNumber uint32
+	AppReply               []uint8
+}
+
+// AppendTo appends encoded response data to b.
+func (f *ForwardCloseResponse) AppendTo(b []uint8) ([]uint8, error) {
+	if len(f.AppReply)&1 == 1 || len(f.AppReply) > 2*255 {
+		return b, ErrTooLong
+	}
+	b = appendUINT(b, f.ConnSerialNumber)
+	b = appendUINT(b, f.VendorID)
+	b = appendUDINT(b, f.OriginatorSerialNumber)
+	b = append(b, uint8(len(f.AppReply)/2), 0)
+	return append(b, f.AppReply...), nil
+}
+
+// Marshal returns encoded response data.
+func (f *ForwardCloseResponse) Marshal() ([]uint8, error) {
+	return f.AppendTo(make([]uint8, 0, 10+len(f.AppReply)))
+}
+
+// Unmarshal decodes response data from b.
+func (f *ForwardCloseResponse) Unmarshal(b []uint8) error {
+	if len(b) < 10 || len(b) < 10+2*int(b[8]) {
+		return ErrShort
+	}
+	f.ConnSerialNumber = uint16At(b, 0)
+	f.VendorID = uint16At(b, 2)
+	f.OriginatorSerialNumber = uint32At(b, 4)
+	f.AppReply = b[10 : 10+2*int(b[8])]
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build go1.18
+
+package cip
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newCodec returns copy of the zero value of marshalTests[i].
+func newCodec(i int) codec {
+	z := reflect.ValueOf(marshalTests[i].zero).Elem()
+	v := reflect.New(z.Type())
+	v.Elem().Set(z)
+	return v.Interface().(codec)
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for i, tt := range marshalTests {
+		f.Add(uint8(i), tt.want)
+	}
+	f.Fuzz(func(t *testing.T, i uint8, b []uint8) {
+		n := int(i) % len(marshalTests)
+		v := newCodec(n)
+		if v.Unmarshal(b) != nil {
+			return
+		}
+		m, err := v.Marshal()
+		if err != nil {
+			t.Fatalf("%s: Marshal() of %+v: %v", marshalTests[n].name, v, err)
+		}
+		v2 := newCodec(n)
+		if err := v2.Unmarshal(m); err != nil || !reflect.DeepEqual(v, v2) {
+			t.Fatalf("%s: Unmarshal(% X) = %+v, %v, want %+v", marshalTests[n].name, m, v2, err, v)
+		}
+	})
+}
+
+func FuzzPath(f *testing.F) {
+	for _, tt := range segmentTests {
+		f.Add(tt.want)
+	}
+	f.Fuzz(func(t *testing.T, b []uint8) {
+		var p Path
+		if p.Unmarshal(b) != nil {
+			return
+		}
+		_ = p.String()
+		m, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal() of %v: %v", p, err)
+		}
+		var p2 Path
+		if err := p2.Unmarshal(m); err != nil || !reflect.DeepEqual(p, p2) {
+			t.Fatalf("Unmarshal(% X) = %v, %v, want %v", m, p2, err, p)
+		}
+	})
+}
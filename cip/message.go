@@ -0,0 +1,125 @@
+package cip
+
+// Request is Message Router request.
+type Request struct {
+	Service uint8
+	Path    []uint8 // padded EPATH, see Path
+	Data    []uint8
+}
+
+// AppendTo appends encoded request to b.
+func (r *Request) AppendTo(b []uint8) ([]uint8, error) {
+	if len(r.Path)&1 == 1 || len(r.Path) > 2*255 {
+		return b, ErrTooLong
+	}
+	b = append(b, r.Service, uint8(len(r.Path)/2))
+	b = append(b, r.Path...)
+	return append(b, r.Data...), nil
+}
+
+// Marshal returns encoded request.
+func (r *Request) Marshal() ([]uint8, error) {
+	return r.AppendTo(make([]uint8, 0, 2+len(r.Path)+len(r.Data)))
+}
+
+// Unmarshal decodes request from b.
+func (r *Request) Unmarshal(b []uint8) error {
+	if len(b) < 2 || len(b) < 2+2*int(b[1]) {
+		return ErrShort
+	}
+	n := 2 + 2*int(b[1])
+	r.Service = b[0]
+	r.Path = b[2:n]
+	r.Data = b[n:]
+	return nil
+}
+
+// Response is Message Router response.
+type Response struct {
+	Service   uint8 // service of the request with ServiceReply bit
+	Status    uint8
+	AddStatus []uint16
+	Data      []uint8
+}
+
+// AppendTo appends encoded response to b.
+func (r *Response) AppendTo(b []uint8) ([]uint8, error) {
+	if len(r.AddStatus) > 255 {
+		return b, ErrTooLong
+	}
+	b = append(b, r.Service, 0, r.Status, uint8(len(r.AddStatus)))
+	for _, s := range r.AddStatus {
+		b = appendUINT(b, s)
+	}
+	return append(b, r.Data...), nil
+}
+
+// Marshal returns encoded response.
+func (r *Response) Marshal() ([]uint8, error) {
+	return r.AppendTo(make([]uint8, 0, 4+2*len(r.AddStatus)+len(r.Data)))
+}
+
+// Unmarshal decodes response from b, capacity of AddStatus is reused.
+func (r *Response) Unmarshal(b []uint8) error {
+	if len(b) < 4 || len(b) < 4+2*int(b[3]) {
+		return ErrShort
+	}
+	r.Service = b[0]
+	r.Status = b[2]
+	r.AddStatus = r.AddStatus[:0]
+	n := 4
+	for i := 0; i < int(b[3]); i++ {
+		r.AddStatus = append(r.AddStatus, uint16At(b, n))
+		n += 2
+	}
+	r.Data = b[n:]
+	return nil
+}
+
+// UnconnectedSend is data of Unconnected Send request of Connection Manager.
+type UnconnectedSend struct {
+	PriorityTimeTick uint8
+	TimeoutTicks     uint8
+	Request          []uint8 // encoded Request
+	RoutePath        []uint8 // padded EPATH of port segments
+}
+
+// AppendTo appends encoded data to b.
+func (u *UnconnectedSend) AppendTo(b []uint8) ([]uint8, error) {
+	if len(u.Request) > 0xFFFF || len(u.RoutePath)&1 == 1 || len(u.RoutePath) > 2*255 {
+		return b, ErrTooLong
+	}
+	b = append(b, u.PriorityTimeTick, u.TimeoutTicks)
+	b = appendUINT(b, uint16(len(u.Request)))
+	b = append(b, u.Request...)
+	if len(u.Request)&1 == 1 {
+		b = append(b, 0)
+	}
+	b = append(b, uint8(len(u.RoutePath)/2), 0)
+	return append(b, u.RoutePath...), nil
+}
+
+// Marshal returns encoded data.
+func (u *UnconnectedSend) Marshal() ([]uint8, error) {
+	return u.AppendTo(make([]uint8, 0, 8+len(u.Request)+len(u.RoutePath)))
+}
+
+// Unmarshal decodes data from b.
+func (u *UnconnectedSend) Unmarshal(b []uint8) error {
+	if len(b) < 4 {
+		return ErrShort
+	}
+	n := 4 + int(uint16At(b, 2))
+	req := b[4:]
+	if n&1 == 1 {
+		n++
+	}
+	if len(b) < n+2 || len(b) < n+2+2*int(b[n]) {
+		return ErrShort
+	}
+	u.PriorityTimeTick = b[0]
+	u.TimeoutTicks = b[1]
+	u.Request = req[:uint16At(b, 2)]
+	u.RoutePath = b[n+2 : n+2+2*int(b[n])]
+	return nil
+}
@@ -0,0 +1,382 @@
+package cip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Segment types
+const (
+	SegmentPort     = 0x00
+	SegmentLogical  = 0x20
+	SegmentSymbolic = 0x60
+	SegmentData     = 0x80 // simple data segment
+	SegmentANSI     = 0x91 // ANSI extended symbol segment
+)
+
+// Logical segment types
+const (
+	LogicalClass     = 0x00
+	LogicalInstance  = 0x04
+	LogicalMember    = 0x08
+	LogicalConnPoint = 0x0C
+	LogicalAttribute = 0x10
+	LogicalSpecial   = 0x14 // electronic key
+	LogicalServiceID = 0x18
+)
+
+const (
+	segType        = 0xE0
+	logicalType    = 0x1C
+	logicalFormat  = 0x03
+	logical16      = 0x01
+	logical32      = 0x02
+	portExtended   = 0x10
+	portNumber     = 0x0F
+	symbolicSize   = 0x1F
+	electronicKey  = 0x04 // key format
+	electronicLen  = 10
+	keyCompatible  = 0x80
+	maxShortSymbol = 31
+)
+
+// ElectronicKey is the key of LogicalSpecial segment.
+type ElectronicKey struct {
+	VendorID      uint16
+	DeviceType    uint16
+	ProductCode   uint16
+	Compatibility bool
+	MajorRevision uint8 // 7 bits
+	MinorRevision uint8
+}
+
+// Segment is EPATH segment.
+type Segment struct {
+	Type    uint8         // SegmentPort, SegmentLogical, SegmentSymbolic, SegmentData or SegmentANSI
+	Logical uint8         // logical type of SegmentLogical
+	Value   uint32        // port number or logical value
+	Data    []uint8       // link address, symbol or data
+	Key     ElectronicKey // key of LogicalSpecial
+}
+
+// Port returns port segment.
+func Port(port uint16, link []uint8) Segment {
+	return Segment{Type: SegmentPort, Value: uint32(port), Data: link}
+}
+
+func logical(typ uint8, v uint32) Segment {
+	return Segment{Type: SegmentLogical, Logical: typ, Value: v}
+}
+
+// Class returns logical class segment.
+func Class(v uint32) Segment { return logical(LogicalClass, v) }
+
+// Instance returns logical instance segment.
+func Instance(v uint32) Segment { return logical(LogicalInstance, v) }
+
+// Attribute returns logical attribute segment.
+func Attribute(v uint32) Segment { return logical(LogicalAttribute, v) }
+
+// Member returns logical member segment, it is an array index in Logix tag paths.
+func Member(v uint32) Segment { return logical(LogicalMember, v) }
+
+// ConnPoint returns logical connection point segment.
+func ConnPoint(v uint32) Segment { return logical(LogicalConnPoint, v) }
+
+// Key returns electronic key segment.
+func Key(k ElectronicKey) Segment {
+	return Segment{Type: SegmentLogical, Logical: LogicalSpecial, Key: k}
+}
+
+// Symbol returns ANSI extended symbol segment, used for Logix tag names.
+func Symbol(name string) Segment {
+	return Segment{Type: SegmentANSI, Data: []uint8(name)}
+}
+
+// Symbolic returns symbolic segment.
+func Symbolic(name string) Segment {
+	return Segment{Type: SegmentSymbolic, Data: []uint8(name)}
+}
+
+// SimpleData returns simple data segment, b is padded to words.
+func SimpleData(b []uint8) Segment {
+	return Segment{Type: SegmentData, Data: b}
+}
+
+func pad(b []uint8, n int) []uint8 {
+	if n&1 == 1 {
+		return append(b, 0)
+	}
+	return b
+}
+
+// AppendTo appends encoded padded segment to b.
+func (s *Segment) AppendTo(b []uint8) ([]uint8, error) {
+	switch s.Type {
+	case SegmentPort:
+		if s.Value > 0xFFFF || len(s.Data) > 255 {
+			return b, ErrTooLong
+		}
+		start := len(b)
+		t := uint8(s.Value)
+		if s.Value >= portNumber {
+			t = portNumber
+		}
+		if len(s.Data) == 1 {
+			b = append(b, t)
+		} else {
+			b = append(b, t|portExtended, uint8(len(s.Data)))
+		}
+		if s.Value >= portNumber {
+			b = appendUINT(b, uint16(s.Value))
+		}
+		b = append(b, s.Data...)
+		return pad(b, len(b)-start), nil
+	case SegmentLogical:
+		t := SegmentLogical | s.Logical
+		switch {
+		case s.Logical == LogicalSpecial:
+			k := &s.Key
+			b = append(b, t, electronicKey)
+			b = appendUINT(b, k.VendorID)
+			b = appendUINT(b, k.DeviceType)
+			b = appendUINT(b, k.ProductCode)
+			major := k.MajorRevision &^ keyCompatible
+			if k.Compatibility {
+				major |= keyCompatible
+			}
+			return append(b, major, k.MinorRevision), nil
+		case s.Logical&^logicalType != 0:
+			return b, ErrSegment
+		case s.Value > 0xFFFF:
+			b = append(b, t|logical32, 0)
+			return appendUDINT(b, s.Value), nil
+		case s.Value > 0xFF:
+			b = append(b, t|logical16, 0)
+			return appendUINT(b, uint16(s.Value)), nil
+		default:
+			return append(b, t, uint8(s.Value)), nil
+		}
+	case SegmentSymbolic:
+		if len(s.Data) == 0 || len(s.Data) > maxShortSymbol {
+			return b, ErrTooLong
+		}
+		b = append(b, SegmentSymbolic|uint8(len(s.Data)))
+		b = append(b, s.Data...)
+		return pad(b, 1+len(s.Data)), nil
+	case SegmentData:
+		if len(s.Data) > 2*255 {
+			return b, ErrTooLong
+		}
+		b = append(b, SegmentData, uint8((len(s.Data)+1)/2))
+		b = append(b, s.Data...)
+		return pad(b, len(s.Data)), nil
+	case SegmentANSI:
+		if len(s.Data) > 255 {
+			return b, ErrTooLong
+		}
+		b = append(b, SegmentANSI, uint8(len(s.Data)))
+		b = append(b, s.Data...)
+		return pad(b, len(s.Data)), nil
+	}
+	return b, ErrSegment
+}
+
+// NextSegment decodes the first segment of padded EPATH b and returns its encoded size.
+// Data of the segment references b.
+func NextSegment(b []uint8) (Segment, int, error) {
+	var s Segment
+	if len(b) == 0 {
+		return s, 0, ErrShort
+	}
+	t := b[0]
+	switch {
+	case t == SegmentANSI || t == SegmentData:
+		if len(b) < 2 {
+			return s, 0, ErrShort
+		}
+		s.Type = t
+		ln := int(b[1])
+		if t == SegmentData {
+			ln *= 2
+		}
+		n := 2 + ln + ln&1
+		if len(b) < n {
+			return s, 0, ErrShort
+		}
+		s.Data = b[2 : 2+ln]
+		return s, n, nil
+
+	case t&segType == SegmentPort:
+		s.Type = SegmentPort
+		s.Value = uint32(t & portNumber)
+		n, ln := 1, 1
+		if t&portExtended != 0 {
+			if len(b) < 2 {
+				return s, 0, ErrShort
+			}
+			n, ln = 2, int(b[1])
+		}
+		if s.Value == portNumber {
+			if len(b) < n+2 {
+				return s, 0, ErrShort
+			}
+			s.Value = uint32(uint16At(b, n))
+			n += 2
+		}
+		if len(b) < n+ln+(n+ln)&1 {
+			return s, 0, ErrShort
+		}
+		s.Data = b[n : n+ln]
+		n += ln
+		return s, n + n&1, nil
+
+	case t&segType == SegmentLogical:
+		s.Type = SegmentLogical
+		s.Logical = t & logicalType
+		if s.Logical == LogicalSpecial {
+			if len(b) < electronicLen {
+				return s, 0, ErrShort
+			}
+			if t&logicalFormat != 0 || b[1] != electronicKey {
+				return s, 0, ErrSegment
+			}
+			s.Key = ElectronicKey{
+				VendorID:      uint16At(b, 2),
+				DeviceType:    uint16At(b, 4),
+				ProductCode:   uint16At(b, 6),
+				Compatibility: b[8]&keyCompatible != 0,
+				MajorRevision: b[8] &^ keyCompatible,
+				MinorRevision: b[9],
+			}
+			return s, electronicLen, nil
+		}
+		switch t & logicalFormat {
+		case 0:
+			if len(b) < 2 {
+				return s, 0, ErrShort
+			}
+			s.Value = uint32(b[1])
+			return s, 2, nil
+		case logical16:
+			if len(b) < 4 {
+				return s, 0, ErrShort
+			}
+			s.Value = uint32(uint16At(b, 2))
+			return s, 4, nil
+		case logical32:
+			if len(b) < 6 {
+				return s, 0, ErrShort
+			}
+			s.Value = uint32At(b, 2)
+			return s, 6, nil
+		}
+
+	case t&segType == SegmentSymbolic:
+		ln := int(t & symbolicSize)
+		if ln == 0 { // extended string formats
+			return s, 0, ErrSegment
+		}
+		n := 1 + ln
+		if len(b) < n+n&1 {
+			return s, 0, ErrShort
+		}
+		s.Type = SegmentSymbolic
+		s.Data = b[1:n]
+		return s, n + n&1, nil
+	}
+	return s, 0, ErrSegment
+}
+
+// Path is EPATH, encoded padded.
+type Path []Segment
+
+// AppendTo appends encoded path to b.
+func (p Path) AppendTo(b []uint8) ([]uint8, error) {
+	var err error
+	for i := range p {
+		b, err = p[i].AppendTo(b)
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// Marshal returns encoded path.
+func (p Path) Marshal() ([]uint8, error) {
+	return p.AppendTo(make([]uint8, 0, 4*len(p)))
+}
+
+// Unmarshal decodes path from b, capacity of p is reused.
+func (p *Path) Unmarshal(b []uint8) error {
+	*p = (*p)[:0]
+	for len(b) > 0 {
+		s, n, err := NextSegment(b)
+		if err != nil {
+			return err
+		}
+		*p = append(*p, s)
+		b = b[n:]
+	}
+	return nil
+}
+
+// String formats the path, e.g. "@6B/1" for class and instance, "arr[2].a" for symbols and members,
+// "port1:0" for port segments.
+func (p Path) String() string {
+	var b strings.Builder
+	for i := range p {
+		p[i].writeTo(&b)
+	}
+	return b.String()
+}
+
+func (s Segment) String() string {
+	var b strings.Builder
+	s.writeTo(&b)
+	return b.String()
+}
+
+func (s *Segment) writeTo(b *strings.Builder) {
+	switch s.Type {
+	case SegmentPort:
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString("port" + strconv.Itoa(int(s.Value)) + ":")
+		if len(s.Data) == 1 {
+			b.WriteString(strconv.Itoa(int(s.Data[0])))
+		} else {
+			b.WriteString(string(s.Data))
+		}
+	case SegmentLogical:
+		switch s.Logical {
+		case LogicalClass:
+			fmt.Fprintf(b, "@%X", s.Value)
+		case LogicalMember:
+			b.WriteString("[" + strconv.Itoa(int(s.Value)) + "]")
+		case LogicalConnPoint:
+			b.WriteString("#" + strconv.Itoa(int(s.Value)))
+		case LogicalSpecial:
+			k := &s.Key
+			fmt.Fprintf(b, "{key %d/%d/%d %d.%d", k.VendorID, k.DeviceType, k.ProductCode, k.MajorRevision, k.MinorRevision)
+			if k.Compatibility {
+				b.WriteString(" compat")
+			}
+			b.WriteByte('}')
+		default:
+			b.WriteString("/" + strconv.Itoa(int(s.Value)))
+		}
+	case SegmentSymbolic, SegmentANSI:
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.Write(s.Data)
+	case SegmentData:
+		fmt.Fprintf(b, "{data % X}", s.Data)
+	default:
+		fmt.Fprintf(b, "?%X", s.Type)
+	}
+}
@@ -13,6 +13,8 @@ type Class struct {
 
 	inst     map[int]*Instance
 	lastInst int
+	ids      []int       // sorted instances, see classInstances
+	insts    []*Instance // instances in order of ids
 	m        sync.RWMutex
 }
 
@@ -133,32 +135,52 @@ func NewClass(n string, attrs int) *Class {
 
 // GetClassInstancesList .
 func (p *PLC) GetClassInstancesList(class int, instanceFrom int, maxInstances int) ([]int, []*Instance) {
+	ids, insts := p.classInstances(class, instanceFrom)
+	if ids == nil {
+		return nil, nil
+	}
+	if maxInstances != 0 && len(ids) > maxInstances {
+		ids, insts = ids[:maxInstances], insts[:maxInstances]
+	}
+	ret := make([]int, len(ids))
+	copy(ret, ids)
+	ret2 := make([]*Instance, len(insts))
+	copy(ret2, insts)
+	return ret, ret2
+}
+
+// classInstances returns instances from instanceFrom in order, returned slices are shared and must not be modified.
+func (p *PLC) classInstances(class int, instanceFrom int) ([]int, []*Instance) {
 	c, cok := p.Class[class]
-	if cok {
-		if instanceFrom <= 0 {
-			instanceFrom = 1
-		}
-		c.m.RLock()
-		ret := make([]int, 0, len(c.inst))
-		i := 0
-		for in := range c.inst {
-			if in >= instanceFrom {
-				ret = append(ret, in)
-				i++
-				if maxInstances != 0 && i == maxInstances {
-					break
+	if !cok {
+		return nil, nil
+	}
+	if instanceFrom <= 0 {
+		instanceFrom = 1
+	}
+	c.m.RLock()
+	ids, insts := c.ids, c.insts
+	c.m.RUnlock()
+	if ids == nil {
+		c.m.Lock()
+		if c.ids == nil {
+			c.ids = make([]int, 0, len(c.inst))
+			for in := range c.inst {
+				if in > 0 {
+					c.ids = append(c.ids, in)
 				}
 			}
+			sort.Ints(c.ids)
+			c.insts = make([]*Instance, len(c.ids))
+			for a, b := range c.ids {
+				c.insts[a] = c.inst[b]
+			}
 		}
-		sort.Ints(ret)
-		ret2 := make([]*Instance, len(ret))
-		for a, b := range ret {
-			ret2[a] = c.inst[b]
-		}
-		c.m.RUnlock()
-		return ret, ret2
+		ids, insts = c.ids, c.insts
+		c.m.Unlock()
 	}
-	return nil, nil
+	i := sort.SearchInts(ids, instanceFrom)
+	return ids[i:], insts[i:]
 }
 
 // GetClassInstance .
@@ -169,7 +191,9 @@ func (p *PLC) GetClassInstance(class int, instance int) *Instance {
 		defer c.m.RUnlock()
 		in, iok := c.inst[instance]
 		if iok {
-			p.debug(c.Name, instance)
+			if p.Verbose {
+				p.debug("instance", "class", c.Name, "instance", instance)
+			}
 			return in
 		}
 	}
@@ -209,6 +233,7 @@ func (p *PLC) SetClassInstanceAttrGetterSetter(class int, instance int, attr int
 func (c *Class) SetInstance(no int, in *Instance) {
 	c.m.Lock()
 	c.inst[no] = in
+	c.ids, c.insts = nil, nil
 	if no > c.lastInst {
 		c.lastInst = no
 	}
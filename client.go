@@ -1,132 +1,123 @@
 package plcconnector
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/rich1111/plcconnector/cip"
 )
 
-// Client .
-type Client struct {
-	c       net.Conn
-	rd      *bufio.Reader
-	wr      *bytes.Buffer
-	wrData  *bytes.Buffer
-	bp      int
-	handle  uint32
-	context uint64
+const unconnSize = 504 // maximum size of the unconnected request message
 
-	Timeout uint16
+// Client is the EtherNet/IP client, safe for concurrent use. Lost connection is reconnected in the background.
+type Client struct {
+	host    string
+	route   []uint8       // padded EPATH of port segments to the target, nil if directly connected
+	mu      sync.Mutex    // guards the fields below
+	sem     chan struct{} // slots of Pipeline requests
+	s       *session      // nil while disconnected
+	ready   chan struct{} // closed when connected
+	closing chan struct{}
+	closed  bool
+	capture Capture
+	connMu  sync.Mutex   // serializes Forward Open and Forward Close
+	conn    *clientConn  // opened by OpenConnection
+	udts    map[int]*UDT // templates by instance
+	handles map[int]*UDT // templates by structure handle
+	scans   map[time.Duration]*scanClass
+	sizes   map[string]int // element sizes of the tags read, see sizeKey
+
+	Logger      Logger                             // receives diagnostics, NopLogger by default
+	Progress    func(tag string, n, total int)     // called after each fragment of large reads and writes, total is 0 if unknown
+	StateChange func(state ClientState, err error) // called when the connection is lost, reconnected or closed
+	Pipeline    int                                // requests sent before their replies are received, 1 by default
+	MaxBackoff  time.Duration                      // maximum delay between reconnection attempts, 30 s by default
+	Timeout     uint16                             // seconds of each request, shortened by the deadline of the context
 }
 
-func (c *Client) read(data interface{}) error {
-	err := binary.Read(c.rd, binary.LittleEndian, data)
-	if err != nil {
-		fmt.Println(err)
-	}
-	return err
+// Connect connects to the host, requests are routed to the backplane slot unless it is -1.
+func Connect(host string, backplane int) (*Client, error) {
+	return ConnectContext(context.Background(), host, backplane)
 }
 
-func (c *Client) write(data interface{}) {
-	err := binary.Write(c.wr, binary.LittleEndian, data)
-	if err != nil {
-		fmt.Println(err)
+// ConnectContext is Connect with the context, which bounds only the initial connection.
+func ConnectContext(ctx context.Context, host string, backplane int) (*Client, error) {
+	var route []uint8
+	if backplane != -1 {
+		route = []uint8{1, uint8(backplane)}
 	}
+	return connect(ctx, host, route)
 }
 
-func (c *Client) writeData(data interface{}) {
-	err := binary.Write(c.wrData, binary.LittleEndian, data)
-	if err != nil {
-		fmt.Println(err)
-	}
+// ConnectRoute connects to the host, requests are routed by the route path as in ParseRoute.
+func ConnectRoute(host string, route string) (*Client, error) {
+	return ConnectRouteContext(context.Background(), host, route)
 }
 
-// Connect .
-func Connect(host string, backplane int) (*Client, error) {
-	var (
-		c   Client
-		h   encapsulationHeader
-		ct  uint16
-		it  itemType
-		ser listServicesData
-		rs  registerSessionData
-	)
-
-	conn, err := net.Dial("tcp4", host)
+// ConnectRouteContext is ConnectRoute with the context, which bounds only the initial connection.
+func ConnectRouteContext(ctx context.Context, host string, route string) (*Client, error) {
+	r, err := ParseRoute(route)
 	if err != nil {
 		return nil, err
 	}
-	c.c = conn
-	c.bp = backplane
-	c.wr = new(bytes.Buffer)
-	c.wrData = new(bytes.Buffer)
-	c.Timeout = 20
-
-	conn.SetDeadline(time.Now().Add(time.Second))
+	return connect(ctx, host, r)
+}
 
-	// ListServices
-	c.write(encapsulationHeader{
-		Command: ecListServices,
-	})
-	_, err = conn.Write(c.wr.Bytes())
-	if err != nil {
-		return nil, err
+// ParseRoute encodes comma separated port and link pairs, e.g. "1,0,2,192.168.1.20,1,3", as port segments.
+// Link is the slot or node number, other links, e.g. IP address, are extended link addresses.
+func ParseRoute(route string) ([]uint8, error) {
+	if strings.TrimSpace(route) == "" {
+		return nil, nil
+	}
+	f := strings.Split(route, ",")
+	if len(f)%2 != 0 {
+		return nil, errors.New("route of unpaired port and link")
+	}
+	var path cip.Path
+	for i := 0; i < len(f); i += 2 {
+		port, err := strconv.ParseUint(strings.TrimSpace(f[i]), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", f[i])
+		}
+		l := strings.TrimSpace(f[i+1])
+		link := []uint8(l)
+		if n, err := strconv.ParseUint(l, 10, 8); err == nil {
+			link = []uint8{uint8(n)}
+		} else if l == "" || l[0] >= '0' && l[0] <= '9' && !strings.Contains(l, ".") {
+			return nil, fmt.Errorf("invalid link %q", f[i+1])
+		}
+		path = append(path, cip.Port(uint16(port), link))
 	}
-	c.rd = bufio.NewReader(conn)
+	return path.Marshal()
+}
 
-	err = c.read(&h)
-	if err != nil {
-		return nil, err
-	}
-	err = c.read(&ct)
-	if err != nil {
-		return nil, err
-	}
-	err = c.read(&it)
-	if err != nil {
-		return nil, err
-	}
-	err = c.read(&ser)
-	if err != nil {
-		return nil, err
-	}
-	if ser.NameOfService[0] != 67 || ser.CapabilityFlags&lscfTCP != lscfTCP {
-		return nil, errors.New("tcp encapsulation not supported")
-	}
-
-	// RegisterSession
-	c.reset()
-	defer c.reset()
-	c.write(encapsulationHeader{
-		Command: ecRegisterSession,
-		Length:  uint16(binary.Size(rs)),
-	})
-	c.write(registerSessionData{
-		ProtocolVersion: 1,
-	})
-	_, err = conn.Write(c.wr.Bytes())
-	if err != nil {
-		return nil, err
+func connect(ctx context.Context, host string, route []uint8) (*Client, error) {
+	c := &Client{
+		host:    host,
+		route:   route,
+		ready:   make(chan struct{}),
+		closing: make(chan struct{}),
+		Timeout: 20,
+		Logger:  NopLogger{},
 	}
-	err = c.read(&h)
-	if err != nil {
-		return nil, err
-	}
-	err = c.read(&rs)
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	s, err := c.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if rs.ProtocolVersion != 1 {
-		return nil, errors.New("unsupported protocol version")
-	}
-	c.handle = h.SessionHandle
-
-	return &c, nil
+	c.s = s
+	close(c.ready)
+	return c, nil
 }
 
 // Identity .
@@ -144,14 +135,19 @@ type Identity struct {
 
 // Discover .
 func Discover() ([]Identity, error) {
-	var (
-		buf bytes.Buffer
-		ids []Identity
-	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return DiscoverContext(ctx)
+}
+
+// DiscoverContext is Discover with the context, identities are collected until its deadline, one second if none.
+func DiscoverContext(ctx context.Context) ([]Identity, error) {
+	var ids []Identity
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	bwrite(&buf, encapsulationHeader{
-		Command: ecListIdentity,
-	})
+	h := cip.EncapsulationHeader{Command: cip.CommandListIdentity}
 
 	laddr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:44818")
 	if err != nil {
@@ -169,9 +165,22 @@ func Discover() ([]Identity, error) {
 	}
 	defer conn.Close()
 
-	conn.SetDeadline(time.Now().Add(time.Second))
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	conn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now()) // interrupts Read
+		case <-stop:
+		}
+	}()
 
-	_, err = conn.WriteToUDP(buf.Bytes(), raddr)
+	_, err = conn.WriteToUDP(h.Marshal(), raddr)
 	if err != nil {
 		return nil, err
 	}
@@ -180,258 +189,750 @@ func Discover() ([]Identity, error) {
 	for {
 		ln, err := conn.Read(buffer)
 		if e, ok := err.(net.Error); ok && e.Timeout() {
+			if ctx.Err() == context.Canceled {
+				return ids, ctx.Err()
+			}
 			return ids, nil
 		} else if err != nil {
 			return nil, err
 		}
-		if ln >= 62 {
-			var id Identity
-			rd := bytes.NewReader(buffer)
-			var (
-				head  encapsulationHeader
-				count uint16
-				typ   itemType
-				data  listIdentityData
-			)
-			bread(rd, &head)
-			bread(rd, &count)
-			bread(rd, &typ)
-			bread(rd, &data)
-			attrs := make([]byte, int(typ.Length)-binary.Size(data))
-			bread(rd, &attrs)
-			id.Addr = net.JoinHostPort(net.IPv4(byte(data.SocketAddr), byte(data.SocketAddr>>8), byte(data.SocketAddr>>16), byte(data.SocketAddr>>24)).String(),
-				strconv.Itoa(int(htons(data.SocketPort))))
-			id.VendorID = int(attrs[0]) + int(attrs[1])<<8
-			id.DeviceType = int(attrs[2]) + int(attrs[3])<<8
-			id.ProductCode = int(attrs[4]) + int(attrs[5])<<8
-			id.Revision = fmt.Sprintf("%d.%d", attrs[6], attrs[7])
-			id.Status = int(attrs[8]) + int(attrs[9])<<8
-			id.SerialNumber = uint(attrs[10]) + uint(attrs[11])<<8 + uint(attrs[12])<<16 + uint(attrs[13])<<24
-			id.Name = string(attrs[15 : 15+attrs[14]])
-			id.State = int(attrs[len(attrs)-1])
-			ids = append(ids, id)
-		}
-	}
-}
-
-// Close .
-func (c *Client) Close() error {
-	c.c.SetDeadline(time.Now().Add(time.Second))
-
-	defer c.reset()
-	// UnregisterSession
-	c.write(encapsulationHeader{
-		Command:       ecUnRegisterSession,
-		SessionHandle: c.handle,
-	})
-
-	c.c.Write(c.wr.Bytes())
-
-	c.context = 0
-	c.handle = 0
+		var (
+			e  cip.Encapsulation
+			it cip.Item
+			li cip.ListIdentity
+		)
+		if e.Unmarshal(buffer[:ln]) != nil || e.Command != cip.CommandListIdentity || len(e.Data) < 2 {
+			continue
+		}
+		if _, err := it.Unmarshal(e.Data[2:]); err != nil || li.Unmarshal(it.Data) != nil {
+			continue
+		}
+		ids = append(ids, Identity{
+			Addr:         net.JoinHostPort(net.IP(li.Socket.Addr[:]).String(), strconv.Itoa(int(li.Socket.Port))),
+			VendorID:     int(li.VendorID),
+			DeviceType:   int(li.DeviceType),
+			ProductCode:  int(li.ProductCode),
+			Revision:     fmt.Sprintf("%d.%d", li.Revision[0], li.Revision[1]),
+			Status:       int(li.Status),
+			SerialNumber: uint(li.SerialNumber),
+			Name:         li.ProductName,
+			State:        int(li.State),
+		})
+	}
+}
 
-	return c.c.Close()
+// Close closes the connection opened by OpenConnection and subscriptions, unregisters the session and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	s, closed := c.s, c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil
+	}
+	c.connMu.Lock()
+	if s != nil && c.connection() != nil {
+		c.forwardClose(context.Background())
+	}
+	c.connMu.Unlock()
+
+	c.mu.Lock()
+	if c.closed { // closed concurrently
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.s = nil
+	close(c.closing)
+	c.closeScans()
+	c.mu.Unlock()
+
+	var err error
+	if s != nil {
+		h := cip.EncapsulationHeader{Command: cip.CommandUnRegisterSession, SessionHandle: s.handle}
+		s.wm.Lock()
+		s.c.SetWriteDeadline(time.Now().Add(time.Second))
+		s.c.Write(h.Marshal())
+		s.wm.Unlock()
+		s.fail(errClientClosed)
+		err = s.close()
+	}
+	c.stateChange(ClientClosed, nil)
+	return err
 }
 
 // GetAttributesAll
 func (c *Client) GetAttributesAll(class, instance int) ([]byte, error) {
+	return c.GetAttributesAllContext(context.Background(), class, instance)
+}
+
+// GetAttributesAllContext is GetAttributesAll with the context.
+func (c *Client) GetAttributesAllContext(ctx context.Context, class, instance int) ([]byte, error) {
 	path := pathCIA(class, instance, -1, -1)
-	return c.sendRecv(path, GetAttrAll)
+	return c.sendRecv(ctx, path, GetAttrAll, nil)
 }
 
 // GetAttributeList
 func (c *Client) GetAttributeList(class, instance int, list []int) ([]byte, error) {
-	path := pathCIA(class, instance, -1, -1)
-	count := len(list)
+	return c.GetAttributeListContext(context.Background(), class, instance, list)
+}
 
-	c.writeData(uint16(count))
+// GetAttributeListContext is GetAttributeList with the context.
+func (c *Client) GetAttributeListContext(ctx context.Context, class, instance int, list []int) ([]byte, error) {
+	path := pathCIA(class, instance, -1, -1)
+	data := appendUINT(nil, uint16(len(list)))
 	for _, v := range list {
-		c.writeData(uint16(v))
+		data = appendUINT(data, uint16(v))
 	}
-
-	return c.sendRecv(path, GetAttrList)
+	return c.sendRecv(ctx, path, GetAttrList, data)
 }
 
 // GetAttributeSingle
 func (c *Client) GetAttributeSingle(class, instance, attr int) ([]byte, error) {
+	return c.GetAttributeSingleContext(context.Background(), class, instance, attr)
+}
+
+// GetAttributeSingleContext is GetAttributeSingle with the context.
+func (c *Client) GetAttributeSingleContext(ctx context.Context, class, instance, attr int) ([]byte, error) {
 	path := pathCIA(class, instance, attr, -1)
-	return c.sendRecv(path, GetAttr)
+	return c.sendRecv(ctx, path, GetAttr, nil)
 }
 
 // ReadTag .
 func (c *Client) ReadTag(tag string, count int) (*Tag, error) {
+	return c.ReadTagContext(context.Background(), tag, count)
+}
+
+// ReadTagContext is ReadTag with the context.
+func (c *Client) ReadTagContext(ctx context.Context, tag string, count int) (*Tag, error) {
 	path := constructPath(parsePath(tag))
 	if path == nil {
 		return nil, errors.New("path parse error")
 	}
 
-	defer c.reset()
-	c.writeHead(path, ReadTag, 2)
-	c.write(uint16(count))
-
-	_, err := c.c.Write(c.wr.Bytes())
+	resp, err := c.request(ctx, path, ReadTag, appendUINT(nil, uint16(count)))
 	if err != nil {
 		return nil, err
 	}
-
-	_, ln, err := c.readHead()
+	t, d, err := tagData(resp.Data)
 	if err != nil {
 		return nil, err
 	}
+	total := 0
+	if l := typeLen(uint16(t)); t < TypeStructHead && l > 0 {
+		total = count * int(l)
+	}
 
-	var t uint16
-	err = c.read(&t)
+	data := append([]uint8(nil), d...)
+	for resp.Status == PartialTransfer {
+		c.progress(tag, len(data), total)
+		req := appendUDINT(appendUINT(nil, uint16(count)), uint32(len(data)))
+		resp, err = c.request(ctx, path, ReadTagFrag, req)
+		if err != nil {
+			return nil, err
+		}
+		_, d, err = tagData(resp.Data)
+		if err != nil {
+			return nil, err
+		}
+		if len(d) == 0 {
+			return nil, errors.New("empty fragment")
+		}
+		data = append(data, d...)
+		if resp.Status == Success {
+			c.progress(tag, len(data), total)
+		}
+	}
+
+	c.learnSize(tag, count, len(data))
+	return &Tag{Name: tag, Type: t, data: data}, nil
+}
+
+// TagInfo describes tag of the controller, as listed by ListTags.
+type TagInfo struct {
+	Name     string
+	Instance int
+	Type     int // atomic type or template instance of the structure
+	ElemLen  int
+	Dim      [3]int
+	Struct   bool
+	System   bool
+}
+
+// ListTags returns controller scoped tags.
+func (c *Client) ListTags() ([]TagInfo, error) {
+	return c.ListTagsContext(context.Background())
+}
+
+// ListTagsContext is ListTags with the context.
+func (c *Client) ListTagsContext(ctx context.Context) ([]TagInfo, error) {
+	list, err := c.listTags(ctx, nil)
+	for _, ti := range list {
+		c.learnSize(ti.Name, 1, ti.ElemLen)
+	}
+	return list, err
+}
+
+// ListProgramTags returns tags of the program, named without the "Program:name." prefix.
+func (c *Client) ListProgramTags(program string) ([]TagInfo, error) {
+	return c.ListProgramTagsContext(context.Background(), program)
+}
+
+// ListProgramTagsContext is ListProgramTags with the context.
+func (c *Client) ListProgramTagsContext(ctx context.Context, program string) ([]TagInfo, error) {
+	prefix, err := cip.Path{cip.Symbol("Program:" + program)}.Marshal()
 	if err != nil {
 		return nil, err
 	}
-	typlen := 2
-	if t == TypeStructHead>>16 {
-		err = c.read(&t)
+	list, err := c.listTags(ctx, prefix)
+	for _, ti := range list {
+		c.learnSize("Program:"+program+"."+ti.Name, 1, ti.ElemLen)
+	}
+	return list, err
+}
+
+// listTags walks Symbol class instances with GetInstanceAttributeList of name, type, element size and dimensions.
+func (c *Client) listTags(ctx context.Context, prefix []uint8) ([]TagInfo, error) {
+	var (
+		list     []TagInfo
+		instance int
+	)
+	attrs := []uint8{4, 0, 1, 0, 2, 0, 7, 0, 8, 0}
+	for {
+		path := append(append([]uint8(nil), prefix...), pathCIA(SymbolClass, instance, -1, -1)...)
+		resp, err := c.request(ctx, path, GetInstAttrList, attrs)
 		if err != nil {
 			return nil, err
 		}
-		typlen = 4
+		d := resp.Data
+		if len(d) == 0 && resp.Status == PartialTransfer {
+			return nil, errors.New("empty list")
+		}
+		for len(d) > 0 {
+			if len(d) < 6 {
+				return nil, cip.ErrShort
+			}
+			ti := TagInfo{Instance: int(binary.LittleEndian.Uint32(d))}
+			l := int(binary.LittleEndian.Uint16(d[4:]))
+			d = d[6:]
+			if len(d) < l+16 {
+				return nil, cip.ErrShort
+			}
+			ti.Name = string(d[:l])
+			d = d[l:]
+			typ := binary.LittleEndian.Uint16(d)
+			ti.Type = int(typ & 0x0FFF)
+			ti.Struct = typ&TypeStruct != 0
+			ti.System = typ&0x1000 != 0 || strings.HasPrefix(ti.Name, "__")
+			ti.ElemLen = int(binary.LittleEndian.Uint16(d[2:]))
+			for i := range ti.Dim {
+				ti.Dim[i] = int(binary.LittleEndian.Uint32(d[4+4*i:]))
+			}
+			d = d[16:]
+			list = append(list, ti)
+			instance = ti.Instance + 1
+		}
+		if resp.Status == Success {
+			return list, nil
+		}
 	}
-	d := make([]uint8, ln-typlen)
-	err = c.read(&d)
-	if err != nil {
-		return nil, err
+}
+
+// tagData splits ReadTag response to the type, TypeStructHead | handle for structures, and data.
+func tagData(d []uint8) (int, []uint8, error) {
+	if len(d) < 2 {
+		return 0, nil, cip.ErrShort
+	}
+	t := int(binary.LittleEndian.Uint16(d))
+	if t == TypeStructHead>>16 {
+		if len(d) < 4 {
+			return 0, nil, cip.ErrShort
+		}
+		return TypeStructHead | int(binary.LittleEndian.Uint16(d[2:])), d[4:], nil
+	}
+	return t, d[2:], nil
+}
+
+// WriteTag writes count elements of type typ to the tag. Data over the message size is written by WriteTagFragmented requests.
+// Type of the structure is TypeStructHead | handle, as returned by ReadTag.
+func (c *Client) WriteTag(tag string, typ, count int, data []uint8) error {
+	return c.WriteTagContext(context.Background(), tag, typ, count, data)
+}
+
+// WriteTagContext is WriteTag with the context.
+func (c *Client) WriteTagContext(ctx context.Context, tag string, typ, count int, data []uint8) error {
+	path := constructPath(parsePath(tag))
+	if path == nil {
+		return errors.New("path parse error")
+	}
+
+	head := appendType(nil, typ)
+	head = appendUINT(head, uint16(count))
+	if 2+len(path)+len(head)+len(data) <= c.msgSize() {
+		_, err := c.sendRecv(ctx, path, WriteTag, append(head, data...))
+		return err
+	}
+
+	n := c.msgSize() - 2 - len(path) - len(head) - 4 // data of the fragment
+	if count > 0 {
+		if el := len(data) / count; el > 0 && el <= n {
+			n -= n % el
+		}
+	}
+	if n <= 0 {
+		return errors.New("path too long")
+	}
+	var buf []uint8
+	for off := 0; off < len(data); off += n {
+		end := off + n
+		if end > len(data) {
+			end = len(data)
+		}
+		buf = appendUDINT(append(buf[:0], head...), uint32(off))
+		_, err := c.sendRecv(ctx, path, WriteTagFrag, append(buf, data[off:end]...))
+		if err != nil {
+			return err
+		}
+		c.progress(tag, end, len(data))
 	}
+	return nil
+}
 
-	// fmt.Println(typeToString(int(t)))
-	// fmt.Println(d)
+func (c *Client) progress(tag string, n, total int) {
+	if c.Progress != nil {
+		c.Progress(tag, n, total)
+	}
+}
 
-	return &Tag{Name: tag, Type: int(t), data: d}, nil
+// WriteBOOL writes v to the tag, elements of the array from the index of the tag.
+func (c *Client) WriteBOOL(tag string, v ...bool) error {
+	return c.WriteBOOLContext(context.Background(), tag, v...)
 }
 
-func (c *Client) reset() {
-	c.wr.Reset()
-	c.wrData.Reset()
-	c.rd.Reset(c.c)
+// WriteBOOLContext is WriteBOOL with the context.
+func (c *Client) WriteBOOLContext(ctx context.Context, tag string, v ...bool) error {
+	b := make([]uint8, len(v))
+	for i, x := range v {
+		if x {
+			b[i] = 0xFF
+		}
+	}
+	return c.WriteTagContext(ctx, tag, TypeBOOL, len(v), b)
 }
 
-func (c *Client) readHead() (int, int, error) {
-	var (
-		h encapsulationHeader
-		s sendData
-		i itemType
-		r response
-	)
+// WriteSINT writes v to the tag, elements of the array from the index of the tag.
+func (c *Client) WriteSINT(tag string, v ...int8) error {
+	return c.WriteSINTContext(context.Background(), tag, v...)
+}
 
-	err := c.read(&h)
-	if err != nil {
-		return 0, 0, err
+// WriteSINTContext is WriteSINT with the context.
+func (c *Client) WriteSINTContext(ctx context.Context, tag string, v ...int8) error {
+	b := make([]uint8, len(v))
+	for i, x := range v {
+		b[i] = uint8(x)
 	}
-	err = c.read(&s)
-	if err != nil {
-		return 0, 0, err
+	return c.WriteTagContext(ctx, tag, TypeSINT, len(v), b)
+}
+
+// WriteINT writes v to the tag, elements of the array from the index of the tag.
+func (c *Client) WriteINT(tag string, v ...int16) error {
+	return c.WriteINTContext(context.Background(), tag, v...)
+}
+
+// WriteINTContext is WriteINT with the context.
+func (c *Client) WriteINTContext(ctx context.Context, tag string, v ...int16) error {
+	b := make([]uint8, 0, 2*len(v))
+	for _, x := range v {
+		b = appendUINT(b, uint16(x))
 	}
-	if s.ItemCount != 2 {
-		return 0, 0, errors.New("itemCount != 2")
+	return c.WriteTagContext(ctx, tag, TypeINT, len(v), b)
+}
+
+// WriteDINT writes v to the tag, elements of the array from the index of the tag.
+func (c *Client) WriteDINT(tag string, v ...int32) error {
+	return c.WriteDINTContext(context.Background(), tag, v...)
+}
+
+// WriteDINTContext is WriteDINT with the context.
+func (c *Client) WriteDINTContext(ctx context.Context, tag string, v ...int32) error {
+	b := make([]uint8, 0, 4*len(v))
+	for _, x := range v {
+		b = appendUDINT(b, uint32(x))
 	}
-	err = c.read(&i)
-	if err != nil {
-		return 0, 0, err
+	return c.WriteTagContext(ctx, tag, TypeDINT, len(v), b)
+}
+
+// WriteREAL writes v to the tag, elements of the array from the index of the tag.
+func (c *Client) WriteREAL(tag string, v ...float32) error {
+	return c.WriteREALContext(context.Background(), tag, v...)
+}
+
+// WriteREALContext is WriteREAL with the context.
+func (c *Client) WriteREALContext(ctx context.Context, tag string, v ...float32) error {
+	b := make([]uint8, 0, 4*len(v))
+	for _, x := range v {
+		b = appendUDINT(b, math.Float32bits(x))
 	}
-	if i.Type != itNullAddress || i.Length != 0 {
-		return 0, 0, errors.New("connected addres item not supported")
+	return c.WriteTagContext(ctx, tag, TypeREAL, len(v), b)
+}
+
+// WriteLINT writes v to the tag, elements of the array from the index of the tag.
+func (c *Client) WriteLINT(tag string, v ...int64) error {
+	return c.WriteLINTContext(context.Background(), tag, v...)
+}
+
+// WriteLINTContext is WriteLINT with the context.
+func (c *Client) WriteLINTContext(ctx context.Context, tag string, v ...int64) error {
+	b := make([]uint8, 0, 8*len(v))
+	for _, x := range v {
+		b = appendULINT(b, uint64(x))
 	}
-	err = c.read(&i)
-	if err != nil {
-		return 0, 0, err
+	return c.WriteTagContext(ctx, tag, TypeLINT, len(v), b)
+}
+
+// TagResult is the result of the tag read by ReadTags.
+type TagResult struct {
+	Tag *Tag
+	Err error
+}
+
+// TagValue is the tag written by WriteTags, Type as in WriteTag.
+type TagValue struct {
+	Name  string
+	Type  int
+	Count int
+	Data  []uint8
+}
+
+// ReadTags reads one element of every tag, batched in Multiple Service Packets.
+// Error is returned if the whole request failed, errors of the tags are in the results.
+func (c *Client) ReadTags(tags []string) ([]TagResult, error) {
+	return c.ReadTagsContext(context.Background(), tags)
+}
+
+// ReadTagsContext is ReadTags with the context.
+func (c *Client) ReadTagsContext(ctx context.Context, tags []string) ([]TagResult, error) {
+	return c.readTags(ctx, tags, nil)
+}
+
+// readTags reads counts[i] elements of tags[i], one element if counts is nil.
+func (c *Client) readTags(ctx context.Context, tags []string, counts []int) ([]TagResult, error) {
+	if counts == nil {
+		counts = make([]int, len(tags))
+		for i := range counts {
+			counts[i] = 1
+		}
 	}
-	if i.Type != itUnconnData || i.Length == 0 {
-		return 0, 0, errors.New("connected data item not supported")
+	res := make([]TagResult, len(tags))
+	reqs := make([][]uint8, 0, len(tags))
+	replies := make([]int, 0, len(tags))
+	idx := make([]int, 0, len(tags))
+	var large []int
+	for i, tag := range tags {
+		path := constructPath(parsePath(tag))
+		if path == nil {
+			res[i].Err = errors.New("path parse error")
+			continue
+		}
+		b, err := (&cip.Request{Service: ReadTag, Path: path, Data: appendUINT(nil, uint16(counts[i]))}).Marshal()
+		if err != nil {
+			res[i].Err = err
+			continue
+		}
+		reply := c.replySize(tag, counts[i])
+		if reply > c.batchSize() {
+			large = append(large, i)
+			continue
+		}
+		reqs = append(reqs, b)
+		replies = append(replies, reply)
+		idx = append(idx, i)
 	}
-	err = c.read(&r)
-	if err != nil {
-		return 0, 0, err
-	}
-	if r.Status != Success { // TODO additional status size
-		return int(r.Status), int(i.Length) - 4, errors.New("status not Success")
-	}
-	return int(r.Status), int(i.Length) - 4, nil
-}
-
-func (c *Client) writeHead(path []uint8, service uint8, dataLen int) {
-	c.c.SetDeadline(time.Now().Add(time.Second * time.Duration(c.Timeout)))
-
-	c.context++
-	c.write(encapsulationHeader{
-		Command:       ecSendRRData,
-		Length:        uint16(16 + 2 + len(path) + dataLen),
-		SessionHandle: c.handle,
-		SenderContext: c.context,
-	})
-	c.write(sendData{
-		Timeout:   c.Timeout,
-		ItemCount: 2,
-	})
-	c.write(itemType{Type: itNullAddress, Length: 0})
-	c.write(itemType{Type: itUnconnData, Length: uint16(2 + len(path) + dataLen)})
-	c.write(protocolData{
-		Service:  service,
-		PathSize: uint8(len(path) / 2),
-	})
-	c.write(path)
-}
-
-func (c *Client) writeHeadCM(path []uint8, service uint8, length int) {
-	c.c.SetDeadline(time.Now().Add(time.Second * time.Duration(c.Timeout)))
-
-	msrLen := 2 + len(path) + length
-	dataLen := msrLen + 14
-	encLen := dataLen + 16
-
-	c.context++
-	c.write(encapsulationHeader{
-		Command:       ecSendRRData,
-		Length:        uint16(encLen),
-		SessionHandle: c.handle,
-		SenderContext: c.context,
-	})
-	c.write(sendData{
-		Timeout:   c.Timeout,
-		ItemCount: 2,
-	})
-	c.write(itemType{Type: itNullAddress, Length: 0})
-	c.write(itemType{Type: itUnconnData, Length: uint16(dataLen)})
-	c.write([]byte{0x52, 0x02, 0x20, 0x06, 0x24, 0x01, // unconencted send, path to connection manager
-		0x05, 0x99, byte(msrLen), byte(msrLen >> 8)}) // timeout
-	c.write(protocolData{
-		Service:  service,
-		PathSize: uint8(len(path) / 2),
-	})
-	c.write(path)
-}
-
-func (c *Client) sendRecv(path []uint8, service uint8) ([]uint8, error) {
-	defer c.reset()
-
-	if c.bp == -1 {
-		c.writeHead(path, service, c.wrData.Len())
-	} else {
-		c.writeHeadCM(path, service, c.wrData.Len())
-	}
-	c.write(c.wrData.Bytes())
-	if c.bp != -1 {
-		c.write([]byte{1, 0, 1, byte(c.bp)})
-	}
-	_, err := c.c.Write(c.wr.Bytes())
+
+	resps, err := c.multiServ(ctx, reqs, replies)
 	if err != nil {
 		return nil, err
 	}
+	for j, resp := range resps {
+		i := idx[j]
+		switch resp.Status {
+		case Success:
+			t, d, err := tagData(resp.Data)
+			if err != nil {
+				res[i].Err = err
+				continue
+			}
+			c.learnSize(tags[i], counts[i], len(d))
+			res[i].Tag = &Tag{Name: tags[i], Type: t, data: d}
+		case PartialTransfer, ReplyTooLarge:
+			res[i].Tag, res[i].Err = c.ReadTagContext(ctx, tags[i], counts[i])
+		default:
+			res[i].Err = respError(resp)
+		}
+	}
+	for _, i := range large {
+		res[i].Tag, res[i].Err = c.ReadTagContext(ctx, tags[i], counts[i])
+	}
+	return res, nil
+}
 
-	_, ln, err := c.readHead()
+// WriteTags writes the tags, batched in Multiple Service Packets. Tags over the message size are written by WriteTag.
+// Error is returned if the whole request failed, errors of the tags are in the results.
+func (c *Client) WriteTags(tags []TagValue) ([]error, error) {
+	return c.WriteTagsContext(context.Background(), tags)
+}
+
+// WriteTagsContext is WriteTags with the context.
+func (c *Client) WriteTagsContext(ctx context.Context, tags []TagValue) ([]error, error) {
+	res := make([]error, len(tags))
+	reqs := make([][]uint8, 0, len(tags))
+	idx := make([]int, 0, len(tags))
+	var large []int
+	for i, tv := range tags {
+		path := constructPath(parsePath(tv.Name))
+		if path == nil {
+			res[i] = errors.New("path parse error")
+			continue
+		}
+		data := appendUINT(appendType(nil, tv.Type), uint16(tv.Count))
+		b, err := (&cip.Request{Service: WriteTag, Path: path, Data: append(data, tv.Data...)}).Marshal()
+		if err != nil {
+			res[i] = err
+			continue
+		}
+		if len(b) > c.batchSize() {
+			large = append(large, i)
+			continue
+		}
+		reqs = append(reqs, b)
+		idx = append(idx, i)
+	}
+
+	resps, err := c.multiServ(ctx, reqs, nil)
 	if err != nil {
 		return nil, err
 	}
+	for j, resp := range resps {
+		if resp.Status != Success {
+			res[idx[j]] = respError(resp)
+		}
+	}
+	for _, i := range large {
+		res[i] = c.WriteTagContext(ctx, tags[i].Name, tags[i].Type, tags[i].Count, tags[i].Data)
+	}
+	return res, nil
+}
+
+// sizeKey returns the tag name without array indexes in lower case, e.g. "arr" for "Arr[2]".
+func sizeKey(tag string) string {
+	var b strings.Builder
+	in := false
+	for _, r := range strings.ToLower(tag) {
+		switch {
+		case r == '[':
+			in = true
+		case r == ']':
+			in = false
+		case !in:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// learnSize records element size of the tag from n bytes of count elements read.
+func (c *Client) learnSize(tag string, count, n int) {
+	if count <= 0 || n < count {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes == nil {
+		c.sizes = make(map[string]int)
+	}
+	c.sizes[sizeKey(tag)] = n / count
+}
+
+// replySize returns expected size of the ReadTag response of count elements, 0 if the tag wasn't read or listed yet.
+func (c *Client) replySize(tag string, count int) int {
+	c.mu.Lock()
+	n, ok := c.sizes[sizeKey(tag)]
+	c.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return 4 + 4 + count*n // response header, type with structure handle
+}
+
+// batchSize returns maximum size of the request in the Multiple Service Packet.
+func (c *Client) batchSize() int {
+	return c.msgSize() - 2 - len(pathCIA(MessageRouter, 1, -1, -1)) - 4
+}
+
+// multiServ sends requests in as few Multiple Service Packets as fit the message size and returns their responses.
+// replies are expected sizes of the responses, nil or smaller than the response header if unknown.
+// Packet is split if the response is too large anyway.
+func (c *Client) multiServ(ctx context.Context, reqs [][]uint8, replies []int) ([]cip.Response, error) {
+	path := pathCIA(MessageRouter, 1, -1, -1)
+	limit := c.batchSize() + 4
+	max := maxStackList // of the current batch, lowered on retry
+	resps := make([]cip.Response, 0, len(reqs))
+	for len(reqs) > 0 {
+		n, size, rsize := 0, 2, 2
+		for n < len(reqs) && n < max && size+2+len(reqs[n]) <= limit {
+			reply := 4
+			if replies != nil && replies[n] > reply {
+				reply = replies[n]
+			}
+			if n > 0 && rsize+2+reply > limit {
+				break
+			}
+			size += 2 + len(reqs[n])
+			rsize += 2 + reply
+			n++
+		}
+		if n == 0 {
+			return nil, errors.New("request too large")
+		}
+
+		data := appendUINT(make([]uint8, 0, size), uint16(n))
+		off := 2 + 2*n
+		for _, r := range reqs[:n] {
+			data = appendUINT(data, uint16(off))
+			off += len(r)
+		}
+		for _, r := range reqs[:n] {
+			data = append(data, r...)
+		}
+
+		resp, err := c.roundTrip(ctx, path, MultiServ, data)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status == ReplyTooLarge && n > 1 { // expected sizes unknown or too small
+			max = n / 2
+			continue
+		}
+		reqs = reqs[n:]
+		if replies != nil {
+			replies = replies[n:]
+		}
+		max = maxStackList
+		if resp.Status != Success && resp.Status != cip.StatusEmbeddedServiceErr {
+			return nil, respError(resp)
+		}
+		d := resp.Data
+		if len(d) < 2+2*n || int(binary.LittleEndian.Uint16(d)) != n {
+			return nil, errors.New("invalid Multiple Service Packet response")
+		}
+		for i := 0; i < n; i++ {
+			start := int(binary.LittleEndian.Uint16(d[2+2*i:]))
+			end := len(d)
+			if i+1 < n {
+				end = int(binary.LittleEndian.Uint16(d[4+2*i:]))
+			}
+			if start < 2+2*n || start > end || end > len(d) {
+				return nil, errors.New("invalid Multiple Service Packet response")
+			}
+			var r cip.Response
+			if err = r.Unmarshal(d[start:end]); err != nil {
+				return nil, err
+			}
+			resps = append(resps, r)
+		}
+	}
+	return resps, nil
+}
 
-	d := make([]byte, ln)
-	err = c.read(&d)
+// appendType appends data type of WriteTag request, structure handle is preceded by 0x02A0.
+func appendType(b []uint8, typ int) []uint8 {
+	if typ >= TypeStructHead {
+		b = appendUINT(b, TypeStructHead>>16)
+	}
+	return appendUINT(b, uint16(typ))
+}
+
+// sendRecv sends Message Router request and returns data of the successful response.
+func (c *Client) sendRecv(ctx context.Context, path []uint8, service uint8, data []uint8) ([]uint8, error) {
+	resp, err := c.request(ctx, path, service, data)
 	if err != nil {
 		return nil, err
 	}
+	if resp.Status != Success {
+		return nil, respError(resp)
+	}
+	return resp.Data, nil
+}
+
+// request sends Message Router request and returns response with Success or PartialTransfer status.
+func (c *Client) request(ctx context.Context, path []uint8, service uint8, data []uint8) (cip.Response, error) {
+	resp, err := c.roundTrip(ctx, path, service, data)
+	if err == nil && resp.Status != Success && resp.Status != PartialTransfer {
+		err = respError(resp)
+	}
+	return resp, err
+}
 
-	return d, nil
+// roundTrip sends Message Router request over the connection if opened, otherwise by the route, and returns the response.
+func (c *Client) roundTrip(ctx context.Context, path []uint8, service uint8, data []uint8) (cip.Response, error) {
+	req := cip.Request{Service: service, Path: path, Data: data}
+	msg, err := req.Marshal()
+	if err != nil {
+		return cip.Response{}, err
+	}
+	if cn := c.connection(); cn != nil {
+		return c.connected(ctx, cn, msg)
+	}
+	if c.route != nil {
+		us := cip.UnconnectedSend{
+			PriorityTimeTick: 0x05,
+			TimeoutTicks:     0x99,
+			Request:          msg,
+			RoutePath:        c.route,
+		}
+		req.Service = UnconnectedSend
+		req.Path = pathCIA(ConnManager, 1, -1, -1)
+		req.Data, err = us.Marshal()
+		if err != nil {
+			return cip.Response{}, err
+		}
+		msg, err = req.Marshal()
+		if err != nil {
+			return cip.Response{}, err
+		}
+	}
+	return c.unconnected(ctx, msg)
+}
+
+// unconnected sends the message by SendRRData and returns the response.
+func (c *Client) unconnected(ctx context.Context, msg []uint8) (cip.Response, error) {
+	var resp cip.Response
+
+	cpf := cip.CPF{
+		Timeout: c.Timeout,
+		Items:   []cip.Item{{Type: cip.ItemNullAddress}, {Type: cip.ItemUnconnData, Data: msg}},
+	}
+	d, err := cpf.Marshal()
+	if err != nil {
+		return resp, err
+	}
+	e, err := c.exchange(ctx, cip.CommandSendRRData, d)
+	if err != nil {
+		return resp, err
+	}
+
+	err = cpf.Unmarshal(e.Data)
+	if err != nil {
+		return resp, err
+	}
+	if len(cpf.Items) != 2 {
+		return resp, errors.New("itemCount != 2")
+	}
+	if cpf.Items[0].Type != cip.ItemNullAddress || len(cpf.Items[0].Data) != 0 {
+		return resp, errors.New("connected address item not supported")
+	}
+	if cpf.Items[1].Type != cip.ItemUnconnData {
+		return resp, errors.New("connected data item not supported")
+	}
+	err = resp.Unmarshal(cpf.Items[1].Data)
+	return resp, err
 }
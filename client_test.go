@@ -0,0 +1,751 @@
+package plcconnector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+func testServe(t *testing.T, p *PLC) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := p.ServeContext(ctx, Options{Addr: "127.0.0.1:0", NoUDP: true, ShutdownTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+	return s.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	p := testSTPLC(t)
+	p.UpdateTag("arr", 0, []uint8{1, 0, 2, 0, 3, 0, 4, 0, 5, 0})
+	addr := testServe(t, p)
+
+	for _, route := range []string{"", "1,0", "1,0,2,10.0.0.1,1,3"} {
+		c, err := ConnectRoute(addr, route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := c.GetAttributesAll(IdentityClass, 1)
+		if err != nil || !bytes.Equal(id, p.Class[IdentityClass].inst[1].getAttrAll()) {
+			t.Errorf("route %q: GetAttributesAll() = % X, %v", route, id, err)
+		}
+		tg, err := c.ReadTag("arr[1]", 2)
+		if err != nil || tg.Type != TypeINT || !bytes.Equal(tg.data, []uint8{2, 0, 3, 0}) {
+			t.Errorf("route %q: ReadTag() = %+v, %v", route, tg, err)
+		}
+		if _, err = c.ReadTag("none", 1); err == nil {
+			t.Errorf("route %q: ReadTag of unknown tag succeeded", route)
+		}
+		if err = c.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		want  []uint8
+		err   bool
+	}{
+		{"", nil, false},
+		{"1,0", []uint8{1, 0}, false},
+		{"1, 0, 2, 192.168.1.20, 1, 3", append(append([]uint8{1, 0, 0x12, 12}, "192.168.1.20"...), 1, 3), false},
+		{"2,10.0.0.10", append(append([]uint8{0x12, 9}, "10.0.0.10"...), 0), false},
+		{"1,1,3,8", []uint8{1, 1, 3, 8}, false},
+		{"18,1", []uint8{0x0F, 18, 0, 1}, false},
+		{"1", nil, true},
+		{"0,1", nil, true},
+		{"x,1", nil, true},
+		{"1,300", nil, true},
+		{"1,", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoute(tt.route)
+		if (err != nil) != tt.err || !bytes.Equal(got, tt.want) {
+			t.Errorf("ParseRoute(%q) = % X, %v, want % X", tt.route, got, err, tt.want)
+		}
+	}
+}
+
+func TestClientWrite(t *testing.T) {
+	p := testSTPLC(t)
+	p.NewTag(make([]int32, 300), "big")
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.WriteINT("arr[1]", 7, -2); err != nil {
+		t.Fatal(err)
+	}
+	if tg, _ := c.ReadTag("arr", 4); tg == nil || !bytes.Equal(tg.data, []uint8{0, 0, 7, 0, 0xFE, 0xFF, 0, 0}) {
+		t.Errorf("arr = %+v", tg)
+	}
+
+	big := make([]int32, 300)
+	for i := range big {
+		big[i] = int32(i)
+	}
+	if err = c.WriteDINT("big", big...); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.ReadNum("big[299]"); v != 299 {
+		t.Errorf("big[299] = %v, want 299", v)
+	}
+
+	pos, err := c.ReadTag("pos", 1)
+	if err != nil || pos.Type < TypeStructHead {
+		t.Fatalf("ReadTag(pos) = %+v, %v", pos, err)
+	}
+	pos.data[0] = 5
+	if err = c.WriteTag("pos", pos.Type, 1, pos.data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.ReadNum("pos.X"); v != 5 {
+		t.Errorf("pos.X = %v, want 5", v)
+	}
+
+	if err = c.WriteDINT("none", 1); err == nil {
+		t.Error("write of unknown tag succeeded")
+	}
+}
+
+func TestClientReadFragmented(t *testing.T) {
+	p := testSTPLC(t)
+	big := make([]int32, 300)
+	for i := range big {
+		big[i] = int32(i)
+	}
+	p.NewTag(big, "big")
+	pts := make([]stTestPos, 50)
+	for i := range pts {
+		pts[i] = stTestPos{X: int32(i), Y: -int32(i)}
+	}
+	p.NewTag(pts, "pts")
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	calls := 0
+	c.Progress = func(tag string, n, total int) {
+		calls++
+		if tag != "big" || n > total || total != 1200 {
+			t.Errorf("Progress(%q, %d, %d)", tag, n, total)
+		}
+	}
+
+	tg, err := c.ReadTag("big", 300)
+	if err != nil || tg.Type != TypeDINT || len(tg.data) != 1200 {
+		t.Fatalf("ReadTag(big) = %v, %v", tg, err)
+	}
+	for i := range big {
+		if v := int32(binary.LittleEndian.Uint32(tg.data[4*i:])); v != big[i] {
+			t.Fatalf("big[%d] = %d, want %d", i, v, big[i])
+		}
+	}
+	if calls < 2 {
+		t.Errorf("Progress called %d times", calls)
+	}
+
+	c.Progress = nil
+	tg, err = c.ReadTag("pts", 50)
+	if err != nil || tg.Type < TypeStructHead || len(tg.data) != 50*12 {
+		t.Fatalf("ReadTag(pts) = %v, %v", tg, err)
+	}
+	if x, y := int32(binary.LittleEndian.Uint32(tg.data[49*12:])), int32(binary.LittleEndian.Uint32(tg.data[49*12+4:])); x != 49 || y != -49 {
+		t.Errorf("pts[49] = %d, %d", x, y)
+	}
+}
+
+func TestClientListTags(t *testing.T) {
+	p := testSTPLC(t)
+	for i := 0; i < 100; i++ {
+		p.NewTag(int16(i), fmt.Sprintf("tag%03d", i))
+	}
+	p.NewTag(make([]stTestPos, 4), "pts")
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	list, err := c.ListTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := make(map[string]TagInfo)
+	for _, ti := range list {
+		tags[ti.Name] = ti
+	}
+	if len(tags) != len(list) || len(list) < 107 {
+		t.Errorf("ListTags() returned %d tags, %d unique", len(list), len(tags))
+	}
+	tests := []TagInfo{
+		{Name: "arr", Type: TypeINT, ElemLen: 2, Dim: [3]int{5}},
+		{Name: "tag099", Type: TypeINT, ElemLen: 2},
+		{Name: "pts", ElemLen: 12, Dim: [3]int{4}, Struct: true},
+	}
+	for _, tt := range tests {
+		ti, ok := tags[tt.Name]
+		tt.Instance = ti.Instance
+		if tt.Struct {
+			tt.Type = ti.Type
+		}
+		if !ok || ti != tt || ti.Instance == 0 {
+			t.Errorf("tag %s = %+v, want %+v", tt.Name, ti, tt)
+		}
+	}
+}
+
+func TestClientListProgramTags(t *testing.T) {
+	p := testSTPLC(t)
+	for i := 0; i < 60; i++ {
+		p.NewTag(int32(i), fmt.Sprintf("Program:Main.x%03d", i))
+	}
+	p.NewTag(int32(0), "Program:MainX.y")
+	p.NewTag(int32(0), "Program:Other.z")
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	list, err := c.ListProgramTags("Main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 60 {
+		t.Fatalf("ListProgramTags() returned %d tags, want 60", len(list))
+	}
+	for i, ti := range list {
+		if want := fmt.Sprintf("x%03d", i); ti.Name != want || ti.Type != TypeDINT || ti.ElemLen != 4 {
+			t.Errorf("tag %d = %+v, want %s", i, ti, want)
+		}
+	}
+	tg, err := c.ReadTag("Program:Main."+list[59].Name, 1)
+	if err != nil || tg.DataDINT()[0] != 59 {
+		t.Errorf("ReadTag() = %+v, %v", tg, err)
+	}
+	if list, err = c.ListProgramTags("None"); err != nil || len(list) != 0 {
+		t.Errorf("ListProgramTags(None) = %v, %v", list, err)
+	}
+}
+
+func TestClientTemplate(t *testing.T) {
+	p := testSTPLC(t)
+	p.NewUDT("DATATYPE POSITION3D DINT x; DINT y; DINT z; END_DATATYPE")
+	p.NewUDT("DATATYPE MHH POSITION3D objects[2]; SINT lives; REAL temp; LREAL temp2[3]; END_DATATYPE")
+	p.CreateTag("MHH", "mhh")
+	d := make([]uint8, 53)
+	d[12], d[24] = 7, 3
+	if !p.UpdateTag("mhh", 0, d) {
+		t.Fatal("UpdateTag failed")
+	}
+	pts := []stTestPos{{X: 1, Y: 2, F: 0.5}, {X: -3, Y: 4, F: 1.5}}
+	p.NewTag(pts, "pts")
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tg, err := c.ReadTag("mhh", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = c.Decode(tg, &m); err != nil {
+		t.Fatal(err)
+	}
+	objs, _ := m["objects"].([]interface{})
+	if len(objs) != 2 || objs[1].(map[string]interface{})["x"] != int32(7) || m["lives"] != int8(3) || len(m["temp2"].([]interface{})) != 3 {
+		t.Errorf("Decode() = %v", m)
+	}
+	var mhh struct {
+		Objects [2]struct{ X, Y, Z int }
+		Lives   int
+		Temp2   []float64
+	}
+	if err = c.Decode(tg, &mhh); err != nil || mhh.Objects[1].X != 7 || mhh.Lives != 3 || len(mhh.Temp2) != 3 {
+		t.Errorf("Decode() = %+v, %v", mhh, err)
+	}
+
+	tg, err = c.ReadTag("pts", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []stTestPos
+	if err = c.Decode(tg, &got); err != nil || len(got) != 2 || got[0] != pts[0] || got[1] != pts[1] {
+		t.Errorf("Decode() = %+v, %v", got, err)
+	}
+	u, ok := c.handles[tg.Type&0xFFFF]
+	if !ok || u.Name != "stTestPos" || u.Size != 12 || len(u.Members) != 3 || u.Members[2].Name != "F" || u.Members[2].Type != TypeREAL || u.Members[2].Offset != 8 {
+		t.Errorf("template = %+v", u)
+	}
+	if u2, err := c.ReadTemplate(u.Instance); err != nil || u2 != u {
+		t.Errorf("ReadTemplate() not cached: %v", err)
+	}
+}
+
+func TestTemplateAttrs(t *testing.T) {
+	ok := []uint8{4, 0, 1, 0, 0, 0, 0x34, 0x12, 2, 0, 0, 0, 3, 0, 4, 0, 0, 0, 9, 0, 0, 0, 5, 0, 0, 0, 12, 0, 0, 0}
+	attrs, err := templateAttrs(ok)
+	if err != nil || attrs[1] != 0x1234 || attrs[2] != 3 || attrs[4] != 9 || attrs[5] != 12 {
+		t.Errorf("templateAttrs() = %v, %v", attrs, err)
+	}
+
+	// attribute 2 rejected, no value follows
+	bad := []uint8{4, 0, 1, 0, 0, 0, 0x34, 0x12, 2, 0, AttrNotSup, 0, 4, 0, 0, 0, 9, 0, 0, 0, 5, 0, 0, 0, 12, 0, 0, 0}
+	var ce *CIPError
+	if _, err = templateAttrs(bad); !errors.As(err, &ce) || ce.Status != AttrNotSup {
+		t.Errorf("templateAttrs() error = %v", err)
+	}
+	if _, err = templateAttrs(ok[:len(ok)-2]); err == nil {
+		t.Error("short reply accepted")
+	}
+	if _, err = templateAttrs(append([]uint8{3, 0}, ok[2:len(ok)-8]...)); err == nil {
+		t.Error("missing attribute accepted")
+	}
+}
+
+func TestClientBatch(t *testing.T) {
+	p := testSTPLC(t)
+	var names []string
+	for i := 0; i < 300; i++ {
+		n := fmt.Sprintf("tag%03d", i)
+		p.NewTag(int32(i), n)
+		names = append(names, n)
+	}
+	p.NewTag(make([]int32, 200), "big")
+	names = append(names, "none", "pos", "arr[2]")
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	res, err := c.ReadTags(names)
+	if err != nil || len(res) != len(names) {
+		t.Fatalf("ReadTags() = %d results, %v", len(res), err)
+	}
+	for i := 0; i < 300; i++ {
+		if tg := res[i].Tag; res[i].Err != nil || tg.Type != TypeDINT || tg.DataDINT()[0] != int32(i) {
+			t.Fatalf("%s = %+v, %v", names[i], tg, res[i].Err)
+		}
+	}
+	if res[300].Err == nil || res[301].Err != nil || res[301].Tag.Type < TypeStructHead || res[302].Err != nil {
+		t.Errorf("ReadTags() = %+v", res[300:])
+	}
+
+	big := make([]uint8, 800)
+	big[796] = 9
+	errs, err := c.WriteTags([]TagValue{
+		{Name: "tag001", Type: TypeDINT, Count: 1, Data: []uint8{0xFF, 0, 0, 0}},
+		{Name: "none", Type: TypeDINT, Count: 1, Data: []uint8{1, 0, 0, 0}},
+		{Name: "big", Type: TypeDINT, Count: 200, Data: big},
+		{Name: "arr[4]", Type: TypeINT, Count: 1, Data: []uint8{5, 0}},
+	})
+	if err != nil || len(errs) != 4 || errs[0] != nil || errs[1] == nil || errs[2] != nil || errs[3] != nil {
+		t.Fatalf("WriteTags() = %v, %v", errs, err)
+	}
+	for tag, want := range map[string]float64{"tag001": 255, "big[199]": 9, "arr[4]": 5} {
+		if v, _ := p.ReadNum(tag); v != want {
+			t.Errorf("%s = %v, want %v", tag, v, want)
+		}
+	}
+}
+
+func TestClientBatchReplySize(t *testing.T) {
+	p := testSTPLC(t)
+	var tags []string
+	var counts []int
+	for i := 0; i < 10; i++ {
+		v := make([]int32, 100)
+		v[99] = int32(i)
+		p.NewTag(v, fmt.Sprintf("d%d", i))
+		tags = append(tags, fmt.Sprintf("d%d", i))
+		counts = append(counts, 100)
+	}
+	p.NewTag(make([]int32, 300), "big")
+	tags = append(tags, "big")
+	counts = append(counts, 300)
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.ListTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp := &testCapture{}
+	c.SetCapture(cp)
+	res, err := c.readTags(context.Background(), tags, counts)
+	c.SetCapture(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range res {
+		if r.Err != nil || len(r.Tag.data) != 4*counts[i] {
+			t.Fatalf("%s = %+v", tags[i], r)
+		}
+		if i < 10 && r.Tag.DataDINT()[99] != int32(i) {
+			t.Errorf("%s[99] = %d, want %d", tags[i], r.Tag.DataDINT()[99], i)
+		}
+	}
+	cp.m.Lock()
+	defer cp.m.Unlock()
+	for _, f := range cp.frames {
+		if n := len(f) - cip.EncapsulationHeaderLen - 16; n > unconnSize { // interface handle, timeout and two item headers
+			t.Errorf("message of %d bytes over %d", n, unconnSize)
+		}
+	}
+}
+
+func TestClientConnected(t *testing.T) {
+	p := testSTPLC(t)
+	p.NewTag(make([]int32, 900), "big")
+	addr := testServe(t, p)
+
+	for _, opts := range []ConnOptions{{}, {Large: true}} {
+		c, err := Connect(addr, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.OpenConnection(opts); err != nil {
+			t.Fatal(err)
+		}
+		big := make([]int32, 900)
+		big[899] = 5
+		if err = c.WriteDINT("big", big...); err != nil {
+			t.Fatal(err)
+		}
+		tg, err := c.ReadTag("big", 900)
+		if err != nil || len(tg.data) != 3600 || tg.DataDINT()[899] != 5 {
+			t.Fatalf("large %v: ReadTag() = %v", opts.Large, err)
+		}
+		if c.conn == nil || (c.conn.seq == 2) != opts.Large { // unfragmented only in Large Forward Open
+			t.Fatalf("large %v: %+v", opts.Large, c.conn)
+		}
+
+		cn := c.conn
+		c.connMu.Lock()
+		c.forwardClose(context.Background()) // dropped by the target
+		c.conn = cn
+		c.connMu.Unlock()
+		if err = c.WriteINT("arr[0]", 7); err != nil {
+			t.Fatal(err)
+		}
+		if c.conn == cn || c.conn.seq != 1 {
+			t.Errorf("large %v: connection not reopened", opts.Large)
+		}
+		if err = c.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	if v, _ := p.ReadNum("arr[0]"); v != 7 {
+		t.Errorf("arr[0] = %v, want 7", v)
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	p := testSTPLC(t)
+	for i := 0; i < 16; i++ {
+		p.NewTag(int32(0), fmt.Sprintf("tag%02d", i))
+	}
+	addr := testServe(t, p)
+
+	for _, connected := range []bool{false, true} {
+		c, err := Connect(addr, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Pipeline = 4
+		if connected {
+			if err = c.OpenConnection(ConnOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tag := fmt.Sprintf("tag%02d", i)
+				for n := int32(1); n <= 20; n++ {
+					if err := c.WriteDINT(tag, n*int32(i)); err != nil {
+						errs <- err
+						return
+					}
+					tg, err := c.ReadTag(tag, 1)
+					if err != nil || tg.DataDINT()[0] != n*int32(i) {
+						errs <- fmt.Errorf("%s = %v, %v", tag, tg, err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("connected %v: %v", connected, err)
+		}
+		c.Close()
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	p := testSTPLC(t)
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(chan ClientState, 10)
+	c.StateChange = func(s ClientState, err error) { states <- s }
+	if err = c.OpenConnection(ConnOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cn := c.connection()
+
+	c.mu.Lock()
+	c.s.c.Close() // dropped socket
+	c.mu.Unlock()
+	if s := <-states; s != ClientDisconnected {
+		t.Errorf("state %v, want disconnected", s)
+	}
+	if err = c.WriteINT("arr[0]", 3); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-states; s != ClientConnected {
+		t.Errorf("state %v, want connected", s)
+	}
+	if c.connection() == cn {
+		t.Error("connection not reopened")
+	}
+	if v, _ := p.ReadNum("arr[0]"); v != 3 {
+		t.Errorf("arr[0] = %v, want 3", v)
+	}
+
+	c.Close()
+	if s := <-states; s != ClientClosed {
+		t.Errorf("state %v, want closed", s)
+	}
+	if _, err = c.ReadTag("arr", 1); err != errClientClosed {
+		t.Errorf("ReadTag() after Close: %v", err)
+	}
+}
+
+func TestClientCloseConcurrent(t *testing.T) {
+	p := testSTPLC(t)
+	c, err := Connect(testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.OpenConnection(ConnOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	if _, err = c.ReadTag("arr", 1); err != errClientClosed {
+		t.Errorf("ReadTag() after Close: %v", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	p := testSTPLC(t)
+	c, err := ConnectContext(context.Background(), testServe(t, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.ReadTagContext(context.Background(), "arr", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ReadTag("none", 1)
+	var ce *CIPError
+	if !errors.As(err, &ce) || ce.Service != ReadTag || ce.Status != PathSegmentError {
+		t.Fatalf("ReadTag(none) error = %v, want CIPError of PathSegmentError", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = c.ReadTagContext(ctx, "arr", 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadTagContext() with canceled context = %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	if err = c.WriteDINTContext(ctx, "arr", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WriteDINTContext() with expired context = %v", err)
+	}
+	if _, err = c.ReadTag("arr", 1); err != nil {
+		t.Errorf("ReadTag() after canceled requests: %v", err)
+	}
+
+	slots := c.slots()
+	slots <- struct{}{} // hung request
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = c.ReadTagContext(ctx, "arr", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReadTagContext() waiting for pipeline = %v", err)
+	}
+	<-slots
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = DiscoverContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("DiscoverContext() with canceled context = %v", err)
+	}
+}
+
+func TestCIPError(t *testing.T) {
+	tests := []struct {
+		err  CIPError
+		want string
+	}{
+		{CIPError{Service: ReadTag, Status: PathUnknown}, "ReadTag: path destination unknown (status 0x05)"},
+		{CIPError{Service: LargeForwOpen, Status: ConnFailure, AddStatus: []uint16{0x0113}}, "LargeForwardOpen: connection failure (status 0x01 0x0113): out of connections"},
+		{CIPError{Service: WriteTag, Status: 0xFF, AddStatus: []uint16{0x2107}}, "WriteTag: general error (status 0xFF 0x2107): data type mismatch"},
+		{CIPError{Service: 0x7F, Status: 0xEE}, "service 0x7F: unknown status (status 0xEE)"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	p := testSTPLC(t)
+	p.NewTag(make([]int32, 300), "big")
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := p.ServeContext(ctx, Options{Addr: "127.0.0.1:0", NoUDP: true, ShutdownTimeout: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.Addr().String()
+	c, err := Connect(addr, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.MaxBackoff = 50 * time.Millisecond
+
+	if _, err = c.Subscribe([]string{"a{x}"}, time.Second, 0); err == nil {
+		t.Error("Subscribe() of invalid count succeeded")
+	}
+	sub, err := c.Subscribe([]string{"a", "big{300}", "none"}, 10*time.Millisecond, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() TagEvent {
+		t.Helper()
+		select {
+		case ev := <-sub.Events():
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return TagEvent{}
+	}
+
+	got := make(map[string]TagEvent)
+	for i := 0; i < 3; i++ {
+		ev := next()
+		got[ev.Path] = ev
+	}
+	if ev := got["a"]; ev.Quality != QualityGood || ev.Tag == nil || ev.Tag.DataDINT()[0] != 0 {
+		t.Errorf("a = %+v", ev)
+	}
+	if ev := got["big{300}"]; ev.Quality != QualityGood || ev.Tag == nil || len(ev.Tag.data) != 1200 {
+		t.Errorf("big = %+v", ev)
+	}
+	var ce *CIPError
+	if ev := got["none"]; ev.Quality != QualityBad || !errors.As(ev.Err, &ce) {
+		t.Errorf("none = %+v", ev)
+	}
+
+	p.WriteNum("a", 3) // within the deadband
+	p.WriteNum("big[299]", 10)
+	if ev := next(); ev.Path != "big{300}" || ev.Tag.DataDINT()[299] != 10 {
+		t.Errorf("event %+v, want big[299] = 10", ev)
+	}
+	p.WriteNum("a", 6)
+	if ev := next(); ev.Path != "a" || ev.Tag.DataDINT()[0] != 6 {
+		t.Errorf("event %+v, want a = 6", ev)
+	}
+
+	cancel() // server down
+	srv.Wait()
+	stale := make(map[string]bool)
+	for len(stale) < 2 {
+		ev := next()
+		if ev.Quality != QualityStale {
+			t.Fatalf("event %+v, want stale", ev)
+		}
+		stale[ev.Path] = true
+		if ev.Path == "a" && (ev.Tag == nil || ev.Tag.DataDINT()[0] != 6) {
+			t.Errorf("stale a = %+v, want last value", ev)
+		}
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	srv, err = p.ServeContext(ctx, Options{Addr: addr, NoUDP: true, ShutdownTimeout: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		srv.Wait()
+	}()
+	good := make(map[string]bool)
+	for len(good) < 2 {
+		if ev := next(); ev.Quality == QualityGood {
+			good[ev.Path] = true
+		}
+	}
+
+	ctx, cancelSub := context.WithCancel(context.Background())
+	sub2, err := c.SubscribeContext(ctx, []string{"a"}, 10*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelSub()
+	for range sub2.Events() { // closed by the context
+	}
+	if _, err = c.SubscribeContext(ctx, []string{"a"}, time.Second, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("SubscribeContext() with canceled context = %v", err)
+	}
+
+	sub.Close()
+	for range sub.Events() {
+	}
+	c.mu.Lock()
+	n := len(c.scans)
+	c.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d scan classes after Close", n)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"os"
 
-	plc "github.com/podeszfa/plcconnector"
+	plc "github.com/rich1111/plcconnector"
 )
 
 func main() {
@@ -99,5 +99,11 @@ func main() {
 	} else {
 		fmt.Println(t)
 	}
+
+	err = c.WriteTag("testSTRUCT", t.Type, 1, t.DataBytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	c.Close()
 }
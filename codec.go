@@ -0,0 +1,222 @@
+package plcconnector
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// Hand written little endian encoding of the request and reply, framing types are in the cip package.
+// binary.Read/Write is left for rare services.
+
+const (
+	maxStackList = 64
+	maxReply     = 0xFFFF - 64 // reply data with CPF items must fit encapsulation Length
+)
+
+var errNotEnoughData = errors.New("not enough data")
+
+func appendUINT(b []uint8, v uint16) []uint8 {
+	return append(b, uint8(v), uint8(v>>8))
+}
+
+func appendUDINT(b []uint8, v uint32) []uint8 {
+	return append(b, uint8(v), uint8(v>>8), uint8(v>>16), uint8(v>>24))
+}
+
+func appendULINT(b []uint8, v uint64) []uint8 {
+	return appendUDINT(appendUDINT(b, uint32(v)), uint32(v>>32))
+}
+
+// next returns n bytes of the request, valid until the next read.
+func (r *req) next(n int) ([]uint8, bool, error) {
+	if n < 0 || (r.lenRem != -1 && r.lenRem < n) {
+		r.err(NotEnoughData)
+		return nil, true, errNotEnoughData
+	}
+	if n > cap(r.in) {
+		r.in = make([]uint8, n)
+	}
+	b := r.in[:n]
+	_, err := io.ReadFull(r.readBuf, b)
+	if err != nil {
+		r.readErr(err)
+	}
+	r.lenRem -= n
+	if r.p.DumpNetwork {
+		r.log(LevelDebug, "read", "data", fmt.Sprintf("% X", b))
+	}
+	return b, false, err
+}
+
+func (r *req) readUSINT(v *uint8) (bool, error) {
+	b, rb, err := r.next(1)
+	if err != nil {
+		return rb, err
+	}
+	*v = b[0]
+	return false, nil
+}
+
+func (r *req) readUINT(v *uint16) (bool, error) {
+	b, rb, err := r.next(2)
+	if err != nil {
+		return rb, err
+	}
+	*v = binary.LittleEndian.Uint16(b)
+	return false, nil
+}
+
+func (r *req) readUDINT(v *uint32) (bool, error) {
+	b, rb, err := r.next(4)
+	if err != nil {
+		return rb, err
+	}
+	*v = binary.LittleEndian.Uint32(b)
+	return false, nil
+}
+
+// readUINTList reads count prefixed list, arr is used if it is large enough.
+func (r *req) readUINTList(arr []uint16) ([]uint16, bool, error) {
+	var n uint16
+	rb, err := r.readUINT(&n)
+	if err != nil {
+		return nil, rb, err
+	}
+	b, rb, err := r.next(2 * int(n)) // checked before the allocation
+	if err != nil {
+		return nil, rb, err
+	}
+	v := arr[:0]
+	if int(n) > len(arr) {
+		v = make([]uint16, 0, n)
+	}
+	for i := 0; i < len(b); i += 2 {
+		v = append(v, binary.LittleEndian.Uint16(b[i:]))
+	}
+	return v, false, nil
+}
+
+func (r *req) readEncHead() error {
+	b, _, err := r.next(cip.EncapsulationHeaderLen)
+	if err != nil {
+		return err
+	}
+	return r.encHead.Unmarshal(b)
+}
+
+func (r *req) readItem(i *cip.ItemHeader) error {
+	b, _, err := r.next(cip.ItemHeaderLen)
+	if err != nil {
+		return err
+	}
+	return i.Unmarshal(b)
+}
+
+// readCPF reads SendRRData header, the address item and header of the data item.
+// Malformed packet is reported by encapsulation status.
+func (r *req) readCPF(addr, data *cip.ItemHeader) (uint32, error) {
+	if r.lenRem < cip.SendDataLen+2*cip.ItemHeaderLen {
+		return cip.EncapInvalidLength, nil
+	}
+	b, _, err := r.next(cip.SendDataLen)
+	if err != nil {
+		return 0, err
+	}
+	r.rrdata.Unmarshal(b)
+	if r.rrdata.ItemCount != 2 {
+		r.debug("itemCount != 2")
+		return cip.EncapIncorrectData, nil
+	}
+
+	err = r.readItem(addr)
+	if err != nil {
+		return 0, err
+	}
+	if int(addr.Length) > r.lenRem-cip.ItemHeaderLen {
+		return cip.EncapInvalidLength, nil
+	}
+	if addr.Type != cip.ItemNullAddress && addr.Type != cip.ItemConnAddress {
+		r.debug("unknown address item", "type", addr.Type)
+		return cip.EncapIncorrectData, nil
+	}
+	_, err = r.skip(int(addr.Length))
+	if err != nil {
+		return 0, err
+	}
+
+	err = r.readItem(data)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case int(data.Length) > r.lenRem:
+		return cip.EncapInvalidLength, nil
+	case data.Type == cip.ItemConnData:
+		if data.Length < 2 { // sequence count
+			return cip.EncapInvalidLength, nil
+		}
+	case data.Type != cip.ItemUnconnData:
+		r.debug("unknown data item", "type", data.Type)
+		return cip.EncapIncorrectData, nil
+	}
+	return cip.EncapSuccess, nil
+}
+
+func (r *req) readProtd() (bool, error) {
+	b, rb, err := r.next(2)
+	if err != nil {
+		return rb, err
+	}
+	r.protd.Service = b[0]
+	r.protd.PathSize = b[1]
+	return false, nil
+}
+
+// nextSized returns n bytes of the request followed by the number of words given by the byte at size.
+func (r *req) nextSized(n, size int) ([]uint8, bool, error) {
+	if r.lenRem != -1 && r.lenRem < n {
+		return r.next(n) // reports the error without waiting for more data
+	}
+	b, err := r.readBuf.Peek(n)
+	if err != nil {
+		return r.next(n) // reports the error
+	}
+	return r.next(n + 2*int(b[size]))
+}
+
+// skip discards n bytes of the request.
+func (r *req) skip(n int) (bool, error) {
+	_, rb, err := r.next(n)
+	return rb, err
+}
+
+func (r *req) writeResp() {
+	var b [8]uint8
+	h, _ := r.resp.AppendTo(b[:0])
+	r.writeBuf.Write(h)
+}
+
+// errExt writes error response with one additional status word.
+func (r *req) errExt(status int, ext uint16) {
+	r.ext[0] = ext
+	r.resp.Status = uint8(status)
+	r.resp.AddStatus = r.ext[:]
+	r.writeResp()
+	r.resp.AddStatus = nil
+}
+
+func (r *req) writeUSINT(v uint8) {
+	r.writeBuf.WriteByte(v)
+}
+
+func (r *req) writeUINT(v uint16) {
+	r.writeBuf.Write([]uint8{uint8(v), uint8(v >> 8)})
+}
+
+func (r *req) writeUDINT(v uint32) {
+	r.writeBuf.Write([]uint8{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)})
+}
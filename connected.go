@@ -0,0 +1,222 @@
+package plcconnector
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+var errConnLost = errors.New("connection lost")
+
+// ConnOptions are parameters of the connection opened by OpenConnection.
+type ConnOptions struct {
+	Route []uint8       // padded EPATH to the target as returned by ParseRoute, the route of the client by default
+	Large bool          // Large Forward Open
+	Size  int           // connection size, 504 or 4002 for Large by default
+	RPI   time.Duration // requested packet interval, 2 s by default
+}
+
+type clientConn struct {
+	opts ConnOptions
+	fo   cip.ForwardOpen
+	otID uint32 // connection ID of the requests, assigned by the target
+	seq  uint16
+}
+
+// OpenConnection opens class 3 connection by Forward Open, requests are sent by SendUnitData afterwards.
+// The connection is reopened if the target drops it and closed by Close.
+func (c *Client) OpenConnection(opts ConnOptions) error {
+	return c.OpenConnectionContext(context.Background(), opts)
+}
+
+// OpenConnectionContext is OpenConnection with the context.
+func (c *Client) OpenConnectionContext(ctx context.Context, opts ConnOptions) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.connection() != nil {
+		c.forwardClose(ctx)
+	}
+	if opts.Size == 0 {
+		opts.Size = unconnSize
+		if opts.Large {
+			opts.Size = 4002
+		}
+	}
+	if opts.Size <= 32 || (!opts.Large && opts.Size > 0x1FF) || opts.Size > 0xFFFF {
+		return errors.New("invalid connection size")
+	}
+	if opts.RPI == 0 {
+		opts.RPI = 2 * time.Second
+	}
+	if opts.Route == nil {
+		opts.Route = c.route
+	}
+	return c.forwardOpen(ctx, opts)
+}
+
+// connection returns the connection opened by OpenConnection.
+func (c *Client) connection() *clientConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// forwardOpen opens the connection, the previous one is kept on error. connMu is held by the caller.
+func (c *Client) forwardOpen(ctx context.Context, opts ConnOptions) error {
+	rpi := uint32(opts.RPI / time.Microsecond)
+	params := uint32(0x4200) // point to point, variable size
+	if opts.Large {
+		params <<= 16
+	}
+	params |= uint32(opts.Size)
+	fo := cip.ForwardOpen{
+		Large:                  opts.Large,
+		PriorityTimeTick:       0x0A,
+		TimeoutTicks:           0x0E,
+		TOConnectionID:         rand.Uint32(),
+		ConnSerialNumber:       uint16(rand.Uint32()),
+		VendorID:               0x1337,
+		OriginatorSerialNumber: rand.Uint32(),
+		ConnTimeoutMult:        3,
+		OTRPI:                  rpi,
+		OTConnParams:           params,
+		TORPI:                  rpi,
+		TOConnParams:           params,
+		TransportType:          0xA3, // server, class 3, application trigger
+		ConnPath:               append(append([]uint8(nil), opts.Route...), pathCIA(MessageRouter, 1, -1, -1)...),
+	}
+	d, err := fo.Marshal()
+	if err != nil {
+		return err
+	}
+	service := uint8(ForwardOpen)
+	if opts.Large {
+		service = LargeForwOpen
+	}
+	msg, err := (&cip.Request{Service: service, Path: pathCIA(ConnManager, 1, -1, -1), Data: d}).Marshal()
+	if err != nil {
+		return err
+	}
+	resp, err := c.unconnected(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if resp.Status != Success {
+		return respError(resp)
+	}
+	var fr cip.ForwardOpenResponse
+	if err = fr.Unmarshal(resp.Data); err != nil {
+		return err
+	}
+	if fr.TOConnectionID != fo.TOConnectionID || fr.ConnSerialNumber != fo.ConnSerialNumber {
+		return errors.New("forward open response doesn't match")
+	}
+	c.mu.Lock()
+	c.conn = &clientConn{opts: opts, fo: fo, otID: fr.OTConnectionID}
+	c.mu.Unlock()
+	return nil
+}
+
+// reopen opens the connection again unless cn was already replaced.
+func (c *Client) reopen(ctx context.Context, cn *clientConn) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.connection() != cn {
+		return nil
+	}
+	c.log(LevelInfo, "reopening connection")
+	return c.forwardOpen(ctx, cn.opts)
+}
+
+// forwardClose closes the connection, errors are ignored. connMu is held by the caller.
+func (c *Client) forwardClose(ctx context.Context) {
+	c.mu.Lock()
+	fo := c.conn.fo
+	c.conn = nil
+	c.mu.Unlock()
+	fc := cip.ForwardClose{
+		PriorityTimeTick:       fo.PriorityTimeTick,
+		TimeoutTicks:           fo.TimeoutTicks,
+		ConnSerialNumber:       fo.ConnSerialNumber,
+		VendorID:               fo.VendorID,
+		OriginatorSerialNumber: fo.OriginatorSerialNumber,
+		ConnPath:               fo.ConnPath,
+	}
+	d, err := fc.Marshal()
+	if err != nil {
+		return
+	}
+	msg, err := (&cip.Request{Service: ForwardClose, Path: pathCIA(ConnManager, 1, -1, -1), Data: d}).Marshal()
+	if err != nil {
+		return
+	}
+	c.unconnected(ctx, msg)
+}
+
+// connected sends the message over the connection, reopened once if lost.
+func (c *Client) connected(ctx context.Context, cn *clientConn, msg []uint8) (cip.Response, error) {
+	resp, err := c.sendUnitData(ctx, cn, msg)
+	if err == errConnLost {
+		if err = c.reopen(ctx, cn); err != nil {
+			return resp, err
+		}
+		if cn = c.connection(); cn == nil {
+			return resp, errConnLost
+		}
+		resp, err = c.sendUnitData(ctx, cn, msg)
+	}
+	return resp, err
+}
+
+func (c *Client) sendUnitData(ctx context.Context, cn *clientConn, msg []uint8) (cip.Response, error) {
+	var resp cip.Response
+
+	c.mu.Lock()
+	cn.seq++
+	seq := cn.seq
+	c.mu.Unlock()
+	cpf := cip.CPF{Items: []cip.Item{
+		{Type: cip.ItemConnAddress, Data: appendUDINT(nil, cn.otID)},
+		{Type: cip.ItemConnData, Data: append(appendUINT(nil, seq), msg...)},
+	}}
+	d, err := cpf.Marshal()
+	if err != nil {
+		return resp, err
+	}
+	e, err := c.exchange(ctx, cip.CommandSendUnitData, d)
+	if err != nil {
+		return resp, err
+	}
+
+	err = cpf.Unmarshal(e.Data)
+	if err != nil {
+		return resp, err
+	}
+	if len(cpf.Items) != 2 {
+		return resp, errors.New("itemCount != 2")
+	}
+	a, it := cpf.Items[0], cpf.Items[1]
+	if a.Type != cip.ItemConnAddress || len(a.Data) != 4 || binary.LittleEndian.Uint32(a.Data) != cn.fo.TOConnectionID || it.Type != cip.ItemConnData {
+		return resp, errConnLost
+	}
+	if len(it.Data) < 2 {
+		return resp, cip.ErrShort
+	}
+	if binary.LittleEndian.Uint16(it.Data) != seq {
+		return resp, errors.New("sequence count doesn't match")
+	}
+	err = resp.Unmarshal(it.Data[2:])
+	return resp, err
+}
+
+// msgSize returns maximum size of the request message.
+func (c *Client) msgSize() int {
+	if cn := c.connection(); cn != nil {
+		return cn.opts.Size - 2
+	}
+	return unconnSize
+}
@@ -0,0 +1,348 @@
+package plcconnector
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Controller modes
+const (
+	ModeRun           = 1
+	ModeProgram       = 2
+	ModeRemoteRun     = 3
+	ModeRemoteProgram = 4
+)
+
+// Keyswitch positions
+const (
+	KeyRun     = 1
+	KeyProgram = 2
+	KeyRemote  = 3
+)
+
+// Identity Status bits
+const (
+	statusConfigured      = 0x0004
+	statusMinorRecFault   = 0x0100
+	statusMinorUnrecFault = 0x0200
+	statusMajorRecFault   = 0x0400
+	statusMajorUnrecFault = 0x0800
+)
+
+// Identity States
+const (
+	identOperational     = 3
+	identMajorRecFault   = 4
+	identMajorUnrecFault = 5
+	identExtMajorFault   = 5 // extended device status
+	identExtRunMode      = 6
+	identExtIdleMode     = 7
+	identExtStatusShift  = 4
+	identKeyswitchShift  = 12
+	maxFaultLog          = 100
+	faultTypeProgram     = 4
+)
+
+var errMode = errors.New("mode not allowed by keyswitch position")
+
+// Fault .
+type Fault struct {
+	Time        time.Time
+	Major       bool
+	Recoverable bool
+	Type        int // bit number in MajorFaultBits/MinorFaultBits, e.g. 4 program fault
+	Code        int
+	Info        string
+}
+
+type controller struct {
+	key    int
+	mode   int
+	active []Fault
+	log    []Fault
+	events int
+	reject map[int]bool
+	m      sync.RWMutex
+}
+
+func (c *controller) faultBits() (uint16, uint32, uint32) {
+	var (
+		st    uint16
+		major uint32
+		minor uint32
+	)
+	for _, f := range c.active {
+		switch {
+		case f.Major && f.Recoverable:
+			st |= statusMajorRecFault
+		case f.Major:
+			st |= statusMajorUnrecFault
+		case f.Recoverable:
+			st |= statusMinorRecFault
+		default:
+			st |= statusMinorUnrecFault
+		}
+		if f.Type >= 0 && f.Type < 32 {
+			if f.Major {
+				major |= 1 << f.Type
+			} else {
+				minor |= 1 << f.Type
+			}
+		}
+	}
+	return st, major, minor
+}
+
+func (c *controller) status() (uint16, uint8) {
+	st, _, _ := c.faultBits()
+	ext := uint16(identExtIdleMode)
+	if c.mode == ModeRun || c.mode == ModeRemoteRun {
+		ext = identExtRunMode
+	}
+	state := uint8(identOperational)
+	if st&statusMajorUnrecFault != 0 {
+		ext = identExtMajorFault
+		state = identMajorUnrecFault
+	} else if st&statusMajorRecFault != 0 {
+		ext = identExtMajorFault
+		state = identMajorRecFault
+	}
+	st |= statusConfigured | ext<<identExtStatusShift | uint16(c.key)<<identKeyswitchShift
+	return st, state
+}
+
+func (p *PLC) initController() {
+	p.ctrl.key = KeyRemote
+	p.ctrl.mode = ModeRemoteRun
+	p.ctrl.reject = make(map[int]bool)
+
+	p.Class[ControllerClass] = NewClass("Controller", 0)
+	in := NewInstance(8)
+	in.attr[1] = &Tag{Name: "Keyswitch", Type: TypeUSINT, getter: func() []uint8 {
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		return []uint8{uint8(p.ctrl.key)}
+	}}
+	in.attr[2] = &Tag{Name: "Mode", Type: TypeUSINT, write: true, getter: func() []uint8 {
+		return []uint8{uint8(p.Mode())}
+	}, setter: func(dt []uint8) uint8 {
+		if len(dt) != 1 {
+			return NotEnoughData
+		}
+		if err := p.setModeRemote(int(dt[0])); err != nil {
+			return DeviceStateConflict
+		}
+		return Success
+	}}
+	in.attr[3] = &Tag{Name: "Status", Type: TypeUINT, getter: func() []uint8 {
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		st, _ := p.ctrl.status()
+		return []uint8{uint8(st), uint8(st >> 8)}
+	}}
+	in.attr[4] = &Tag{Name: "MajorFaultBits", Type: TypeDINT, getter: func() []uint8 {
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		_, major, _ := p.ctrl.faultBits()
+		x := make([]uint8, 4)
+		binary.LittleEndian.PutUint32(x, major)
+		return x
+	}}
+	in.attr[5] = &Tag{Name: "MinorFaultBits", Type: TypeDINT, getter: func() []uint8 {
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		_, _, minor := p.ctrl.faultBits()
+		x := make([]uint8, 4)
+		binary.LittleEndian.PutUint32(x, minor)
+		return x
+	}}
+	in.attr[6] = &Tag{Name: "MajorEvents", Type: TypeINT, getter: func() []uint8 {
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		return []uint8{uint8(p.ctrl.events), uint8(p.ctrl.events >> 8)}
+	}}
+	in.attr[7] = &Tag{Name: "FaultCount", Type: TypeUINT, getter: func() []uint8 {
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		return []uint8{uint8(len(p.ctrl.log)), uint8(len(p.ctrl.log) >> 8)}
+	}}
+	in.attr[8] = &Tag{Name: "LastFault", getter: func() []uint8 { // INT Type, INT Code, LINT Timestamp (us)
+		p.ctrl.m.RLock()
+		defer p.ctrl.m.RUnlock()
+		x := make([]uint8, 12)
+		if n := len(p.ctrl.log); n > 0 {
+			f := p.ctrl.log[n-1]
+			binary.LittleEndian.PutUint16(x, uint16(f.Type))
+			binary.LittleEndian.PutUint16(x[2:], uint16(f.Code))
+			binary.LittleEndian.PutUint64(x[4:], uint64(f.Time.UnixNano()/1000))
+		}
+		return x
+	}}
+	p.Class[ControllerClass].SetInstance(1, in)
+
+	p.updateIdentity()
+}
+
+func (p *PLC) updateIdentity() {
+	p.ctrl.m.RLock()
+	st, state := p.ctrl.status()
+	p.ctrl.m.RUnlock()
+	in := p.Class[IdentityClass].inst[1]
+	in.SetAttrUINT(5, st)
+	in.SetAttrUSINT(8, state)
+}
+
+// Mode returns current controller mode.
+func (p *PLC) Mode() int {
+	p.ctrl.m.RLock()
+	defer p.ctrl.m.RUnlock()
+	return p.ctrl.mode
+}
+
+// Keyswitch returns current keyswitch position.
+func (p *PLC) Keyswitch() int {
+	p.ctrl.m.RLock()
+	defer p.ctrl.m.RUnlock()
+	return p.ctrl.key
+}
+
+// Running reports whether controller is in run mode without major fault.
+func (p *PLC) Running() bool {
+	p.ctrl.m.RLock()
+	defer p.ctrl.m.RUnlock()
+	st, _, _ := p.ctrl.faultBits()
+	return (p.ctrl.mode == ModeRun || p.ctrl.mode == ModeRemoteRun) && st&(statusMajorRecFault|statusMajorUnrecFault) == 0
+}
+
+// SetKeyswitch sets keyswitch position, Remote keeps run or program mode.
+func (p *PLC) SetKeyswitch(key int) error {
+	p.ctrl.m.Lock()
+	switch key {
+	case KeyRun:
+		p.ctrl.mode = ModeRun
+	case KeyProgram:
+		p.ctrl.mode = ModeProgram
+	case KeyRemote:
+		if p.ctrl.mode == ModeRun {
+			p.ctrl.mode = ModeRemoteRun
+		} else if p.ctrl.mode == ModeProgram {
+			p.ctrl.mode = ModeRemoteProgram
+		}
+	default:
+		p.ctrl.m.Unlock()
+		return errors.New("unknown keyswitch position")
+	}
+	p.ctrl.key = key
+	p.ctrl.m.Unlock()
+	p.updateIdentity()
+	return nil
+}
+
+// SetMode sets controller mode, keyswitch is moved accordingly.
+func (p *PLC) SetMode(mode int) error {
+	switch mode {
+	case ModeRun:
+		return p.SetKeyswitch(KeyRun)
+	case ModeProgram:
+		return p.SetKeyswitch(KeyProgram)
+	case ModeRemoteRun, ModeRemoteProgram:
+		p.ctrl.m.Lock()
+		p.ctrl.key = KeyRemote
+		p.ctrl.mode = mode
+		p.ctrl.m.Unlock()
+		p.updateIdentity()
+		return nil
+	}
+	return errors.New("unknown mode")
+}
+
+// setModeRemote changes mode on request of the client, only in Remote keyswitch position.
+func (p *PLC) setModeRemote(mode int) error {
+	p.ctrl.m.RLock()
+	key := p.ctrl.key
+	p.ctrl.m.RUnlock()
+	if key != KeyRemote || (mode != ModeRemoteRun && mode != ModeRemoteProgram) {
+		return errMode
+	}
+	return p.SetMode(mode)
+}
+
+// RejectWrites sets modes in which tag writes from clients are rejected.
+func (p *PLC) RejectWrites(modes ...int) {
+	p.ctrl.m.Lock()
+	p.ctrl.reject = make(map[int]bool)
+	for _, m := range modes {
+		p.ctrl.reject[m] = true
+	}
+	p.ctrl.m.Unlock()
+}
+
+func (p *PLC) writeAllowed() bool {
+	p.ctrl.m.RLock()
+	defer p.ctrl.m.RUnlock()
+	return !p.ctrl.reject[p.ctrl.mode]
+}
+
+// RaiseFault adds fault to the active faults and fault log. Major fault stops logic execution.
+func (p *PLC) RaiseFault(f Fault) {
+	if f.Time.IsZero() {
+		f.Time = time.Now()
+	}
+	p.ctrl.m.Lock()
+	p.ctrl.active = append(p.ctrl.active, f)
+	p.ctrl.log = append(p.ctrl.log, f)
+	if len(p.ctrl.log) > maxFaultLog {
+		p.ctrl.log = p.ctrl.log[len(p.ctrl.log)-maxFaultLog:]
+	}
+	if f.Major {
+		p.ctrl.events++
+	}
+	p.ctrl.m.Unlock()
+	p.debug("fault", "type", f.Type, "code", f.Code, "info", f.Info)
+	p.updateIdentity()
+}
+
+// ClearFaults clears recoverable faults.
+func (p *PLC) ClearFaults() {
+	p.ctrl.m.Lock()
+	active := p.ctrl.active[:0]
+	for _, f := range p.ctrl.active {
+		if !f.Recoverable {
+			active = append(active, f)
+		}
+	}
+	p.ctrl.active = active
+	p.ctrl.m.Unlock()
+	p.updateIdentity()
+}
+
+// Faults returns active faults.
+func (p *PLC) Faults() []Fault {
+	p.ctrl.m.RLock()
+	defer p.ctrl.m.RUnlock()
+	return append([]Fault(nil), p.ctrl.active...)
+}
+
+// FaultLog returns logged faults, oldest first.
+func (p *PLC) FaultLog() []Fault {
+	p.ctrl.m.RLock()
+	defer p.ctrl.m.RUnlock()
+	return append([]Fault(nil), p.ctrl.log...)
+}
+
+// identityReset handles Reset service of the Identity object.
+// Type 0 emulates power cycle (clears all faults), type 1 returns to out-of-box configuration.
+func (p *PLC) identityReset(typ uint8) {
+	p.ctrl.m.Lock()
+	p.ctrl.active = nil
+	if typ == 1 {
+		p.ctrl.log = nil
+		p.ctrl.events = 0
+		p.ctrl.key = KeyRemote
+		p.ctrl.mode = ModeRemoteRun
+	}
+	p.ctrl.m.Unlock()
+	p.updateIdentity()
+}
@@ -0,0 +1,68 @@
+package plcconnector
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestController(t *testing.T) {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := p.Class[IdentityClass].inst[1]
+	status := func() uint16 { return binary.LittleEndian.Uint16(ident.getAttrData(5)) }
+	state := func() uint8 { return ident.getAttrData(8)[0] }
+
+	if !p.Running() || p.Keyswitch() != KeyRemote {
+		t.Fatal("default mode should be remote run")
+	}
+	if s := status(); s>>identKeyswitchShift != KeyRemote || (s>>identExtStatusShift)&0x0F != identExtRunMode {
+		t.Errorf("status = %#04x", s)
+	}
+
+	mode, _, _ := p.GetClassInstanceAttr(ControllerClass, 1, 2)
+	if mode.SetDataBytes([]uint8{ModeRemoteProgram}) != Success || p.Mode() != ModeRemoteProgram || p.Running() {
+		t.Error("remote program mode not set")
+	}
+	p.SetKeyswitch(KeyRun)
+	if mode.SetDataBytes([]uint8{ModeRemoteProgram}) != DeviceStateConflict || p.Mode() != ModeRun {
+		t.Error("mode changed remotely with keyswitch in run")
+	}
+
+	p.RejectWrites(ModeProgram)
+	if !p.writeAllowed() {
+		t.Error("write rejected in run mode")
+	}
+	p.SetMode(ModeProgram)
+	if p.writeAllowed() {
+		t.Error("write allowed in program mode")
+	}
+	p.SetMode(ModeRemoteRun)
+
+	p.RaiseFault(Fault{Major: false, Recoverable: true, Type: 10})
+	if status()&statusMinorRecFault == 0 || state() != identOperational || !p.Running() {
+		t.Errorf("minor fault: status = %#04x state = %d", status(), state())
+	}
+	p.RaiseFault(Fault{Major: true, Recoverable: false, Type: faultTypeProgram})
+	if status()&statusMajorUnrecFault == 0 || state() != identMajorUnrecFault || p.Running() {
+		t.Errorf("major fault: status = %#04x state = %d", status(), state())
+	}
+	p.ClearFaults()
+	if len(p.Faults()) != 1 || p.Running() {
+		t.Error("unrecoverable fault cleared")
+	}
+	bits, _, _ := p.GetClassInstanceAttr(ControllerClass, 1, 4)
+	if binary.LittleEndian.Uint32(bits.DataBytes()) != 1<<faultTypeProgram {
+		t.Error("major fault bits")
+	}
+
+	p.identityReset(0)
+	if len(p.Faults()) != 0 || len(p.FaultLog()) != 2 || !p.Running() || state() != identOperational {
+		t.Error("reset type 0")
+	}
+	p.identityReset(1)
+	if len(p.FaultLog()) != 0 {
+		t.Error("reset type 1 should clear fault log")
+	}
+}
@@ -39,7 +39,7 @@ func (p *PLC) getEDS(section string, item string) (string, error) {
 	if ok {
 		v, vok := s[item]
 		if vok {
-			fmt.Println(section, item, v)
+			p.debug("EDS", "section", section, "item", item, "value", v)
 			return v, nil
 		}
 	}
@@ -122,7 +122,7 @@ func (p *PLC) loadEDS(fn string) error {
 				p.favicon = f[i : i+icoSize]
 				i += icoSize
 
-				fmt.Printf("ICO: %d icon(s), %d bytes\n", icons, icoSize)
+				p.log(LevelInfo, "ICO", "icons", icons, "bytes", icoSize)
 			} else {
 				return errBadICO
 			}
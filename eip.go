@@ -7,27 +7,22 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+
+	"github.com/rich1111/plcconnector/cip"
 )
 
+// pathEl types
 const (
-	ansiExtended = 0x91
-	pathBit      = 0xFF
-
-	pathType    = 0xE0
-	pathLogical = 0x20
-
-	pathSegType   = 0x1C
-	pathClass     = 0x00
-	pathInstance  = 0x04
-	pathMember    = 0x08
-	pathAttribute = 0x10
-
-	pathSize = 0x03
-	path8    = 0x00
-	path16   = 0x01
-	path32   = 0x02
+	ansiExtended  = cip.SegmentANSI
+	pathBit       = 0xFF
+	pathClass     = cip.LogicalClass
+	pathInstance  = cip.LogicalInstance
+	pathMember    = cip.LogicalMember
+	pathAttribute = cip.LogicalAttribute
 )
 
+const maxInterned = 1024
+
 var errPath = errors.New("path error")
 
 type pathEl struct {
@@ -134,33 +129,52 @@ func constructPath(p []pathEl) []uint8 {
 	if p == nil {
 		return nil
 	}
-	b := make([]uint8, 0, len(p)*10)
+	path := make(cip.Path, 0, len(p))
 	for _, e := range p {
 		switch e.typ {
 		case ansiExtended:
-			byt := []uint8(e.txt)
-			if len(byt) > 255 {
-				return nil
-			}
-			b = append(b, []uint8{ansiExtended, uint8(len(byt))}...)
-			b = append(b, byt...)
-			if len(byt)&1 == 1 {
-				b = append(b, 0)
+			path = append(path, cip.Symbol(e.txt))
+		case pathMember:
+			path = append(path, cip.Member(uint32(e.val)))
+		case pathBit:
+		default:
+			return nil
+		}
+	}
+	b, err := path.AppendTo(make([]uint8, 0, len(p)*10))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func pathString(p []pathEl) string {
+	var b strings.Builder
+	for i, e := range p {
+		switch e.typ {
+		case ansiExtended:
+			if i > 0 {
+				b.WriteRune('.')
 			}
+			b.WriteString(e.txt)
 		case pathMember:
-			if e.val > 65535 {
-				b = append(b, []uint8{pathLogical | pathMember | path32, 0, uint8(e.val), uint8(e.val >> 8), uint8(e.val >> 16), uint8(e.val >> 24)}...)
-			} else if e.val > 255 {
-				b = append(b, []uint8{pathLogical | pathMember | path16, 0, uint8(e.val), uint8(e.val >> 8)}...)
+			if i > 0 && p[i-1].typ == pathMember {
+				b.WriteRune(',')
 			} else {
-				b = append(b, []uint8{pathLogical | pathMember, uint8(e.val)}...)
+				b.WriteRune('[')
+			}
+			b.WriteString(strconv.Itoa(e.val))
+			if i == len(p)-1 || p[i+1].typ != pathMember {
+				b.WriteRune(']')
 			}
 		case pathBit:
+			b.WriteRune('.')
+			b.WriteString(strconv.Itoa(e.val))
 		default:
-			return nil
+			b.WriteString("@" + strconv.Itoa(e.typ) + ":" + strconv.Itoa(e.val))
 		}
 	}
-	return b
+	return b.String()
 }
 
 func (r *req) parsePath(path []uint8) (int, int, int, int, []pathEl, error) {
@@ -168,173 +182,137 @@ func (r *req) parsePath(path []uint8) (int, int, int, int, []pathEl, error) {
 	insta := -1
 	attri := -1
 	membi := -1
-	pth := []pathEl{}
-	x := 0
-	for i := 0; i < len(path); i++ {
-		if path[i] == ansiExtended && i+1 < len(path) && i+1+int(path[i+1]) < len(path) {
-			ln := path[i+1]
-			ansi := string(path[i+2 : i+int(ln)+2])
-			i += int(ln) + 1
-			if ln&1 == 1 {
-				i++
+	pth := r.path[:0]
+	for x := 0; len(path) > 0; x++ {
+		s, n, err := cip.NextSegment(path)
+		if err != nil {
+			r.debug("path error", "err", err, "segment", path[0])
+			return 0, 0, 0, 0, nil, errPath
+		}
+		path = path[n:]
+		if s.Type == cip.SegmentANSI {
+			pth = append(pth, pathEl{typ: ansiExtended, txt: r.intern(s.Data)})
+			continue
+		}
+		if s.Type != cip.SegmentLogical {
+			r.debug("path type error", "segment", s.Type)
+			return 0, 0, 0, 0, nil, errPath
+		}
+		el := int(s.Value)
+		switch s.Logical {
+		case pathClass:
+			if class == -1 && x == 0 {
+				class = el
 			}
-			pth = append(pth, pathEl{typ: ansiExtended, txt: ansi})
-		} else if (path[i] & pathType) == pathLogical {
-			typ := path[i] & pathSegType
-			size := path[i] & pathSize
-			el := 0
-			switch {
-			case size == path8 && i+1 < len(path):
-				el = int(path[i+1])
-				i++
-			case size == path16 && i+3 < len(path):
-				el = int(path[i+2]) + (int(path[i+3]) << 8)
-				i += 3
-			case size == path32 && i+5 < len(path):
-				el = int(path[i+2]) + (int(path[i+3]) << 8) + (int(path[i+4]) << 16) + (int(path[i+5]) << 24)
-				i += 5
-			default:
-				r.p.debug("path size error")
-				return 0, 0, 0, 0, nil, errPath
+		case pathInstance:
+			if insta == -1 && x == 1 {
+				insta = el
 			}
-			switch typ {
-			case pathClass:
-				if class == -1 && x == 0 {
-					class = el
-				}
-				pth = append(pth, pathEl{typ: pathClass, val: el})
-			case pathInstance:
-				if insta == -1 && x == 1 {
-					insta = el
-				}
-				pth = append(pth, pathEl{typ: pathInstance, val: el})
-			case pathAttribute:
-				if attri == -1 && x == 2 {
-					attri = el
-				}
-				pth = append(pth, pathEl{typ: pathAttribute, val: el})
-			case pathMember:
-				if attri == -1 && x == 2 {
-					attri = el
-				} else if membi == -1 && x == 3 {
-					membi = el
-				}
-				pth = append(pth, pathEl{typ: pathMember, val: el})
-			default:
-				r.p.debug("path segment type error")
-				return 0, 0, 0, 0, nil, errPath
+		case pathAttribute:
+			if attri == -1 && x == 2 {
+				attri = el
 			}
-		} else {
-			r.p.debug("path type error", path[i])
+		case pathMember:
+			if attri == -1 && x == 2 {
+				attri = el
+			} else if membi == -1 && x == 3 {
+				membi = el
+			}
+		default:
+			r.debug("path segment type error")
 			return 0, 0, 0, 0, nil, errPath
 		}
-		x++
+		pth = append(pth, pathEl{typ: int(s.Logical), val: el})
 	}
 	return class, insta, attri, membi, pth, nil
 }
 
+// intern returns symbolic segment as string, allocated once per connection.
+func (r *req) intern(b []uint8) string {
+	if s, ok := r.names[string(b)]; ok {
+		return s
+	}
+	if r.names == nil || len(r.names) >= maxInterned {
+		r.names = make(map[string]string)
+	}
+	s := string(b)
+	r.names[s] = s
+	return s
+}
+
 func (r *req) eipNOP() error {
-	r.p.debug("NOP")
+	r.debug("NOP")
 
-	data := make([]byte, r.encHead.Length)
-	_, err := r.read(&data)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := r.skip(int(r.encHead.Length))
+	return err
 }
 
 func (r *req) eipRegisterSession() error {
-	r.p.debug("RegisterSession")
+	r.debug("RegisterSession")
 
-	var data registerSessionData
-	_, err := r.read(&data)
+	var data cip.RegisterSession
+	if r.lenRem < cip.RegisterSessionLen {
+		r.encHead.Status = cip.EncapInvalidLength
+		return nil
+	}
+	b, _, err := r.next(cip.RegisterSessionLen)
 	if err != nil {
 		return err
 	}
+	data.Unmarshal(b)
 
 	if data.ProtocolVersion > 1 {
-		r.encHead.Status = eipInvalidProtocolVersion
+		r.encHead.Status = cip.EncapUnsupportedProtocol
 		data.ProtocolVersion = 1
 	} else {
 		r.encHead.SessionHandle = rand.Uint32()
 	}
 
-	r.write(data)
+	r.writeBuf.Write(data.Marshal())
 	return nil
 }
 
 func (r *req) eipListIdentity() error {
-	var (
-		data listIdentityData
-		typ  itemType
-	)
-
-	data.ProtocolVersion = 1
-	data.SocketFamily = htons(2)
-	data.SocketPort = htons(r.p.port)
-	data.SocketAddr, _ = getNetIf()
+	sa := cip.SocketAddr{Family: 2, Port: r.port}
+	addr, _ := getNetIf()
+	binary.LittleEndian.PutUint32(sa.Addr[:], addr)
 
 	attrs := r.p.Class[IdentityClass].inst[0x01].getAttrList([]int{1, 2, 3, 4, 5, 6, 7, 8})
 
-	typ.Type = itListIdentity
-	typ.Length = uint16(binary.Size(data) + len(attrs))
-
-	r.write(uint16(1)) // ItemCount
-	r.write(typ)
-	r.write(data)
-	r.write(attrs)
+	typ := cip.ItemHeader{Type: cip.ItemListIdentity, Length: uint16(2 + cip.SocketAddrLen + len(attrs))}
+	b := appendUINT(nil, 1) // ItemCount
+	b = typ.AppendTo(b)
+	b = appendUINT(b, 1) // ProtocolVersion
+	b = sa.AppendTo(b)
+	r.writeBuf.Write(append(b, attrs...))
 	return nil
 }
 
 func (r *req) eipListServices() error {
-	var (
-		data listServicesData
-		typ  itemType
-	)
+	data := cip.ListServices{ProtocolVersion: 1, CapabilityFlags: cip.CapabilityTCP, Name: "Communications"}
+	typ := cip.ItemHeader{Type: cip.ItemListServices, Length: cip.ListServicesLen}
 
-	typ.Type = itListService
-	typ.Length = uint16(binary.Size(data))
-
-	data.ProtocolVersion = 1
-	data.CapabilityFlags = lscfTCP
-	data.NameOfService = [16]int8{67, 111, 109, 109, 117, 110, 105, 99, 97, 116, 105, 111, 110, 115, 0, 0} // Communications
-
-	r.write(uint16(1)) // ItemCount
-	r.write(typ)
-	r.write(data)
+	b := appendUINT(nil, 1) // ItemCount
+	b = typ.AppendTo(b)
+	b, _ = data.AppendTo(b)
+	r.writeBuf.Write(b)
 	return nil
 }
 
 func pathCIA(clas, instance, attr, member int) []uint8 {
-	path := make([]uint8, 0, 6)
-	if clas > 65535 {
-		path = append(path, []uint8{0x22, 0, uint8(clas), uint8(clas >> 8), uint8(clas >> 16), uint8(clas >> 24)}...)
-	} else if clas > 255 {
-		path = append(path, []uint8{0x21, 0, uint8(clas), uint8(clas >> 8)}...)
-	} else if clas >= 0 {
-		path = append(path, []uint8{0x20, uint8(clas)}...)
+	path := make(cip.Path, 0, 4)
+	if clas >= 0 {
+		path = append(path, cip.Class(uint32(clas)))
 	}
-	if instance > 65535 {
-		path = append(path, []uint8{0x26, 0, uint8(instance), uint8(instance >> 8), uint8(instance >> 16), uint8(instance >> 24)}...)
-	} else if instance > 255 {
-		path = append(path, []uint8{0x25, 0, uint8(instance), uint8(instance >> 8)}...)
-	} else if instance >= 0 {
-		path = append(path, []uint8{0x24, uint8(instance)}...)
+	if instance >= 0 {
+		path = append(path, cip.Instance(uint32(instance)))
 	}
-	if attr > 65535 {
-		path = append(path, []uint8{0x32, 0, uint8(attr), uint8(attr >> 8), uint8(attr >> 16), uint8(attr >> 24)}...)
-	} else if attr > 255 {
-		path = append(path, []uint8{0x31, 0, uint8(attr), uint8(attr >> 8)}...)
-	} else if attr >= 0 {
-		path = append(path, []uint8{0x30, uint8(attr)}...)
+	if attr >= 0 {
+		path = append(path, cip.Attribute(uint32(attr)))
 	}
-	if member > 65535 {
-		path = append(path, []uint8{0x2A, 0, uint8(member), uint8(member >> 8), uint8(member >> 16), uint8(member >> 24)}...)
-	} else if member > 255 {
-		path = append(path, []uint8{0x29, 0, uint8(member), uint8(member >> 8)}...)
-	} else if member >= 0 {
-		path = append(path, []uint8{0x28, uint8(member)}...)
+	if member >= 0 {
+		path = append(path, cip.Member(uint32(member)))
 	}
-	return path
+	b, _ := path.AppendTo(make([]uint8, 0, 6))
+	return b
 }
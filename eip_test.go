@@ -105,6 +105,17 @@ func Test_constructPath(t *testing.T) {
 	}
 }
 
+func Test_pathString(t *testing.T) {
+	tests := []string{"tag", "tag[41].2", "tag3[60000].count", "tag[1,2,3]", "Program:Main.tag[6].count[7]"}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			if got := pathString(parsePath(tt)); got != tt {
+				t.Errorf("pathString(parsePath(\"%s\")) = %v", tt, got)
+			}
+		})
+	}
+}
+
 func Test_pathCIA(t *testing.T) {
 	type args struct {
 		clas     int
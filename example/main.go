@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
@@ -70,15 +71,8 @@ type structTest2 struct {
 }
 
 func main() {
-	signalTrap := make(chan os.Signal, 1)
-	signal.Notify(signalTrap, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		signalType := <-signalTrap
-		signal.Stop(signalTrap)
-		fmt.Printf("interrupt: %d\n", signalType)
-		os.Exit(0)
-	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// inicjalizacja
 	eds := ""
@@ -182,6 +176,9 @@ func main() {
 		p.SetSizeTagForAssemblyClass(assemblyOutInstance, 1)
 	}
 
+	// komunikaty diagnostyczne
+	p.Logger = plc.NewStdLogger(nil, plc.LevelDebug)
+
 	// nie wyświetlaj dodatkowych informacji
 	p.Verbose = true
 	p.DumpNetwork = false
@@ -189,11 +186,22 @@ func main() {
 	// callback
 	// p.Callback(call)
 
-	// strona WWW
-	go p.ServeHTTP("0.0.0.0:28080")
+	// zapis ruchu sieciowego do pliku pcap (Wireshark) lub czytelny zapis na stdout
+	// pc, _ := plc.CreatePcap("plc.pcap")
+	// defer pc.Close()
+	// p.Capture = pc
+	// p.Capture = plc.NewTraceWriter(os.Stdout)
 
-	// serwer
-	p.Serve("0.0.0.0:44818")
+	// serwer i strona WWW, zamykane po sygnale
+	srv, err := p.ServeContext(ctx, plc.Options{Addr: "0.0.0.0:44818", HTTPAddr: "0.0.0.0:28080"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = srv.Wait()
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 
@@ -0,0 +1,91 @@
+//go:build go1.18
+
+package plcconnector
+
+import (
+	"testing"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// fuzzMessages returns CIP requests of every served service.
+func fuzzMessages() [][]uint8 {
+	cm := pathCIA(ConnManager, 1, -1, -1)
+	msg := func(service uint8, path []uint8, data ...uint8) []uint8 {
+		b, _ := (&cip.Request{Service: service, Path: path, Data: data}).Marshal()
+		return b
+	}
+	fo, _ := (&cip.ForwardOpen{TOConnectionID: 1, OTRPI: 1000, TORPI: 1000, TOConnParams: 0x43F4, ConnPath: pathCIA(2, 1, -1, -1)}).Marshal()
+	lfo, _ := (&cip.ForwardOpen{Large: true, TOConnectionID: 1, TOConnParams: 4002, ConnPath: pathCIA(2, 1, -1, -1)}).Marshal()
+	fc, _ := (&cip.ForwardClose{ConnPath: pathCIA(2, 1, -1, -1)}).Marshal()
+	read := testReadTagReq("arr", 2)
+	unc, _ := (&cip.UnconnectedSend{PriorityTimeTick: 5, TimeoutTicks: 0x99, Request: read, RoutePath: []uint8{1, 0}}).Marshal()
+	arr := testSymbolPath("arr")
+	return [][]uint8{
+		read,
+		msg(ReadTagFrag, arr, 2, 0, 2, 0, 0, 0),
+		msg(WriteTag, arr, TypeINT, 0, 2, 0, 7, 0, 8, 0),
+		msg(WriteTag, testSymbolPath("pos"), 0xA0, 0x02, 0x34, 0x12, 1, 0, 0, 0, 0, 0),
+		msg(WriteTagFrag, arr, TypeINT, 0, 5, 0, 2, 0, 0, 0, 7, 0),
+		msg(ReadModifyWrite, testSymbolPath("a"), 4, 0, 1, 0, 0, 0, 0xFE, 0xFF, 0xFF, 0xFF),
+		testMultiServReq(testReadTagReq("a", 1), msg(WriteTag, testSymbolPath("b"), TypeDINT, 0, 1, 0, 1, 0, 0, 0)),
+		testInstAttrListReq(),
+		msg(GetAttrAll, pathCIA(IdentityClass, 1, -1, -1)),
+		msg(GetAttrList, pathCIA(IdentityClass, 1, -1, -1), 2, 0, 1, 0, 7, 0),
+		msg(SetAttrList, pathCIA(TCPClass, 1, -1, -1), 1, 0, 13, 0, 1, 0),
+		msg(GetAttr, pathCIA(IdentityClass, 1, 1, -1)),
+		msg(SetAttr, pathCIA(TCPClass, 1, 13, -1), 1, 0),
+		msg(InititateUpload, pathCIA(FileClass, 0xC8, -1, -1), 100),
+		msg(UploadTransfer, pathCIA(FileClass, 0xC8, -1, -1), 0),
+		msg(ForwardOpen, cm, fo...),
+		msg(LargeForwOpen, cm, lfo...),
+		msg(ForwardClose, cm, fc...),
+		msg(UnconnectedSend, cm, unc...),
+		msg(ReadTemplate, pathCIA(TemplateClass, 1, -1, -1), 0, 0, 0, 0, 100, 0),
+		msg(Reset, pathCIA(IdentityClass, 1, -1, -1), 0),
+		msg(NextInst, pathCIA(SymbolClass, 0, -1, -1), 10),
+		msg(GetMember, pathCIA(SymbolClass, 1, 1, 0)),
+	}
+}
+
+// fuzzCheck fails unless out is a sequence of complete encapsulation replies.
+func fuzzCheck(t *testing.T, out []uint8) {
+	for len(out) > 0 {
+		var e cip.Encapsulation
+		if err := e.Unmarshal(out); err != nil {
+			t.Fatalf("reply % X: %v", out, err)
+		}
+		out = out[cip.EncapsulationHeaderLen+len(e.Data):]
+	}
+}
+
+func FuzzRequest(f *testing.F) {
+	p := testSTPLC(f)
+	for _, m := range fuzzMessages() {
+		f.Add(testRRData(m))
+	}
+	for _, c := range []uint16{cip.CommandNOP, cip.CommandListIdentity, cip.CommandListServices, cip.CommandListInterfaces, 0x99} {
+		f.Add((&cip.EncapsulationHeader{Command: c}).AppendTo(nil))
+	}
+	f.Add(append((&cip.EncapsulationHeader{Command: cip.CommandRegisterSession, Length: 4}).AppendTo(nil), 1, 0, 0, 0))
+	f.Fuzz(func(t *testing.T, b []uint8) {
+		c := &testConn{req: b, n: 1, keep: true}
+		p.handleRequest(c, nil)
+		fuzzCheck(t, c.out.Bytes())
+	})
+}
+
+func FuzzService(f *testing.F) {
+	p := testSTPLC(f)
+	for _, m := range fuzzMessages() {
+		f.Add(m)
+	}
+	f.Fuzz(func(t *testing.T, msg []uint8) {
+		if len(msg) > 0xFFFF-cip.SendDataLen-2*cip.ItemHeaderLen {
+			return
+		}
+		c := &testConn{req: testRRData(msg), n: 1, keep: true}
+		p.handleRequest(c, nil)
+		fuzzCheck(t, c.out.Bytes())
+	})
+}
@@ -0,0 +1,482 @@
+package plcconnector
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ring-buffer file: 32 B header ("PLCH", version, capacity, head, count), then capacity * (int64 unix ns, float64 value)
+const (
+	histMagic      = "PLCH"
+	histVersion    = 1
+	histHeaderLen  = 32
+	histRecordLen  = 16
+	histSize       = 100000
+	histQueueLen   = 4096
+	histResolution = 10 * time.Millisecond
+)
+
+// HistorySeries describes recorded tag or member path.
+type HistorySeries struct {
+	Path     string
+	Interval time.Duration // sampling interval, 0: record on change
+	Deadband float64       // minimal change recorded, only on change
+	Size     int           // capacity of the ring buffer in points, default 100000
+}
+
+// HistoryPoint is recorded value or aggregate of values in Time .. next point.
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int       `json:"count"`
+}
+
+type histSample struct {
+	s *histSeries
+	t time.Time
+	v float64
+}
+
+type histSeries struct {
+	HistorySeries
+	path  []pathEl
+	src   string
+	f     *os.File
+	cap   uint32
+	head  uint32
+	count uint32
+	last  float64
+	lastT time.Time
+	has   bool
+	m     sync.Mutex
+}
+
+type historian struct {
+	dir     string
+	series  map[string]*histSeries
+	byTag   map[string][]*histSeries
+	ch      chan histSample
+	stop    chan struct{}
+	done    chan struct{}
+	running bool
+	m       sync.Mutex
+}
+
+func histFileName(path string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(path)) + ".hist"
+}
+
+func (s *histSeries) open(file string) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	hdr := make([]uint8, histHeaderLen)
+	n, err := f.ReadAt(hdr, 0)
+	if n == 0 && err == io.EOF {
+		copy(hdr, histMagic)
+		binary.LittleEndian.PutUint32(hdr[4:], histVersion)
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(s.Size))
+		_, err = f.WriteAt(hdr, 0)
+		if err == nil {
+			err = f.Truncate(histHeaderLen + int64(s.Size)*histRecordLen)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	} else if err != nil || string(hdr[:4]) != histMagic || binary.LittleEndian.Uint32(hdr[4:]) != histVersion {
+		f.Close()
+		return errors.New(file + ": not a history file")
+	}
+	s.f = f
+	s.cap = binary.LittleEndian.Uint32(hdr[8:])
+	s.head = binary.LittleEndian.Uint32(hdr[12:])
+	s.count = binary.LittleEndian.Uint32(hdr[16:])
+	if s.cap == 0 || s.head >= s.cap || s.count > s.cap {
+		f.Close()
+		return errors.New(file + ": corrupted header")
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() != histHeaderLen+int64(s.cap)*histRecordLen {
+		err = errors.New(file + ": capacity does not match file size")
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *histSeries) append(t time.Time, v float64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	rec := make([]uint8, histRecordLen)
+	binary.LittleEndian.PutUint64(rec, uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint64(rec[8:], math.Float64bits(v))
+	if _, err := s.f.WriteAt(rec, histHeaderLen+int64(s.head)*histRecordLen); err != nil {
+		return err
+	}
+	s.head = (s.head + 1) % s.cap
+	if s.count < s.cap {
+		s.count++
+	}
+	hdr := make([]uint8, 8)
+	binary.LittleEndian.PutUint32(hdr, s.head)
+	binary.LittleEndian.PutUint32(hdr[4:], s.count)
+	_, err := s.f.WriteAt(hdr, 12)
+	return err
+}
+
+// read returns points between from and to, oldest first.
+func (s *histSeries) read(from, to time.Time) ([]HistoryPoint, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.f == nil {
+		return nil, errors.New("historian stopped")
+	}
+	// oldest records up to the end of file, then the rest from the start
+	first := (s.head + s.cap - s.count) % s.cap
+	n := s.count
+	if n > s.cap-first {
+		n = s.cap - first
+	}
+	buf := make([]uint8, int(s.count)*histRecordLen)
+	if _, err := s.f.ReadAt(buf[:int(n)*histRecordLen], histHeaderLen+int64(first)*histRecordLen); err != nil {
+		return nil, err
+	}
+	if _, err := s.f.ReadAt(buf[int(n)*histRecordLen:], histHeaderLen); err != nil {
+		return nil, err
+	}
+	r := make([]HistoryPoint, 0, s.count)
+	for i := 0; i < int(s.count); i++ {
+		rec := buf[i*histRecordLen:]
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(rec)))
+		if t.Before(from) || t.After(to) {
+			continue
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(rec[8:]))
+		r = append(r, HistoryPoint{Time: t, Min: v, Max: v, Avg: v, Count: 1})
+	}
+	return r, nil
+}
+
+func downsample(pts []HistoryPoint, from, to time.Time, maxPoints int) []HistoryPoint {
+	if maxPoints <= 0 || len(pts) <= maxPoints {
+		return pts
+	}
+	step := to.Sub(from) / time.Duration(maxPoints)
+	if step <= 0 {
+		step = 1
+	}
+	r := make([]HistoryPoint, 0, maxPoints)
+	var cur *HistoryPoint
+	for _, x := range pts {
+		b := from.Add(x.Time.Sub(from) / step * step)
+		if cur == nil || !cur.Time.Equal(b) {
+			if cur != nil {
+				cur.Avg /= float64(cur.Count)
+			}
+			r = append(r, HistoryPoint{Time: b, Min: x.Min, Max: x.Max})
+			cur = &r[len(r)-1]
+		}
+		cur.Min = math.Min(cur.Min, x.Min)
+		cur.Max = math.Max(cur.Max, x.Max)
+		cur.Avg += x.Avg * float64(x.Count)
+		cur.Count += x.Count
+	}
+	if cur != nil {
+		cur.Avg /= float64(cur.Count)
+	}
+	return r
+}
+
+// StartHistorian starts recording into directory dir.
+func (p *PLC) StartHistorian(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	h := &p.hist
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.running {
+		return errors.New("historian already started")
+	}
+	h.dir = dir
+	h.series = make(map[string]*histSeries)
+	h.byTag = make(map[string][]*histSeries)
+	h.ch = make(chan histSample, histQueueLen)
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	h.running = true
+	go p.histWriter(h.ch, h.stop, h.done)
+	go p.histSampler(h.stop)
+	return nil
+}
+
+// StopHistorian stops recording and closes files.
+func (p *PLC) StopHistorian() {
+	h := &p.hist
+	h.m.Lock()
+	if !h.running {
+		h.m.Unlock()
+		return
+	}
+	h.running = false
+	close(h.stop)
+	done := h.done
+	h.m.Unlock()
+	<-done
+
+	h.m.Lock()
+	for _, s := range h.series {
+		s.m.Lock()
+		s.f.Close()
+		s.f = nil
+		s.m.Unlock()
+	}
+	h.series = nil
+	h.byTag = nil
+	h.m.Unlock()
+}
+
+// AddHistory starts recording of the path. Existing file is continued.
+func (p *PLC) AddHistory(hs HistorySeries) error {
+	s := &histSeries{HistorySeries: hs}
+	if s.Size <= 0 {
+		s.Size = histSize
+	}
+	s.path = parsePath(hs.Path)
+	if s.path == nil {
+		return errors.New("history " + hs.Path + ": " + errPath.Error())
+	}
+	p.tMut.RLock()
+	_, _, err := p.readNum(s.path)
+	if err == nil {
+		pth, _ := splitBit(s.path)
+		tg, _, _, _, _, _ := p.parsePathEl(pth)
+		s.src = strings.ToLower(tg.Name)
+	}
+	p.tMut.RUnlock()
+	if err != nil {
+		return errors.New("history " + hs.Path + ": " + err.Error())
+	}
+
+	h := &p.hist
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.running {
+		return errors.New("historian not started")
+	}
+	name := strings.ToLower(hs.Path)
+	if _, ok := h.series[name]; ok {
+		return errors.New("history " + hs.Path + ": already recorded")
+	}
+	if err = s.open(filepath.Join(h.dir, histFileName(hs.Path))); err != nil {
+		return errors.New("history " + hs.Path + ": " + err.Error())
+	}
+	h.series[name] = s
+	h.byTag[s.src] = append(h.byTag[s.src], s)
+	return nil
+}
+
+// History returns recorded values of the path between from and to.
+// If there are more than maxPoints values, they are aggregated into maxPoints intervals.
+func (p *PLC) History(path string, from, to time.Time, maxPoints int) ([]HistoryPoint, error) {
+	p.hist.m.Lock()
+	s, ok := p.hist.series[strings.ToLower(path)]
+	p.hist.m.Unlock()
+	if !ok {
+		return nil, errors.New("history " + path + ": not recorded")
+	}
+	pts, err := s.read(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return downsample(pts, from, to, maxPoints), nil
+}
+
+func (p *PLC) historyPaths(tag string) []string {
+	p.hist.m.Lock()
+	defer p.hist.m.Unlock()
+	var r []string
+	for _, s := range p.hist.byTag[strings.ToLower(tag)] {
+		r = append(r, s.Path)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// histSample must be called with tMut and hist.m locked.
+func (p *PLC) histSample(s *histSeries, now time.Time, onChange bool) {
+	v, _, err := p.readNum(s.path)
+	if err != nil {
+		return
+	}
+	if onChange && s.has && (v == s.last || math.Abs(v-s.last) < s.Deadband) {
+		return
+	}
+	s.has = true
+	s.last = v
+	s.lastT = now
+	select {
+	case p.hist.ch <- histSample{s: s, t: now, v: v}:
+	default:
+		p.debug("history sample dropped", "path", s.Path)
+	}
+}
+
+// histCheck must be called with tMut locked.
+func (p *PLC) histCheck(t *Tag) {
+	p.hist.m.Lock()
+	defer p.hist.m.Unlock()
+	if !p.hist.running {
+		return
+	}
+	now := time.Now()
+	for _, s := range p.hist.byTag[strings.ToLower(t.Name)] {
+		if s.Interval == 0 {
+			p.histSample(s, now, true)
+		}
+	}
+}
+
+func (p *PLC) histSampler(stop chan struct{}) {
+	tick := time.NewTicker(histResolution)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-tick.C:
+			p.tMut.RLock()
+			p.hist.m.Lock()
+			for _, s := range p.hist.series {
+				if s.Interval > 0 && now.Sub(s.lastT) >= s.Interval {
+					p.histSample(s, now, false)
+				}
+			}
+			p.hist.m.Unlock()
+			p.tMut.RUnlock()
+		}
+	}
+}
+
+func (p *PLC) histWriter(ch chan histSample, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case x := <-ch:
+			if err := x.s.append(x.t, x.v); err != nil {
+				p.debug("history", "path", x.s.Path, "err", err)
+			}
+		case <-stop:
+			for {
+				select {
+				case x := <-ch:
+					x.s.append(x.t, x.v)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+type jsHistory struct {
+	Dir    string `json:"dir"`
+	Series []struct {
+		Path     string  `json:"path"`
+		Interval string  `json:"interval,omitempty"`
+		Deadband float64 `json:"deadband,omitempty"`
+		Size     int     `json:"size,omitempty"`
+	} `json:"series"`
+}
+
+func (p *PLC) importHistory(js *jsHistory) error {
+	if err := p.StartHistorian(js.Dir); err != nil {
+		return err
+	}
+	for _, j := range js.Series {
+		hs := HistorySeries{Path: j.Path, Deadband: j.Deadband, Size: j.Size}
+		if j.Interval != "" {
+			var err error
+			if hs.Interval, err = time.ParseDuration(j.Interval); err != nil {
+				return errors.New("history " + j.Path + ": " + err.Error())
+			}
+		}
+		if err := p.AddHistory(hs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyHTTP serves /.history?path=&from=&to=&max=&format=csv, times in RFC 3339, default last hour.
+func (p *PLC) historyHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	var err error
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	maxPoints := 500
+	if s := q.Get("max"); s != "" {
+		if maxPoints, err = strconv.Atoi(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	pts, err := p.History(q.Get("path"), from, to, maxPoints)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c := csv.NewWriter(w)
+		c.Write([]string{"time", "min", "max", "avg", "count"})
+		for _, x := range pts {
+			c.Write([]string{x.Time.Format(time.RFC3339Nano), strconv.FormatFloat(x.Min, 'g', -1, 64), strconv.FormatFloat(x.Max, 'g', -1, 64), strconv.FormatFloat(x.Avg, 'g', -1, 64), strconv.Itoa(x.Count)})
+		}
+		c.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(pts)
+}
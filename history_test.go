@@ -0,0 +1,124 @@
+package plcconnector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_downsample(t *testing.T) {
+	from := time.Unix(0, 0)
+	var pts []HistoryPoint
+	for i := 0; i < 10; i++ {
+		v := float64(i)
+		pts = append(pts, HistoryPoint{Time: from.Add(time.Duration(i) * time.Second), Min: v, Max: v, Avg: v, Count: 1})
+	}
+	tests := []struct {
+		name string
+		max  int
+		want []HistoryPoint
+	}{
+		{"raw", 10, pts},
+		{"no limit", 0, pts},
+		{"two", 2, []HistoryPoint{
+			{Time: from, Min: 0, Max: 4, Avg: 2, Count: 5},
+			{Time: from.Add(5 * time.Second), Min: 5, Max: 9, Avg: 7, Count: 5},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := downsample(pts, from, from.Add(10*time.Second), tt.max)
+			if len(got) != len(tt.want) {
+				t.Fatalf("len = %d, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func waitHistory(t *testing.T, p *PLC, path string, last float64) []HistoryPoint {
+	for i := 0; i < 100; i++ {
+		pts, err := p.History(path, time.Time{}, time.Now(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pts) > 0 && pts[len(pts)-1].Avg == last {
+			return pts
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: %v not recorded", path, last)
+	return nil
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(int32(0), "cnt")
+	p.NewTag(stTestPos{}, "pos")
+
+	if p.AddHistory(HistorySeries{Path: "cnt"}) == nil {
+		t.Error("history added before start")
+	}
+	if err = p.StartHistorian(dir); err != nil {
+		t.Fatal(err)
+	}
+	if p.AddHistory(HistorySeries{Path: "nosuchtag"}) == nil {
+		t.Error("unknown tag accepted")
+	}
+	if err = p.AddHistory(HistorySeries{Path: "cnt", Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.AddHistory(HistorySeries{Path: "pos.F", Deadband: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.historyPaths("POS")) != 1 {
+		t.Error("historyPaths")
+	}
+
+	for i := 1; i <= 5; i++ {
+		p.WriteNum("cnt", float64(i))
+		p.WriteNum("cnt", float64(i))
+	}
+	p.WriteNum("pos.F", 0.5)
+	p.WriteNum("pos.F", 1.2)
+	p.WriteNum("pos.F", 1.5)
+	p.WriteNum("pos.X", 3)
+
+	pts := waitHistory(t, p, "cnt", 5)
+	if len(pts) != 3 || pts[0].Avg != 3 || pts[2].Avg != 5 {
+		t.Errorf("ring buffer = %+v", pts)
+	}
+	if pts = waitHistory(t, p, "pos.f", 1.5); len(pts) != 2 || pts[0].Avg != 0.5 {
+		t.Errorf("deadband = %+v", pts)
+	}
+
+	p.StopHistorian()
+	p.StartHistorian(dir)
+	p.AddHistory(HistorySeries{Path: "cnt", Size: 3})
+	p.WriteNum("cnt", 6)
+	if pts = waitHistory(t, p, "cnt", 6); len(pts) != 3 || pts[0].Avg != 4 {
+		t.Errorf("reopened = %+v", pts)
+	}
+	p.StopHistorian()
+
+	f, err := os.OpenFile(filepath.Join(dir, "cnt.hist"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]uint8{0xFF, 0xFF, 0xFF, 0x7F}, 8) // capacity
+	f.Close()
+	p.StartHistorian(dir)
+	if p.AddHistory(HistorySeries{Path: "cnt", Size: 3}) == nil {
+		t.Error("capacity over file size accepted")
+	}
+	p.StopHistorian()
+}
@@ -12,9 +12,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"math"
 	"net/http"
+	"net/url"
 	"path"
 	"sort"
 	"strconv"
@@ -33,6 +35,9 @@ var mainJS string
 //go:embed web/tag.js
 var tagJS string
 
+//go:embed web/trend.js
+var trendJS string
+
 const version = "2021.04"
 
 func (p *PLC) tagsIndexHTML(w http.ResponseWriter, r *http.Request) {
@@ -42,7 +47,7 @@ func (p *PLC) tagsIndexHTML(w http.ResponseWriter, r *http.Request) {
 
 	var toSend strings.Builder
 
-	toSend.WriteString("<!DOCTYPE html>\n<html><style>" + mainCSS + "</style><script>" + mainJS + "</script><title>" + p.Name + "</title><h3>" + p.Name + "</h3><p>Wersja biblioteki: " + version + "</p>\n<input type=checkbox id=showbtn name=showbtn><label for=showbtn>Pokaż wszystkie</label><table><tr><th>Nazwa</th><th>Rozmiar</th><th>Typ</th><th>Odczyt</th><th>ASCII</th></tr>\n")
+	toSend.WriteString("<!DOCTYPE html>\n<html><style>" + mainCSS + "</style><script>" + mainJS + "</script><title>" + p.Name + "</title><h3>" + p.Name + "</h3><p>Wersja biblioteki: " + version + "</p>\n" + iif(len(p.Alarms()) > 0, "<p><a href=\"/.alarms\">Alarmy</a></p>\n", "") + iif(p.auditEnabled(), "<p><a href=\"/.audit\">Dziennik zapisów</a></p>\n", "") + "<input type=checkbox id=showbtn name=showbtn><label for=showbtn>Pokaż wszystkie</label><table><tr><th>Nazwa</th><th>Rozmiar</th><th>Typ</th><th>Odczyt</th><th>ASCII</th></tr>\n")
 
 	p.tMut.RLock()
 	arr := make([]string, 0, len(p.tags))
@@ -109,7 +114,7 @@ type tagJSON struct {
 	ASCII []string  `json:"ascii,omitempty"`
 }
 
-func tagToJSON(t *Tag) string {
+func (p *PLC) tagToJSON(t *Tag) string {
 	var tj tagJSON
 	tj.Count = one(t.Dim[0])
 	ln := t.ElemLen()
@@ -157,7 +162,7 @@ func tagToJSON(t *Tag) string {
 
 	b, err := json.Marshal(tj)
 	if err != nil {
-		fmt.Println(err)
+		p.log(LevelError, "tag JSON", "tag", t.Name, "err", err)
 		return "{}"
 	}
 	return string(b)
@@ -277,12 +282,18 @@ func structToHTML(t *Tag, data []uint8, n int, N bool, prevName string, b *strin
 	}
 }
 
-func tagToHTML(t *Tag) string {
+func tagToHTML(t *Tag, hist []string) string {
 	var toSend strings.Builder
 
 	ln := t.ElemLen()
 
 	toSend.WriteString("<!DOCTYPE html>\n<html><style>" + mainCSS + "</style><script>" + tagJS + "</script><title>" + t.Name + "</title><a href=\"/#" + t.Name + "\">powrót</a> <a href=\"\">odśwież</a><h3>" + t.Name + "</h3>")
+	if len(hist) > 0 {
+		toSend.WriteString("<script>" + trendJS + "</script>")
+		for _, h := range hist {
+			toSend.WriteString("<h4>" + h + " <a href=\"/.history?format=csv&path=" + url.QueryEscape(h) + "\">CSV</a></h4><canvas class=trend data-path=\"" + html.EscapeString(h) + "\" width=800 height=200></canvas>\n")
+		}
+	}
 	if t.Type > TypeStructHead {
 		if t.Dim[0] > 0 {
 			toSend.WriteString("<h4>" + t.TypeString() + t.DimString() + "</h4><table><tr><th>N</th><th>Nazwa</th><th>Typ</th><th>Wartość</th></tr>")
@@ -395,6 +406,16 @@ func (p *PLC) handler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "image/vnd.microsoft.icon")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Write(p.favicon)
+	} else if r.URL.Path == "/.alarms" {
+		p.alarmsHTML(w, r)
+	} else if r.URL.Path == "/.audit" {
+		p.auditHTTP(w, r)
+	} else if r.URL.Path == "/metrics" {
+		p.metricsHTTP(w, r)
+	} else if r.URL.Path == "/.history" {
+		p.historyHTTP(w, r)
+	} else if r.URL.Path == "/.alarmAck" {
+		p.alarmAckHTTP(w, r)
 	} else if r.URL.Path == "/.tagSet" && r.Method == http.MethodPost {
 		w.Header().Set("Cache-Control", "no-store")
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -418,7 +439,9 @@ func (p *PLC) handler(w http.ResponseWriter, r *http.Request) {
 			arr[i] = byte(x)
 		}
 
-		ok := p.saveTag(pth, 0, 0, arr, 0)
+		p.lockTags()
+		ok := p.saveTag(pth, 0, 0, arr, 0, auditCtx{service: "tagSet", source: r.RemoteAddr})
+		p.unlockTags()
 
 		if ok {
 			io.WriteString(w, "ok")
@@ -432,14 +455,14 @@ func (p *PLC) handler(w http.ResponseWriter, r *http.Request) {
 		if ok {
 			_, json := r.URL.Query()["json"]
 			if json {
-				str := tagToJSON(t)
+				str := p.tagToJSON(t)
 				p.tMut.RUnlock()
 				w.Header().Set("Cache-Control", "no-store")
 				w.Header().Set("Content-Type", "application/json; charset=utf-8")
 				w.Header().Set("X-Content-Type-Options", "nosniff")
 				io.WriteString(w, str)
 			} else {
-				str := tagToHTML(t)
+				str := tagToHTML(t, p.historyPaths(t.Name))
 				p.tMut.RUnlock()
 				w.Header().Set("Cache-Control", "no-store")
 				w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -457,15 +480,16 @@ func (p *PLC) handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-var server *http.Server
-
-// ServeHTTP listens on the TCP network address host.
+// ServeHTTP listens on the TCP network address host. See also Options.HTTPAddr.
 func (p *PLC) ServeHTTP(host string) *http.Server {
-	server = &http.Server{Addr: host, Handler: http.HandlerFunc(p.handler)}
+	server := &http.Server{Addr: host, Handler: http.HandlerFunc(p.handler)}
+	p.servMut.Lock()
+	p.httpServ = server
+	p.servMut.Unlock()
 	go func() {
 		err := server.ListenAndServe()
 		if err != nil {
-			fmt.Println("plcconnector ServeHTTP: ", err)
+			p.log(LevelError, "ServeHTTP", "err", err)
 		}
 	}()
 	return server
@@ -473,11 +497,18 @@ func (p *PLC) ServeHTTP(host string) *http.Server {
 
 // CloseHTTP shutdowns the HTTP server
 func (p *PLC) CloseHTTP() error {
+	p.servMut.Lock()
+	server := p.httpServ
+	p.httpServ = nil
+	p.servMut.Unlock()
+	if server == nil {
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	var err error
 	if err = server.Shutdown(ctx); err != nil {
-		fmt.Println("plcconnector CloseHTTP: ", err)
+		p.log(LevelError, "CloseHTTP", "err", err)
 	}
 	p.debug("server.Shutdown")
 	return err
@@ -3,7 +3,6 @@ package plcconnector
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"os"
 	"strings"
 )
@@ -35,9 +34,13 @@ type jsTemplates struct {
 
 // JS .
 type JS struct {
-	AC        [5]int                 `json:"ac"`
-	Symbols   map[string]jsSymbols   `json:"symbols"`
-	Templates map[string]jsTemplates `json:"templates"`
+	AC         [5]int                 `json:"ac"`
+	Symbols    map[string]jsSymbols   `json:"symbols"`
+	Templates  map[string]jsTemplates `json:"templates"`
+	Simulation []jsGenerator          `json:"simulation,omitempty"`
+	Alarms     []jsAlarm              `json:"alarms,omitempty"`
+	History    *jsHistory             `json:"history,omitempty"`
+	Audit      *jsAudit               `json:"audit,omitempty"`
 }
 
 // ImportJSON .
@@ -114,6 +117,35 @@ func (p *PLC) ImportJSON(file string) error {
 	in.SetAttrDINT(10, int32(db.AC[4]))
 	p.Class[SymbolClass].inst[0].SetAttrUDINT(8, uint32(db.AC[2]))
 
+	if len(db.Simulation) > 0 {
+		err = p.importSimulation(db.Simulation)
+		if err != nil {
+			return err
+		}
+		p.StartSimulation()
+	}
+
+	if db.Audit != nil {
+		err = p.StartAudit(db.Audit.File, db.Audit.MaxSize, db.Audit.Keep)
+		if err != nil {
+			return err
+		}
+	}
+
+	if db.History != nil {
+		err = p.importHistory(db.History)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(db.Alarms) > 0 {
+		err = p.importAlarms(db.Alarms)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -144,9 +176,7 @@ func (p *PLC) ImportMemoryJSON(file string) error {
 		}
 		if c.Read {
 			if len(c.Rx) != len(tag.data) {
-				if p.Verbose {
-					fmt.Println(file, "data length mismatch", n)
-				}
+				p.debug("data length mismatch", "file", file, "tag", n)
 				continue
 				// return errors.New("data length mismatch " + n)
 			}
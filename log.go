@@ -0,0 +1,144 @@
+package plcconnector
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Level of a log message.
+type Level int
+
+// Log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL" + fmt.Sprint(int(l))
+}
+
+// Logger receives diagnostics of PLC and Client. kv holds alternating keys and values, e.g. "addr", "10.0.0.1:50000", "service", 0x4C.
+// Common keys are addr, session, service, class, instance, attr, status and err.
+// Debug messages are sent only if Verbose or DumpNetwork of PLC is enabled.
+type Logger interface {
+	Log(level Level, msg string, kv ...interface{})
+}
+
+// NopLogger discards all messages, it is the default Logger.
+type NopLogger struct{}
+
+// Log .
+func (NopLogger) Log(level Level, msg string, kv ...interface{}) {}
+
+// StdLogger writes messages of at least Level to the standard library logger, log.Default() if L is nil.
+type StdLogger struct {
+	L     *log.Logger
+	Level Level
+}
+
+// NewStdLogger returns Logger writing messages of level min and above to l.
+func NewStdLogger(l *log.Logger, min Level) *StdLogger {
+	return &StdLogger{L: l, Level: min}
+}
+
+// Log writes message as "LEVEL msg key=value ...".
+func (s *StdLogger) Log(level Level, msg string, kv ...interface{}) {
+	if level < s.Level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		fmt.Fprint(&b, kv[i])
+		b.WriteByte('=')
+		if i+1 < len(kv) {
+			v := kv[i+1]
+			if s, ok := v.(string); ok && strings.ContainsAny(s, " =\"") {
+				v = fmt.Sprintf("%q", s)
+			}
+			fmt.Fprint(&b, v)
+		}
+	}
+	l := s.L
+	if l == nil {
+		l = log.Default()
+	}
+	l.Output(2, b.String())
+}
+
+func logTo(l Logger, level Level, msg string, kv ...interface{}) {
+	if l != nil {
+		l.Log(level, msg, kv...)
+	}
+}
+
+func (p *PLC) log(level Level, msg string, kv ...interface{}) {
+	logTo(p.Logger, level, msg, kv...)
+}
+
+func (p *PLC) debug(msg string, kv ...interface{}) {
+	if p.Verbose {
+		logTo(p.Logger, LevelDebug, msg, kv...)
+	}
+}
+
+// log adds fields of the request.
+func (r *req) log(level Level, msg string, kv ...interface{}) {
+	if r.p.Logger == nil {
+		return
+	}
+	f := make([]interface{}, 0, len(kv)+12)
+	if r.addr != nil {
+		f = append(f, "addr", r.addr.String())
+	}
+	if r.encHead.SessionHandle != 0 {
+		f = append(f, "session", r.encHead.SessionHandle)
+	}
+	if r.protd.Service != 0 {
+		f = append(f, "service", fmt.Sprintf("0x%X", r.protd.Service))
+		if r.class > 0 {
+			f = append(f, "class", fmt.Sprintf("0x%X", r.class), "instance", r.instance, "attr", r.attr)
+		}
+	}
+	r.p.Logger.Log(level, msg, append(f, kv...)...)
+}
+
+// readErr logs error of reading the request, end of stream is expected when client disconnects.
+func (r *req) readErr(err error) {
+	if err == io.EOF {
+		r.debug("read", "err", err)
+	} else {
+		r.log(LevelWarn, "read", "err", err)
+	}
+}
+
+func (r *req) debug(msg string, kv ...interface{}) {
+	if r.p.Verbose {
+		r.log(LevelDebug, msg, kv...)
+	}
+}
+
+func (c *Client) log(level Level, msg string, kv ...interface{}) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Log(level, msg, append([]interface{}{"addr", c.host}, kv...)...)
+}
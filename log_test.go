@@ -0,0 +1,63 @@
+package plcconnector
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+type testLogger struct {
+	msgs []string
+}
+
+func (l *testLogger) Log(level Level, msg string, kv ...interface{}) {
+	var b bytes.Buffer
+	lg := NewStdLogger(log.New(&b, "", 0), LevelDebug)
+	lg.Log(level, msg, kv...)
+	l.msgs = append(l.msgs, strings.TrimSpace(b.String()))
+}
+
+func TestStdLogger(t *testing.T) {
+	tests := []struct {
+		name  string
+		level Level
+		msg   string
+		kv    []interface{}
+		want  string
+	}{
+		{"fields", LevelWarn, "read", []interface{}{"addr", "1.2.3.4:5", "err", errors.New("broken pipe")}, "WARN read addr=1.2.3.4:5 err=broken pipe\n"},
+		{"quoted", LevelError, "ST", []interface{}{"program", "a b"}, "ERROR ST program=\"a b\"\n"},
+		{"odd", LevelInfo, "ICO", []interface{}{"icons"}, "INFO ICO icons=\n"},
+		{"filtered", LevelDebug, "ReadTag", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			NewStdLogger(log.New(&b, "", 0), LevelInfo).Log(tt.level, tt.msg, tt.kv...)
+			if b.String() != tt.want {
+				t.Errorf("Log() = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	p := testSTPLC(t)
+	l := &testLogger{}
+	p.Logger = l
+	c := &testConn{req: testRRData([]uint8{0x77, 2, 0x20, 1, 0x24, 1}), n: 1}
+	p.handleRequest(c, nil)
+	want := "WARN unknown service addr=127.0.0.1:1234 session=1 service=0x77 class=0x1 instance=1 attr=-1"
+	if len(l.msgs) != 1 || l.msgs[0] != want {
+		t.Errorf("log %q, want %q", l.msgs, want)
+	}
+
+	l.msgs = nil
+	p.Verbose = true
+	p.handleRequest(&testConn{req: testRRData(testReadTagReq("a", 1)), n: 1}, nil)
+	if len(l.msgs) == 0 || !strings.HasPrefix(l.msgs[0], "DEBUG SendRRData/SendUnitData addr=127.0.0.1:1234 session=1") {
+		t.Errorf("verbose log %q", l.msgs)
+	}
+}
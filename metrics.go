@@ -0,0 +1,276 @@
+package plcconnector
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// latencyBuckets are upper bounds of the request latency histogram in seconds.
+var latencyBuckets = [...]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+
+// metricCommands are encapsulation commands counted separately, the rest is counted as other.
+var metricCommands = [...]uint16{cip.CommandNOP, cip.CommandListServices, cip.CommandListIdentity, cip.CommandListInterfaces, cip.CommandRegisterSession, cip.CommandUnRegisterSession, cip.CommandSendRRData, cip.CommandSendUnitData}
+
+var commandNames = [len(metricCommands) + 1]string{"NOP", "ListServices", "ListIdentity", "ListInterfaces", "RegisterSession", "UnRegisterSession", "SendRRData", "SendUnitData", "other"}
+
+func commandIndex(c uint16) int {
+	for i, x := range metricCommands {
+		if x == c {
+			return i
+		}
+	}
+	return len(metricCommands)
+}
+
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64 // last is +Inf
+	sum    uint64                          // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && s > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// metrics are updated atomically, all fields are 64-bit for alignment on 32-bit platforms.
+type metrics struct {
+	commands       [len(metricCommands) + 1]uint64
+	latency        [len(metricCommands) + 1]histogram
+	services       [256]uint64
+	statuses       [256]uint64
+	connsOpened    uint64
+	connsActive    int64
+	sessionsOpened uint64
+	sessionsActive int64
+	bytesIn        uint64
+	bytesOut       uint64
+	listIdentity   uint64
+}
+
+// tagStats counts accesses of the tag by clients.
+type tagStats struct {
+	reads  uint64
+	writes uint64
+}
+
+func (t *Tag) countRead() {
+	if t.stats != nil {
+		atomic.AddUint64(&t.stats.reads, 1)
+	}
+}
+
+func (t *Tag) countWrite() {
+	if t.stats != nil {
+		atomic.AddUint64(&t.stats.writes, 1)
+	}
+}
+
+// request counts encapsulation command with n bytes.
+func (m *metrics) request(command uint16, n int) {
+	atomic.AddUint64(&m.commands[commandIndex(command)], 1)
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+}
+
+// reply counts reply of n bytes to the command received at start.
+func (m *metrics) reply(command uint16, n int, start time.Time) {
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+	m.latency[commandIndex(command)].observe(time.Since(start))
+}
+
+// service runs serviceHandle and counts the service and the general status of its response.
+func (r *req) service() bool {
+	start := r.writeBuf.Len()
+	atomic.AddUint64(&r.p.met.services[r.protd.Service], 1)
+	ok := r.serviceHandle()
+	if b := r.writeBuf.Bytes(); len(b) > start+2 {
+		atomic.AddUint64(&r.p.met.statuses[b[start+2]], 1)
+	}
+	return ok
+}
+
+// Histogram of request latency.
+type Histogram struct {
+	Bounds []float64 // upper bounds of buckets in seconds
+	Counts []uint64  // cumulative count of requests in buckets
+	Count  uint64
+	Sum    time.Duration
+}
+
+// TagStats counts client reads and writes of the tag.
+type TagStats struct {
+	Reads  uint64
+	Writes uint64
+}
+
+// Stats is a snapshot of the server metrics.
+type Stats struct {
+	ConnsOpened     uint64
+	ConnsActive     int64
+	SessionsOpened  uint64
+	SessionsActive  int64
+	Commands        map[string]uint64    // requests by encapsulation command
+	Services        map[uint8]uint64     // CIP requests by service code, services of MultipleServicePacket included
+	Statuses        map[uint8]uint64     // CIP responses by general status
+	BytesIn         uint64               // received encapsulation bytes
+	BytesOut        uint64               // sent encapsulation bytes
+	Latency         map[string]Histogram // by encapsulation command
+	Tags            map[string]TagStats  // tags read or written by clients
+	ListIdentityUDP uint64
+}
+
+// Stats returns snapshot of the server metrics.
+func (p *PLC) Stats() Stats {
+	m := &p.met
+	s := Stats{
+		ConnsOpened:     atomic.LoadUint64(&m.connsOpened),
+		ConnsActive:     atomic.LoadInt64(&m.connsActive),
+		SessionsOpened:  atomic.LoadUint64(&m.sessionsOpened),
+		SessionsActive:  atomic.LoadInt64(&m.sessionsActive),
+		Commands:        make(map[string]uint64),
+		Services:        make(map[uint8]uint64),
+		Statuses:        make(map[uint8]uint64),
+		BytesIn:         atomic.LoadUint64(&m.bytesIn),
+		BytesOut:        atomic.LoadUint64(&m.bytesOut),
+		Latency:         make(map[string]Histogram),
+		Tags:            make(map[string]TagStats),
+		ListIdentityUDP: atomic.LoadUint64(&m.listIdentity),
+	}
+	for i := range m.commands {
+		if n := atomic.LoadUint64(&m.commands[i]); n > 0 {
+			s.Commands[commandNames[i]] = n
+		}
+		h := &m.latency[i]
+		var hs Histogram
+		for j := range h.counts {
+			hs.Count += atomic.LoadUint64(&h.counts[j])
+			if j < len(latencyBuckets) {
+				hs.Bounds = append(hs.Bounds, latencyBuckets[j])
+				hs.Counts = append(hs.Counts, hs.Count)
+			}
+		}
+		if hs.Count > 0 {
+			hs.Sum = time.Duration(atomic.LoadUint64(&h.sum))
+			s.Latency[commandNames[i]] = hs
+		}
+	}
+	for i := range m.services {
+		if n := atomic.LoadUint64(&m.services[i]); n > 0 {
+			s.Services[uint8(i)] = n
+		}
+		if n := atomic.LoadUint64(&m.statuses[i]); n > 0 {
+			s.Statuses[uint8(i)] = n
+		}
+	}
+	p.tMut.RLock()
+	for _, t := range p.tags {
+		if t.stats == nil {
+			continue
+		}
+		ts := TagStats{Reads: atomic.LoadUint64(&t.stats.reads), Writes: atomic.LoadUint64(&t.stats.writes)}
+		if ts.Reads > 0 || ts.Writes > 0 {
+			s.Tags[t.Name] = ts
+		}
+	}
+	p.tMut.RUnlock()
+	return s
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]uint64) []string {
+	k := make([]string, 0, len(m))
+	for x := range m {
+		k = append(k, x)
+	}
+	sort.Strings(k)
+	return k
+}
+
+// writeMetrics writes stats in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, s Stats) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("plcconnector_connections_opened_total", "counter", "TCP connections accepted.")
+	fmt.Fprintln(w, "plcconnector_connections_opened_total", s.ConnsOpened)
+	metric("plcconnector_connections_active", "gauge", "Open TCP connections.")
+	fmt.Fprintln(w, "plcconnector_connections_active", s.ConnsActive)
+	metric("plcconnector_sessions_opened_total", "counter", "Registered sessions.")
+	fmt.Fprintln(w, "plcconnector_sessions_opened_total", s.SessionsOpened)
+	metric("plcconnector_sessions_active", "gauge", "Registered sessions not closed yet.")
+	fmt.Fprintln(w, "plcconnector_sessions_active", s.SessionsActive)
+
+	metric("plcconnector_requests_total", "counter", "Encapsulation requests by command.")
+	for _, c := range sortedKeys(s.Commands) {
+		fmt.Fprintf(w, "plcconnector_requests_total{command=%q} %d\n", c, s.Commands[c])
+	}
+	metric("plcconnector_cip_requests_total", "counter", "CIP requests by service code.")
+	for i := 0; i < 256; i++ {
+		if n, ok := s.Services[uint8(i)]; ok {
+			fmt.Fprintf(w, "plcconnector_cip_requests_total{service=\"0x%02X\"} %d\n", i, n)
+		}
+	}
+	metric("plcconnector_cip_responses_total", "counter", "CIP responses by general status.")
+	for i := 0; i < 256; i++ {
+		if n, ok := s.Statuses[uint8(i)]; ok {
+			fmt.Fprintf(w, "plcconnector_cip_responses_total{status=\"0x%02X\"} %d\n", i, n)
+		}
+	}
+
+	metric("plcconnector_received_bytes_total", "counter", "Received encapsulation bytes.")
+	fmt.Fprintln(w, "plcconnector_received_bytes_total", s.BytesIn)
+	metric("plcconnector_sent_bytes_total", "counter", "Sent encapsulation bytes.")
+	fmt.Fprintln(w, "plcconnector_sent_bytes_total", s.BytesOut)
+
+	metric("plcconnector_request_duration_seconds", "histogram", "Time from receiving request header to sending reply.")
+	var cmds []string
+	for c := range s.Latency {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	for _, c := range cmds {
+		h := s.Latency[c]
+		for i, b := range h.Bounds {
+			fmt.Fprintf(w, "plcconnector_request_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n", c, b, h.Counts[i])
+		}
+		fmt.Fprintf(w, "plcconnector_request_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", c, h.Count)
+		fmt.Fprintf(w, "plcconnector_request_duration_seconds_sum{command=%q} %g\n", c, h.Sum.Seconds())
+		fmt.Fprintf(w, "plcconnector_request_duration_seconds_count{command=%q} %d\n", c, h.Count)
+	}
+
+	var tags []string
+	for t := range s.Tags {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	metric("plcconnector_tag_reads_total", "counter", "Client reads of the tag.")
+	for _, t := range tags {
+		fmt.Fprintf(w, "plcconnector_tag_reads_total{tag=\"%s\"} %d\n", labelEscaper.Replace(t), s.Tags[t].Reads)
+	}
+	metric("plcconnector_tag_writes_total", "counter", "Client writes of the tag.")
+	for _, t := range tags {
+		fmt.Fprintf(w, "plcconnector_tag_writes_total{tag=\"%s\"} %d\n", labelEscaper.Replace(t), s.Tags[t].Writes)
+	}
+
+	metric("plcconnector_udp_list_identity_total", "counter", "ListIdentity requests received over UDP.")
+	fmt.Fprintln(w, "plcconnector_udp_list_identity_total", s.ListIdentityUDP)
+}
+
+func (p *PLC) metricsHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeMetrics(w, p.Stats())
+}
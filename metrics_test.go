@@ -0,0 +1,79 @@
+package plcconnector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+func TestStats(t *testing.T) {
+	p := testSTPLC(t)
+	reg := cip.EncapsulationHeader{Command: cip.CommandRegisterSession, Length: 4}
+	req := appendUDINT(reg.AppendTo(nil), 1)
+	req = append(req, testRRData(testReadTagReq("arr", 1))...)
+	req = append(req, testRRData(testMultiServReq(testReadTagReq("a", 1), testReadTagReq("none", 1)))...)
+	p.handleRequest(&testConn{req: req, n: 1}, nil)
+
+	s := p.Stats()
+	if s.ConnsOpened != 1 || s.ConnsActive != 0 || s.SessionsOpened != 1 || s.SessionsActive != 0 {
+		t.Errorf("connections %+v", s)
+	}
+	if s.Commands["RegisterSession"] != 1 || s.Commands["SendRRData"] != 2 {
+		t.Errorf("Commands %v", s.Commands)
+	}
+	if s.Services[ReadTag] != 3 || s.Services[MultiServ] != 1 {
+		t.Errorf("Services %v", s.Services)
+	}
+	if s.Statuses[Success] != 3 || s.Statuses[PathSegmentError] != 1 {
+		t.Errorf("Statuses %v", s.Statuses)
+	}
+	if s.BytesIn != uint64(len(req)) || s.BytesOut == 0 {
+		t.Errorf("bytes %d %d", s.BytesIn, s.BytesOut)
+	}
+	if h := s.Latency["SendRRData"]; h.Count != 2 || h.Counts[len(h.Counts)-1] > 2 || h.Sum <= 0 {
+		t.Errorf("Latency %+v", h)
+	}
+	if s.Tags["arr"] != (TagStats{Reads: 1}) || s.Tags["a"] != (TagStats{Reads: 1}) || len(s.Tags) != 2 {
+		t.Errorf("Tags %v", s.Tags)
+	}
+
+	p.lockTags()
+	p.saveTag(parsePath("a"), 0, 0, []uint8{1, 0, 0, 0}, 0, auditCtx{})
+	p.unlockTags()
+	if s = p.Stats(); s.Tags["a"] != (TagStats{Reads: 1, Writes: 1}) {
+		t.Errorf("Tags %v", s.Tags)
+	}
+}
+
+func TestMetricsHTTP(t *testing.T) {
+	p := testSTPLC(t)
+	p.handleRequest(&testConn{req: testRRData(testReadTagReq("arr", 1)), n: 3}, nil)
+	p.met.latency[commandIndex(cip.CommandSendRRData)].observe(2 * time.Second)
+
+	w := httptest.NewRecorder()
+	p.handler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error("Content-Type", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE plcconnector_requests_total counter\n",
+		"plcconnector_connections_opened_total 1\n",
+		`plcconnector_requests_total{command="SendRRData"} 3` + "\n",
+		`plcconnector_cip_requests_total{service="0x4C"} 3` + "\n",
+		`plcconnector_cip_responses_total{status="0x00"} 3` + "\n",
+		`plcconnector_request_duration_seconds_bucket{command="SendRRData",le="1"} 3` + "\n",
+		`plcconnector_request_duration_seconds_bucket{command="SendRRData",le="+Inf"} 4` + "\n",
+		`plcconnector_request_duration_seconds_count{command="SendRRData"} 4` + "\n",
+		`plcconnector_tag_reads_total{tag="arr"} 3` + "\n",
+		"plcconnector_udp_list_identity_total 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package plcconnector
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errServerClosed = errors.New("server closed")
+
+// Options of ServeContext.
+type Options struct {
+	Addr            string        // EtherNet/IP TCP address, ":44818" if empty
+	UDPAddr         string        // ListIdentity UDP address, host of Addr and bound TCP port if empty
+	NoUDP           bool          // disables UDP listener
+	HTTPAddr        string        // web interface address, disabled if empty
+	ShutdownTimeout time.Duration // time for active sessions to finish, 5 s if zero
+}
+
+// Server is a running EtherNet/IP server started by ServeContext.
+type Server struct {
+	p      *PLC
+	opt    Options
+	port   uint16
+	tcp    net.Listener
+	udp    *net.UDPConn
+	http   *http.Server
+	httpLn net.Listener
+	cancel context.CancelFunc
+	done   chan struct{}
+	loops  sync.WaitGroup // listeners
+	wg     sync.WaitGroup // sessions and UDP requests
+
+	m       sync.Mutex
+	closing bool
+	conns   map[net.Conn]struct{}
+	err     error
+}
+
+// ServeContext binds TCP, UDP and optional HTTP listeners and serves them in background until ctx is done.
+// Bind errors are returned immediately. On shutdown active sessions finish the current request within ShutdownTimeout and are closed.
+func (p *PLC) ServeContext(ctx context.Context, opt Options) (*Server, error) {
+	if opt.Addr == "" {
+		opt.Addr = ":44818"
+	}
+	if opt.ShutdownTimeout <= 0 {
+		opt.ShutdownTimeout = 5 * time.Second
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	s := &Server{p: p, opt: opt, done: make(chan struct{}), conns: make(map[net.Conn]struct{})}
+	sock := net.ListenConfig{Control: sockControl(p.Logger)}
+	ln, err := sock.Listen(ctx, "tcp", opt.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s.tcp = ln
+	s.port = uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	if !opt.NoUDP {
+		host := opt.UDPAddr
+		if host == "" {
+			h, _, _ := net.SplitHostPort(opt.Addr)
+			host = net.JoinHostPort(h, strconv.Itoa(int(s.port)))
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp4", host)
+		if err == nil {
+			s.udp, err = net.ListenUDP("udp4", udpAddr)
+		}
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+	}
+
+	if opt.HTTPAddr != "" {
+		s.httpLn, err = net.Listen("tcp", opt.HTTPAddr)
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+		s.http = &http.Server{Handler: http.HandlerFunc(p.handler)}
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.loops.Add(1)
+	go s.serveTCP()
+	if s.udp != nil {
+		s.loops.Add(1)
+		go s.serveUDP()
+	}
+	if s.http != nil {
+		s.loops.Add(1)
+		go func() {
+			defer s.loops.Done()
+			if err := s.http.Serve(s.httpLn); err != http.ErrServerClosed {
+				s.fail(err)
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		s.shutdown()
+	}()
+	return s, nil
+}
+
+// Addr returns bound TCP address.
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// UDPAddr returns bound UDP address or nil.
+func (s *Server) UDPAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// HTTPAddr returns bound HTTP address or nil.
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpLn == nil {
+		return nil
+	}
+	return s.httpLn.Addr()
+}
+
+// Wait blocks until the server is shut down and returns the error which stopped it, nil if the context was done.
+func (s *Server) Wait() error {
+	<-s.done
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+// Close shutdowns the server and waits for it.
+func (s *Server) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+func (s *Server) fail(err error) {
+	s.m.Lock()
+	if s.err == nil && !s.closing {
+		s.err = err
+	}
+	s.m.Unlock()
+	s.cancel()
+}
+
+func (s *Server) closeListeners() {
+	s.tcp.Close()
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.httpLn != nil {
+		s.httpLn.Close()
+	}
+}
+
+// begin registers session or UDP request, false if server is shutting down.
+func (s *Server) begin(conn net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closing {
+		return false
+	}
+	s.wg.Add(1)
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (s *Server) end(conn net.Conn) {
+	if conn != nil {
+		s.m.Lock()
+		delete(s.conns, conn)
+		s.m.Unlock()
+	}
+	s.wg.Done()
+}
+
+// deadline sets read deadline of the session, s may be nil.
+func (s *Server) deadline(conn net.Conn, t time.Time) error {
+	if s == nil {
+		return conn.SetReadDeadline(t)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closing {
+		return errServerClosed
+	}
+	return conn.SetReadDeadline(t)
+}
+
+func (s *Server) serveTCP() {
+	defer s.loops.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if !s.begin(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.end(conn)
+			s.p.handleRequest(conn, s)
+		}()
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.loops.Done()
+	buffer := make([]byte, 0x8000)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buffer)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if !s.begin(nil) {
+			return
+		}
+		go func(dt []byte) {
+			defer s.end(nil)
+			s.p.handleUDPRequest(s.udp, dt, addr, s.port)
+		}(append([]byte(nil), buffer[:n]...))
+	}
+}
+
+func (s *Server) shutdown() {
+	s.m.Lock()
+	s.closing = true
+	now := time.Now()
+	for c := range s.conns {
+		c.SetReadDeadline(now) // idle sessions stop waiting for the next request
+	}
+	s.m.Unlock()
+	s.closeListeners()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opt.ShutdownTimeout)
+	defer cancel()
+	if s.http != nil && s.http.Shutdown(ctx) != nil {
+		s.http.Close()
+	}
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.m.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.m.Unlock()
+		<-drained
+	}
+	s.loops.Wait()
+	s.p.debug("Serve shutdown", "addr", s.Addr().String())
+	close(s.done)
+}
@@ -0,0 +1,153 @@
+package plcconnector
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+func testRegisterSession(t *testing.T, conn net.Conn) {
+	h := cip.EncapsulationHeader{Command: cip.CommandRegisterSession, Length: 4}
+	_, err := conn.Write(appendUDINT(h.AppendTo(nil), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]uint8, cip.EncapsulationHeaderLen+4)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Unmarshal(b)
+	if h.Command != cip.CommandRegisterSession || h.Status != 0 || h.SessionHandle == 0 {
+		t.Fatalf("RegisterSession reply %+v", h)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var srvs []*Server
+	for i := 0; i < 2; i++ {
+		p, err := Init("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := p.ServeContext(ctx, Options{Addr: "127.0.0.1:0", HTTPAddr: "127.0.0.1:0", ShutdownTimeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvs = append(srvs, s)
+	}
+	if srvs[0].Addr().String() == srvs[1].Addr().String() {
+		t.Fatal("same address", srvs[0].Addr())
+	}
+
+	_, err := srvs[0].p.ServeContext(ctx, Options{Addr: srvs[0].Addr().String()})
+	if err == nil {
+		t.Error("bind error not reported")
+	}
+
+	var conns []net.Conn
+	for _, s := range srvs {
+		if s.UDPAddr().(*net.UDPAddr).Port != s.Addr().(*net.TCPAddr).Port {
+			t.Error("UDP port differs", s.UDPAddr(), s.Addr())
+		}
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		testRegisterSession(t, conn)
+		conns = append(conns, conn)
+
+		uc, err := net.Dial("udp", s.UDPAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uc.Close()
+		h := cip.EncapsulationHeader{Command: cip.CommandListIdentity}
+		uc.Write(h.AppendTo(nil))
+		uc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b := make([]uint8, 512)
+		n, err := uc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Unmarshal(b[:n])
+		if h.Command != cip.CommandListIdentity || int(h.Length) != n-cip.EncapsulationHeaderLen {
+			t.Errorf("ListIdentity reply %+v", h)
+		}
+		if n := s.p.Stats().ListIdentityUDP; n != 1 {
+			t.Error("ListIdentityUDP", n)
+		}
+
+		resp, err := http.Get("http://" + s.HTTPAddr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	start := time.Now()
+	if err := srvs[0].Close(); err != nil {
+		t.Error(err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Error("idle session not drained, shutdown took", d)
+	}
+	conns[0].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conns[0].Read(make([]uint8, 1)); err != io.EOF {
+		t.Error("session not closed:", err)
+	}
+	if _, err := net.Dial("tcp", srvs[0].Addr().String()); err == nil {
+		t.Error("listener not closed")
+	}
+
+	// the other instance keeps serving
+	testRegisterSession(t, conns[1])
+
+	cancel()
+	if err := srvs[1].Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		p, err := Init("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Serve("127.0.0.1:0")
+		}()
+		p.Close() // before, while or after binding
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve not stopped by Close")
+		}
+	}
+}
+
+func TestCloseWithoutServe(t *testing.T) {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if err := p.CloseHTTP(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,386 @@
+package plcconnector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// ClientState is the state of the client connection reported to StateChange.
+type ClientState int
+
+// Client states
+const (
+	ClientConnected    ClientState = iota // session registered
+	ClientDisconnected                    // connection lost, reconnecting in the background
+	ClientClosed                          // closed by Close
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientConnected:
+		return "connected"
+	case ClientDisconnected:
+		return "disconnected"
+	case ClientClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+var (
+	errClientClosed = errors.New("client closed")
+	errNotConnected = errors.New("not connected")
+	errTimeout      = fmt.Errorf("request timed out: %w", context.DeadlineExceeded)
+	errSessionLost  = errors.New("session lost")
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	minBackoff  = 100 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+// session is the TCP connection with registered encapsulation session, replies are matched to requests by SenderContext.
+type session struct {
+	cl      *Client
+	c       net.Conn
+	handle  uint32
+	wm      sync.Mutex // frames are written whole
+	m       sync.Mutex
+	context uint64
+	pending map[uint64]chan cip.Encapsulation
+	err     error // set when the connection is lost
+	once    sync.Once
+	cerr    error // of closing the socket
+}
+
+// dial connects to the host and registers the session.
+func (c *Client) dial(ctx context.Context) (*session, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp4", c.host)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{cl: c, c: conn, pending: make(map[uint64]chan cip.Encapsulation)}
+	go c.readLoop(s)
+
+	err = s.register(ctx)
+	if err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// register checks the encapsulation support and registers the session.
+func (s *session) register(ctx context.Context) error {
+	e, err := s.exchange(ctx, cip.CommandListServices, nil)
+	if err != nil {
+		return err
+	}
+	var (
+		it cip.Item
+		ls cip.ListServices
+	)
+	if len(e.Data) < 2 {
+		return cip.ErrShort
+	}
+	_, err = it.Unmarshal(e.Data[2:])
+	if err != nil {
+		return err
+	}
+	err = ls.Unmarshal(it.Data)
+	if err != nil {
+		return err
+	}
+	if ls.Name == "" || ls.Name[0] != 'C' || ls.CapabilityFlags&cip.CapabilityTCP == 0 {
+		return errors.New("tcp encapsulation not supported")
+	}
+
+	rs := cip.RegisterSession{ProtocolVersion: 1}
+	e, err = s.exchange(ctx, cip.CommandRegisterSession, rs.Marshal())
+	if err != nil {
+		return err
+	}
+	err = rs.Unmarshal(e.Data)
+	if err != nil {
+		return err
+	}
+	if rs.ProtocolVersion != 1 {
+		return errors.New("unsupported protocol version")
+	}
+	s.handle = e.SessionHandle
+	return nil
+}
+
+// exchange sends the command and waits for the reply until ctx is done.
+func (s *session) exchange(ctx context.Context, command uint16, data []uint8) (cip.Encapsulation, error) {
+	if err := ctx.Err(); err != nil { // not sent, the session is kept
+		return cip.Encapsulation{}, ctxError(err)
+	}
+	ch := make(chan cip.Encapsulation, 1)
+	s.m.Lock()
+	if s.err != nil {
+		s.m.Unlock()
+		return cip.Encapsulation{}, errSessionLost
+	}
+	s.context++
+	id := s.context
+	s.pending[id] = ch
+	s.m.Unlock()
+
+	e := cip.Encapsulation{
+		EncapsulationHeader: cip.EncapsulationHeader{
+			Command:       command,
+			SessionHandle: s.handle,
+			SenderContext: id,
+		},
+		Data: data,
+	}
+	b, err := e.AppendTo(nil)
+	if err != nil {
+		s.remove(id)
+		return e, err
+	}
+	deadline, _ := ctx.Deadline()
+	s.wm.Lock()
+	s.c.SetWriteDeadline(deadline)
+	_, err = s.c.Write(b)
+	s.wm.Unlock()
+	s.captureFrame(b, true)
+	if err != nil {
+		s.remove(id)
+		s.fail(err)
+		return e, err
+	}
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return e, s.err
+		}
+		if r.Status != cip.EncapSuccess {
+			return r, fmt.Errorf("encapsulation status 0x%X", r.Status)
+		}
+		return r, nil
+	case <-ctx.Done():
+		s.remove(id)
+		return e, ctxError(ctx.Err())
+	}
+}
+
+func (s *session) remove(id uint64) {
+	s.m.Lock()
+	delete(s.pending, id)
+	s.m.Unlock()
+}
+
+// fail closes the connection and the pending requests.
+func (s *session) fail(err error) {
+	s.m.Lock()
+	if s.err == nil {
+		s.err = err
+		for _, ch := range s.pending {
+			close(ch)
+		}
+		s.pending = nil
+	}
+	s.m.Unlock()
+	s.close()
+}
+
+// close closes the socket once, by Close or by the read loop on the lost connection.
+func (s *session) close() error {
+	s.once.Do(func() {
+		s.cerr = s.c.Close()
+	})
+	return s.cerr
+}
+
+// readLoop reads replies and passes them to the requests until the connection is lost.
+func (c *Client) readLoop(s *session) {
+	rd := bufio.NewReader(s.c)
+	for {
+		var (
+			h [cip.EncapsulationHeaderLen]uint8
+			e cip.Encapsulation
+		)
+		_, err := io.ReadFull(rd, h[:])
+		if err == nil {
+			e.EncapsulationHeader.Unmarshal(h[:])
+			b := make([]uint8, len(h)+int(e.Length))
+			copy(b, h[:])
+			_, err = io.ReadFull(rd, b[len(h):])
+			e.Data = b[len(h):]
+			if err == nil {
+				s.captureFrame(b, false)
+			}
+		}
+		if err != nil {
+			s.fail(err)
+			c.lost(s, err)
+			return
+		}
+		s.m.Lock()
+		ch, ok := s.pending[e.SenderContext]
+		delete(s.pending, e.SenderContext)
+		s.m.Unlock()
+		if ok {
+			ch <- e
+		} else {
+			c.log(LevelDebug, "unexpected reply", "context", e.SenderContext)
+		}
+	}
+}
+
+// lost starts reconnecting if s is the current session.
+func (c *Client) lost(s *session, err error) {
+	c.mu.Lock()
+	if c.s != s {
+		c.mu.Unlock()
+		return
+	}
+	c.s = nil
+	c.ready = make(chan struct{})
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.log(LevelWarn, "connection lost", "err", err)
+	c.stateChange(ClientDisconnected, err)
+	go c.reconnect()
+}
+
+// reconnect connects again with exponential backoff and reopens the connection opened by OpenConnection.
+func (c *Client) reconnect() {
+	backoff := minBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+		s, err := c.dial(ctx)
+		cancel()
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				s.fail(errClientClosed)
+				return
+			}
+			c.s = s
+			close(c.ready)
+			c.mu.Unlock()
+			c.log(LevelInfo, "reconnected")
+			if cn := c.connection(); cn != nil {
+				if err = c.reopen(context.Background(), cn); err != nil {
+					c.log(LevelWarn, "forward open", "err", err)
+				}
+			}
+			c.stateChange(ClientConnected, nil)
+			return
+		}
+		c.log(LevelDebug, "reconnect", "err", err, "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-c.closing:
+			return
+		}
+		backoff *= 2
+		max := c.MaxBackoff
+		if max <= 0 {
+			max = maxBackoff
+		}
+		if backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// session returns the current session, waiting for the reconnection until ctx is done.
+func (c *Client) session(ctx context.Context) (*session, error) {
+	for {
+		c.mu.Lock()
+		s, ready, closed := c.s, c.ready, c.closed
+		c.mu.Unlock()
+		if closed {
+			return nil, errClientClosed
+		}
+		if s != nil {
+			return s, nil
+		}
+		select {
+		case <-ready:
+		case <-c.closing:
+			return nil, errClientClosed
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v: %w", errNotConnected, ctx.Err())
+		}
+	}
+}
+
+// exchange sends the command in the current session, at most Pipeline requests wait for replies at once.
+// The request times out after Timeout unless ctx is done earlier.
+func (c *Client) exchange(ctx context.Context, command uint16, data []uint8) (cip.Encapsulation, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	slots := c.slots()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return cip.Encapsulation{}, ctxError(ctx.Err())
+	}
+	defer func() { <-slots }()
+
+	for {
+		s, err := c.session(ctx)
+		if err != nil {
+			return cip.Encapsulation{}, err
+		}
+		e, err := s.exchange(ctx, command, data)
+		if err == errSessionLost { // not sent
+			c.lost(s, err)
+			continue
+		}
+		return e, err
+	}
+}
+
+// ctxError returns errTimeout for the expired deadline.
+func ctxError(err error) error {
+	if err == context.DeadlineExceeded {
+		return errTimeout
+	}
+	return err
+}
+
+// slots returns the semaphore of Pipeline requests, replaced if Pipeline was changed.
+func (c *Client) slots() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.Pipeline
+	if n < 1 {
+		n = 1
+	}
+	if cap(c.sem) != n {
+		c.sem = make(chan struct{}, n)
+	}
+	return c.sem
+}
+
+func (c *Client) timeout() time.Duration {
+	return time.Duration(c.Timeout) * time.Second
+}
+
+func (c *Client) stateChange(state ClientState, err error) {
+	if c.StateChange != nil {
+		c.StateChange(state, err)
+	}
+}
@@ -0,0 +1,361 @@
+package plcconnector
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Generator types
+const (
+	GenRamp    = "ramp"    // Offset .. Offset+Amplitude sawtooth with Period
+	GenSine    = "sine"    // Offset + Amplitude*sin with Period
+	GenSquare  = "square"  // Offset and Offset+Amplitude, each for half of Period
+	GenRandom  = "random"  // random walk by Step, limited to Offset±Amplitude if Amplitude != 0
+	GenCounter = "counter" // Offset + n*Step, wraps at Offset+Amplitude if Amplitude != 0
+	GenCSV     = "csv"     // replay of File: rows "value" each held for Period or "seconds,value"
+	GenStep    = "step"    // Values each held for Period
+)
+
+const simResolution = 10 * time.Millisecond
+
+// Generator describes simulated value of numeric tag or member path.
+type Generator struct {
+	Path      string
+	Type      string
+	Period    time.Duration
+	Interval  time.Duration // update interval, default 100 ms
+	Amplitude float64
+	Offset    float64
+	Noise     float64 // standard deviation of gaussian noise
+	Step      float64
+	File      string
+	Values    []float64
+	Paused    bool
+}
+
+type simGen struct {
+	Generator
+	path  []pathEl
+	start time.Time
+	last  time.Time
+	val   float64
+	times []float64
+}
+
+type simulation struct {
+	gens    map[string]*simGen
+	m       sync.Mutex
+	paused  bool
+	running bool
+	stop    chan struct{}
+}
+
+func loadCSVGen(g *simGen) error {
+	f, err := os.Open(g.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := csv.NewReader(f)
+	rd.FieldsPerRecord = -1
+	rd.Comment = '#'
+	rows, err := rd.ReadAll()
+	if err != nil {
+		return err
+	}
+	g.Values = g.Values[:0]
+	for i, r := range rows {
+		if len(r) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(r[len(r)-1]), 64)
+		if err != nil {
+			if i == 0 { // header
+				continue
+			}
+			return fmt.Errorf("%s:%d: %w", g.File, i+1, err)
+		}
+		if len(r) > 1 {
+			t, err := strconv.ParseFloat(strings.TrimSpace(r[0]), 64)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", g.File, i+1, err)
+			}
+			g.times = append(g.times, t)
+		}
+		g.Values = append(g.Values, v)
+	}
+	if len(g.Values) == 0 {
+		return errors.New(g.File + ": no values")
+	}
+	if g.times != nil && len(g.times) != len(g.Values) {
+		return errors.New(g.File + ": mixed rows with and without time")
+	}
+	return nil
+}
+
+func (g *simGen) hold(e float64) float64 {
+	per := g.Period.Seconds()
+	if per <= 0 {
+		per = g.Interval.Seconds()
+	}
+	return g.Values[int(e/per)%len(g.Values)]
+}
+
+func (g *simGen) value(now time.Time) float64 {
+	e := now.Sub(g.start).Seconds()
+	phase := 0.0
+	if g.Period > 0 {
+		phase = math.Mod(e, g.Period.Seconds()) / g.Period.Seconds()
+	}
+	var v float64
+	switch g.Type {
+	case GenRamp:
+		v = g.Offset + g.Amplitude*phase
+	case GenSine:
+		v = g.Offset + g.Amplitude*math.Sin(2*math.Pi*phase)
+	case GenSquare:
+		v = g.Offset
+		if phase < 0.5 {
+			v += g.Amplitude
+		}
+	case GenRandom:
+		g.val += (rand.Float64()*2 - 1) * g.Step
+		if g.Amplitude != 0 {
+			g.val = math.Max(-math.Abs(g.Amplitude), math.Min(math.Abs(g.Amplitude), g.val))
+		}
+		v = g.Offset + g.val
+	case GenCounter:
+		g.val += g.Step
+		if g.Amplitude != 0 && math.Abs(g.val) > math.Abs(g.Amplitude) {
+			g.val = 0
+		}
+		v = g.Offset + g.val
+	case GenCSV:
+		if g.times != nil {
+			end := g.times[len(g.times)-1]
+			if g.Period > 0 {
+				end = g.Period.Seconds()
+			}
+			if end > 0 {
+				e = math.Mod(e, end)
+			}
+			i := sort.SearchFloat64s(g.times, e)
+			if i == len(g.times) || (i > 0 && g.times[i] > e) {
+				i--
+			}
+			v = g.Values[i]
+		} else {
+			v = g.hold(e)
+		}
+		v = g.Offset + v
+	case GenStep:
+		v = g.Offset + g.hold(e)
+	}
+	if g.Noise != 0 {
+		v += rand.NormFloat64() * g.Noise
+	}
+	return v
+}
+
+func (p *PLC) newSimGen(g Generator) (*simGen, error) {
+	sg := &simGen{Generator: g}
+	sg.path = parsePath(g.Path)
+	if sg.path == nil {
+		return nil, errors.New("generator " + g.Path + ": " + errPath.Error())
+	}
+	if sg.Interval <= 0 {
+		sg.Interval = 100 * time.Millisecond
+	}
+	switch g.Type {
+	case GenRamp, GenSine, GenSquare:
+		if g.Period <= 0 {
+			return nil, errors.New("generator " + g.Path + ": period required")
+		}
+	case GenRandom, GenCounter:
+		if sg.Step == 0 {
+			sg.Step = 1
+		}
+	case GenCSV:
+		if err := loadCSVGen(sg); err != nil {
+			return nil, errors.New("generator " + g.Path + ": " + err.Error())
+		}
+	case GenStep:
+		if len(g.Values) == 0 {
+			return nil, errors.New("generator " + g.Path + ": values required")
+		}
+		sg.Values = append([]float64(nil), g.Values...)
+	default:
+		return nil, errors.New("generator " + g.Path + ": unknown type " + g.Type)
+	}
+	p.tMut.RLock()
+	_, _, err := p.readNum(sg.path)
+	p.tMut.RUnlock()
+	if err != nil {
+		return nil, errors.New("generator " + g.Path + ": " + err.Error())
+	}
+	return sg, nil
+}
+
+// AddGenerator attaches generator to the tag or member path, replacing previous one.
+func (p *PLC) AddGenerator(g Generator) error {
+	sg, err := p.newSimGen(g)
+	if err != nil {
+		return err
+	}
+	s := &p.sim
+	s.m.Lock()
+	if s.gens == nil {
+		s.gens = make(map[string]*simGen)
+	}
+	sg.start = time.Now()
+	s.gens[strings.ToLower(g.Path)] = sg
+	s.m.Unlock()
+	return nil
+}
+
+// RemoveGenerator detaches generator from the path.
+func (p *PLC) RemoveGenerator(path string) {
+	p.sim.m.Lock()
+	delete(p.sim.gens, strings.ToLower(path))
+	p.sim.m.Unlock()
+}
+
+// Generators returns list of attached generators.
+func (p *PLC) Generators() []Generator {
+	p.sim.m.Lock()
+	defer p.sim.m.Unlock()
+	r := make([]Generator, 0, len(p.sim.gens))
+	for _, g := range p.sim.gens {
+		r = append(r, g.Generator)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Path < r[j].Path })
+	return r
+}
+
+// PauseGenerator pauses or resumes single generator.
+func (p *PLC) PauseGenerator(path string, pause bool) bool {
+	p.sim.m.Lock()
+	defer p.sim.m.Unlock()
+	g, ok := p.sim.gens[strings.ToLower(path)]
+	if ok {
+		g.Paused = pause
+	}
+	return ok
+}
+
+// PauseSimulation pauses or resumes all generators.
+func (p *PLC) PauseSimulation(pause bool) {
+	p.sim.m.Lock()
+	p.sim.paused = pause
+	p.sim.m.Unlock()
+}
+
+// SimulationPaused reports whether simulation is paused.
+func (p *PLC) SimulationPaused() bool {
+	p.sim.m.Lock()
+	defer p.sim.m.Unlock()
+	return p.sim.paused
+}
+
+// StartSimulation starts updating tags with attached generators.
+func (p *PLC) StartSimulation() {
+	s := &p.sim
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	go p.simLoop(s.stop)
+}
+
+// StopSimulation stops updating tags.
+func (p *PLC) StopSimulation() {
+	s := &p.sim
+	s.m.Lock()
+	if s.running {
+		close(s.stop)
+		s.running = false
+	}
+	s.m.Unlock()
+}
+
+func (p *PLC) simLoop(stop chan struct{}) {
+	tick := time.NewTicker(simResolution)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-tick.C:
+			p.simStep(now)
+		}
+	}
+}
+
+func (p *PLC) simStep(now time.Time) {
+	s := &p.sim
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.paused {
+		return
+	}
+	for _, g := range s.gens {
+		if g.Paused || now.Sub(g.last) < g.Interval {
+			continue
+		}
+		g.last = now
+		v := g.value(now)
+		p.lockTags()
+		err := p.writeNum(g.path, v)
+		p.unlockTags()
+		if err != nil {
+			p.debug("generator", "path", g.Path, "err", err)
+		}
+	}
+}
+
+type jsGenerator struct {
+	Path      string    `json:"path"`
+	Type      string    `json:"type"`
+	Period    string    `json:"period,omitempty"`
+	Interval  string    `json:"interval,omitempty"`
+	Amplitude float64   `json:"amplitude,omitempty"`
+	Offset    float64   `json:"offset,omitempty"`
+	Noise     float64   `json:"noise,omitempty"`
+	Step      float64   `json:"step,omitempty"`
+	File      string    `json:"file,omitempty"`
+	Values    []float64 `json:"values,omitempty"`
+	Paused    bool      `json:"paused,omitempty"`
+}
+
+func (p *PLC) importSimulation(js []jsGenerator) error {
+	for _, j := range js {
+		g := Generator{Path: j.Path, Type: j.Type, Amplitude: j.Amplitude, Offset: j.Offset, Noise: j.Noise, Step: j.Step, File: j.File, Values: j.Values, Paused: j.Paused}
+		var err error
+		if j.Period != "" {
+			if g.Period, err = time.ParseDuration(j.Period); err != nil {
+				return errors.New("generator " + j.Path + ": " + err.Error())
+			}
+		}
+		if j.Interval != "" {
+			if g.Interval, err = time.ParseDuration(j.Interval); err != nil {
+				return errors.New("generator " + j.Path + ": " + err.Error())
+			}
+		}
+		if err = p.AddGenerator(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
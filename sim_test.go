@@ -0,0 +1,82 @@
+package plcconnector
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_simGenValue(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		g    simGen
+		at   time.Duration
+		want float64
+	}{
+		{"ramp", simGen{Generator: Generator{Type: GenRamp, Period: 10 * time.Second, Amplitude: 100, Offset: 5}}, 2500 * time.Millisecond, 30},
+		{"sine", simGen{Generator: Generator{Type: GenSine, Period: 4 * time.Second, Amplitude: 10, Offset: 1}}, time.Second, 11},
+		{"square high", simGen{Generator: Generator{Type: GenSquare, Period: 2 * time.Second, Amplitude: 1}}, 500 * time.Millisecond, 1},
+		{"square low", simGen{Generator: Generator{Type: GenSquare, Period: 2 * time.Second, Amplitude: 1}}, 1500 * time.Millisecond, 0},
+		{"step", simGen{Generator: Generator{Type: GenStep, Period: time.Second, Values: []float64{1, 2, 3}}}, 4200 * time.Millisecond, 2},
+		{"counter", simGen{Generator: Generator{Type: GenCounter, Step: 2, Offset: 10}}, 0, 12},
+		{"csv time", simGen{Generator: Generator{Type: GenCSV, Values: []float64{1, 2, 3}}, times: []float64{0, 1, 5}}, 3 * time.Second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.g.start = start
+			if got := tt.g.value(start.Add(tt.at)); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("value() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(int32(0), "cnt")
+	p.NewTag(float32(0), "val")
+
+	if p.AddGenerator(Generator{Path: "nosuchtag", Type: GenCounter}) == nil {
+		t.Error("unknown tag accepted")
+	}
+	if p.AddGenerator(Generator{Path: "val", Type: GenSine}) == nil {
+		t.Error("sine without period accepted")
+	}
+
+	csvFile := filepath.Join(t.TempDir(), "val.csv")
+	os.WriteFile(csvFile, []byte("value\n1.5\n2.5\n"), 0o644)
+	if err = p.AddGenerator(Generator{Path: "val", Type: GenCSV, File: csvFile, Period: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.AddGenerator(Generator{Path: "cnt", Type: GenCounter, Interval: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	p.simStep(now)
+	p.simStep(now.Add(time.Second))
+	if v, _ := p.ReadNum("cnt"); v != 2 {
+		t.Errorf("cnt = %v, want 2", v)
+	}
+	if v, _ := p.ReadNum("val"); v != 1.5 {
+		t.Errorf("val = %v, want 1.5", v)
+	}
+
+	p.PauseSimulation(true)
+	p.simStep(now.Add(2 * time.Second))
+	if v, _ := p.ReadNum("cnt"); v != 2 {
+		t.Errorf("paused cnt = %v, want 2", v)
+	}
+	p.PauseSimulation(false)
+	p.PauseGenerator("CNT", true)
+	p.simStep(now.Add(3 * time.Second))
+	if v, _ := p.ReadNum("cnt"); v != 2 {
+		t.Errorf("paused generator cnt = %v, want 2", v)
+	}
+}
@@ -0,0 +1,1716 @@
+package plcconnector
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// IEC 61131-3 Structured Text subset:
+//   PROGRAM/END_PROGRAM, VAR/END_VAR, :=, IF/ELSIF/ELSE, CASE, FOR, WHILE, REPEAT, EXIT, RETURN,
+//   arithmetic, comparison and boolean operators, TON/TOF/CTU function blocks.
+// Names not declared in VAR blocks are resolved as tags (the same as ReadTag path).
+
+const stMaxLoop = 1_000_000
+
+var errSTReturn = errors.New("RETURN")
+var errSTExit = errors.New("EXIT")
+
+const (
+	stEOF = iota
+	stIdent
+	stInt
+	stReal
+	stTime
+	stOp
+)
+
+type stToken struct {
+	k   int
+	s   string // upper case for identifiers and keywords
+	raw string
+	i   int64
+	f   float64
+	pos int
+	end int
+}
+
+func (t stToken) is(s string) bool {
+	return (t.k == stOp || t.k == stIdent) && t.s == s
+}
+
+func stError(src string, pos int, msg string) error {
+	line := 1 + strings.Count(src[:pos], "\n")
+	return fmt.Errorf("ST line %d: %s", line, msg)
+}
+
+func stLex(src string) ([]stToken, error) {
+	var toks []stToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case strings.HasPrefix(src[i:], "(*"):
+			e := strings.Index(src[i+2:], "*)")
+			if e == -1 {
+				return nil, stError(src, i, "unterminated comment")
+			}
+			i += e + 4
+		case strings.HasPrefix(src[i:], "/*"):
+			e := strings.Index(src[i+2:], "*/")
+			if e == -1 {
+				return nil, stError(src, i, "unterminated comment")
+			}
+			i += e + 4
+		case strings.HasPrefix(src[i:], "//"):
+			e := strings.IndexByte(src[i:], '\n')
+			if e == -1 {
+				e = len(src) - i
+			}
+			i += e
+		case c == '_' || unicode.IsLetter(rune(c)):
+			s := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			id := src[s:i]
+			if i < len(src) && src[i] == '#' { // typed literal
+				up := strings.ToUpper(id)
+				i++
+				if up == "T" || up == "TIME" || up == "LT" || up == "LTIME" {
+					ts := i
+					if i < len(src) && src[i] == '-' {
+						i++
+					}
+					for i < len(src) && (src[i] == '_' || src[i] == '.' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+						i++
+					}
+					ms, err := stDuration(src[ts:i])
+					if err != nil {
+						return nil, stError(src, s, err.Error())
+					}
+					toks = append(toks, stToken{k: stTime, i: ms, raw: src[s:i], pos: s, end: i})
+				} else if up == "BOOL" {
+					ts := i
+					for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+						i++
+					}
+					v := strings.ToUpper(src[ts:i])
+					toks = append(toks, stToken{k: stIdent, s: iif(v == "1" || v == "TRUE", "TRUE", "FALSE"), raw: src[s:i], pos: s, end: i})
+				} else { // INT#5, REAL#1.5 etc.
+					continue
+				}
+				continue
+			}
+			toks = append(toks, stToken{k: stIdent, s: strings.ToUpper(id), raw: id, pos: s, end: i})
+		case unicode.IsDigit(rune(c)):
+			s := i
+			t, n, err := stNumber(src[i:])
+			if err != nil {
+				return nil, stError(src, s, err.Error())
+			}
+			t.pos = s
+			t.end = s + n
+			i += n
+			toks = append(toks, t)
+		default:
+			op := ""
+			for _, o := range []string{":=", "<>", "<=", ">=", "**", "..", "=>"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/=<>()[],;:.&", rune(c)) {
+					return nil, stError(src, i, "unexpected character "+strconv.QuoteRune(rune(c)))
+				}
+				op = string(c)
+			}
+			toks = append(toks, stToken{k: stOp, s: op, raw: op, pos: i, end: i + len(op)})
+			i += len(op)
+		}
+	}
+	toks = append(toks, stToken{k: stEOF, pos: len(src), end: len(src)})
+	return toks, nil
+}
+
+func stNumber(s string) (stToken, int, error) {
+	i := 0
+	for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '_') {
+		i++
+	}
+	if i < len(s) && s[i] == '#' { // based integer
+		base, err := strconv.Atoi(strings.ReplaceAll(s[:i], "_", ""))
+		if err != nil {
+			return stToken{}, 0, err
+		}
+		j := i + 1
+		for j < len(s) && (unicode.IsDigit(rune(s[j])) || unicode.IsLetter(rune(s[j])) || s[j] == '_') {
+			j++
+		}
+		v, err := strconv.ParseUint(strings.ReplaceAll(s[i+1:j], "_", ""), base, 64)
+		if err != nil {
+			return stToken{}, 0, errors.New("bad number " + s[:j])
+		}
+		return stToken{k: stInt, i: int64(v), raw: s[:j]}, j, nil
+	}
+	real := false
+	if i+1 < len(s) && s[i] == '.' && unicode.IsDigit(rune(s[i+1])) {
+		real = true
+		i++
+		for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '_') {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && unicode.IsDigit(rune(s[j])) {
+			real = true
+			i = j
+			for i < len(s) && unicode.IsDigit(rune(s[i])) {
+				i++
+			}
+		}
+	}
+	txt := strings.ReplaceAll(s[:i], "_", "")
+	if real {
+		f, err := strconv.ParseFloat(txt, 64)
+		if err != nil {
+			return stToken{}, 0, errors.New("bad number " + s[:i])
+		}
+		return stToken{k: stReal, f: f, raw: s[:i]}, i, nil
+	}
+	v, err := strconv.ParseInt(txt, 10, 64)
+	if err != nil {
+		return stToken{}, 0, errors.New("bad number " + s[:i])
+	}
+	return stToken{k: stInt, i: v, raw: s[:i]}, i, nil
+}
+
+// stDuration parses duration part of time literal (1h2m3s4ms) into miliseconds.
+func stDuration(s string) (int64, error) {
+	s = strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return 0, errors.New("bad time literal")
+	}
+	ms := 0.0
+	for s != "" {
+		i := 0
+		for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '.') {
+			i++
+		}
+		v, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0, errors.New("bad time literal")
+		}
+		s = s[i:]
+		var mul float64
+		switch {
+		case strings.HasPrefix(s, "ms"):
+			mul, s = 1, s[2:]
+		case strings.HasPrefix(s, "us"):
+			mul, s = 0.001, s[2:]
+		case strings.HasPrefix(s, "ns"):
+			mul, s = 0.000001, s[2:]
+		case strings.HasPrefix(s, "d"):
+			mul, s = 86400000, s[1:]
+		case strings.HasPrefix(s, "h"):
+			mul, s = 3600000, s[1:]
+		case strings.HasPrefix(s, "m"):
+			mul, s = 60000, s[1:]
+		case strings.HasPrefix(s, "s"):
+			mul, s = 1000, s[1:]
+		default:
+			return 0, errors.New("bad time literal unit")
+		}
+		ms += v * mul
+	}
+	if neg {
+		ms = -ms
+	}
+	return int64(ms), nil
+}
+
+// values
+
+const (
+	stBool = iota
+	stIntK
+	stRealK
+)
+
+type stValue struct {
+	k int
+	i int64
+	f float64
+}
+
+func stB(b bool) stValue {
+	if b {
+		return stValue{k: stBool, i: 1}
+	}
+	return stValue{k: stBool}
+}
+
+func stI(i int64) stValue   { return stValue{k: stIntK, i: i} }
+func stR(f float64) stValue { return stValue{k: stRealK, f: f} }
+
+func (v stValue) real() float64 {
+	if v.k == stRealK {
+		return v.f
+	}
+	return float64(v.i)
+}
+
+func (v stValue) int() int64 {
+	if v.k == stRealK {
+		return int64(math.Round(v.f))
+	}
+	return v.i
+}
+
+func (v stValue) bool() bool {
+	if v.k == stRealK {
+		return v.f != 0
+	}
+	return v.i != 0
+}
+
+func (v stValue) String() string {
+	switch v.k {
+	case stBool:
+		return iif(v.i != 0, "TRUE", "FALSE")
+	case stRealK:
+		return strconv.FormatFloat(v.f, 'g', -1, 64)
+	}
+	return strconv.FormatInt(v.i, 10)
+}
+
+func stFromNum(f float64, typ int) stValue {
+	switch typ {
+	case TypeBOOL:
+		return stB(f != 0)
+	case TypeREAL, TypeLREAL:
+		return stR(f)
+	}
+	return stI(int64(f))
+}
+
+// convert value to elementary type typ
+func stConvert(v stValue, typ int) stValue {
+	switch typ {
+	case TypeBOOL:
+		return stB(v.bool())
+	case TypeREAL:
+		return stR(float64(float32(v.real())))
+	case TypeLREAL:
+		return stR(v.real())
+	case TypeSINT:
+		return stI(int64(int8(v.int())))
+	case TypeUSINT:
+		return stI(int64(uint8(v.int())))
+	case TypeINT:
+		return stI(int64(int16(v.int())))
+	case TypeUINT:
+		return stI(int64(uint16(v.int())))
+	case TypeDINT, TypeTIME:
+		return stI(int64(int32(v.int())))
+	case TypeUDINT:
+		return stI(int64(uint32(v.int())))
+	}
+	return stI(v.int())
+}
+
+// function blocks
+
+type stFB interface {
+	get(name string) (stValue, bool)
+	set(name string, v stValue) bool
+	call(now time.Time)
+}
+
+type stTimer struct {
+	off     bool // TOF
+	in      bool
+	pt      int64
+	q       bool
+	et      int64
+	running bool
+	start   time.Time
+}
+
+func (t *stTimer) get(name string) (stValue, bool) {
+	switch name {
+	case "IN":
+		return stB(t.in), true
+	case "PT":
+		return stI(t.pt), true
+	case "Q":
+		return stB(t.q), true
+	case "ET":
+		return stI(t.et), true
+	}
+	return stValue{}, false
+}
+
+func (t *stTimer) set(name string, v stValue) bool {
+	switch name {
+	case "IN":
+		t.in = v.bool()
+	case "PT":
+		t.pt = v.int()
+	default:
+		return false
+	}
+	return true
+}
+
+func (t *stTimer) elapsed(now time.Time) {
+	if !t.running {
+		t.running = true
+		t.start = now
+	}
+	t.et = now.Sub(t.start).Milliseconds()
+	if t.et >= t.pt {
+		t.et = t.pt
+	}
+}
+
+func (t *stTimer) call(now time.Time) {
+	if !t.off { // TON
+		if t.in {
+			t.elapsed(now)
+			t.q = t.et >= t.pt
+		} else {
+			t.running = false
+			t.q = false
+			t.et = 0
+		}
+		return
+	}
+	if t.in { // TOF
+		t.running = false
+		t.q = true
+		t.et = 0
+	} else if t.q {
+		t.elapsed(now)
+		if t.et >= t.pt {
+			t.q = false
+		}
+	} else {
+		t.running = false
+	}
+}
+
+type stCounter struct {
+	cu    bool
+	prev  bool
+	reset bool
+	pv    int64
+	cv    int64
+	q     bool
+}
+
+func (c *stCounter) get(name string) (stValue, bool) {
+	switch name {
+	case "CU":
+		return stB(c.cu), true
+	case "RESET", "R":
+		return stB(c.reset), true
+	case "PV":
+		return stI(c.pv), true
+	case "CV":
+		return stI(c.cv), true
+	case "Q":
+		return stB(c.q), true
+	}
+	return stValue{}, false
+}
+
+func (c *stCounter) set(name string, v stValue) bool {
+	switch name {
+	case "CU":
+		c.cu = v.bool()
+	case "RESET", "R":
+		c.reset = v.bool()
+	case "PV":
+		c.pv = v.int()
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *stCounter) call(now time.Time) {
+	if c.reset {
+		c.cv = 0
+	} else if c.cu && !c.prev && c.cv < math.MaxInt32 {
+		c.cv++
+	}
+	c.prev = c.cu
+	c.q = c.cv >= c.pv
+}
+
+func stNewFB(typ string) stFB {
+	switch typ {
+	case "TON":
+		return &stTimer{}
+	case "TOF":
+		return &stTimer{off: true}
+	case "CTU":
+		return &stCounter{}
+	}
+	return nil
+}
+
+type stVar struct {
+	typ int
+	v   stValue
+	fb  stFB
+}
+
+// AST
+
+type stCtx struct {
+	s     *STProgram
+	now   time.Time
+	loops int
+}
+
+type stExpr interface {
+	eval(c *stCtx) (stValue, error)
+}
+
+type stConst struct{ v stValue }
+
+func (e *stConst) eval(c *stCtx) (stValue, error) { return e.v, nil }
+
+// selector of reference: name, indexes or bit
+type stSel struct {
+	name string
+	idx  []stExpr
+	bit  int
+}
+
+type stRef struct {
+	sel []stSel
+	pos int
+}
+
+func (e *stRef) eval(c *stCtx) (stValue, error) {
+	return c.s.load(c, e)
+}
+
+type stUnary struct {
+	op string
+	x  stExpr
+}
+
+func (e *stUnary) eval(c *stCtx) (stValue, error) {
+	v, err := e.x.eval(c)
+	if err != nil {
+		return v, err
+	}
+	switch e.op {
+	case "-":
+		if v.k == stRealK {
+			return stR(-v.f), nil
+		}
+		return stI(-v.i), nil
+	case "NOT":
+		if v.k == stBool {
+			return stB(v.i == 0), nil
+		}
+		return stI(^v.int()), nil
+	}
+	return v, nil
+}
+
+type stBinary struct {
+	op   string
+	x, y stExpr
+	pos  int
+}
+
+func (e *stBinary) eval(c *stCtx) (stValue, error) {
+	a, err := e.x.eval(c)
+	if err != nil {
+		return a, err
+	}
+	b, err := e.y.eval(c)
+	if err != nil {
+		return b, err
+	}
+	real := a.k == stRealK || b.k == stRealK
+	switch e.op {
+	case "+":
+		if real {
+			return stR(a.real() + b.real()), nil
+		}
+		return stI(a.i + b.i), nil
+	case "-":
+		if real {
+			return stR(a.real() - b.real()), nil
+		}
+		return stI(a.i - b.i), nil
+	case "*":
+		if real {
+			return stR(a.real() * b.real()), nil
+		}
+		return stI(a.i * b.i), nil
+	case "/":
+		if real {
+			return stR(a.real() / b.real()), nil
+		}
+		if b.i == 0 {
+			return a, stError(c.s.src, e.pos, "division by zero")
+		}
+		return stI(a.i / b.i), nil
+	case "MOD":
+		if real {
+			return stR(math.Mod(a.real(), b.real())), nil
+		}
+		if b.i == 0 {
+			return a, stError(c.s.src, e.pos, "division by zero")
+		}
+		return stI(a.i % b.i), nil
+	case "**":
+		return stR(math.Pow(a.real(), b.real())), nil
+	case "=":
+		if real {
+			return stB(a.real() == b.real()), nil
+		}
+		return stB(a.i == b.i), nil
+	case "<>":
+		if real {
+			return stB(a.real() != b.real()), nil
+		}
+		return stB(a.i != b.i), nil
+	case "<":
+		if real {
+			return stB(a.real() < b.real()), nil
+		}
+		return stB(a.i < b.i), nil
+	case ">":
+		if real {
+			return stB(a.real() > b.real()), nil
+		}
+		return stB(a.i > b.i), nil
+	case "<=":
+		if real {
+			return stB(a.real() <= b.real()), nil
+		}
+		return stB(a.i <= b.i), nil
+	case ">=":
+		if real {
+			return stB(a.real() >= b.real()), nil
+		}
+		return stB(a.i >= b.i), nil
+	case "AND", "&":
+		if a.k == stBool && b.k == stBool {
+			return stB(a.i != 0 && b.i != 0), nil
+		}
+		return stI(a.int() & b.int()), nil
+	case "OR":
+		if a.k == stBool && b.k == stBool {
+			return stB(a.i != 0 || b.i != 0), nil
+		}
+		return stI(a.int() | b.int()), nil
+	case "XOR":
+		if a.k == stBool && b.k == stBool {
+			return stB((a.i != 0) != (b.i != 0)), nil
+		}
+		return stI(a.int() ^ b.int()), nil
+	}
+	return a, stError(c.s.src, e.pos, "unknown operator "+e.op)
+}
+
+type stFunc struct {
+	name string
+	args []stExpr
+	pos  int
+}
+
+var stFuncs1 = map[string]func(float64) float64{
+	"SQRT": math.Sqrt,
+	"SIN":  math.Sin,
+	"COS":  math.Cos,
+	"TAN":  math.Tan,
+	"ASIN": math.Asin,
+	"ACOS": math.Acos,
+	"ATAN": math.Atan,
+	"EXP":  math.Exp,
+	"LN":   math.Log,
+	"LOG":  math.Log10,
+}
+
+func (e *stFunc) eval(c *stCtx) (stValue, error) {
+	a := make([]stValue, len(e.args))
+	for i, x := range e.args {
+		v, err := x.eval(c)
+		if err != nil {
+			return v, err
+		}
+		a[i] = v
+	}
+	argc := func(n int) error {
+		if len(a) != n {
+			return stError(c.s.src, e.pos, fmt.Sprintf("%s expects %d arguments", e.name, n))
+		}
+		return nil
+	}
+	if f, ok := stFuncs1[e.name]; ok {
+		if err := argc(1); err != nil {
+			return stValue{}, err
+		}
+		return stR(f(a[0].real())), nil
+	}
+	switch e.name {
+	case "ABS":
+		if err := argc(1); err != nil {
+			return stValue{}, err
+		}
+		if a[0].k == stRealK {
+			return stR(math.Abs(a[0].f)), nil
+		}
+		if a[0].i < 0 {
+			return stI(-a[0].i), nil
+		}
+		return a[0], nil
+	case "TRUNC":
+		if err := argc(1); err != nil {
+			return stValue{}, err
+		}
+		return stI(int64(a[0].real())), nil
+	case "MIN", "MAX":
+		if len(a) == 0 {
+			return stValue{}, argc(1)
+		}
+		r := a[0]
+		for _, v := range a[1:] {
+			if (e.name == "MIN" && v.real() < r.real()) || (e.name == "MAX" && v.real() > r.real()) {
+				r = v
+			}
+		}
+		return r, nil
+	case "LIMIT":
+		if err := argc(3); err != nil {
+			return stValue{}, err
+		}
+		if a[1].real() < a[0].real() {
+			return a[0], nil
+		}
+		if a[1].real() > a[2].real() {
+			return a[2], nil
+		}
+		return a[1], nil
+	case "SEL":
+		if err := argc(3); err != nil {
+			return stValue{}, err
+		}
+		if a[0].bool() {
+			return a[2], nil
+		}
+		return a[1], nil
+	}
+	if i := strings.Index(e.name, "_TO_"); i != -1 { // DINT_TO_REAL etc.
+		if err := argc(1); err != nil {
+			return stValue{}, err
+		}
+		typ := stTypes[e.name[i+4:]]
+		if typ == 0 {
+			return stValue{}, stError(c.s.src, e.pos, "unknown conversion "+e.name)
+		}
+		if typ != TypeREAL && typ != TypeLREAL && typ != TypeBOOL {
+			a[0] = stI(a[0].int())
+		}
+		return stConvert(a[0], typ), nil
+	}
+	return stValue{}, stError(c.s.src, e.pos, "unknown function "+e.name)
+}
+
+type stStmt interface {
+	exec(c *stCtx) error
+}
+
+type stAssign struct {
+	ref *stRef
+	x   stExpr
+}
+
+func (s *stAssign) exec(c *stCtx) error {
+	v, err := s.x.eval(c)
+	if err != nil {
+		return err
+	}
+	return c.s.store(c, s.ref, v)
+}
+
+type stCall struct {
+	name string
+	args map[string]stExpr
+	pos  int
+}
+
+func (s *stCall) exec(c *stCtx) error {
+	vr, ok := c.s.vars[s.name]
+	if !ok || vr.fb == nil {
+		return stError(c.s.src, s.pos, s.name+" is not a function block")
+	}
+	for n, x := range s.args {
+		v, err := x.eval(c)
+		if err != nil {
+			return err
+		}
+		if !vr.fb.set(n, v) {
+			return stError(c.s.src, s.pos, "unknown input "+n)
+		}
+	}
+	vr.fb.call(c.now)
+	return nil
+}
+
+type stIf struct {
+	cond []stExpr
+	then [][]stStmt
+	els  []stStmt
+}
+
+func (s *stIf) exec(c *stCtx) error {
+	for i, x := range s.cond {
+		v, err := x.eval(c)
+		if err != nil {
+			return err
+		}
+		if v.bool() {
+			return stExec(c, s.then[i])
+		}
+	}
+	return stExec(c, s.els)
+}
+
+type stCase struct {
+	x      stExpr
+	labels [][][2]int64
+	body   [][]stStmt
+	els    []stStmt
+}
+
+func (s *stCase) exec(c *stCtx) error {
+	v, err := s.x.eval(c)
+	if err != nil {
+		return err
+	}
+	n := v.int()
+	for i, l := range s.labels {
+		for _, r := range l {
+			if n >= r[0] && n <= r[1] {
+				return stExec(c, s.body[i])
+			}
+		}
+	}
+	return stExec(c, s.els)
+}
+
+type stFor struct {
+	v              *stRef
+	from, to, step stExpr
+	body           []stStmt
+	pos            int
+}
+
+func (s *stFor) exec(c *stCtx) error {
+	from, err := s.from.eval(c)
+	if err != nil {
+		return err
+	}
+	step := stI(1)
+	if s.step != nil {
+		step, err = s.step.eval(c)
+		if err != nil {
+			return err
+		}
+	}
+	if step.int() == 0 {
+		return stError(c.s.src, s.pos, "FOR step is 0")
+	}
+	i := from.int()
+	for {
+		to, err := s.to.eval(c)
+		if err != nil {
+			return err
+		}
+		if (step.int() > 0 && i > to.int()) || (step.int() < 0 && i < to.int()) {
+			return nil
+		}
+		if err = c.s.store(c, s.v, stI(i)); err != nil {
+			return err
+		}
+		if err = c.loop(s.pos); err != nil {
+			return err
+		}
+		err = stExec(c, s.body)
+		if err == errSTExit {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		v, err := c.s.load(c, s.v)
+		if err != nil {
+			return err
+		}
+		i = v.int() + step.int()
+	}
+}
+
+type stWhile struct {
+	cond   stExpr
+	body   []stStmt
+	repeat bool
+	pos    int
+}
+
+func (s *stWhile) exec(c *stCtx) error {
+	for {
+		if !s.repeat {
+			v, err := s.cond.eval(c)
+			if err != nil {
+				return err
+			}
+			if !v.bool() {
+				return nil
+			}
+		}
+		if err := c.loop(s.pos); err != nil {
+			return err
+		}
+		err := stExec(c, s.body)
+		if err == errSTExit {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if s.repeat {
+			v, err := s.cond.eval(c)
+			if err != nil {
+				return err
+			}
+			if v.bool() {
+				return nil
+			}
+		}
+	}
+}
+
+type stJump struct{ err error }
+
+func (s *stJump) exec(c *stCtx) error { return s.err }
+
+func (c *stCtx) loop(pos int) error {
+	c.loops++
+	if c.loops > stMaxLoop {
+		return stError(c.s.src, pos, "loop limit exceeded")
+	}
+	return nil
+}
+
+func stExec(c *stCtx, body []stStmt) error {
+	for _, s := range body {
+		if err := s.exec(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parser
+
+type stParser struct {
+	src  string
+	toks []stToken
+	n    int
+	vars map[string]*stVar
+}
+
+var stTypes = map[string]int{
+	"BOOL": TypeBOOL, "SINT": TypeSINT, "INT": TypeINT, "DINT": TypeDINT, "LINT": TypeLINT,
+	"USINT": TypeUSINT, "UINT": TypeUINT, "UDINT": TypeUDINT, "ULINT": TypeULINT,
+	"BYTE": TypeUSINT, "WORD": TypeUINT, "DWORD": TypeUDINT, "LWORD": TypeULINT,
+	"REAL": TypeREAL, "LREAL": TypeLREAL, "TIME": TypeTIME,
+}
+
+var stKeywords = map[string]bool{
+	"IF": true, "THEN": true, "ELSIF": true, "ELSE": true, "END_IF": true, "CASE": true, "OF": true, "END_CASE": true,
+	"FOR": true, "TO": true, "BY": true, "DO": true, "END_FOR": true, "WHILE": true, "END_WHILE": true,
+	"REPEAT": true, "UNTIL": true, "END_REPEAT": true, "EXIT": true, "RETURN": true,
+	"VAR": true, "END_VAR": true, "PROGRAM": true, "END_PROGRAM": true,
+	"AND": true, "OR": true, "XOR": true, "NOT": true, "MOD": true, "TRUE": true, "FALSE": true,
+}
+
+func (ps *stParser) peek() stToken { return ps.toks[ps.n] }
+
+func (ps *stParser) peek2() stToken {
+	if ps.n+1 < len(ps.toks) {
+		return ps.toks[ps.n+1]
+	}
+	return ps.toks[len(ps.toks)-1]
+}
+
+func (ps *stParser) next() stToken {
+	t := ps.toks[ps.n]
+	if t.k != stEOF {
+		ps.n++
+	}
+	return t
+}
+
+func (ps *stParser) errorf(t stToken, f string, a ...interface{}) error {
+	return stError(ps.src, t.pos, fmt.Sprintf(f, a...))
+}
+
+func (ps *stParser) expect(s string) error {
+	t := ps.next()
+	if !t.is(s) {
+		if t.k == stEOF {
+			return ps.errorf(t, "expected %s, got end of file", s)
+		}
+		return ps.errorf(t, "expected %s, got %s", s, t.raw)
+	}
+	return nil
+}
+
+func (ps *stParser) accept(s string) bool {
+	if ps.peek().is(s) {
+		ps.n++
+		return true
+	}
+	return false
+}
+
+func (ps *stParser) ident() (stToken, error) {
+	t := ps.next()
+	if t.k != stIdent || stKeywords[t.s] {
+		return t, ps.errorf(t, "expected identifier, got %s", iif(t.k == stEOF, "end of file", t.raw))
+	}
+	return t, nil
+}
+
+func (ps *stParser) program() (string, []stStmt, error) {
+	name := ""
+	if ps.accept("PROGRAM") {
+		t, err := ps.ident()
+		if err != nil {
+			return "", nil, err
+		}
+		name = t.raw
+	}
+	for ps.accept("VAR") {
+		if err := ps.vardecl(); err != nil {
+			return "", nil, err
+		}
+	}
+	body, err := ps.stmts("END_PROGRAM")
+	if err != nil {
+		return "", nil, err
+	}
+	if ps.accept("END_PROGRAM") {
+		ps.accept(";")
+	}
+	if t := ps.peek(); t.k != stEOF {
+		return "", nil, ps.errorf(t, "unexpected %s", t.raw)
+	}
+	return name, body, nil
+}
+
+func (ps *stParser) vardecl() error {
+	for !ps.accept("END_VAR") {
+		var names []stToken
+		for {
+			t, err := ps.ident()
+			if err != nil {
+				return err
+			}
+			names = append(names, t)
+			if !ps.accept(",") {
+				break
+			}
+		}
+		if err := ps.expect(":"); err != nil {
+			return err
+		}
+		tt, err := ps.ident()
+		if err != nil {
+			return err
+		}
+		var init stExpr
+		if ps.accept(":=") {
+			if init, err = ps.expr(); err != nil {
+				return err
+			}
+		}
+		if err = ps.expect(";"); err != nil {
+			return err
+		}
+		for _, n := range names {
+			if _, ok := ps.vars[n.s]; ok {
+				return ps.errorf(n, "%s redeclared", n.raw)
+			}
+			v := &stVar{}
+			if fb := stNewFB(tt.s); fb != nil {
+				if init != nil {
+					return ps.errorf(tt, "function block %s can not be initialized", tt.raw)
+				}
+				v.fb = fb
+			} else if typ, ok := stTypes[tt.s]; ok {
+				v.typ = typ
+				v.v = stConvert(stI(0), typ)
+				if init != nil {
+					iv, err := init.eval(&stCtx{s: &STProgram{src: ps.src}})
+					if err != nil {
+						return ps.errorf(n, "%s initial value must be constant", n.raw)
+					}
+					v.v = stConvert(iv, typ)
+				}
+			} else {
+				return ps.errorf(tt, "unknown type %s", tt.raw)
+			}
+			ps.vars[n.s] = v
+		}
+	}
+	return nil
+}
+
+func (ps *stParser) stmts(end ...string) ([]stStmt, error) {
+	var body []stStmt
+	for {
+		t := ps.peek()
+		if t.k == stEOF {
+			return body, nil
+		}
+		for _, e := range end {
+			if t.is(e) {
+				return body, nil
+			}
+		}
+		if ps.caseLabel() {
+			return body, nil
+		}
+		if ps.accept(";") {
+			continue
+		}
+		s, err := ps.stmt()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+}
+
+// caseLabel reports whether CASE label starts at the current token.
+func (ps *stParser) caseLabel() bool {
+	t := ps.peek()
+	return t.k == stInt || (t.is("-") && ps.peek2().k == stInt)
+}
+
+func (ps *stParser) stmt() (stStmt, error) {
+	t := ps.peek()
+	var (
+		s   stStmt
+		err error
+	)
+	switch {
+	case t.is("IF"):
+		s, err = ps.ifStmt()
+	case t.is("CASE"):
+		s, err = ps.caseStmt()
+	case t.is("FOR"):
+		s, err = ps.forStmt()
+	case t.is("WHILE"):
+		ps.next()
+		w := &stWhile{pos: t.pos}
+		if w.cond, err = ps.expr(); err != nil {
+			return nil, err
+		}
+		if err = ps.expect("DO"); err != nil {
+			return nil, err
+		}
+		if w.body, err = ps.stmts("END_WHILE"); err != nil {
+			return nil, err
+		}
+		s, err = w, ps.expect("END_WHILE")
+	case t.is("REPEAT"):
+		ps.next()
+		w := &stWhile{repeat: true, pos: t.pos}
+		if w.body, err = ps.stmts("UNTIL"); err != nil {
+			return nil, err
+		}
+		if err = ps.expect("UNTIL"); err != nil {
+			return nil, err
+		}
+		if w.cond, err = ps.expr(); err != nil {
+			return nil, err
+		}
+		s, err = w, ps.expect("END_REPEAT")
+	case t.is("EXIT"):
+		ps.next()
+		s = &stJump{errSTExit}
+	case t.is("RETURN"):
+		ps.next()
+		s = &stJump{errSTReturn}
+	case t.k == stIdent && !stKeywords[t.s]:
+		if ps.peek2().is("(") {
+			s, err = ps.callStmt()
+		} else {
+			var r *stRef
+			if r, err = ps.ref(); err != nil {
+				return nil, err
+			}
+			if err = ps.expect(":="); err != nil {
+				return nil, err
+			}
+			a := &stAssign{ref: r}
+			a.x, err = ps.expr()
+			s = a
+		}
+	default:
+		if t.k == stEOF {
+			return nil, ps.errorf(t, "unexpected end of file")
+		}
+		return nil, ps.errorf(t, "unexpected %s", t.raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ps.accept(";") {
+		return nil, ps.errorf(ps.peek(), "expected ;")
+	}
+	return s, nil
+}
+
+func (ps *stParser) callStmt() (stStmt, error) {
+	t := ps.next()
+	c := &stCall{name: t.s, args: make(map[string]stExpr), pos: t.pos}
+	if v, ok := ps.vars[t.s]; !ok || v.fb == nil {
+		return nil, ps.errorf(t, "%s is not a function block instance", t.raw)
+	}
+	ps.next() // (
+	for !ps.accept(")") {
+		a, err := ps.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err = ps.expect(":="); err != nil {
+			return nil, err
+		}
+		c.args[a.s], err = ps.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !ps.peek().is(")") {
+			if err = ps.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func (ps *stParser) ifStmt() (stStmt, error) {
+	s := &stIf{}
+	ps.next()
+	for {
+		cond, err := ps.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err = ps.expect("THEN"); err != nil {
+			return nil, err
+		}
+		body, err := ps.stmts("ELSIF", "ELSE", "END_IF")
+		if err != nil {
+			return nil, err
+		}
+		s.cond = append(s.cond, cond)
+		s.then = append(s.then, body)
+		if !ps.accept("ELSIF") {
+			break
+		}
+	}
+	if ps.accept("ELSE") {
+		var err error
+		if s.els, err = ps.stmts("END_IF"); err != nil {
+			return nil, err
+		}
+	}
+	return s, ps.expect("END_IF")
+}
+
+func (ps *stParser) label() (int64, error) {
+	neg := ps.accept("-")
+	t := ps.next()
+	if t.k != stInt {
+		return 0, ps.errorf(t, "expected integer CASE label")
+	}
+	if neg {
+		return -t.i, nil
+	}
+	return t.i, nil
+}
+
+func (ps *stParser) caseStmt() (stStmt, error) {
+	s := &stCase{}
+	ps.next()
+	var err error
+	if s.x, err = ps.expr(); err != nil {
+		return nil, err
+	}
+	if err = ps.expect("OF"); err != nil {
+		return nil, err
+	}
+	for ps.caseLabel() {
+		var l [][2]int64
+		for {
+			a, err := ps.label()
+			if err != nil {
+				return nil, err
+			}
+			b := a
+			if ps.accept("..") {
+				if b, err = ps.label(); err != nil {
+					return nil, err
+				}
+			}
+			l = append(l, [2]int64{a, b})
+			if !ps.accept(",") {
+				break
+			}
+		}
+		if err = ps.expect(":"); err != nil {
+			return nil, err
+		}
+		body, err := ps.stmts("ELSE", "END_CASE")
+		if err != nil {
+			return nil, err
+		}
+		s.labels = append(s.labels, l)
+		s.body = append(s.body, body)
+	}
+	if ps.accept("ELSE") {
+		if s.els, err = ps.stmts("END_CASE"); err != nil {
+			return nil, err
+		}
+	}
+	return s, ps.expect("END_CASE")
+}
+
+func (ps *stParser) forStmt() (stStmt, error) {
+	t := ps.next()
+	s := &stFor{pos: t.pos}
+	var err error
+	if s.v, err = ps.ref(); err != nil {
+		return nil, err
+	}
+	if err = ps.expect(":="); err != nil {
+		return nil, err
+	}
+	if s.from, err = ps.expr(); err != nil {
+		return nil, err
+	}
+	if err = ps.expect("TO"); err != nil {
+		return nil, err
+	}
+	if s.to, err = ps.expr(); err != nil {
+		return nil, err
+	}
+	if ps.accept("BY") {
+		if s.step, err = ps.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if err = ps.expect("DO"); err != nil {
+		return nil, err
+	}
+	if s.body, err = ps.stmts("END_FOR"); err != nil {
+		return nil, err
+	}
+	return s, ps.expect("END_FOR")
+}
+
+// ref parses variable or tag reference: name{.name|[expr{,expr}]|.bit}
+func (ps *stParser) ref() (*stRef, error) {
+	t, err := ps.ident()
+	if err != nil {
+		return nil, err
+	}
+	name := t.raw
+	end := t.end
+	// Program:Main, Local:1:I
+	for {
+		c := ps.peek()
+		nx := ps.peek2()
+		if c.is(":") && c.pos == end && (nx.k == stIdent || nx.k == stInt) && nx.pos == c.end {
+			name += ":" + nx.raw
+			end = nx.end
+			ps.n += 2
+			continue
+		}
+		break
+	}
+	r := &stRef{sel: []stSel{{name: name, bit: -1}}, pos: t.pos}
+	for {
+		switch {
+		case ps.accept("."):
+			n := ps.next()
+			switch {
+			case n.k == stInt:
+				r.sel = append(r.sel, stSel{bit: int(n.i)})
+				return r, nil
+			case n.k == stIdent:
+				r.sel = append(r.sel, stSel{name: n.raw, bit: -1})
+			default:
+				return nil, ps.errorf(n, "expected member name")
+			}
+		case ps.accept("["):
+			s := stSel{bit: -1}
+			for {
+				x, err := ps.expr()
+				if err != nil {
+					return nil, err
+				}
+				s.idx = append(s.idx, x)
+				if !ps.accept(",") {
+					break
+				}
+			}
+			if err := ps.expect("]"); err != nil {
+				return nil, err
+			}
+			r.sel = append(r.sel, s)
+		default:
+			return r, nil
+		}
+	}
+}
+
+var stPrec = [][]string{
+	{"OR"},
+	{"XOR"},
+	{"AND", "&"},
+	{"=", "<>"},
+	{"<", ">", "<=", ">="},
+	{"+", "-"},
+	{"*", "/", "MOD"},
+	{"**"},
+}
+
+func (ps *stParser) expr() (stExpr, error) {
+	return ps.binary(0)
+}
+
+func (ps *stParser) binary(lvl int) (stExpr, error) {
+	if lvl == len(stPrec) {
+		return ps.unary()
+	}
+	x, err := ps.binary(lvl + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := ps.peek()
+		found := false
+		for _, op := range stPrec[lvl] {
+			if t.is(op) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return x, nil
+		}
+		ps.next()
+		y, err := ps.binary(lvl + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &stBinary{op: t.s, x: x, y: y, pos: t.pos}
+	}
+}
+
+func (ps *stParser) unary() (stExpr, error) {
+	t := ps.peek()
+	if t.is("-") || t.is("NOT") || t.is("+") {
+		ps.next()
+		x, err := ps.unary()
+		if err != nil {
+			return nil, err
+		}
+		if t.is("+") {
+			return x, nil
+		}
+		return &stUnary{op: t.s, x: x}, nil
+	}
+	return ps.primary()
+}
+
+func (ps *stParser) primary() (stExpr, error) {
+	t := ps.peek()
+	switch {
+	case t.k == stInt, t.k == stTime:
+		ps.next()
+		return &stConst{stI(t.i)}, nil
+	case t.k == stReal:
+		ps.next()
+		return &stConst{stR(t.f)}, nil
+	case t.is("TRUE"), t.is("FALSE"):
+		ps.next()
+		return &stConst{stB(t.s == "TRUE")}, nil
+	case t.is("("):
+		ps.next()
+		x, err := ps.expr()
+		if err != nil {
+			return nil, err
+		}
+		return x, ps.expect(")")
+	case t.k == stIdent && !stKeywords[t.s]:
+		if ps.peek2().is("(") {
+			ps.n += 2
+			f := &stFunc{name: t.s, pos: t.pos}
+			for !ps.accept(")") {
+				x, err := ps.expr()
+				if err != nil {
+					return nil, err
+				}
+				f.args = append(f.args, x)
+				if !ps.peek().is(")") {
+					if err = ps.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return f, nil
+		}
+		return ps.ref()
+	}
+	if t.k == stEOF {
+		return nil, ps.errorf(t, "unexpected end of file")
+	}
+	return nil, ps.errorf(t, "unexpected %s", t.raw)
+}
+
+// STProgram is Structured Text program executed against tags of the PLC.
+type STProgram struct {
+	Name string
+
+	body    []stStmt
+	err     error
+	m       sync.Mutex
+	p       *PLC
+	running bool
+	src     string
+	stop    chan struct{}
+	vars    map[string]*stVar
+}
+
+// CompileST compiles Structured Text program src.
+func (p *PLC) CompileST(src string) (*STProgram, error) {
+	toks, err := stLex(src)
+	if err != nil {
+		return nil, err
+	}
+	ps := stParser{src: src, toks: toks, vars: make(map[string]*stVar)}
+	name, body, err := ps.program()
+	if err != nil {
+		return nil, err
+	}
+	return &STProgram{Name: name, body: body, p: p, src: src, vars: ps.vars}, nil
+}
+
+// LoadST compiles Structured Text program from file.
+func (p *PLC) LoadST(file string) (*STProgram, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := p.CompileST(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if s.Name == "" {
+		s.Name = file
+	}
+	return s, nil
+}
+
+func (s *STProgram) path(c *stCtx, r *stRef) ([]pathEl, error) {
+	pth := make([]pathEl, 0, len(r.sel)+2)
+	for _, sl := range r.sel {
+		switch {
+		case sl.name != "":
+			pth = append(pth, pathEl{typ: ansiExtended, txt: sl.name})
+		case sl.idx != nil:
+			for _, x := range sl.idx {
+				v, err := x.eval(c)
+				if err != nil {
+					return nil, err
+				}
+				if v.int() < 0 {
+					return nil, stError(s.src, r.pos, "negative index")
+				}
+				pth = append(pth, pathEl{typ: pathMember, val: int(v.int())})
+			}
+		default:
+			pth = append(pth, pathEl{typ: pathBit, val: sl.bit})
+		}
+	}
+	return pth, nil
+}
+
+func (s *STProgram) local(r *stRef) (*stVar, bool) {
+	v, ok := s.vars[strings.ToUpper(r.sel[0].name)]
+	return v, ok
+}
+
+func (s *STProgram) load(c *stCtx, r *stRef) (stValue, error) {
+	if v, ok := s.local(r); ok {
+		switch {
+		case v.fb != nil && len(r.sel) == 2 && r.sel[1].name != "":
+			x, ok := v.fb.get(strings.ToUpper(r.sel[1].name))
+			if !ok {
+				return x, stError(s.src, r.pos, "unknown member "+r.sel[1].name)
+			}
+			return x, nil
+		case v.fb == nil && len(r.sel) == 1:
+			return v.v, nil
+		case v.fb == nil && len(r.sel) == 2 && r.sel[1].name == "" && r.sel[1].idx == nil:
+			return stB((v.v.int()>>r.sel[1].bit)&1 == 1), nil
+		}
+		return stValue{}, stError(s.src, r.pos, "bad reference to "+r.sel[0].name)
+	}
+	if s.p == nil {
+		return stValue{}, stError(s.src, r.pos, "constant expected")
+	}
+	pth, err := s.path(c, r)
+	if err != nil {
+		return stValue{}, err
+	}
+	s.p.tMut.RLock()
+	f, typ, err := s.p.readNum(pth)
+	s.p.tMut.RUnlock()
+	if err != nil {
+		return stValue{}, stError(s.src, r.pos, r.sel[0].name+": "+err.Error())
+	}
+	return stFromNum(f, typ), nil
+}
+
+func (s *STProgram) store(c *stCtx, r *stRef, x stValue) error {
+	if v, ok := s.local(r); ok {
+		switch {
+		case v.fb != nil && len(r.sel) == 2 && r.sel[1].name != "":
+			if !v.fb.set(strings.ToUpper(r.sel[1].name), x) {
+				return stError(s.src, r.pos, "unknown input "+r.sel[1].name)
+			}
+			return nil
+		case v.fb == nil && len(r.sel) == 1:
+			v.v = stConvert(x, v.typ)
+			return nil
+		case v.fb == nil && len(r.sel) == 2 && r.sel[1].name == "" && r.sel[1].idx == nil:
+			n := v.v.int()
+			if x.bool() {
+				n |= 1 << r.sel[1].bit
+			} else {
+				n &^= 1 << r.sel[1].bit
+			}
+			v.v = stConvert(stI(n), v.typ)
+			return nil
+		}
+		return stError(s.src, r.pos, "bad reference to "+r.sel[0].name)
+	}
+	pth, err := s.path(c, r)
+	if err != nil {
+		return err
+	}
+	s.p.lockTags()
+	err = s.p.writeNum(pth, x.real())
+	s.p.unlockTags()
+	if err != nil {
+		return stError(s.src, r.pos, r.sel[0].name+": "+err.Error())
+	}
+	return nil
+}
+
+// Scan executes program once.
+func (s *STProgram) Scan() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	c := stCtx{s: s, now: time.Now()}
+	err := stExec(&c, s.body)
+	if err == errSTReturn || err == errSTExit {
+		err = nil
+	}
+	s.err = err
+	return err
+}
+
+// Run executes program every interval until Stop is called. Scan is skipped when controller is not running,
+// scan error raises major recoverable program fault.
+func (s *STProgram) Run(interval time.Duration) {
+	s.m.Lock()
+	if s.running {
+		s.m.Unlock()
+		return
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	stop := s.stop
+	s.m.Unlock()
+
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				if !s.p.Running() {
+					continue
+				}
+				if err := s.Scan(); err != nil {
+					s.p.log(LevelError, "ST", "program", s.Name, "err", err)
+					s.p.RaiseFault(Fault{Major: true, Recoverable: true, Type: faultTypeProgram, Info: s.Name + ": " + err.Error()})
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops periodic execution.
+func (s *STProgram) Stop() {
+	s.m.Lock()
+	if s.running {
+		close(s.stop)
+		s.running = false
+	}
+	s.m.Unlock()
+}
+
+// Err returns error of the last scan.
+func (s *STProgram) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
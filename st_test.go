@@ -0,0 +1,190 @@
+package plcconnector
+
+import (
+	"testing"
+	"time"
+)
+
+type stTestPos struct {
+	X int32
+	Y int32
+	F float32
+}
+
+func Test_stDuration(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    int64
+		wantErr bool
+	}{
+		{"5s", 5000, false},
+		{"1h2m3s4ms", 3723004, false},
+		{"1.5s", 1500, false},
+		{"-250ms", -250, false},
+		{"1d", 86400000, false},
+		{"", 0, true},
+		{"5x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := stDuration(tt.args)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("stDuration(%q) = %v, %v, want %v", tt.args, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func testSTPLC(t testing.TB) *PLC {
+	p, err := Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NewTag(int32(0), "a")
+	p.NewTag(int32(0), "b")
+	p.NewTag(float32(0), "r")
+	p.NewTag(false, "flag")
+	p.NewTag([]int16{0, 0, 0, 0, 0}, "arr")
+	p.NewTag(stTestPos{}, "pos")
+	return p
+}
+
+func TestST(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		tag  string
+		want float64
+	}{
+		{"assign", "a := 2 + 3 * 4;", "a", 14},
+		{"paren", "a := (2 + 3) * 4;", "a", 20},
+		{"div", "a := 7 / 2;", "a", 3},
+		{"mod", "a := 7 MOD 3;", "a", 1},
+		{"real", "r := 7 / 2.0;", "r", 3.5},
+		{"neg", "a := -5 + 1;", "a", -4},
+		{"bool", "flag := 3 > 2 AND NOT (1 = 2);", "flag", 1},
+		{"if", "IF a = 0 THEN b := 1; ELSIF a = 1 THEN b := 2; ELSE b := 3; END_IF;", "b", 1},
+		{"case", "a := 5; CASE a OF 1: b := 1; 2, 3: b := 2; 4..6: b := 3; ELSE b := 4; END_CASE;", "b", 3},
+		{"case else", "a := 9; CASE a OF 1: b := 1; ELSE b := 4; END_CASE;", "b", 4},
+		{"for", "VAR i : INT; END_VAR FOR i := 0 TO 4 DO arr[i] := i * 10; END_FOR; a := arr[3];", "a", 30},
+		{"for by", "VAR i : INT; END_VAR a := 0; FOR i := 10 TO 1 BY -3 DO a := a + i; END_FOR;", "a", 22},
+		{"while", "a := 0; WHILE a < 10 DO a := a + 3; END_WHILE;", "a", 12},
+		{"repeat", "a := 0; REPEAT a := a + 1; UNTIL a >= 4 END_REPEAT;", "a", 4},
+		{"exit", "VAR i : DINT; END_VAR FOR i := 1 TO 100 DO IF i = 7 THEN EXIT; END_IF; END_FOR; a := i;", "a", 7},
+		{"struct", "pos.X := 10; pos.Y := pos.X * 2; a := pos.Y;", "a", 20},
+		{"struct real", "pos.F := 1.5; r := pos.F * 2;", "r", 3},
+		{"bit", "a := 0; a.3 := TRUE; b := a;", "b", 8},
+		{"bit read", "a := 5; flag := a.2;", "flag", 1},
+		{"func", "r := SQRT(16.0) + ABS(-2) + MAX(1, 7, 3);", "r", 13},
+		{"limit", "a := LIMIT(0, 150, 100);", "a", 100},
+		{"conv", "a := REAL_TO_DINT(2.6);", "a", 3},
+		{"time", "a := T#1m30s;", "a", 90000},
+		{"hex", "a := 16#FF;", "a", 255},
+		{"local", "VAR x : INT := 5; END_VAR a := x * 2;", "a", 10},
+		{"program", "PROGRAM Main (* comment *) VAR x : DINT; END_VAR x := 3; a := x; // comment\nEND_PROGRAM", "a", 3},
+		{"return", "a := 1; RETURN; a := 2;", "a", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testSTPLC(t)
+			s, err := p.CompileST(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Scan(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.ReadNum(tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %v, want %v", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSTErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		compile bool
+	}{
+		{"missing semicolon", "a := 1", true},
+		{"unterminated if", "IF a = 1 THEN a := 2;", true},
+		{"bad char", "a := 1 $ 2;", true},
+		{"unknown type", "VAR x : FOO; END_VAR", true},
+		{"not fb", "a();", true},
+		{"unknown tag", "nosuchtag := 1;", false},
+		{"division by zero", "a := 1 / 0;", false},
+		{"endless loop", "WHILE TRUE DO a := 1; END_WHILE;", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testSTPLC(t)
+			s, err := p.CompileST(tt.src)
+			if tt.compile {
+				if err == nil {
+					t.Error("compile error expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Scan() == nil {
+				t.Error("scan error expected")
+			}
+		})
+	}
+}
+
+func TestSTFunctionBlocks(t *testing.T) {
+	p := testSTPLC(t)
+	s, err := p.CompileST(`VAR c : CTU; END_VAR
+		c(CU := flag, PV := 3);
+		a := c.CV;
+		IF c.Q THEN b := 1; END_IF;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		p.WriteNum("flag", 1)
+		s.Scan()
+		p.WriteNum("flag", 0)
+		s.Scan()
+	}
+	if a, _ := p.ReadNum("a"); a != 3 {
+		t.Errorf("CTU CV = %v, want 3", a)
+	}
+	if b, _ := p.ReadNum("b"); b != 1 {
+		t.Errorf("CTU Q = %v, want 1", b)
+	}
+
+	now := time.Now()
+	ton := &stTimer{pt: 100}
+	ton.set("IN", stB(true))
+	ton.call(now)
+	ton.call(now.Add(50 * time.Millisecond))
+	if ton.q || ton.et != 50 {
+		t.Errorf("TON early Q=%v ET=%v", ton.q, ton.et)
+	}
+	ton.call(now.Add(150 * time.Millisecond))
+	if !ton.q || ton.et != 100 {
+		t.Errorf("TON Q=%v ET=%v", ton.q, ton.et)
+	}
+
+	tof := &stTimer{off: true, pt: 100}
+	tof.set("IN", stB(true))
+	tof.call(now)
+	tof.set("IN", stB(false))
+	tof.call(now.Add(10 * time.Millisecond))
+	if !tof.q {
+		t.Error("TOF Q dropped too early")
+	}
+	tof.call(now.Add(120 * time.Millisecond))
+	if tof.q {
+		t.Error("TOF Q still set")
+	}
+}
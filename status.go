@@ -0,0 +1,126 @@
+package plcconnector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// CIPError is the error status of the response, use errors.As to get it from errors returned by the client.
+type CIPError struct {
+	Service   uint8    // service of the request
+	Status    uint8    // general status
+	AddStatus []uint16 // additional (extended) status
+}
+
+func (e *CIPError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s (status 0x%02X", serviceName(e.Service), StatusText(e.Status), e.Status)
+	for _, x := range e.AddStatus {
+		fmt.Fprintf(&b, " 0x%04X", x)
+	}
+	b.WriteByte(')')
+	if len(e.AddStatus) > 0 {
+		if t, ok := extStatusText[uint32(e.Status)<<16|uint32(e.AddStatus[0])]; ok {
+			b.WriteString(": " + t)
+		}
+	}
+	return b.String()
+}
+
+// Extended returns the first extended status word, 0 if none.
+func (e *CIPError) Extended() uint16 {
+	if len(e.AddStatus) == 0 {
+		return 0
+	}
+	return e.AddStatus[0]
+}
+
+var statusText = map[uint8]string{
+	Success:                      "success",
+	ConnFailure:                  "connection failure",
+	0x02:                         "resource unavailable",
+	0x03:                         "invalid parameter value",
+	PathSegmentError:             "path segment error",
+	PathUnknown:                  "path destination unknown",
+	PartialTransfer:              "partial transfer",
+	0x07:                         "connection lost",
+	ServNotSup:                   "service not supported",
+	0x09:                         "invalid attribute value",
+	AttrListError:                "attribute list error",
+	0x0B:                         "already in requested mode/state",
+	ObjectStateConflict:          "object state conflict",
+	0x0D:                         "object already exists",
+	AttrNotSettable:              "attribute not settable",
+	PrivilegeViol:                "privilege violation",
+	DeviceStateConflict:          "device state conflict",
+	ReplyTooLarge:                "reply data too large",
+	0x12:                         "fragmentation of a primitive value",
+	NotEnoughData:                "not enough data",
+	AttrNotSup:                   "attribute not supported",
+	TooMuchData:                  "too much data",
+	ObjectNotExist:               "object does not exist",
+	0x17:                         "service fragmentation sequence not in progress",
+	0x18:                         "no stored attribute data",
+	0x19:                         "store operation failure",
+	0x1A:                         "routing failure, request packet too large",
+	0x1B:                         "routing failure, response packet too large",
+	0x1C:                         "missing attribute list entry data",
+	0x1D:                         "invalid attribute value list",
+	cip.StatusEmbeddedServiceErr: "embedded service error",
+	0x1F:                         "vendor specific error",
+	InvalidPar:                   "invalid parameter",
+	0x25:                         "key failure in path",
+	0x26:                         "path size invalid",
+	0x27:                         "unexpected attribute in list",
+	0x28:                         "invalid member ID",
+	0x29:                         "member not settable",
+	0xFF:                         "general error",
+}
+
+// extStatusText by general status << 16 | extended status, Connection Manager and Logix codes.
+var extStatusText = map[uint32]string{
+	0x01<<16 | 0x0100: "connection in use or duplicate forward open",
+	0x01<<16 | 0x0103: "transport class and trigger combination not supported",
+	0x01<<16 | 0x0106: "ownership conflict",
+	0x01<<16 | 0x0107: "target connection not found",
+	0x01<<16 | 0x0108: "invalid network connection parameter",
+	0x01<<16 | 0x0109: "invalid connection size",
+	0x01<<16 | 0x0110: "target for connection not configured",
+	0x01<<16 | 0x0111: "RPI not supported",
+	0x01<<16 | 0x0113: "out of connections",
+	0x01<<16 | 0x0114: "vendor ID or product code mismatch",
+	0x01<<16 | 0x0115: "product type mismatch",
+	0x01<<16 | 0x0116: "revision mismatch",
+	0x01<<16 | 0x0117: "invalid produced or consumed application path",
+	0x01<<16 | 0x0118: "invalid or inconsistent configuration application path",
+	0x01<<16 | 0x011A: "target object out of connections",
+	0x01<<16 | 0x0203: "connection timed out",
+	0x01<<16 | 0x0204: "unconnected request timed out",
+	0x01<<16 | 0x0205: "parameter error in unconnected request",
+	0x01<<16 | 0x0311: "invalid port ID in route path",
+	0x01<<16 | 0x0312: "invalid link address in route path",
+	0x01<<16 | 0x0315: "invalid segment in connection path",
+	0xFF<<16 | 0x2101: "keyswitch position prevents the service",
+	0xFF<<16 | 0x2104: "offset beyond end of the tag",
+	0xFF<<16 | 0x2105: "access beyond end of the tag",
+	0xFF<<16 | 0x2107: "data type mismatch",
+}
+
+// StatusText returns the description of the general status.
+func StatusText(status uint8) string {
+	if t, ok := statusText[status]; ok {
+		return t
+	}
+	return "unknown status"
+}
+
+// respError returns CIPError of the response.
+func respError(resp cip.Response) error {
+	e := &CIPError{Service: resp.Service &^ cip.ServiceReply, Status: resp.Status}
+	if len(resp.AddStatus) > 0 {
+		e.AddStatus = append([]uint16(nil), resp.AddStatus...)
+	}
+	return e
+}
@@ -0,0 +1,309 @@
+package plcconnector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const subEventsLen = 100
+
+// Quality of the subscribed tag value.
+type Quality int
+
+// Qualities
+const (
+	QualityGood  Quality = iota // read successfully
+	QualityStale                // read failed, e.g. connection lost, Tag is the last good value
+	QualityBad                  // rejected by the target, e.g. unknown tag, see Err
+)
+
+func (q Quality) String() string {
+	switch q {
+	case QualityGood:
+		return "good"
+	case QualityStale:
+		return "stale"
+	case QualityBad:
+		return "bad"
+	}
+	return "unknown"
+}
+
+// TagEvent is sent when the value moves beyond the deadband or the quality changes.
+type TagEvent struct {
+	Path    string // as subscribed
+	Tag     *Tag   // nil if never read
+	Quality Quality
+	Err     error // reason of the quality other than good
+	Time    time.Time
+}
+
+// Subscription reads tags periodically, see Client.Subscribe.
+type Subscription struct {
+	c      *Client
+	sc     *scanClass
+	items  []*subItem
+	events chan TagEvent
+	done   chan struct{} // closed with events
+	closed bool          // guarded by c.mu
+}
+
+type subItem struct {
+	sub      *Subscription
+	path     string
+	tag      string
+	count    int
+	deadband float64
+	large    bool // read by ReadTag, too large for Multiple Service Packet
+	sent     bool
+	last     *Tag // last sent value
+	quality  Quality
+}
+
+// scanClass reads tags of the subscriptions with the same interval together.
+type scanClass struct {
+	interval time.Duration
+	items    []*subItem
+	stop     chan struct{}
+}
+
+// Subscribe reads the tags every interval and sends TagEvent when the value or quality changes. Elements of numeric types must move by deadband at least.
+// Count of the array elements is given in braces, e.g. "arr{10}". Tags of all subscriptions with the same interval are read in Multiple Service Packets, large ones fragmented.
+func (c *Client) Subscribe(paths []string, interval time.Duration, deadband float64) (*Subscription, error) {
+	return c.SubscribeContext(context.Background(), paths, interval, deadband)
+}
+
+// SubscribeContext is Subscribe with the context, the subscription is closed when the context is done.
+func (c *Client) SubscribeContext(ctx context.Context, paths []string, interval time.Duration, deadband float64) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, errors.New("invalid interval")
+	}
+	sub := &Subscription{c: c, events: make(chan TagEvent, subEventsLen), done: make(chan struct{})}
+	for _, p := range paths {
+		it := &subItem{sub: sub, path: p, tag: p, count: 1, deadband: deadband}
+		if i := strings.LastIndexByte(p, '{'); i >= 0 && strings.HasSuffix(p, "}") {
+			n, err := strconv.Atoi(p[i+1 : len(p)-1])
+			if err != nil || n < 1 || n > 0xFFFF {
+				return nil, errors.New(p + ": invalid count")
+			}
+			it.tag, it.count = p[:i], n
+		}
+		if constructPath(parsePath(it.tag)) == nil {
+			return nil, errors.New(p + ": path parse error")
+		}
+		sub.items = append(sub.items, it)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errClientClosed
+	}
+	sc, ok := c.scans[interval]
+	if !ok {
+		sc = &scanClass{interval: interval, stop: make(chan struct{})}
+		if c.scans == nil {
+			c.scans = make(map[time.Duration]*scanClass)
+		}
+		c.scans[interval] = sc
+		go c.scan(sc)
+	}
+	sc.items = append(sc.items, sub.items...)
+	sub.sc = sc
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+			case <-sub.done:
+			}
+		}()
+	}
+	return sub, nil
+}
+
+// Events returns channel of the tag events, closed by Close. Events are dropped when channel is full and sent again on the next scan.
+func (s *Subscription) Events() <-chan TagEvent {
+	return s.events
+}
+
+// Close stops reading the tags.
+func (s *Subscription) Close() {
+	c := s.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.events)
+	close(s.done)
+	sc := s.sc
+	items := sc.items[:0]
+	for _, it := range sc.items {
+		if it.sub != s {
+			items = append(items, it)
+		}
+	}
+	sc.items = items
+	if len(items) == 0 && c.scans[sc.interval] == sc {
+		delete(c.scans, sc.interval)
+		close(sc.stop)
+	}
+}
+
+// closeScans closes all subscriptions, c.mu is held by the caller.
+func (c *Client) closeScans() {
+	for _, sc := range c.scans {
+		for _, it := range sc.items {
+			if !it.sub.closed {
+				it.sub.closed = true
+				close(it.sub.events)
+				close(it.sub.done)
+			}
+		}
+		close(sc.stop)
+	}
+	c.scans = nil
+}
+
+// scan polls the scan class until it is stopped.
+func (c *Client) scan(sc *scanClass) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-sc.stop
+		cancel()
+	}()
+	t := time.NewTicker(sc.interval)
+	defer t.Stop()
+	for {
+		c.poll(ctx, sc)
+		select {
+		case <-t.C:
+		case <-sc.stop:
+			return
+		}
+	}
+}
+
+// poll reads the tags of the scan class once.
+func (c *Client) poll(ctx context.Context, sc *scanClass) {
+	c.mu.Lock()
+	items := append([]*subItem(nil), sc.items...)
+	online := c.s != nil
+	c.mu.Unlock()
+	now := time.Now()
+	if !online { // don't wait for the reconnection
+		for _, it := range items {
+			c.update(it, nil, errNotConnected, now)
+		}
+		return
+	}
+
+	var (
+		batch  []*subItem
+		tags   []string
+		counts []int
+	)
+	for _, it := range items {
+		if it.large {
+			tg, err := c.ReadTagContext(ctx, it.tag, it.count)
+			if ctx.Err() != nil {
+				return
+			}
+			c.update(it, tg, err, now)
+			continue
+		}
+		batch = append(batch, it)
+		tags = append(tags, it.tag)
+		counts = append(counts, it.count)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	res, err := c.readTags(ctx, tags, counts)
+	if ctx.Err() != nil {
+		return
+	}
+	limit := c.batchSize()
+	for i, it := range batch {
+		if err != nil {
+			c.update(it, nil, err, now)
+			continue
+		}
+		if tg := res[i].Tag; tg != nil && len(tg.data) > limit {
+			it.large = true
+		}
+		c.update(it, res[i].Tag, res[i].Err, now)
+	}
+}
+
+// update sends the event if the value moved beyond the deadband or the quality changed.
+func (c *Client) update(it *subItem, tg *Tag, err error, now time.Time) {
+	q := QualityGood
+	if err != nil {
+		var ce *CIPError
+		q = QualityStale
+		if errors.As(err, &ce) {
+			q = QualityBad
+		}
+		tg = it.last
+	} else {
+		tg.Name = it.path
+	}
+	if it.sent && q == it.quality && (err != nil || !beyond(it.last, tg, it.deadband)) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if it.sub.closed {
+		return
+	}
+	select {
+	case it.sub.events <- TagEvent{Path: it.path, Tag: tg, Quality: q, Err: err, Time: now}:
+		it.sent = true
+		it.last = tg
+		it.quality = q
+	default:
+		c.log(LevelDebug, "tag event dropped", "path", it.path)
+	}
+}
+
+// beyond reports whether any element of t moved beyond the deadband from old, other than numeric values on any change.
+func beyond(old, t *Tag, deadband float64) bool {
+	if old == nil || old.Type != t.Type || len(old.data) != len(t.data) {
+		return true
+	}
+	l := int(typeLen(uint16(t.Type)))
+	if deadband <= 0 || l == 0 || !numeric(t.Type) {
+		return !bytes.Equal(old.data, t.data)
+	}
+	for i := 0; i+l <= len(t.data); i += l {
+		a, b := numFromBytes(t.Type, old.data[i:]), numFromBytes(t.Type, t.data[i:])
+		if a != b && math.Abs(a-b) >= deadband {
+			return true
+		}
+	}
+	return false
+}
+
+func numeric(typ int) bool {
+	if typ >= TypeStructHead {
+		return false
+	}
+	switch (Tag{Type: typ}).NumType() {
+	case TypeSINT, TypeUSINT, TypeINT, TypeUINT, TypeDINT, TypeUDINT, TypeLINT, TypeULINT, TypeREAL, TypeLREAL:
+		return true
+	}
+	return false
+}
@@ -1,13 +1,15 @@
 package plcconnector
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"math"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type structData struct {
@@ -31,9 +33,11 @@ type Tag struct {
 	in     *Instance
 	offset int
 	prot   uint8
-	write  bool // TODO mutex
+	write  bool
 	getter func() []uint8
 	setter func([]uint8) uint8
+	m      *sync.RWMutex // data lock of tags in the database
+	stats  *tagStats
 }
 
 func (st structData) Elem(n string) *Tag {
@@ -723,10 +727,36 @@ func (t *Tag) SetDataBytes(dt []byte) uint8 {
 	if len(dt) < len(t.data) {
 		return NotEnoughData
 	}
+	t.lock()
 	copy(t.data, dt)
+	t.unlock()
 	return Success
 }
 
+func (t *Tag) lock() {
+	if t.m != nil {
+		t.m.Lock()
+	}
+}
+
+func (t *Tag) unlock() {
+	if t.m != nil {
+		t.m.Unlock()
+	}
+}
+
+func (t *Tag) rlock() {
+	if t.m != nil {
+		t.m.RLock()
+	}
+}
+
+func (t *Tag) runlock() {
+	if t.m != nil {
+		t.m.RUnlock()
+	}
+}
+
 // DataBytes returns array of bytes.
 func (t *Tag) DataBytes() []byte {
 	if t.getter != nil {
@@ -823,8 +853,6 @@ func (t *Tag) DataString() string {
 		return string(t.data[2:])
 	case TypeSHORTSTRING:
 		return string(t.data[1:])
-	default:
-		fmt.Println("DataString error", t.Type)
 	}
 	return "error string"
 }
@@ -862,6 +890,43 @@ func (p *PLC) tagError(service int, status int, tag *Tag) {
 	}
 }
 
+// notifyWrite is called with tMut locked after data of the tag was changed.
+func (p *PLC) notifyWrite(t *Tag) {
+	p.alarmCheck(t)
+	p.histCheck(t)
+}
+
+// lockTags locks tMut for writing. Data of the tag is changed only with tMut and the tag locked,
+// so single tag reads need only the tag lock while no writer holds tMut.
+func (p *PLC) lockTags() {
+	p.tMut.Lock()
+	atomic.StoreInt32(&p.writing, 1)
+}
+
+func (p *PLC) unlockTags() {
+	atomic.StoreInt32(&p.writing, 0)
+	p.tMut.Unlock()
+}
+
+// tag returns tag by name without locking tMut.
+func (p *PLC) tag(name string) (*Tag, bool) {
+	t, ok := p.tagIdx.Load(strings.ToLower(name))
+	if !ok {
+		return nil, false
+	}
+	return t.(*Tag), true
+}
+
+func (p *PLC) symbolName(instance int) (string, bool) {
+	p.symbols.m.RLock()
+	in, ok := p.symbols.inst[instance]
+	p.symbols.m.RUnlock()
+	if !ok {
+		return "", false
+	}
+	return in.attr[1].DataString(), true
+}
+
 func (p *PLC) parsePathEl(path []pathEl) (*Tag, uint32, int, int, int, error) {
 	var (
 		copyFrom int
@@ -885,25 +950,25 @@ func (p *PLC) parsePathEl(path []pathEl) (*Tag, uint32, int, int, int, error) {
 				pi = 2
 			} else if len(path) > 2 && path[1].typ == pathClass && path[1].val == SymbolClass && path[2].typ == pathInstance {
 				pi = 3
-				inst, ok := p.symbols.inst[path[2].val]
+				name, ok := p.symbolName(path[2].val)
 				if !ok {
 					return nil, 0, 0, 0, 0, errors.New("path no tag")
 				}
-				tag = inst.attr[1].DataString()
+				tag = name
 			}
 		} else {
 			tag = path[0].txt
 		}
 	} else if len(path) > 1 && path[0].typ == pathClass && path[0].val == SymbolClass && path[1].typ == pathInstance {
 		pi = 2
-		inst, ok := p.symbols.inst[path[1].val]
+		name, ok := p.symbolName(path[1].val)
 		if !ok {
 			return nil, 0, 0, 0, 0, errors.New("path no tag")
 		}
-		tag = inst.attr[1].DataString()
+		tag = name
 	}
 
-	tg, ok := p.tags[strings.ToLower(tag)]
+	tg, ok := p.tag(tag)
 
 	if !ok {
 		return nil, 0, 0, 0, 0, errors.New("path no tag")
@@ -936,7 +1001,7 @@ func (p *PLC) parsePathEl(path []pathEl) (*Tag, uint32, int, int, int, error) {
 			memb = path[i].txt
 			el := tgc.st.Elem(memb)
 			if el == nil {
-				fmt.Println("no member", memb, "in struct", tgc.Name)
+				p.debug("no member in struct", "member", memb, "struct", tgc.Name)
 				return nil, 0, 0, 0, 0, errors.New("path no member in struct")
 			}
 			tl = el.Len()
@@ -953,49 +1018,67 @@ func (p *PLC) parsePathEl(path []pathEl) (*Tag, uint32, int, int, int, error) {
 	if tgc.st == nil {
 		tgtyp &= TypeType
 	}
-	p.debug(tgc.TypeString())
+	if p.Verbose {
+		p.debug("path", "type", tgc.TypeString())
+	}
 
 	return tg, tgtyp, tl, copyFrom, index, nil
 }
 
-func (p *PLC) readTag(path []pathEl, count uint16) ([]uint8, uint32, int, bool) {
-	p.tMut.RLock()
-	defer p.tMut.RUnlock()
+// tagView is part of the tag selected for reading.
+type tagView struct {
+	tg    *Tag
+	typ   uint32
+	elLen int
+	from  int
+	n     int // length in bytes
+	bit   int // BOOL member of the struct, -1 otherwise
+	index int
+}
 
+// viewTag resolves path for reading count elements, data of the tag isn't accessed.
+func (p *PLC) viewTag(path []pathEl, count uint16) (tagView, bool) {
 	tg, tgtyp, tl, copyFrom, index, err := p.parsePathEl(path)
 	if err != nil {
 		p.tagError(ReadTag, PathSegmentError, nil)
-		return nil, 0, 0, false
+		return tagView{}, false
 	}
-
-	copyLen := int(count) * tl
-	tgdata := make([]uint8, copyLen)
-	if copyFrom+copyLen > len(tg.data) {
+	v := tagView{tg: tg, typ: tgtyp, elLen: tl, from: copyFrom, n: int(count) * tl, bit: -1, index: index}
+	if tg.st != nil && tgtyp == TypeBOOL {
+		v.bit, v.elLen, v.n = tl, 1, 1
+	}
+	if v.bit >= 8 || copyFrom+v.n > len(tg.data) {
 		p.tagError(ReadTag, PathSegmentError, nil)
-		return nil, 0, 0, false
+		return tagView{}, false
 	}
-	if tg.st != nil && tgtyp == TypeBOOL {
-		if tl >= 8 {
-			panic("tl >= 8")
-		}
-		tgdata = make([]uint8, 1)
-		if ((tg.data[copyFrom] >> tl) & 1) > 0 {
-			tgdata[0] = 0xFF
+	return v, true
+}
+
+// readView writes n bytes of the view starting at offset to b.
+// Caller must hold tMut or make sure no writer holds it, see lockTags.
+func (p *PLC) readView(b *bytes.Buffer, v *tagView, offset, n int) {
+	start := b.Len()
+	v.tg.rlock()
+	if v.bit >= 0 {
+		if (v.tg.data[v.from]>>v.bit)&1 > 0 {
+			b.WriteByte(0xFF)
 		} else {
-			tgdata[0] = 0
+			b.WriteByte(0)
 		}
 	} else {
-		copy(tgdata, tg.data[copyFrom:])
+		b.Write(v.tg.data[v.from+offset : v.from+offset+n])
 	}
+	v.tg.runlock()
+	v.tg.countRead()
 
-	p.tagError(ReadTag, Success, &Tag{Name: tg.Name, Type: int(tgtyp), Index: index, data: tgdata})
-	return tgdata, tgtyp, tl, true
+	if p.callback != nil {
+		data := append([]uint8(nil), b.Bytes()[start:]...)
+		p.tagError(ReadTag, Success, &Tag{Name: v.tg.Name, Type: int(v.typ), Index: v.index, data: data})
+	}
 }
 
-func (p *PLC) readModWriteTag(path []pathEl, orMask, andMask []uint8) bool {
-	p.tMut.Lock()
-	defer p.tMut.Unlock()
-
+// readModWriteTag must be called with tMut locked.
+func (p *PLC) readModWriteTag(path []pathEl, orMask, andMask []uint8, ctx auditCtx) bool {
 	tg, tgtyp, _, copyFrom, index, err := p.parsePathEl(path)
 	if err != nil {
 		p.tagError(ReadModifyWrite, PathSegmentError, nil)
@@ -1007,21 +1090,34 @@ func (p *PLC) readModWriteTag(path []pathEl, orMask, andMask []uint8) bool {
 		return false
 	}
 
+	audit := p.auditEnabled()
+	var old []uint8
+	if audit {
+		old = append(old, tg.data[copyFrom:copyFrom+len(orMask)]...)
+	}
+	tg.lock()
 	for i, or := range orMask {
 		tg.data[copyFrom+i] |= or
 	}
 	for i, and := range andMask {
 		tg.data[copyFrom+i] &= and
 	}
+	tg.unlock()
+	tg.countWrite()
+	p.notifyWrite(tg)
+	if audit {
+		p.audit(ctx, pathString(path), old, tg.data[copyFrom:copyFrom+len(orMask)], Success)
+	}
 
-	p.tagError(ReadModifyWrite, Success, &Tag{Name: tg.Name, Type: int(tgtyp), Index: index, data: tg.data[copyFrom : copyFrom+len(orMask)]})
+	if p.callback != nil {
+		data := append([]uint8(nil), tg.data[copyFrom:copyFrom+len(orMask)]...)
+		p.tagError(ReadModifyWrite, Success, &Tag{Name: tg.Name, Type: int(tgtyp), Index: index, data: data})
+	}
 	return true
 }
 
-func (p *PLC) saveTag(path []pathEl, typ uint16, count int, data []uint8, offset int) bool {
-	p.tMut.Lock()
-	defer p.tMut.Unlock()
-
+// saveTag must be called with tMut locked.
+func (p *PLC) saveTag(path []pathEl, typ uint16, count int, data []uint8, offset int, ctx auditCtx) bool {
 	tg, tgtyp, tl, copyFrom, index, err := p.parsePathEl(path)
 	if err != nil {
 		p.tagError(WriteTag, PathSegmentError, nil)
@@ -1032,10 +1128,21 @@ func (p *PLC) saveTag(path []pathEl, typ uint16, count int, data []uint8, offset
 		p.tagError(WriteTag, TooMuchData, nil)
 		return false
 	}
+	from, to := copyFrom+offset, copyFrom+offset+len(data)
 	if tg.st != nil && tgtyp == TypeBOOL {
-		if tl >= 8 {
-			panic("tl >= 8")
+		if tl >= 8 || len(data) == 0 || from >= len(tg.data) {
+			p.tagError(WriteTag, PathSegmentError, nil)
+			return false
 		}
+		to = from + 1
+	}
+	audit := p.auditEnabled()
+	var old []uint8
+	if audit {
+		old = append(old, tg.data[from:to]...)
+	}
+	tg.lock()
+	if tg.st != nil && tgtyp == TypeBOOL {
 		if data[0] == 0 {
 			tg.data[copyFrom+offset] &^= 1 << tl
 		} else {
@@ -1044,11 +1151,203 @@ func (p *PLC) saveTag(path []pathEl, typ uint16, count int, data []uint8, offset
 	} else {
 		copy(tg.data[copyFrom+offset:], data)
 	}
+	tg.unlock()
+	tg.countWrite()
+	p.notifyWrite(tg)
+	if audit {
+		p.audit(ctx, pathString(path), old, tg.data[from:to], Success)
+	}
 
-	p.tagError(WriteTag, Success, &Tag{Name: tg.Name, Type: int(tgtyp), Index: index, data: data})
+	if p.callback != nil {
+		p.tagError(WriteTag, Success, &Tag{Name: tg.Name, Type: int(tgtyp), Index: index, data: append([]uint8(nil), data...)})
+	}
 	return true
 }
 
+func numFromBytes(typ int, b []uint8) float64 {
+	switch (Tag{Type: typ}).NumType() {
+	case TypeBOOL:
+		if b[0] != 0 {
+			return 1
+		}
+		return 0
+	case TypeSINT:
+		return float64(int8(b[0]))
+	case TypeUSINT:
+		return float64(b[0])
+	case TypeINT:
+		return float64(int16(binary.LittleEndian.Uint16(b)))
+	case TypeUINT:
+		return float64(binary.LittleEndian.Uint16(b))
+	case TypeDINT:
+		return float64(int32(binary.LittleEndian.Uint32(b)))
+	case TypeUDINT:
+		return float64(binary.LittleEndian.Uint32(b))
+	case TypeLINT:
+		return float64(int64(binary.LittleEndian.Uint64(b)))
+	case TypeULINT:
+		return float64(binary.LittleEndian.Uint64(b))
+	case TypeREAL:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case TypeLREAL:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+func numToBytes(typ int, v float64) []uint8 {
+	b := make([]uint8, typeLen(uint16(typ)))
+	switch (Tag{Type: typ}).NumType() {
+	case TypeBOOL:
+		if v != 0 {
+			b[0] = 0xFF
+		}
+	case TypeSINT, TypeUSINT:
+		b[0] = uint8(int64(v))
+	case TypeINT, TypeUINT:
+		binary.LittleEndian.PutUint16(b, uint16(int64(v)))
+	case TypeDINT, TypeUDINT:
+		binary.LittleEndian.PutUint32(b, uint32(int64(v)))
+	case TypeLINT:
+		binary.LittleEndian.PutUint64(b, uint64(int64(v)))
+	case TypeULINT:
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	case TypeREAL:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v)))
+	case TypeLREAL:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+func isNumType(typ int) bool {
+	switch (Tag{Type: typ}).NumType() {
+	case TypeBOOL, TypeSINT, TypeUSINT, TypeINT, TypeUINT, TypeDINT, TypeUDINT, TypeLINT, TypeULINT, TypeREAL, TypeLREAL:
+		return typ < TypeStructHead
+	}
+	return false
+}
+
+func splitBit(path []pathEl) ([]pathEl, int) {
+	if n := len(path); n > 0 && path[n-1].typ == pathBit {
+		return path[:n-1], path[n-1].val
+	}
+	return path, -1
+}
+
+// readNum returns single numeric element pointed by path, must be called with tMut locked.
+func (p *PLC) readNum(path []pathEl) (float64, int, error) {
+	path, bit := splitBit(path)
+	tg, tgtyp, tl, copyFrom, _, err := p.parsePathEl(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	typ := int(tgtyp)
+	if tg.st != nil && typ == TypeBOOL {
+		if tl >= 8 || copyFrom >= len(tg.data) {
+			return 0, 0, errors.New("path bit out of range")
+		}
+		return float64((tg.data[copyFrom] >> tl) & 1), TypeBOOL, nil
+	}
+	if !isNumType(typ) {
+		return 0, 0, errors.New("path is not numeric")
+	}
+	ln := int(typeLen(uint16(typ)))
+	if copyFrom+ln > len(tg.data) {
+		return 0, 0, errors.New("path index too big")
+	}
+	v := numFromBytes(typ, tg.data[copyFrom:copyFrom+ln])
+	if bit >= 0 {
+		if bit >= 8*ln {
+			return 0, 0, errors.New("path bit out of range")
+		}
+		return float64((uint64(int64(v)) >> bit) & 1), TypeBOOL, nil
+	}
+	return v, typ, nil
+}
+
+// writeNum sets single numeric element pointed by path, must be called with tMut locked.
+func (p *PLC) writeNum(path []pathEl, v float64) error {
+	tg, err := p.setNum(path, v)
+	if err == nil {
+		p.notifyWrite(tg)
+	}
+	return err
+}
+
+// setNum is writeNum without write notification.
+func (p *PLC) setNum(path []pathEl, v float64) (*Tag, error) {
+	path, bit := splitBit(path)
+	tg, tgtyp, tl, copyFrom, _, err := p.parsePathEl(path)
+	if err != nil {
+		return nil, err
+	}
+	typ := int(tgtyp)
+	if tg.st != nil && typ == TypeBOOL {
+		if tl >= 8 || copyFrom >= len(tg.data) {
+			return nil, errors.New("path bit out of range")
+		}
+		tg.lock()
+		if v == 0 {
+			tg.data[copyFrom] &^= 1 << tl
+		} else {
+			tg.data[copyFrom] |= 1 << tl
+		}
+		tg.unlock()
+		return tg, nil
+	}
+	if !isNumType(typ) {
+		return nil, errors.New("path is not numeric")
+	}
+	ln := int(typeLen(uint16(typ)))
+	if copyFrom+ln > len(tg.data) {
+		return nil, errors.New("path index too big")
+	}
+	if bit >= 0 {
+		if bit >= 8*ln {
+			return nil, errors.New("path bit out of range")
+		}
+		x := uint64(int64(numFromBytes(typ, tg.data[copyFrom:copyFrom+ln])))
+		if v == 0 {
+			x &^= 1 << bit
+		} else {
+			x |= 1 << bit
+		}
+		v = float64(int64(x))
+		if typ == TypeULINT {
+			v = float64(x)
+		}
+	}
+	b := numToBytes(typ, v)
+	tg.lock()
+	copy(tg.data[copyFrom:], b)
+	tg.unlock()
+	return tg, nil
+}
+
+// ReadNum returns numeric value of the tag or member path, e.g. "pos1.x" or "testDINT[2].3".
+func (p *PLC) ReadNum(path string) (float64, error) {
+	pth := parsePath(path)
+	if pth == nil {
+		return 0, errPath
+	}
+	p.tMut.RLock()
+	defer p.tMut.RUnlock()
+	v, _, err := p.readNum(pth)
+	return v, err
+}
+
+// WriteNum sets numeric value of the tag or member path.
+func (p *PLC) WriteNum(path string, v float64) error {
+	pth := parsePath(path)
+	if pth == nil {
+		return errPath
+	}
+	p.lockTags()
+	defer p.unlockTags()
+	return p.writeNum(pth, v)
+}
+
 func (p *PLC) addTag(t Tag, instance int) {
 	if t.data == nil {
 		t.data = make([]uint8, t.ElemLen()*t.Dims())
@@ -1083,15 +1382,18 @@ func (p *PLC) addTag(t Tag, instance int) {
 
 	name := strings.ToLower(t.Name)
 	t.in = in
+	t.m = new(sync.RWMutex)
+	t.stats = new(tagStats)
 
-	p.tMut.Lock()
+	p.lockTags()
 	if instance == -1 {
 		p.symbols.SetInstance(p.symbols.lastInst+1, in)
 	} else {
 		p.symbols.SetInstance(instance, in)
 	}
 	p.tags[name] = &t
-	p.tMut.Unlock()
+	p.tagIdx.Store(name, &t)
+	p.unlockTags()
 
 	in = p.Class[0xAC].inst[1]
 	crc := in.attr[3].DataDINT()[0] + int32(crc16([]byte(name))) + int32(t.Type+t.Dims())
@@ -1106,22 +1408,27 @@ func (p *PLC) AddTag(t Tag) {
 
 // UpdateTag sets data to the tag
 func (p *PLC) UpdateTag(name string, offset int, data []uint8) bool {
-	p.tMut.Lock()
-	defer p.tMut.Unlock()
-	t, ok := p.tags[strings.ToLower(name)]
+	p.lockTags()
+	defer p.unlockTags()
+	t, ok := p.tag(name)
 	if !ok {
-		fmt.Println("plcconnector UpdateTag: no tag named ", name)
+		p.log(LevelWarn, "UpdateTag: no tag", "tag", name)
 		return false
 	}
 	offset *= t.ElemLen()
 	to := offset + len(data)
 	if to > len(t.data) {
-		fmt.Println("plcconnector UpdateTag: to large data ", name)
+		p.log(LevelWarn, "UpdateTag: too large data", "tag", name)
 		return false
 	}
+	old := append([]uint8(nil), t.data[offset:to]...)
+	t.lock()
 	for i := offset; i < to; i++ {
 		t.data[i] = data[i-offset]
 	}
+	t.unlock()
+	p.notifyWrite(t)
+	p.audit(auditCtx{service: "UpdateTag", source: "api"}, t.Name, old, data, Success)
 	return true
 }
 
@@ -1154,10 +1461,13 @@ func (p *PLC) addInOutTagForAssemblyClass(t Tag, instance int) {
 
 	name := strings.ToLower(t.Name)
 	t.in = in
+	t.m = new(sync.RWMutex)
+	t.stats = new(tagStats)
 
-	p.tMut.Lock()
+	p.lockTags()
 	p.tags[name] = &t
-	p.tMut.Unlock()
+	p.tagIdx.Store(name, &t)
+	p.unlockTags()
 }
 
 func (p *PLC) CreateInOutTagForAssemblyClass(typ string, name string, instance int, writable bool, getter func() []uint8, setter func([]uint8) uint8) {
@@ -0,0 +1,189 @@
+package plcconnector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+type testReader struct {
+	r  *req
+	rd *bytes.Reader
+}
+
+// newTestReader returns req for ReadTag/ReadTagFrag services without network connection.
+func newTestReader(p *PLC, maxData int) *testReader {
+	rd := bytes.NewReader(nil)
+	r := &req{p: p, class: -1, maxData: maxData, readBuf: bufio.NewReader(rd), writeBuf: new(bytes.Buffer)}
+	return &testReader{r: r, rd: rd}
+}
+
+// read returns status and data of the response.
+func (t *testReader) read(path []pathEl, service uint8, count uint16, offset uint32) (uint8, []uint8) {
+	r := t.r
+	body := []uint8{uint8(count), uint8(count >> 8)}
+	if service == ReadTagFrag {
+		body = append(body, uint8(offset), uint8(offset>>8), uint8(offset>>16), uint8(offset>>24))
+	}
+	t.rd.Reset(body)
+	r.readBuf.Reset(t.rd)
+	r.reset()
+	r.lenRem = len(body)
+	r.path = path
+	r.dataLen = len(body)
+	r.protd.Service = service
+	r.resp = cip.Response{Service: service + 128}
+	r.serviceHandle()
+	b := r.writeBuf.Bytes()
+	if r.resp.Status != Success && r.resp.Status != PartialTransfer {
+		return r.resp.Status, nil
+	}
+	return r.resp.Status, b[6:]
+}
+
+func TestReadTagService(t *testing.T) {
+	p := testSTPLC(t)
+	p.UpdateTag("arr", 0, []uint8{1, 0, 2, 0, 3, 0, 4, 0, 5, 0})
+	p.NewTag(struct{ On, Off bool }{true, false}, "bits")
+
+	tests := []struct {
+		name    string
+		path    string
+		service uint8
+		count   uint16
+		offset  uint32
+		maxData int
+		status  uint8
+		want    []uint8
+	}{
+		{"whole", "arr", ReadTag, 5, 0, 472, Success, []uint8{1, 0, 2, 0, 3, 0, 4, 0, 5, 0}},
+		{"element", "arr[3]", ReadTag, 1, 0, 472, Success, []uint8{4, 0}},
+		{"partial", "arr", ReadTag, 5, 0, 5, PartialTransfer, []uint8{1, 0, 2, 0}},
+		{"fragment", "arr", ReadTagFrag, 5, 6, 472, Success, []uint8{4, 0, 5, 0}},
+		{"bool member", "bits.On", ReadTag, 1, 0, 472, Success, []uint8{0xFF}},
+		{"too many", "arr", ReadTag, 6, 0, 472, PathSegmentError, nil},
+		{"bad offset", "arr", ReadTagFrag, 5, 10, 472, PathSegmentError, nil},
+		{"no tag", "none", ReadTag, 1, 0, 472, PathSegmentError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, data := newTestReader(p, tt.maxData).read(parsePath(tt.path), tt.service, tt.count, tt.offset)
+			if st != tt.status || !bytes.Equal(data, tt.want) {
+				t.Errorf("read() = %X, %v, want %X, %v", st, data, tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTagConcurrent(t *testing.T) {
+	p := testSTPLC(t)
+	p.NewTag(make([]int32, 100), "big")
+	path := parsePath("big")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr := newTestReader(p, 472)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, data := tr.read(path, ReadTag, 100, 0)
+				for _, b := range data {
+					if b != data[0] {
+						t.Error("torn read", data)
+						return
+					}
+				}
+			}
+		}()
+	}
+	buf := make([]uint8, 400)
+	for i := 0; i < 500; i++ {
+		for j := range buf {
+			buf[j] = uint8(i)
+		}
+		if i%2 == 0 {
+			p.UpdateTag("big", 0, buf)
+		} else {
+			p.Transaction(func(tx Tx) error { return tx.UpdateTag("big", 0, buf) })
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func benchPLC(b *testing.B) *PLC {
+	p, err := Init("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		p.NewTag(make([]int32, 100), n)
+	}
+	return p
+}
+
+func benchReadTag(b *testing.B, parallelism int, writer bool) {
+	p := benchPLC(b)
+	paths := [][]pathEl{parsePath("a"), parsePath("b"), parsePath("c"), parsePath("d"), parsePath("e"), parsePath("f"), parsePath("g"), parsePath("h")}
+	stop := make(chan struct{})
+	if writer {
+		go func() {
+			var x [4]uint8
+			for i := uint32(0); ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				binary.LittleEndian.PutUint32(x[:], i)
+				p.UpdateTag("a", int(i%100), x[:])
+			}
+		}()
+	}
+	b.ReportAllocs()
+	b.SetBytes(400)
+	b.SetParallelism(parallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		tr := newTestReader(p, 472)
+		for i := 0; pb.Next(); i++ {
+			tr.read(paths[i%len(paths)], ReadTag, 100, 0)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+}
+
+func BenchmarkReadTag(b *testing.B) {
+	p := benchPLC(b)
+	path := parsePath("a")
+	tr := newTestReader(p, 472)
+	b.ReportAllocs()
+	b.SetBytes(400)
+	for i := 0; i < b.N; i++ {
+		tr.read(path, ReadTag, 100, 0)
+	}
+}
+
+func BenchmarkReadTagParallel(b *testing.B) {
+	benchReadTag(b, 16, false)
+}
+
+func BenchmarkReadTagParallelWriter(b *testing.B) {
+	benchReadTag(b, 16, true)
+}
+
+func BenchmarkReadTagManyClients(b *testing.B) {
+	benchReadTag(b, 64, true)
+}
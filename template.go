@@ -0,0 +1,404 @@
+package plcconnector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// UDT is the structure definition read by ReadTemplate.
+type UDT struct {
+	Name     string
+	Instance int
+	Handle   int
+	Size     int // structure size in bytes
+	Members  []UDTMember
+}
+
+// UDTMember is the member of the structure.
+type UDTMember struct {
+	Name   string
+	Type   int // atomic type or template instance of the structure
+	Struct bool
+	Count  int // array size, 0 for scalar, bit number for BOOL
+	Offset int
+}
+
+// hidden reports whether the member is the host of BOOL members or other internal member.
+func (m UDTMember) hidden() bool {
+	return strings.HasPrefix(m.Name, "ZZZZZZZZZZ") || strings.HasPrefix(m.Name, "__")
+}
+
+// templateAttrs returns attributes 1, 2, 4 and 5 of the GetAttributeList reply of the Template instance.
+func templateAttrs(d []uint8) (map[uint16]uint32, error) {
+	if len(d) < 2 {
+		return nil, cip.ErrShort
+	}
+	n := int(binary.LittleEndian.Uint16(d))
+	d = d[2:]
+	attrs := make(map[uint16]uint32, n)
+	for i := 0; i < n; i++ {
+		if len(d) < 4 {
+			return nil, cip.ErrShort
+		}
+		id, status := binary.LittleEndian.Uint16(d), binary.LittleEndian.Uint16(d[2:])
+		d = d[4:]
+		if status != Success {
+			return nil, &CIPError{Service: GetAttrList, Status: uint8(status)}
+		}
+		switch id {
+		case 1, 2:
+			if len(d) < 2 {
+				return nil, cip.ErrShort
+			}
+			attrs[id] = uint32(binary.LittleEndian.Uint16(d))
+			d = d[2:]
+		case 4, 5:
+			if len(d) < 4 {
+				return nil, cip.ErrShort
+			}
+			attrs[id] = binary.LittleEndian.Uint32(d)
+			d = d[4:]
+		default:
+			return nil, fmt.Errorf("unexpected template attribute %d", id)
+		}
+	}
+	for _, id := range []uint16{1, 2, 4, 5} {
+		if _, ok := attrs[id]; !ok {
+			return nil, fmt.Errorf("missing template attribute %d", id)
+		}
+	}
+	return attrs, nil
+}
+
+// ReadTemplate reads the structure definition of the Template class instance, as listed in TagInfo.Type of the structure.
+func (c *Client) ReadTemplate(instance int) (*UDT, error) {
+	return c.ReadTemplateContext(context.Background(), instance)
+}
+
+// ReadTemplateContext is ReadTemplate with the context.
+func (c *Client) ReadTemplateContext(ctx context.Context, instance int) (*UDT, error) {
+	c.mu.Lock()
+	u, ok := c.udts[instance]
+	c.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+
+	d, err := c.GetAttributeListContext(ctx, TemplateClass, instance, []int{1, 2, 4, 5})
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := templateAttrs(d)
+	if err != nil {
+		return nil, err
+	}
+	u = &UDT{Instance: instance}
+	u.Handle = int(attrs[1])
+	members := int(attrs[2])
+	defSize := int(attrs[4])*4 - 23
+	u.Size = int(attrs[5])
+	if defSize < 8*members {
+		return nil, errors.New("template definition too short")
+	}
+
+	path := pathCIA(TemplateClass, instance, -1, -1)
+	var def []uint8
+	for {
+		req := appendUINT(appendUDINT(nil, uint32(len(def))), uint16(defSize-len(def)))
+		resp, err := c.request(ctx, path, ReadTemplate, req)
+		if err != nil {
+			return nil, err
+		}
+		def = append(def, resp.Data...)
+		if resp.Status == Success {
+			break
+		}
+		if len(resp.Data) == 0 {
+			return nil, errors.New("empty fragment")
+		}
+	}
+	if len(def) < 8*members {
+		return nil, cip.ErrShort
+	}
+
+	u.Members = make([]UDTMember, members)
+	for i := range u.Members {
+		m := &u.Members[i]
+		m.Count = int(binary.LittleEndian.Uint16(def[8*i:]))
+		typ := binary.LittleEndian.Uint16(def[8*i+2:])
+		m.Type = int(typ & TypeType)
+		m.Struct = typ&TypeStruct != 0
+		m.Offset = int(binary.LittleEndian.Uint32(def[8*i+4:]))
+		if m.Offset > u.Size {
+			return nil, errors.New("member offset out of structure")
+		}
+	}
+	names := bytes.Split(def[8*members:], []uint8{0})
+	if len(names) < members+1 {
+		return nil, errors.New("missing member names")
+	}
+	u.Name = string(names[0])
+	if i := strings.IndexByte(u.Name, ';'); i >= 0 {
+		u.Name = u.Name[:i]
+	}
+	for i := range u.Members {
+		u.Members[i].Name = string(names[i+1])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.udts == nil {
+		c.udts = make(map[int]*UDT)
+		c.handles = make(map[int]*UDT)
+	}
+	if u2, ok := c.udts[instance]; ok { // read concurrently
+		return u2, nil
+	}
+	c.udts[instance] = u
+	c.handles[u.Handle] = u
+	return u, nil
+}
+
+// templateByHandle returns the structure definition of the handle, looked up in templates of the controller tags if not read yet.
+func (c *Client) templateByHandle(ctx context.Context, handle int) (*UDT, error) {
+	c.mu.Lock()
+	u, ok := c.handles[handle]
+	c.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+	list, err := c.ListTagsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ti := range list {
+		if !ti.Struct {
+			continue
+		}
+		if u, err := c.ReadTemplateContext(ctx, ti.Type); err == nil && u.Handle == handle {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("template of handle 0x%X not found", handle)
+}
+
+// Decode decodes data of the structure tag read by ReadTag into v, which is *map[string]interface{}, *[]map[string]interface{}, pointer to the struct or pointer to the slice of structs.
+// Struct fields are matched to members case insensitive. Atomic arrays are decoded as []interface{}.
+func (c *Client) Decode(t *Tag, v interface{}) error {
+	return c.DecodeContext(context.Background(), t, v)
+}
+
+// DecodeContext is Decode with the context.
+func (c *Client) DecodeContext(ctx context.Context, t *Tag, v interface{}) error {
+	if t.Type < TypeStructHead {
+		return errors.New("not a structure")
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("v is not a non-nil pointer")
+	}
+	u, err := c.templateByHandle(ctx, t.Type&0xFFFF)
+	if err != nil {
+		return err
+	}
+	if u.Size <= 0 || len(t.data)%u.Size != 0 {
+		return errors.New("data size not multiple of the structure size")
+	}
+
+	var x interface{}
+	if n := len(t.data) / u.Size; n == 1 {
+		x, err = c.decodeUDT(ctx, u, t.data, 0)
+	} else {
+		x, err = c.decodeArray(ctx, u, t.data, n, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	el := rv.Elem()
+	switch m := x.(type) {
+	case map[string]interface{}:
+		if el.Kind() == reflect.Slice || el.Kind() == reflect.Array {
+			x = []interface{}{m}
+		}
+	case []interface{}:
+		if el.Kind() == reflect.Struct || el.Kind() == reflect.Map {
+			x = m[0]
+		}
+	}
+	return setValue(el, x)
+}
+
+// decodeArray decodes n consecutive structures.
+func (c *Client) decodeArray(ctx context.Context, u *UDT, d []uint8, n int, depth int) ([]interface{}, error) {
+	if len(d) < n*u.Size {
+		return nil, cip.ErrShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		m, err := c.decodeUDT(ctx, u, d[i*u.Size:], depth)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = m
+	}
+	return a, nil
+}
+
+// decodeUDT decodes the structure at the beginning of d, hidden members are skipped.
+func (c *Client) decodeUDT(ctx context.Context, u *UDT, d []uint8, depth int) (map[string]interface{}, error) {
+	if depth > 8 {
+		return nil, errors.New("structures nested too deep")
+	}
+	if len(d) < u.Size {
+		return nil, cip.ErrShort
+	}
+	res := make(map[string]interface{}, len(u.Members))
+	for _, m := range u.Members {
+		if m.hidden() {
+			continue
+		}
+		md := d[m.Offset:]
+		n := m.Count
+		if m.Struct {
+			mu, err := c.ReadTemplateContext(ctx, m.Type)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				res[m.Name], err = c.decodeUDT(ctx, mu, md, depth+1)
+			} else {
+				res[m.Name], err = c.decodeArray(ctx, mu, md, n, depth+1)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if m.Type == TypeBOOL {
+			if len(md) < 1 {
+				return nil, cip.ErrShort
+			}
+			res[m.Name] = md[0]>>(n&7)&1 != 0
+			continue
+		}
+		l := int(typeLen(uint16(m.Type)))
+		if l == 0 {
+			return nil, fmt.Errorf("member %s of unknown type 0x%X", m.Name, m.Type)
+		}
+		if n == 0 {
+			if len(md) < l {
+				return nil, cip.ErrShort
+			}
+			res[m.Name] = atomicValue(m.Type, md)
+			continue
+		}
+		if len(md) < n*l {
+			return nil, cip.ErrShort
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i] = atomicValue(m.Type, md[i*l:])
+		}
+		res[m.Name] = a
+	}
+	return res, nil
+}
+
+// atomicValue returns Go value of the atomic type from the beginning of b.
+func atomicValue(typ int, b []uint8) interface{} {
+	switch typ {
+	case TypeBOOL:
+		return b[0] != 0
+	case TypeSINT:
+		return int8(b[0])
+	case TypeINT:
+		return int16(binary.LittleEndian.Uint16(b))
+	case TypeDINT:
+		return int32(binary.LittleEndian.Uint32(b))
+	case TypeLINT:
+		return int64(binary.LittleEndian.Uint64(b))
+	case TypeREAL:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b))
+	case TypeLREAL:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	switch typeLen(uint16(typ)) {
+	case 1:
+		return b[0]
+	case 2:
+		return binary.LittleEndian.Uint16(b)
+	case 4:
+		return binary.LittleEndian.Uint32(b)
+	case 8:
+		return binary.LittleEndian.Uint64(b)
+	}
+	return append([]uint8(nil), b[:typeLen(uint16(typ))]...)
+}
+
+// setValue stores decoded x into rv.
+func setValue(rv reflect.Value, x interface{}) error {
+	if rv.Kind() == reflect.Interface {
+		rv.Set(reflect.ValueOf(x))
+		return nil
+	}
+	switch x := x.(type) {
+	case map[string]interface{}:
+		switch rv.Kind() {
+		case reflect.Map:
+			if !reflect.TypeOf(x).AssignableTo(rv.Type()) {
+				return fmt.Errorf("can't decode structure into %v", rv.Type())
+			}
+			rv.Set(reflect.ValueOf(x))
+		case reflect.Struct:
+			t := rv.Type()
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.PkgPath != "" {
+					continue
+				}
+				for k, v := range x {
+					if strings.EqualFold(k, f.Name) {
+						if err := setValue(rv.Field(i), v); err != nil {
+							return fmt.Errorf("%s: %v", f.Name, err)
+						}
+						break
+					}
+				}
+			}
+		default:
+			return fmt.Errorf("can't decode structure into %v", rv.Type())
+		}
+	case []interface{}:
+		switch rv.Kind() {
+		case reflect.Slice:
+			rv.Set(reflect.MakeSlice(rv.Type(), len(x), len(x)))
+		case reflect.Array:
+			if rv.Len() < len(x) {
+				x = x[:rv.Len()]
+			}
+		default:
+			return fmt.Errorf("can't decode array into %v", rv.Type())
+		}
+		for i, v := range x {
+			if err := setValue(rv.Index(i), v); err != nil {
+				return err
+			}
+		}
+	default:
+		v := reflect.ValueOf(x)
+		if (v.Kind() == reflect.Bool) != (rv.Kind() == reflect.Bool) || !v.Type().ConvertibleTo(rv.Type()) {
+			return fmt.Errorf("can't decode %v into %v", v.Type(), rv.Type())
+		}
+		rv.Set(v.Convert(rv.Type()))
+	}
+	return nil
+}
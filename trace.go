@@ -0,0 +1,190 @@
+package plcconnector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/rich1111/plcconnector/cip"
+)
+
+// TraceWriter writes decoded frames as text lines, e.g.
+//
+//	15:04:05.000000 10.0.0.5:50123 > 10.0.0.1:44818 SendRRData session=0x1A2B3C4D status=0x0 items=[Null UnconnData(12)] ReadTag path=arr[2] data=2
+//	15:04:05.000120 10.0.0.1:44818 > 10.0.0.5:50123 SendRRData session=0x1A2B3C4D status=0x0 items=[Null UnconnData(8)] ReadTag reply status=0x0 data=4
+type TraceWriter struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// NewTraceWriter returns Capture writing decoded trace to w.
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	return &TraceWriter{w: w}
+}
+
+var itemNames = map[uint16]string{
+	cip.ItemNullAddress:  "Null",
+	cip.ItemListIdentity: "ListIdentity",
+	cip.ItemConnAddress:  "ConnAddress",
+	cip.ItemConnData:     "ConnData",
+	cip.ItemUnconnData:   "UnconnData",
+	cip.ItemListServices: "ListService",
+	cip.ItemSockAddrOT:   "SockAddrOT",
+	cip.ItemSockAddrTO:   "SockAddrTO",
+	cip.ItemSeqAddress:   "SeqAddress",
+}
+
+// serviceNames of services used with the symbol and message router objects, codes are shared by other classes.
+var serviceNames = map[uint8]string{
+	GetAttrAll:      "GetAttributesAll",
+	SetAttrAll:      "SetAttributesAll",
+	GetAttrList:     "GetAttributeList",
+	SetAttrList:     "SetAttributeList",
+	Reset:           "Reset",
+	MultiServ:       "MultipleServicePacket",
+	GetAttr:         "GetAttributeSingle",
+	SetAttr:         "SetAttributeSingle",
+	NextInst:        "FindNextObjectInstance",
+	GetMember:       "GetMember",
+	InititateUpload: "InitiateUpload",
+	ReadTag:         "ReadTag",
+	WriteTag:        "WriteTag",
+	ReadModifyWrite: "ReadModifyWrite",
+	UploadTransfer:  "UploadTransfer",
+	ReadTagFrag:     "ReadTagFragmented",
+	WriteTagFrag:    "WriteTagFragmented",
+	ForwardOpen:     "ForwardOpen",
+	GetInstAttrList: "GetInstanceAttributeList",
+	LargeForwOpen:   "LargeForwardOpen",
+}
+
+func serviceName(s uint8) string {
+	if n, ok := serviceNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("service 0x%X", s)
+}
+
+func commandName(c uint16) string {
+	if i := commandIndex(c); i < len(metricCommands) {
+		return commandNames[i]
+	}
+	return fmt.Sprintf("command 0x%X", c)
+}
+
+// Capture writes one line for the frame.
+func (t *TraceWriter) Capture(f Frame) {
+	var b strings.Builder
+	b.WriteString(f.Time.Format("15:04:05.000000 "))
+	b.WriteString(f.Src.String() + " > " + f.Dst.String() + " ")
+	traceFrame(&b, f.Data)
+	b.WriteByte('\n')
+	t.m.Lock()
+	io.WriteString(t.w, b.String())
+	t.m.Unlock()
+}
+
+func traceFrame(b *strings.Builder, d []uint8) {
+	var h cip.EncapsulationHeader
+	if h.Unmarshal(d) != nil {
+		fmt.Fprintf(b, "short frame % X", d)
+		return
+	}
+	fmt.Fprintf(b, "%s session=0x%X status=0x%X", commandName(h.Command), h.SessionHandle, h.Status)
+	d = d[cip.EncapsulationHeaderLen:]
+	if h.Command != cip.CommandSendRRData && h.Command != cip.CommandSendUnitData {
+		fmt.Fprintf(b, " len=%d", len(d))
+		return
+	}
+	var sd cip.SendData
+	if sd.Unmarshal(d) != nil {
+		return
+	}
+	d = d[cip.SendDataLen:]
+	var msg []uint8
+	b.WriteString(" items=[")
+	for i := 0; i < int(sd.ItemCount) && len(d) >= cip.ItemHeaderLen; i++ {
+		var it cip.ItemHeader
+		it.Unmarshal(d)
+		d = d[cip.ItemHeaderLen:]
+		n := int(it.Length)
+		if n > len(d) {
+			n = len(d)
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		name, ok := itemNames[it.Type]
+		if !ok {
+			name = fmt.Sprintf("0x%X", it.Type)
+		}
+		b.WriteString(name)
+		if it.Type == cip.ItemConnAddress && n >= 4 {
+			fmt.Fprintf(b, "(0x%X)", binary.LittleEndian.Uint32(d))
+		} else if n > 0 {
+			fmt.Fprintf(b, "(%d)", n)
+		}
+		switch it.Type {
+		case cip.ItemUnconnData:
+			msg = d[:n]
+		case cip.ItemConnData:
+			if n >= 2 {
+				msg = d[2:n]
+			}
+		}
+		d = d[n:]
+	}
+	b.WriteByte(']')
+	if len(msg) > 0 {
+		b.WriteByte(' ')
+		traceCIP(b, msg)
+	}
+}
+
+// traceCIP writes service, path or status of the CIP message.
+func traceCIP(b *strings.Builder, d []uint8) {
+	if len(d) < 2 {
+		fmt.Fprintf(b, "% X", d)
+		return
+	}
+	if d[0]&cip.ServiceReply != 0 {
+		var resp cip.Response
+		if resp.Unmarshal(d) != nil {
+			fmt.Fprintf(b, "% X", d)
+			return
+		}
+		fmt.Fprintf(b, "%s reply status=0x%X", serviceName(resp.Service&^cip.ServiceReply), resp.Status)
+		if len(resp.AddStatus) > 0 {
+			fmt.Fprintf(b, " ext=%X", resp.AddStatus)
+		}
+		if len(resp.Data) > 0 {
+			fmt.Fprintf(b, " data=%d", len(resp.Data))
+		}
+		return
+	}
+	var req cip.Request
+	if req.Unmarshal(d) != nil {
+		fmt.Fprintf(b, "%s bad path % X", serviceName(d[0]), d)
+		return
+	}
+	fmt.Fprintf(b, "%s path=%s", serviceName(req.Service), epathString(req.Path))
+	if len(req.Data) > 0 {
+		fmt.Fprintf(b, " data=%d", len(req.Data))
+	}
+}
+
+// epathString formats padded EPATH, see cip.Path.String, undecodable rest is written in hex.
+func epathString(p []uint8) string {
+	var path cip.Path
+	for len(p) > 0 {
+		s, n, err := cip.NextSegment(p)
+		if err != nil {
+			return path.String() + fmt.Sprintf("?% X", p)
+		}
+		path = append(path, s)
+		p = p[n:]
+	}
+	return path.String()
+}
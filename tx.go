@@ -0,0 +1,105 @@
+package plcconnector
+
+import (
+	"errors"
+)
+
+// Tx gives access to tags inside Transaction.
+type Tx interface {
+	ReadNum(path string) (float64, error)
+	WriteNum(path string, v float64) error
+	ReadTag(name string) ([]uint8, error)
+	UpdateTag(name string, offset int, data []uint8) error
+}
+
+type tx struct {
+	p    *PLC
+	orig map[*Tag][]uint8
+	tags []*Tag
+}
+
+func (t *tx) save(tg *Tag) {
+	if _, ok := t.orig[tg]; !ok {
+		t.orig[tg] = append([]uint8(nil), tg.data...)
+		t.tags = append(t.tags, tg)
+	}
+}
+
+func (t *tx) ReadNum(path string) (float64, error) {
+	pth := parsePath(path)
+	if pth == nil {
+		return 0, errPath
+	}
+	v, _, err := t.p.readNum(pth)
+	return v, err
+}
+
+func (t *tx) WriteNum(path string, v float64) error {
+	pth := parsePath(path)
+	if pth == nil {
+		return errPath
+	}
+	base, _ := splitBit(pth)
+	tg, _, _, _, _, err := t.p.parsePathEl(base)
+	if err != nil {
+		return err
+	}
+	t.save(tg)
+	_, err = t.p.setNum(pth, v)
+	return err
+}
+
+func (t *tx) ReadTag(name string) ([]uint8, error) {
+	tg, ok := t.p.tag(name)
+	if !ok {
+		return nil, errors.New("no tag named " + name)
+	}
+	return append([]uint8(nil), tg.data...), nil
+}
+
+func (t *tx) UpdateTag(name string, offset int, data []uint8) error {
+	tg, ok := t.p.tag(name)
+	if !ok {
+		return errors.New("no tag named " + name)
+	}
+	offset *= tg.ElemLen()
+	if offset < 0 || offset+len(data) > len(tg.data) {
+		return errors.New("too large data for " + name)
+	}
+	t.save(tg)
+	tg.lock()
+	copy(tg.data[offset:], data)
+	tg.unlock()
+	return nil
+}
+
+// Transaction runs f with exclusive access to tags. Changes are reverted if f returns error or panics.
+// Clients never see partial changes, alarms, historian and audit log are notified after commit.
+func (p *PLC) Transaction(f func(tx Tx) error) (err error) {
+	t := &tx{p: p, orig: make(map[*Tag][]uint8)}
+	p.lockTags()
+	defer p.unlockTags()
+	defer func() {
+		if r := recover(); r != nil {
+			t.rollback()
+			panic(r)
+		}
+	}()
+	if err = f(t); err != nil {
+		t.rollback()
+		return err
+	}
+	for _, tg := range t.tags {
+		p.notifyWrite(tg)
+		p.audit(auditCtx{service: "Transaction", source: "api"}, tg.Name, t.orig[tg], tg.data, Success)
+	}
+	return nil
+}
+
+func (t *tx) rollback() {
+	for tg, d := range t.orig {
+		tg.lock()
+		copy(tg.data, d)
+		tg.unlock()
+	}
+}
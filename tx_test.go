@@ -0,0 +1,84 @@
+package plcconnector
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	p := testSTPLC(t)
+
+	err := p.Transaction(func(tx Tx) error {
+		if err := tx.WriteNum("a", 5); err != nil {
+			return err
+		}
+		v, _ := tx.ReadNum("a")
+		return tx.WriteNum("pos.X", v*2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.ReadNum("pos.X"); v != 10 {
+		t.Errorf("pos.X = %v, want 10", v)
+	}
+
+	errAbort := errors.New("abort")
+	err = p.Transaction(func(tx Tx) error {
+		tx.WriteNum("a", 7)
+		tx.UpdateTag("arr", 1, []uint8{1, 0, 2, 0})
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("err = %v", err)
+	}
+	if v, _ := p.ReadNum("a"); v != 5 {
+		t.Errorf("a = %v after rollback, want 5", v)
+	}
+	if v, _ := p.ReadNum("arr[1]"); v != 0 {
+		t.Errorf("arr[1] = %v after rollback, want 0", v)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic not propagated")
+			}
+		}()
+		p.Transaction(func(tx Tx) error {
+			tx.WriteNum("b", 3)
+			panic("test")
+		})
+	}()
+	if v, _ := p.ReadNum("b"); v != 0 {
+		t.Errorf("b = %v after panic, want 0", v)
+	}
+	if p.Transaction(func(tx Tx) error { return tx.UpdateTag("arr", 4, []uint8{1, 0, 2, 0}) }) == nil {
+		t.Error("too large data accepted")
+	}
+}
+
+func Test_multiServWrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   []uint8
+		writes bool
+		ok     bool
+	}{
+		{"reads", []uint8{ReadTag, 0, ReadTag, 0}, false, true},
+		{"write", []uint8{ReadTag, 0, WriteTag, 0}, true, true},
+		{"rmw", []uint8{ReadModifyWrite, 0, GetAttr, 0}, true, true},
+		{"bad offset", []uint8{ReadTag, 0}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svs := []uint16{6, 8} // count + 2 offsets
+			r := req{readBuf: bufio.NewReader(bytes.NewReader(tt.body)), dataLen: 6 + len(tt.body), lenRem: len(tt.body)}
+			writes, ok := r.multiServWrites(svs, 6)
+			if writes != tt.writes || ok != tt.ok {
+				t.Errorf("multiServWrites() = %v, %v, want %v, %v", writes, ok, tt.writes, tt.ok)
+			}
+		})
+	}
+}
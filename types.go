@@ -1,18 +1,20 @@
 package plcconnector
 
+import "github.com/rich1111/plcconnector/cip"
+
 // Service
 const (
 	// Common
-	GetAttrAll  = 0x01
-	SetAttrAll  = 0x02
-	GetAttrList = 0x03
-	SetAttrList = 0x04
-	Reset       = 0x05
-	MultiServ   = 0x0A
-	GetAttr     = 0x0E
-	SetAttr     = 0x10
-	NextInst    = 0x11
-	GetMember   = 0x18
+	GetAttrAll  = cip.ServiceGetAttributesAll
+	SetAttrAll  = cip.ServiceSetAttributesAll
+	GetAttrList = cip.ServiceGetAttributeList
+	SetAttrList = cip.ServiceSetAttributeList
+	Reset       = cip.ServiceReset
+	MultiServ   = cip.ServiceMultipleService
+	GetAttr     = cip.ServiceGetAttributeSingle
+	SetAttr     = cip.ServiceSetAttributeSingle
+	NextInst    = cip.ServiceFindNextObjectInstance
+	GetMember   = cip.ServiceGetMember
 
 	// Class Specific
 	InititateUpload = 0x4B
@@ -20,14 +22,14 @@ const (
 	ReadTemplate    = 0x4C
 	WriteTag        = 0x4D
 	ReadModifyWrite = 0x4E
-	ForwardClose    = 0x4E
+	ForwardClose    = cip.ServiceForwardClose
 	UploadTransfer  = 0x4F
-	UnconnectedSend = 0x52
+	UnconnectedSend = cip.ServiceUnconnectedSend
 	ReadTagFrag     = 0x52
 	WriteTagFrag    = 0x53
-	ForwardOpen     = 0x54
+	ForwardOpen     = cip.ServiceForwardOpen
 	GetInstAttrList = 0x55
-	LargeForwOpen   = 0x5B
+	LargeForwOpen   = cip.ServiceLargeForwardOpen
 )
 
 // Classes
@@ -40,10 +42,11 @@ const (
 
 	DLRClass = 0x47 // Device Level Ring
 
-	ProgramClass  = 0x64
-	SymbolClass   = 0x6B
-	TemplateClass = 0x6C
-	ClockClass    = 0x8B
+	ProgramClass    = 0x64
+	SymbolClass     = 0x6B
+	TemplateClass   = 0x6C
+	ClockClass      = 0x8B
+	ControllerClass = 0x73 // vendor specific controller status
 
 	PortClass     = 0xF4
 	TCPClass      = 0xF5
@@ -94,172 +97,30 @@ const (
 
 // Status codes
 const (
-	Success          = 0x00
-	PathSegmentError = 0x04
-	PathUnknown      = 0x05
-	PartialTransfer  = 0x06
-	ServNotSup       = 0x08
-	AttrListError    = 0x0A
-	AttrNotSettable  = 0x0E
-	PrivilegeViol    = 0x0F
-	NotEnoughData    = 0x13
-	AttrNotSup       = 0x14
-	TooMuchData      = 0x15
-	ObjectNotExist   = 0x16
-	InvalidPar       = 0x20
-)
-
-// EIP Error Codes
-const (
-	eipSuccess                = 0x00
-	eipInvalid                = 0x01
-	eipNoMemory               = 0x02
-	eipIncorrectData          = 0x03
-	eipInvalidSessionHandle   = 0x64
-	eipInvalidLength          = 0x65
-	eipInvalidProtocolVersion = 0x69
-)
-
-// EIP Encapsulationn Commands
-const (
-	ecNOP               = 0x00
-	ecListServices      = 0x04
-	ecListIdentity      = 0x63
-	ecListInterfaces    = 0x64
-	ecRegisterSession   = 0x65
-	ecUnRegisterSession = 0x66
-	ecSendRRData        = 0x6f
-	ecSendUnitData      = 0x70
-	ecIndicateStatus    = 0x72
-	ecCancel            = 0x73
-)
-
-// Item Type Codes
-const (
-	itNullAddress  = 0x0000
-	itListIdentity = 0x000C
-	itConnAddress  = 0x00A1
-	itConnData     = 0x00B1
-	itUnconnData   = 0x00B2
-	itListService  = 0x0100
-	itSockAddrOT   = 0x8000
-	itSockAddrTO   = 0x8001
-	itSeqAddress   = 0x8002
+	Success             = cip.StatusSuccess
+	ConnFailure         = cip.StatusConnectionFailure
+	PathSegmentError    = cip.StatusPathSegmentError
+	PathUnknown         = cip.StatusPathUnknown
+	PartialTransfer     = cip.StatusPartialTransfer
+	ServNotSup          = cip.StatusServiceNotSupported
+	AttrListError       = cip.StatusAttrListError
+	ObjectStateConflict = cip.StatusObjectStateConflict
+	AttrNotSettable     = cip.StatusAttrNotSettable
+	PrivilegeViol       = cip.StatusPrivilegeViolation
+	DeviceStateConflict = cip.StatusDeviceStateConflict
+	ReplyTooLarge       = cip.StatusReplyDataTooLarge
+	NotEnoughData       = cip.StatusNotEnoughData
+	AttrNotSup          = cip.StatusAttrNotSupported
+	TooMuchData         = cip.StatusTooMuchData
+	ObjectNotExist      = cip.StatusObjectNotExist
+	InvalidPar          = cip.StatusInvalidParameter
 )
 
-// ListService Communications Capability Flags
-const (
-	lscfTCP = 32
-	lscfUDP = 256
-)
-
-type encapsulationHeader struct {
-	Command       uint16
-	Length        uint16
-	SessionHandle uint32
-	Status        uint32
-	SenderContext uint64
-	Options       uint32
-}
-
-type registerSessionData struct {
-	ProtocolVersion uint16
-	OptionFlags     uint16
-}
-
-type listServicesData struct {
-	ProtocolVersion uint16
-	CapabilityFlags uint16
-	NameOfService   [16]int8
-}
-
-type listIdentityData struct {
-	ProtocolVersion uint16
-	SocketFamily    uint16
-	SocketPort      uint16
-	SocketAddr      uint32
-	SocketZero      [8]uint8
-}
-
-type sendData struct {
-	InterfaceHandle uint32
-	Timeout         uint16
-	ItemCount       uint16
-}
-
-type itemType struct {
-	Type   uint16
-	Length uint16
-}
-
 type protocolData struct {
 	Service  uint8
 	PathSize uint8
 }
 
-type forwardOpenData struct {
-	TimeOut                uint16
-	OTConnectionID         uint32
-	TOConnectionID         uint32
-	ConnSerialNumber       uint16
-	VendorID               uint16
-	OriginatorSerialNumber uint32
-	ConnTimeoutMult        uint8
-	_                      [3]uint8
-	OTRPI                  uint32
-	OTConnPar              uint16
-	TORPI                  uint32
-	TOConnPar              uint16
-	TransportType          uint8
-	ConnPathSize           uint8
-}
-
-type largeForwardOpenData struct {
-	TimeOut                uint16
-	OTConnectionID         uint32
-	TOConnectionID         uint32
-	ConnSerialNumber       uint16
-	VendorID               uint16
-	OriginatorSerialNumber uint32
-	ConnTimeoutMult        uint8
-	_                      [3]uint8
-	OTRPI                  uint32
-	OTConnPar              uint32
-	TORPI                  uint32
-	TOConnPar              uint32
-	TransportType          uint8
-	ConnPathSize           uint8
-}
-
-type forwardCloseData struct {
-	TimeOut                uint16
-	ConnSerialNumber       uint16
-	VendorID               uint16
-	OriginatorSerialNumber uint32
-	ConnPathSize           uint8
-	_                      uint8
-}
-
-type forwardOpenResponse struct {
-	OTConnectionID         uint32
-	TOConnectionID         uint32
-	ConnSerialNumber       uint16
-	VendorID               uint16
-	OriginatorSerialNumber uint32
-	OTAPI                  uint32
-	TOAPI                  uint32
-	AppReplySize           uint8
-	_                      uint8
-}
-
-type forwardCloseResponse struct {
-	ConnSerialNumber       uint16
-	VendorID               uint16
-	OriginatorSerialNumber uint32
-	AppReplySize           uint8
-	_                      uint8
-}
-
 type initUploadResponse struct {
 	FileSize     uint32
 	TransferSize uint8
@@ -282,10 +143,3 @@ type readTemplateResponse struct {
 	Offset uint32
 	Number uint16
 }
-
-type response struct {
-	Service       uint8
-	_             uint8
-	Status        uint8
-	AddStatusSize uint8
-}
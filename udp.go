@@ -3,103 +3,77 @@ package plcconnector
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
-	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
+
+	"github.com/rich1111/plcconnector/cip"
 )
 
-func (p *PLC) handleUDPRequest(conn *net.UDPConn, dt []byte, n int, addr *net.UDPAddr) {
+func (p *PLC) handleUDPRequest(conn *net.UDPConn, dt []byte, addr *net.UDPAddr, port uint16) {
 	r := req{lenRem: -1}
 	r.p = p
+	r.port = port
+	r.addr = addr
 	r.readBuf = bufio.NewReader(bytes.NewReader(dt))
-	r.writeBuf = new(bytes.Buffer)
+	r.writeBuf = getBuf()
+	defer putBuf(r.writeBuf)
+	if p.Capture != nil {
+		p.Capture.Capture(Frame{Time: time.Now(), Src: addr, Dst: conn.LocalAddr(), Data: dt})
+	}
 
-	_, err := r.read(&r.encHead)
+	err := r.readEncHead()
 	if err != nil {
 		return
 	}
+	start := time.Now()
 	r.lenRem = int(r.encHead.Length)
+	p.met.request(r.encHead.Command, cip.EncapsulationHeaderLen+r.lenRem)
 
 	switch r.encHead.Command {
-	case ecListIdentity:
+	case cip.CommandListIdentity:
+		atomic.AddUint64(&p.met.listIdentity, 1)
 		if r.eipListIdentity() != nil {
 			return
 		}
 
-	case ecListServices:
+	case cip.CommandListServices:
 		if r.eipListServices() != nil {
 			return
 		}
 
-	case ecListInterfaces:
+	case cip.CommandListInterfaces:
 		r.write(uint16(0)) // ItemCount
 
 	default:
-		p.debug("UDP unknown command:", r.encHead.Command)
+		r.debug("UDP unknown command", "command", r.encHead.Command)
 
-		data := make([]uint8, r.encHead.Length)
-		_, err = r.read(&data)
+		data, _, err := r.next(int(r.encHead.Length))
 		if err != nil {
 			return
 		}
-		r.encHead.Status = eipInvalid
+		r.encHead.Status = cip.EncapInvalidCommand
 
-		r.write(data)
+		r.writeBuf.Write(data)
 	}
 
 	err = conn.SetWriteDeadline(time.Now().Add(time.Second))
 	if err != nil {
-		fmt.Println(err)
+		r.log(LevelWarn, "set deadline", "err", err)
 		return
 	}
 
 	r.encHead.Length = uint16(r.writeBuf.Len())
-	var buf bytes.Buffer
+	buf := r.encHead.AppendTo(make([]uint8, 0, cip.EncapsulationHeaderLen+r.writeBuf.Len()))
+	buf = append(buf, r.writeBuf.Bytes()...)
 
-	err = binary.Write(&buf, binary.LittleEndian, r.encHead)
+	_, err = conn.WriteToUDP(buf, addr)
 	if err != nil {
-		fmt.Println(err)
+		r.log(LevelWarn, "write", "err", err)
 		return
 	}
-	buf.Write(r.writeBuf.Bytes())
-
-	_, err = conn.WriteToUDP(buf.Bytes(), addr)
-	if err != nil {
-		fmt.Println(err)
-	}
-}
-
-func (p *PLC) serveUDP(host string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp4", host)
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.ListenUDP("udp4", udpAddr)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	for {
-		buffer := make([]byte, 0x8000)
-
-		conn.SetDeadline(time.Now().Add(time.Second))
-
-		n, addr, err := conn.ReadFromUDP(buffer)
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			p.closeMut.RLock()
-			endP := p.closeI
-			p.closeMut.RUnlock()
-			if endP {
-				break
-			}
-		} else if err != nil {
-			return err
-		} else {
-			go p.handleUDPRequest(conn, buffer, n, addr)
-		}
+	p.met.reply(r.encHead.Command, len(buf), start)
+	if p.Capture != nil {
+		p.Capture.Capture(Frame{Time: time.Now(), Src: conn.LocalAddr(), Dst: addr, Data: buf})
 	}
-	return nil
 }
@@ -91,16 +91,16 @@ func (p *PLC) newUDT(udt []udtT, name string, handle int, size int) error {
 }
 
 func (p *PLC) addUDT(st *structData) int {
-	p.tMut.Lock()
+	p.lockTags()
 	ste, ok := p.tids[st.n]
 	if ok {
-		p.tMut.Unlock()
+		p.unlockTags()
 		return ste.i
 	}
 	st.i = p.tidLast
 	p.tids[st.n] = *st
 	p.tidLast++
-	p.tMut.Unlock()
+	p.unlockTags()
 
 	var tp *Instance
 	var buf bytes.Buffer
@@ -131,10 +131,10 @@ func (p *PLC) addUDT(st *structData) int {
 	tp.attr[4] = TagUDINT((uint32(buf.Len())+20)/4, "TemplateObjectDefinitionSize") // (x * 4) - 20 // 23 in pdf, was 16
 	tp.attr[5] = TagUDINT(uint32(st.l), "TemplateStructureSize")
 
-	p.tMut.Lock()
+	p.lockTags()
 	p.template.SetInstance(st.i, tp)
 	p.template.SetInstance(int(st.h), tp)
-	p.tMut.Unlock()
+	p.unlockTags()
 	return st.i
 }
 
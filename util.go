@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
 	"strconv"
@@ -25,23 +24,8 @@ func iif(x bool, a string, b string) string {
 	return b
 }
 
-func bread(rd io.Reader, data interface{}) error {
-	err := binary.Read(rd, binary.LittleEndian, data)
-	if err != nil {
-		fmt.Println(err)
-	}
-	return err
-}
-
 func bwrite(buf io.Writer, data interface{}) {
-	err := binary.Write(buf, binary.LittleEndian, data)
-	if err != nil {
-		fmt.Println(err)
-	}
-}
-
-func htons(v uint16) uint16 {
-	return binary.LittleEndian.Uint16([]byte{byte(v >> 8), byte(v)})
+	binary.Write(buf, binary.LittleEndian, data) // fixed size data can't fail
 }
 
 func getNetIf() (uint32, []byte) {
@@ -1,16 +1,17 @@
 package plcconnector
 
 import (
-	"fmt"
 	"syscall"
 )
 
-func sockControl(network, address string, c syscall.RawConn) error {
-	return c.Control(func(fd uintptr) {
-		err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-		if err != nil {
-			fmt.Println("SO_REUSEADDR:", err)
-			return
-		}
-	})
+// sockControl returns Control function of net.ListenConfig setting SO_REUSEADDR.
+func sockControl(l Logger) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			if err != nil {
+				logTo(l, LevelWarn, "SO_REUSEADDR", "addr", address, "err", err)
+			}
+		})
+	}
 }
@@ -0,0 +1,40 @@
+async function trend(canvas) {
+  const response = await fetch('/.history?max=' + canvas.width + '&path=' + encodeURIComponent(canvas.dataset.path), { cache: 'no-cache' });
+  if (!response.ok) {
+    return;
+  }
+  const pts = await response.json() || [];
+  const ctx = canvas.getContext('2d');
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  if (pts.length === 0) {
+    ctx.fillText('brak danych', 10, 20);
+    return;
+  }
+  const t0 = Date.parse(pts[0].time), t1 = Date.parse(pts[pts.length - 1].time);
+  let min = Math.min(...pts.map(p => p.min)), max = Math.max(...pts.map(p => p.max));
+  if (min === max) {
+    min -= 1;
+    max += 1;
+  }
+  const x = t => t1 === t0 ? 0 : (Date.parse(t) - t0) / (t1 - t0) * (canvas.width - 1);
+  const y = v => (canvas.height - 20) - (v - min) / (max - min) * (canvas.height - 30);
+  ctx.fillStyle = '#ccc';
+  for (const p of pts) {
+    ctx.fillRect(x(p.time), y(p.max), 1, Math.max(1, y(p.min) - y(p.max)));
+  }
+  ctx.strokeStyle = '#00f';
+  ctx.beginPath();
+  pts.forEach((p, i) => i === 0 ? ctx.moveTo(x(p.time), y(p.avg)) : ctx.lineTo(x(p.time), y(p.avg)));
+  ctx.stroke();
+  ctx.fillStyle = '#000';
+  ctx.fillText(max.toString(), 2, 10);
+  ctx.fillText(min.toString(), 2, canvas.height - 22);
+  ctx.fillText(new Date(t0).toLocaleString() + ' - ' + new Date(t1).toLocaleString(), 2, canvas.height - 5);
+}
+
+document.addEventListener("DOMContentLoaded", function (e) {
+  for (const c of document.getElementsByClassName("trend")) {
+    trend(c);
+    setInterval(trend, 5000, c);
+  }
+});